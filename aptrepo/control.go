@@ -0,0 +1,100 @@
+package aptrepo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Field is a single field of a Debian control paragraph. Multi-line values keep
+// their continuation lines, without the leading space.
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Paragraph is a Debian control paragraph with its fields in file order.
+type Paragraph []Field
+
+// Get returns the value of the field name, compared case-insensitively as
+// Debian control fields are.
+func (p Paragraph) Get(name string) string {
+	for _, field := range p {
+		if strings.EqualFold(field.Name, name) {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+// Set replaces the value of the field name or appends the field.
+func (p Paragraph) Set(name, value string) Paragraph {
+	for i, field := range p {
+		if strings.EqualFold(field.Name, name) {
+			p[i].Value = value
+			return p
+		}
+	}
+	return append(p, Field{Name: name, Value: value})
+}
+
+// String formats the paragraph in control file syntax, without the blank line
+// that separates paragraphs.
+func (p Paragraph) String() string {
+	var out strings.Builder
+	for _, field := range p {
+		lines := strings.Split(field.Value, "\n")
+		out.WriteString(field.Name + ":")
+		if lines[0] != "" {
+			out.WriteString(" " + lines[0])
+		}
+		out.WriteString("\n")
+		for _, line := range lines[1:] {
+			if line == "" {
+				line = "."
+			}
+			out.WriteString(" " + line + "\n")
+		}
+	}
+	return out.String()
+}
+
+// ParseParagraphs reads every paragraph of a control file such as a Packages
+// index or a package's control file.
+func ParseParagraphs(r io.Reader) (paragraphs []Paragraph, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var current Paragraph
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.TrimSpace(line) == "":
+			if len(current) > 0 {
+				paragraphs = append(paragraphs, current)
+				current = nil
+			}
+		case strings.HasPrefix(line, "#"):
+		case line[0] == ' ' || line[0] == '\t':
+			if len(current) == 0 {
+				return nil, fmt.Errorf("continuation line without a field: %q", line)
+			}
+			current[len(current)-1].Value += "\n" + line[1:]
+		default:
+			name, value, ok := strings.Cut(line, ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid control line: %q", line)
+			}
+			current = append(current, Field{Name: name, Value: strings.TrimSpace(value)})
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(current) > 0 {
+		paragraphs = append(paragraphs, current)
+	}
+
+	return
+}
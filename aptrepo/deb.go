@@ -0,0 +1,158 @@
+package aptrepo
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const arMagic = "!<arch>\n"
+
+// Deb is a .deb file with the paragraph of its control file.
+type Deb struct {
+	Path    string
+	Control Paragraph
+	Size    int64
+	MD5     string
+	SHA1    string
+	SHA256  string
+}
+
+func (d Deb) Name() string {
+	return d.Control.Get("Package")
+}
+
+func (d Deb) Version() string {
+	return d.Control.Get("Version")
+}
+
+// Filename is the name of the .deb in a repository, following Debian's
+// name_version_architecture.deb convention.
+func (d Deb) Filename() string {
+	version := d.Version()
+	if _, rest, ok := strings.Cut(version, ":"); ok {
+		version = rest
+	}
+	return fmt.Sprintf("%s_%s_%s.deb", d.Name(), version, d.Control.Get("Architecture"))
+}
+
+// ReadDeb reads the control file and checksums of a .deb.
+func ReadDeb(debPath string) (deb Deb, err error) {
+	content, err := os.ReadFile(debPath)
+	if err != nil {
+		return deb, err
+	}
+
+	md5Sum := md5.Sum(content)
+	sha1Sum := sha1.Sum(content)
+	sha256Sum := sha256.Sum256(content)
+	deb = Deb{
+		Path:   debPath,
+		Size:   int64(len(content)),
+		MD5:    hex.EncodeToString(md5Sum[:]),
+		SHA1:   hex.EncodeToString(sha1Sum[:]),
+		SHA256: hex.EncodeToString(sha256Sum[:]),
+	}
+
+	control, err := readControl(content)
+	if err != nil {
+		return deb, fmt.Errorf("error reading control file of %s: %w", debPath, err)
+	}
+	paragraphs, err := ParseParagraphs(bytes.NewReader(control))
+	if err != nil {
+		return deb, fmt.Errorf("error parsing control file of %s: %w", debPath, err)
+	}
+	if len(paragraphs) != 1 || paragraphs[0].Get("Package") == "" {
+		return deb, fmt.Errorf("control file of %s does not describe a package", debPath)
+	}
+	deb.Control = paragraphs[0]
+
+	return
+}
+
+// readControl extracts the control file from the control.tar member of the
+// ar archive a .deb is.
+func readControl(content []byte) ([]byte, error) {
+	if !bytes.HasPrefix(content, []byte(arMagic)) {
+		return nil, errors.New("not a Debian package")
+	}
+
+	r := bytes.NewReader(content[len(arMagic):])
+	header := make([]byte, 60)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, errors.New("package has no control.tar member")
+			}
+			return nil, err
+		}
+		name := strings.TrimSuffix(strings.TrimSpace(string(header[0:16])), "/")
+		size, err := strconv.ParseInt(strings.TrimSpace(string(header[48:58])), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size of member %s", name)
+		}
+		member := io.NewSectionReader(r, int64(len(content)-len(arMagic)-r.Len()), size)
+
+		if strings.HasPrefix(name, "control.tar") {
+			decompressed, err := decompress(path.Ext(name), member)
+			if err != nil {
+				return nil, err
+			}
+			return findControl(decompressed)
+		}
+
+		if _, err = r.Seek(size+size%2, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func decompress(ext string, r io.Reader) (io.Reader, error) {
+	switch ext {
+	case ".tar":
+		return r, nil
+	case ".gz":
+		return gzip.NewReader(r)
+	case ".xz":
+		return xz.NewReader(bufio.NewReader(r))
+	case ".zst":
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %s", ext)
+	}
+}
+
+func findControl(r io.Reader) ([]byte, error) {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, errors.New("control.tar has no control file")
+			}
+			return nil, err
+		}
+		if path.Clean(header.Name) == "control" {
+			return io.ReadAll(tr)
+		}
+	}
+}
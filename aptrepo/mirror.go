@@ -0,0 +1,206 @@
+package aptrepo
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+)
+
+// Architecture is the only architecture the builder produces ISOs for.
+const Architecture = "amd64"
+
+// Mirror is a local copy of an apt repository, indexed by package name.
+type Mirror struct {
+	root     string
+	packages map[string][]Paragraph
+	provides map[string][]string
+}
+
+// LoadMirror indexes every Packages file under the dists directory of a local
+// mirror, or at its root for a flat repository. Only amd64 and
+// architecture-independent packages are indexed.
+func LoadMirror(root string) (*Mirror, error) {
+	m := &Mirror{root: root, packages: map[string][]Paragraph{}, provides: map[string][]string{}}
+
+	var indexes []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == "pool" {
+			return filepath.SkipDir
+		}
+		switch d.Name() {
+		case "Packages", "Packages.gz", "Packages.xz":
+			indexes = append(indexes, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error searching mirror %s: %w", root, err)
+	}
+
+	// Prefer the uncompressed index when a directory has several.
+	seen := map[string]bool{}
+	sort.Strings(indexes)
+	for _, index := range indexes {
+		dir := filepath.Dir(index)
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		if err = m.loadIndex(index); err != nil {
+			return nil, err
+		}
+	}
+	if len(m.packages) == 0 {
+		return nil, fmt.Errorf("mirror %s has no %s packages", root, Architecture)
+	}
+
+	return m, nil
+}
+
+func (m *Mirror) loadIndex(index string) error {
+	f, err := os.Open(index)
+	if err != nil {
+		return fmt.Errorf("error opening index %s: %w", index, err)
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	var r io.Reader = f
+	switch filepath.Ext(index) {
+	case ".gz":
+		if r, err = gzip.NewReader(f); err != nil {
+			return fmt.Errorf("error reading index %s: %w", index, err)
+		}
+	case ".xz":
+		if r, err = xz.NewReader(bufio.NewReader(f)); err != nil {
+			return fmt.Errorf("error reading index %s: %w", index, err)
+		}
+	}
+
+	paragraphs, err := ParseParagraphs(r)
+	if err != nil {
+		return fmt.Errorf("error parsing index %s: %w", index, err)
+	}
+	for _, p := range paragraphs {
+		arch := p.Get("Architecture")
+		if arch != Architecture && arch != "all" {
+			continue
+		}
+		name := p.Get("Package")
+		m.packages[name] = append(m.packages[name], p)
+		for _, provided := range splitRelations(p.Get("Provides")) {
+			m.provides[provided[0]] = append(m.provides[provided[0]], name)
+		}
+	}
+
+	return nil
+}
+
+// latest returns the newest version of a package, or of a package providing
+// name.
+func (m *Mirror) latest(name string) (Paragraph, bool) {
+	candidates := m.packages[name]
+	if len(candidates) == 0 {
+		for _, provider := range m.provides[name] {
+			candidates = append(candidates, m.packages[provider]...)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, false
+	}
+
+	best := candidates[0]
+	for _, candidate := range candidates[1:] {
+		if CompareVersions(candidate.Get("Version"), best.Get("Version")) > 0 {
+			best = candidate
+		}
+	}
+	return best, true
+}
+
+// Resolve returns the .deb files of the newest versions of the named packages
+// and of everything they depend on. Version constraints are not checked, and
+// essential and required packages are assumed to be on every installed system.
+// Dependencies the mirror does not have are returned as missing, since the
+// target's own repositories may still provide them.
+func (m *Mirror) Resolve(names []string) (debs []string, missing []string, err error) {
+	for _, name := range names {
+		if _, ok := m.latest(name); !ok {
+			return nil, nil, fmt.Errorf("package %s is not in the mirror", name)
+		}
+	}
+
+	resolved := map[string]bool{}
+	queue := append([]string{}, names...)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+
+		p, ok := m.latest(name)
+		if !ok {
+			if !resolved[name] {
+				resolved[name] = true
+				missing = append(missing, name)
+			}
+			continue
+		}
+		pkg := p.Get("Package")
+		if resolved[pkg] {
+			continue
+		}
+		resolved[pkg] = true
+		if p.Get("Essential") == "yes" || p.Get("Priority") == "required" {
+			continue
+		}
+		debs = append(debs, filepath.Join(m.root, filepath.FromSlash(p.Get("Filename"))))
+
+		for _, field := range []string{"Pre-Depends", "Depends"} {
+			for _, alternatives := range splitRelations(p.Get(field)) {
+				dependency := alternatives[0]
+				for _, alternative := range alternatives {
+					if _, ok := m.latest(alternative); ok {
+						dependency = alternative
+						break
+					}
+				}
+				queue = append(queue, dependency)
+			}
+		}
+	}
+
+	return
+}
+
+// splitRelations parses a relationship field such as Depends into the package
+// names of its groups of alternatives.
+func splitRelations(field string) (groups [][]string) {
+	for _, group := range strings.Split(field, ",") {
+		var alternatives []string
+		for _, alternative := range strings.Split(group, "|") {
+			name := strings.TrimSpace(alternative)
+			if i := strings.IndexAny(name, " (["); i >= 0 {
+				name = name[:i]
+			}
+			name, _, _ = strings.Cut(name, ":")
+			if name != "" {
+				alternatives = append(alternatives, name)
+			}
+		}
+		if len(alternatives) > 0 {
+			groups = append(groups, alternatives)
+		}
+	}
+	return
+}
@@ -0,0 +1,125 @@
+package aptrepo
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testIndex is a Packages index of a mirror, with the fields Resolve reads.
+const testIndex = `Package: app
+Version: 1.0
+Architecture: amd64
+Filename: pool/a/app_1.0_amd64.deb
+Pre-Depends: init-system-helpers (>= 1.54~)
+Depends: libc6 (>= 2.34), libfoo1 | libfoo-compat, mail-transport-agent, libbar (>= 2), python3:any
+
+Package: app
+Version: 1.1
+Architecture: amd64
+Filename: pool/a/app_1.1_amd64.deb
+Pre-Depends: init-system-helpers (>= 1.54~)
+Depends: libc6 (>= 2.34), libfoo1 | libfoo-compat, mail-transport-agent, libbar (>= 2), python3:any
+
+Package: app
+Version: 2.0
+Architecture: arm64
+Filename: pool/a/app_2.0_arm64.deb
+
+Package: libc6
+Version: 2.39-0ubuntu8
+Architecture: amd64
+Priority: required
+Filename: pool/g/libc6_2.39-0ubuntu8_amd64.deb
+
+Package: init-system-helpers
+Version: 1.66ubuntu1
+Architecture: all
+Essential: yes
+Filename: pool/i/init-system-helpers_1.66ubuntu1_all.deb
+
+Package: libfoo-compat
+Version: 3.0
+Architecture: amd64
+Filename: pool/l/libfoo-compat_3.0_amd64.deb
+Depends: libbar
+
+Package: postfix
+Version: 3.8.6-1build2
+Architecture: amd64
+Provides: mail-transport-agent, default-mta (= 3.8.6-1build2)
+Filename: pool/p/postfix_3.8.6-1build2_amd64.deb
+
+Package: python3
+Version: 3.12.3-0ubuntu1
+Architecture: amd64
+Filename: pool/p/python3_3.12.3-0ubuntu1_amd64.deb
+`
+
+func TestMirrorResolve(t *testing.T) {
+	root := t.TempDir()
+	index := filepath.Join(root, "dists", "noble", "main", "binary-amd64", "Packages")
+	if err := os.MkdirAll(filepath.Dir(index), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(index, []byte(testIndex), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mirror, err := LoadMirror(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		names   []string
+		debs    []string
+		missing []string
+		err     string
+	}{
+		{
+			// The newest amd64 version, the alternative the mirror has, the
+			// provider of a virtual package and a dependency it lacks.
+			names:   []string{"app"},
+			debs:    []string{"pool/a/app_1.1_amd64.deb", "pool/l/libfoo-compat_3.0_amd64.deb", "pool/p/postfix_3.8.6-1build2_amd64.deb", "pool/p/python3_3.12.3-0ubuntu1_amd64.deb"},
+			missing: []string{"libbar"},
+		},
+		{
+			// Essential and required packages are never carried.
+			names: []string{"libc6", "init-system-helpers"},
+		},
+		{
+			names: []string{"default-mta", "postfix"},
+			debs:  []string{"pool/p/postfix_3.8.6-1build2_amd64.deb"},
+		},
+		{
+			names: []string{"libbar"},
+			err:   "package libbar is not in the mirror",
+		},
+	}
+	for _, test := range tests {
+		debs, missing, err := mirror.Resolve(test.names)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Resolve(%q): got error %v, want %q", test.names, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Resolve(%q): %v", test.names, err)
+			continue
+		}
+		var want []string
+		for _, deb := range test.debs {
+			want = append(want, filepath.Join(root, deb))
+		}
+		slices.Sort(debs)
+		if !slices.Equal(debs, want) {
+			t.Errorf("Resolve(%q) = %q, want %q", test.names, debs, want)
+		}
+		if !slices.Equal(missing, test.missing) {
+			t.Errorf("Resolve(%q) misses %q, want %q", test.names, missing, test.missing)
+		}
+	}
+}
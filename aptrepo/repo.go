@@ -0,0 +1,321 @@
+package aptrepo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+const (
+	// Dir is the directory at the root of the ISO that holds the repository.
+	Dir = "apt"
+	// KeyringFile is the binary public key the repository is signed with,
+	// stored next to the indexes for use as the source's Signed-By keyring.
+	KeyringFile = "archive-keyring.gpg"
+)
+
+// Sources selects the packages of an offline repository.
+type Sources struct {
+	// DebDirs are directories whose .deb files are all included.
+	DebDirs []string
+	// Packages are resolved with their dependencies against Mirror.
+	Packages []string
+	Mirror   string
+	// AllowMissing accepts dependencies of Packages that Mirror does not
+	// have, which the installed system must then get from elsewhere.
+	AllowMissing bool
+}
+
+func (s Sources) Empty() bool {
+	return len(s.DebDirs) == 0 && len(s.Packages) == 0
+}
+
+// Collect returns the .deb files selected by the sources, and the dependencies
+// of Packages that Mirror does not have.
+func (s Sources) Collect() (debs []string, missing []string, err error) {
+	for _, dir := range s.DebDirs {
+		matches, err := filepath.Glob(filepath.Join(dir, "*.deb"))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(matches) == 0 {
+			return nil, nil, fmt.Errorf("no .deb files in %s", dir)
+		}
+		debs = append(debs, matches...)
+	}
+
+	if len(s.Packages) > 0 {
+		if s.Mirror == "" {
+			return nil, nil, errors.New("a mirror is required to resolve packages")
+		}
+		mirror, err := LoadMirror(s.Mirror)
+		if err != nil {
+			return nil, nil, err
+		}
+		resolved, unresolved, err := mirror.Resolve(s.Packages)
+		if err != nil {
+			return nil, nil, err
+		}
+		debs = append(debs, resolved...)
+		missing = unresolved
+	}
+
+	return
+}
+
+// NewKey generates a signing key for a repository.
+func NewKey() (*openpgp.Entity, error) {
+	return openpgp.NewEntity("ubuntu-iso-builder offline repository", "", "", &packet.Config{
+		Algorithm:   packet.PubKeyAlgoRSA,
+		RSABits:     3072,
+		DefaultHash: crypto.SHA256,
+	})
+}
+
+// LoadOrCreateKey reads an armored private key from path, or generates one and
+// saves it there so later builds sign with the same key. An empty path always
+// generates a key that is used for a single build.
+func LoadOrCreateKey(path string) (*openpgp.Entity, error) {
+	if path == "" {
+		return NewKey()
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		key, err := NewKey()
+		if err != nil {
+			return nil, err
+		}
+		return key, writePrivateKey(path, key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening repository key %s: %w", path, err)
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	keys, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading repository key %s: %w", path, err)
+	}
+	if len(keys) != 1 || keys[0].PrivateKey == nil {
+		return nil, fmt.Errorf("repository key %s must hold exactly one private key", path)
+	}
+	if keys[0].PrivateKey.Encrypted {
+		return nil, fmt.Errorf("repository key %s is protected by a passphrase", path)
+	}
+	return keys[0], nil
+}
+
+func writePrivateKey(path string, key *openpgp.Entity) error {
+	var out bytes.Buffer
+	w, err := armor.Encode(&out, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		return err
+	}
+	if err = key.SerializePrivate(w, nil); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, out.Bytes(), 0600)
+}
+
+// Build replaces dir with a flat repository of the debs, signed with key. When
+// several debs are the same package, only the newest version is kept.
+func Build(dir string, debs []string, key *openpgp.Entity) error {
+	packages := map[string]Deb{}
+	for _, path := range debs {
+		deb, err := ReadDeb(path)
+		if err != nil {
+			return err
+		}
+		id := deb.Name() + ":" + deb.Control.Get("Architecture")
+		if current, ok := packages[id]; ok && CompareVersions(current.Version(), deb.Version()) >= 0 {
+			continue
+		}
+		packages[id] = deb
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("error removing repository %s: %w", dir, err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating repository %s: %w", dir, err)
+	}
+
+	ids := make([]string, 0, len(packages))
+	for id := range packages {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var index bytes.Buffer
+	for _, id := range ids {
+		deb := packages[id]
+		if err := copyDeb(deb.Path, filepath.Join(dir, deb.Filename())); err != nil {
+			return fmt.Errorf("error copying %s: %w", deb.Path, err)
+		}
+		entry := append(Paragraph{}, deb.Control...)
+		entry = entry.Set("Filename", deb.Filename())
+		entry = entry.Set("Size", fmt.Sprint(deb.Size))
+		entry = entry.Set("MD5sum", deb.MD5)
+		entry = entry.Set("SHA1", deb.SHA1)
+		entry = entry.Set("SHA256", deb.SHA256)
+		index.WriteString(entry.String() + "\n")
+	}
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write(index.Bytes()); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	files := map[string][]byte{
+		"Packages":    index.Bytes(),
+		"Packages.gz": compressed.Bytes(),
+	}
+	release := releaseFile(files)
+
+	inRelease, err := clearSign(release, key)
+	if err != nil {
+		return fmt.Errorf("error signing Release: %w", err)
+	}
+
+	var releaseSignature bytes.Buffer
+	if err = openpgp.ArmoredDetachSign(&releaseSignature, key, bytes.NewReader(release), &packet.Config{DefaultHash: crypto.SHA256}); err != nil {
+		return fmt.Errorf("error signing Release: %w", err)
+	}
+
+	var keyring bytes.Buffer
+	if err = key.Serialize(&keyring); err != nil {
+		return fmt.Errorf("error exporting repository key: %w", err)
+	}
+
+	files["Release"] = release
+	files["InRelease"] = inRelease
+	files["Release.gpg"] = releaseSignature.Bytes()
+	files[KeyringFile] = keyring.Bytes()
+	for name, content := range files {
+		if err = os.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			return fmt.Errorf("error writing %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// clearSign wraps text in a cleartext signature as InRelease is. The armor
+// carries a CRC24 checksum, which older gpgv releases still expect.
+func clearSign(text []byte, key *openpgp.Entity) ([]byte, error) {
+	message := bytes.TrimSuffix(text, []byte("\n"))
+
+	var out bytes.Buffer
+	out.WriteString("-----BEGIN PGP SIGNED MESSAGE-----\nHash: SHA256\n\n")
+	for _, line := range strings.Split(string(message), "\n") {
+		if strings.HasPrefix(line, "-") {
+			out.WriteString("- ")
+		}
+		out.WriteString(line + "\n")
+	}
+
+	var signature bytes.Buffer
+	if err := openpgp.DetachSignText(&signature, key, bytes.NewReader(message), &packet.Config{DefaultHash: crypto.SHA256}); err != nil {
+		return nil, err
+	}
+	w, err := armor.Encode(&out, "PGP SIGNATURE", nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(signature.Bytes()); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	out.WriteString("\n")
+
+	return out.Bytes(), nil
+}
+
+// releaseFile lists the checksums of the indexes for apt to verify them.
+func releaseFile(indexes map[string][]byte) []byte {
+	names := make([]string, 0, len(indexes))
+	for name := range indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	release := Paragraph{
+		{Name: "Origin", Value: "ubuntu-iso-builder"},
+		{Name: "Label", Value: "ubuntu-iso-builder offline"},
+		{Name: "Date", Value: time.Now().UTC().Format(time.RFC1123)},
+		{Name: "Architectures", Value: Architecture + " all"},
+		{Name: "Description", Value: "Packages carried on the installation ISO"},
+	}
+	sums := []struct {
+		field string
+		sum   func([]byte) string
+	}{
+		{"MD5Sum", func(b []byte) string { s := md5.Sum(b); return hex.EncodeToString(s[:]) }},
+		{"SHA1", func(b []byte) string { s := sha1.Sum(b); return hex.EncodeToString(s[:]) }},
+		{"SHA256", func(b []byte) string { s := sha256.Sum256(b); return hex.EncodeToString(s[:]) }},
+	}
+	for _, sum := range sums {
+		var lines []string
+		for _, name := range names {
+			lines = append(lines, fmt.Sprintf("%s %d %s", sum.sum(indexes[name]), len(indexes[name]), name))
+		}
+		release = append(release, Field{Name: sum.field, Value: "\n" + strings.Join(lines, "\n")})
+	}
+
+	return []byte(release.String())
+}
+
+func copyDeb(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func(in *os.File) {
+		_ = in.Close()
+	}(in)
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
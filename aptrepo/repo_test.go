@@ -0,0 +1,141 @@
+package aptrepo
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+)
+
+// writeDeb writes a .deb with the control file and no data.
+func writeDeb(t *testing.T, dir, name, control string) string {
+	t.Helper()
+
+	var controlTar bytes.Buffer
+	gz := gzip.NewWriter(&controlTar)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: "./control", Mode: 0644, Size: int64(len(control))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte(control)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	deb := bytes.NewBufferString(arMagic)
+	for _, member := range []struct {
+		name    string
+		content []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", controlTar.Bytes()},
+	} {
+		fmt.Fprintf(deb, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", member.name, 0, 0, 0, "100644", len(member.content))
+		deb.Write(member.content)
+		if len(member.content)%2 == 1 {
+			deb.WriteString("\n")
+		}
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, deb.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBuild(t *testing.T) {
+	debDir := t.TempDir()
+	debs := []string{
+		writeDeb(t, debDir, "tool-1.deb", "Package: tool\nVersion: 1:1.0\nArchitecture: amd64\nDescription: a tool\n"),
+		writeDeb(t, debDir, "tool-2.deb", "Package: tool\nVersion: 1:1.0-1\nArchitecture: amd64\nDescription: a tool\n"),
+		writeDeb(t, debDir, "tool-0.deb", "Package: tool\nVersion: 2.0\nArchitecture: amd64\nDescription: an old tool\n"),
+		writeDeb(t, debDir, "data.deb", "Package: data\nVersion: 0.1\nArchitecture: all\nDescription: some data\n with a long description\n"),
+	}
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := filepath.Join(t.TempDir(), Dir)
+	if err = Build(repo, debs, key); err != nil {
+		t.Fatal(err)
+	}
+
+	packages, err := os.ReadFile(filepath.Join(repo, "Packages"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	paragraphs, err := ParseParagraphs(bytes.NewReader(packages))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []string
+	for _, p := range paragraphs {
+		entries = append(entries, p.Get("Package")+" "+p.Get("Version")+" "+p.Get("Filename"))
+		if _, err = os.Stat(filepath.Join(repo, p.Get("Filename"))); err != nil {
+			t.Errorf("%s is not in the repository: %v", p.Get("Filename"), err)
+		}
+		if p.Get("SHA256") == "" || p.Get("Size") == "" {
+			t.Errorf("%s has no checksum or size", p.Get("Package"))
+		}
+	}
+	if got := strings.Join(entries, ", "); got != "data 0.1 data_0.1_all.deb, tool 1:1.0-1 tool_1.0-1_amd64.deb" {
+		t.Errorf("got packages %s, want the newest version of each", got)
+	}
+
+	keyring, err := os.ReadFile(filepath.Join(repo, KeyringFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := openpgp.ReadKeyRing(bytes.NewReader(keyring))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].PrivateKey != nil {
+		t.Errorf("the keyring does not hold just the public key")
+	}
+
+	release, err := os.ReadFile(filepath.Join(repo, "Release"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(packages)
+	if line := fmt.Sprintf(" %s %d Packages\n", hex.EncodeToString(sum[:]), len(packages)); !strings.Contains(string(release), line) {
+		t.Errorf("Release does not list the checksum of Packages:\n%s", release)
+	}
+	signature, err := os.ReadFile(filepath.Join(repo, "Release.gpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = openpgp.CheckArmoredDetachedSignature(keys, bytes.NewReader(release), bytes.NewReader(signature), nil); err != nil {
+		t.Errorf("Release.gpg does not verify: %v", err)
+	}
+
+	inRelease, err := os.ReadFile(filepath.Join(repo, "InRelease"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := clearsign.Decode(inRelease)
+	if block == nil {
+		t.Fatalf("InRelease is not clearsigned:\n%s", inRelease)
+	}
+	if string(block.Plaintext) != strings.TrimSuffix(string(release), "\n") {
+		t.Errorf("InRelease signs\n%s\nwant\n%s", block.Plaintext, release)
+	}
+	if _, err = block.VerifySignature(keys, nil); err != nil {
+		t.Errorf("InRelease does not verify: %v", err)
+	}
+}
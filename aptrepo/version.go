@@ -0,0 +1,105 @@
+package aptrepo
+
+import (
+	"strings"
+)
+
+// CompareVersions compares two Debian package versions the way dpkg does and
+// returns -1, 0 or 1.
+func CompareVersions(a, b string) int {
+	aEpoch, aUpstream, aRevision := splitVersion(a)
+	bEpoch, bUpstream, bRevision := splitVersion(b)
+
+	if c := compareNumbers(aEpoch, bEpoch); c != 0 {
+		return c
+	}
+	if c := compareVersionPart(aUpstream, bUpstream); c != 0 {
+		return c
+	}
+	return compareVersionPart(aRevision, bRevision)
+}
+
+// splitVersion splits [epoch:]upstream[-revision].
+func splitVersion(version string) (epoch, upstream, revision string) {
+	epoch = "0"
+	if e, rest, ok := strings.Cut(version, ":"); ok {
+		epoch, version = e, rest
+	}
+	upstream = version
+	if i := strings.LastIndex(version, "-"); i >= 0 {
+		upstream, revision = version[:i], version[i+1:]
+	}
+	return
+}
+
+// compareVersionPart compares alternating runs of non-digits and digits.
+func compareVersionPart(a, b string) int {
+	for a != "" || b != "" {
+		var aText, bText string
+		aText, a = splitRun(a, false)
+		bText, b = splitRun(b, false)
+		if c := compareText(aText, bText); c != 0 {
+			return c
+		}
+
+		var aNum, bNum string
+		aNum, a = splitRun(a, true)
+		bNum, b = splitRun(b, true)
+		if c := compareNumbers(aNum, bNum); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func splitRun(s string, digits bool) (run, rest string) {
+	i := 0
+	for i < len(s) && (s[i] >= '0' && s[i] <= '9') == digits {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// order ranks a character of a non-digit run: ~ sorts before everything,
+// even the end of the string, and letters sort before other characters.
+func order(c byte) int {
+	switch {
+	case c == '~':
+		return -1
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		return int(c)
+	default:
+		return int(c) + 256
+	}
+}
+
+func compareText(a, b string) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var ac, bc int
+		if i < len(a) {
+			ac = order(a[i])
+		}
+		if i < len(b) {
+			bc = order(b[i])
+		}
+		if ac != bc {
+			if ac < bc {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func compareNumbers(a, b string) int {
+	a = strings.TrimLeft(a, "0")
+	b = strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(a, b)
+}
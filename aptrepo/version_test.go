@@ -0,0 +1,42 @@
+package aptrepo
+
+import "testing"
+
+// The expected orderings are dpkg --compare-versions for the same versions.
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"1:1.0", "2.0", 1},
+		{"0:1.0", "1.0", 0},
+		{"2:1.0", "10:0.1", -1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0~~", "1.0~", -1},
+		{"1.0~", "1.0", -1},
+		{"1.0", "1.0+dfsg", -1},
+		{"1.0a", "1.0+", -1},
+		{"1.0-1", "1.0-2", -1},
+		{"1.0-10", "1.0-9", 1},
+		{"1.0", "1.0-0", 0},
+		{"1.0-1ubuntu1", "1.0-1", 1},
+		{"1.0-1~deb12u1", "1.0-1", -1},
+		{"1.2-3-4", "1.2-3-10", -1},
+		{"1.001", "1.1", 0},
+		{"007", "7", 0},
+		{"1.0.0", "1.0", 1},
+		{"24.0.7-0ubuntu4.1", "24.0.7-0ubuntu4", 1},
+	}
+	for _, test := range tests {
+		if got := CompareVersions(test.a, test.b); got != test.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+		if got := CompareVersions(test.b, test.a); got != -test.want {
+			t.Errorf("CompareVersions(%q, %q) = %d, want %d", test.b, test.a, got, -test.want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package builder
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/hunoz/ubuntu-iso-builder/aptrepo"
+	log "github.com/sirupsen/logrus"
+)
+
+// BuildAptRepo builds the offline apt repository selected by sources under
+// outputPath and returns its directory. The repository is signed with the key
+// at keyPath, which is created on first use, or with a key generated for this
+// build when keyPath is empty. Dependencies missing from the mirror are an
+// error unless the sources allow them.
+func BuildAptRepo(sources aptrepo.Sources, keyPath, outputPath string) (string, error) {
+	log.Infoln("📦 Building offline apt repository...")
+
+	debs, missing, err := sources.Collect()
+	if err != nil {
+		return "", fmt.Errorf("error collecting packages: %w", err)
+	}
+	if len(missing) > 0 && !sources.AllowMissing {
+		return "", fmt.Errorf("dependencies %s are not in the mirror, add them to the mirror or allow missing dependencies", strings.Join(missing, ", "))
+	}
+	for _, name := range missing {
+		log.Warnf("⚠️ Dependency %s is not in the mirror, the installed system must provide it", name)
+	}
+
+	key, err := aptrepo.LoadOrCreateKey(keyPath)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(outputPath, "apt-repo")
+	if err = aptrepo.Build(dir, debs, key); err != nil {
+		return "", err
+	}
+
+	log.Infof("✅ Offline apt repository with %d packages written to %s", len(debs), dir)
+	return dir, nil
+}
@@ -0,0 +1,261 @@
+package builder
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	generate_cloud_config "github.com/hunoz/ubuntu-iso-builder/generate-cloud-config"
+	"github.com/hunoz/ubuntu-iso-builder/images"
+	log "github.com/sirupsen/logrus"
+)
+
+// BatchItem is one ISO to build from a shared extraction of the source ISO.
+type BatchItem struct {
+	Name        string
+	CloudConfig string
+	Payloads    []generate_cloud_config.Payload
+}
+
+// BatchResult reports the outcome of building a single BatchItem.
+type BatchResult struct {
+	Name     string
+	IsoPath  string
+	Duration time.Duration
+	Err      error
+}
+
+// BatchBuilder builds many ISOs from one download and extraction of the source
+// ISO. Every item is assembled in its own hard-linked staging copy of the
+// extraction, so only the files that differ per host take extra space.
+type BatchBuilder struct {
+	base *ISOBuilder
+	jobs int
+}
+
+func (bb *BatchBuilder) stagingRoot() string {
+	return filepath.Join(bb.base.outputPath, "staging")
+}
+
+// prepare runs the shared steps once before any item is built.
+func (bb *BatchBuilder) prepare() bool {
+	steps := []struct {
+		name string
+		fn   func() bool
+	}{
+		{
+			name: "Checking dependencies",
+			fn:   bb.base.checkDependencies,
+		},
+		{
+			name: "Downloading ISO",
+			fn:   bb.base.downloadIso,
+		},
+		{
+			name: "Extracting ISO",
+			fn:   bb.base.extractIso,
+		},
+		{
+			name: "Preparing boot images",
+			fn: func() bool {
+				_, ok := bb.base.prepareBootImages()
+				return ok
+			},
+		},
+	}
+
+	for _, step := range steps {
+		log.Infof("📍 Step: %s", step.name)
+		if !step.fn() {
+			log.Errorf("❌ Build failed at: %s", step.name)
+			return false
+		}
+	}
+
+	return true
+}
+
+func (bb *BatchBuilder) buildItem(item BatchItem) (result BatchResult) {
+	start := time.Now()
+	result.Name = item.Name
+	defer func() {
+		result.Duration = time.Since(start)
+	}()
+
+	b := &ISOBuilder{
+		cloudConfig: item.CloudConfig,
+		osType:      bb.base.osType,
+		version:     bb.base.version,
+		outputPath:  bb.base.outputPath,
+		name:        item.Name,
+		stageDir:    filepath.Join(bb.stagingRoot(), item.Name),
+		payloads:    item.Payloads,
+		aptRepoDir:  bb.base.aptRepoDir,
+		images:      bb.base.images,
+	}
+	defer func() {
+		_ = os.RemoveAll(b.stageDir)
+	}()
+
+	if err := linkTree(b.extractDir(), b.stageDir); err != nil {
+		result.Err = fmt.Errorf("error staging source files: %w", err)
+		return
+	}
+
+	steps := []struct {
+		name string
+		fn   func() bool
+	}{
+		{
+			name: "Creating autoinstall config",
+			fn:   b.createAutoinstallConfigs,
+		},
+		{
+			name: "Modifying boot config",
+			fn:   b.modifyGrubConfig,
+		},
+		{
+			name: "Building final ISO",
+			fn:   b.buildIso,
+		},
+	}
+
+	for _, step := range steps {
+		log.Infof("📍 [%s] Step: %s", item.Name, step.name)
+		if !step.fn() {
+			result.Err = fmt.Errorf("build failed at: %s", step.name)
+			return
+		}
+	}
+
+	result.IsoPath = b.destIsoPath()
+	return
+}
+
+// Build prepares the shared extraction and then builds every item on a pool of
+// at most jobs workers. Results are returned in the order of items. If the
+// shared preparation fails, every item reports that failure.
+func (bb *BatchBuilder) Build(items []BatchItem) []BatchResult {
+	results := make([]BatchResult, len(items))
+	if !bb.prepare() {
+		for i, item := range items {
+			results[i] = BatchResult{Name: item.Name, Err: fmt.Errorf("preparing the source ISO failed")}
+		}
+		return results
+	}
+
+	jobs := bb.jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = bb.buildItem(items[i])
+			}
+		}()
+	}
+	for i := range items {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	_ = os.RemoveAll(bb.stagingRoot())
+	return results
+}
+
+// SetAptRepo sets the apt repository carried under /apt on every ISO.
+func (bb *BatchBuilder) SetAptRepo(dir string) {
+	bb.base.SetAptRepo(dir)
+}
+
+// SetImages sets the image archives carried under /images on every ISO.
+func (bb *BatchBuilder) SetImages(archives []images.Archive) {
+	bb.base.SetImages(archives)
+}
+
+func NewBatchBuilder(osType, version, outputPath string, jobs int) *BatchBuilder {
+	return &BatchBuilder{
+		base: NewISOBuilder("", osType, version, outputPath),
+		jobs: jobs,
+	}
+}
+
+// linkTree recreates the directory tree src at dst, hard-linking every file.
+// Files that cannot be linked, e.g. across filesystems, are copied instead.
+func linkTree(src, dst string) error {
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+		if err := os.Link(path, target); err == nil {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer func(in *os.File) {
+		_ = in.Close()
+	}(in)
+
+	stat, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, stat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// replaceFile writes data to a new inode at path. Staged trees hard-link the
+// shared extraction, so writing in place would change every host's copy.
+func replaceFile(path string, data []byte, perm os.FileMode) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.WriteFile(path, data, perm)
+}
@@ -9,7 +9,9 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/hunoz/ubuntu-iso-builder/aptrepo"
 	generate_cloud_config "github.com/hunoz/ubuntu-iso-builder/generate-cloud-config"
+	"github.com/hunoz/ubuntu-iso-builder/images"
 	"github.com/hunoz/ubuntu-iso-builder/utils"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v3"
@@ -33,6 +35,11 @@ type ISOBuilder struct {
 	osType         string
 	version        string
 	outputPath     string
+	name           string
+	stageDir       string
+	payloads       []generate_cloud_config.Payload
+	aptRepoDir     string
+	images         []images.Archive
 	progressReader *utils.ProgressReader
 }
 
@@ -53,11 +60,23 @@ func (b *ISOBuilder) extractDir() string {
 	return fmt.Sprintf("%s%s%s", b.outputPath, string(os.PathSeparator), "source-files")
 }
 
+// workDir is the tree the ISO is assembled from. It is the extraction itself
+// unless the builder was given its own staging copy of a shared extraction.
+func (b *ISOBuilder) workDir() string {
+	if b.stageDir != "" {
+		return b.stageDir
+	}
+	return b.extractDir()
+}
+
 func (b *ISOBuilder) sourceIsoPath() string {
 	return fmt.Sprintf("%s%s%s", b.outputPath, string(os.PathSeparator), fmt.Sprintf("ubuntu-%s-%s-amd64.iso", b.version, b.ubuntuType()))
 }
 
 func (b *ISOBuilder) destIsoPath() string {
+	if b.name != "" {
+		return fmt.Sprintf("%s%s%s", b.outputPath, string(os.PathSeparator), fmt.Sprintf("ubuntu-%s-%s-autoinstall.iso", b.version, b.name))
+	}
 	return fmt.Sprintf("%s%s%s", b.outputPath, string(os.PathSeparator), fmt.Sprintf("ubuntu-%s-autoinstall.iso", b.version))
 }
 
@@ -131,14 +150,14 @@ func (b *ISOBuilder) extractIso() bool {
 	// Remove existing directory if it exists
 	if _, err := os.Stat(extractDir); err == nil {
 		if err := os.RemoveAll(extractDir); err != nil {
-			log.Infoln("❌ Failed to remove existing directory: %v\n", err)
+			log.Errorf("❌ Failed to remove existing directory: %v", err)
 			return false
 		}
 	}
 
 	// Create the extraction directory
 	if err := os.MkdirAll(extractDir, 0755); err != nil {
-		log.Infoln("❌ Failed to create directory: %v\n", err)
+		log.Errorf("❌ Failed to create directory: %v", err)
 		return false
 	}
 
@@ -171,8 +190,8 @@ func (b *ISOBuilder) createAutoinstallConfigs() bool {
 	dump := strings.Join([]string{"#cloud-config", b.cloudConfig}, "\n")
 	hostname := config.AutoInstall.UserData.Hostname
 
-	autoinstallFile := filepath.Join(b.extractDir(), "autoinstall.yaml")
-	if err := os.WriteFile(autoinstallFile, []byte(dump), 0644); err != nil {
+	autoinstallFile := filepath.Join(b.workDir(), "autoinstall.yaml")
+	if err := replaceFile(autoinstallFile, []byte(dump), 0644); err != nil {
 		log.Errorf("error creating autoinstall config file: %v", err)
 		return false
 	}
@@ -180,7 +199,7 @@ func (b *ISOBuilder) createAutoinstallConfigs() bool {
 	// Method 2: Create nocloud datasource files for compatibility
 	/*nocloud_dir = self.extract_dir / "nocloud"
 	nocloud_dir.mkdir(exist_ok=True)*/
-	noCloudDir := filepath.Join(b.extractDir(), "nocloud")
+	noCloudDir := filepath.Join(b.workDir(), "nocloud")
 	if err := os.MkdirAll(noCloudDir, 0755); err != nil {
 		log.Errorf("error creating nocloud directory: %v", err)
 		return false
@@ -188,7 +207,7 @@ func (b *ISOBuilder) createAutoinstallConfigs() bool {
 
 	// Write user-data (preserve original formatting)
 	userDataFile := filepath.Join(noCloudDir, "user-data")
-	if err := os.WriteFile(userDataFile, []byte(dump), 0644); err != nil {
+	if err := replaceFile(userDataFile, []byte(dump), 0644); err != nil {
 		log.Errorf("error writing user-data file: %v", err)
 		return false
 	}
@@ -197,22 +216,78 @@ func (b *ISOBuilder) createAutoinstallConfigs() bool {
 	metaDataFile := filepath.Join(noCloudDir, "meta-data")
 	metaData := fmt.Sprintf("instance-id: %s\n", hostname)
 	metaData += fmt.Sprintf("local-hostname: %s\n", hostname)
-	if err := os.WriteFile(metaDataFile, []byte(metaData), 0644); err != nil {
+	if err := replaceFile(metaDataFile, []byte(metaData), 0644); err != nil {
 		log.Errorf("error writing meta-data file: %v", err)
 		return false
 	}
 
+	// Write network-config so the live installer comes up with the host's
+	// network instead of DHCP
+	networkConfigFile := filepath.Join(noCloudDir, "network-config")
+	if network := config.AutoInstall.Network; network != nil {
+		networkConfig, err := yaml.Marshal(network)
+		if err != nil {
+			log.Errorf("error encoding network-config: %v", err)
+			return false
+		}
+		if err := replaceFile(networkConfigFile, networkConfig, 0644); err != nil {
+			log.Errorf("error writing network-config file: %v", err)
+			return false
+		}
+	} else if err := os.Remove(networkConfigFile); err != nil && !os.IsNotExist(err) {
+		log.Errorf("error removing network-config file: %v", err)
+		return false
+	}
+
 	/*# Write vendor-data (required by nocloud)
 	vendor_data_file = nocloud_dir / "vendor-data"
 	with open(vendor_data_file, 'w') as f:
 	f.write("#cloud-config\n{}\n")*/
 	// Write vendor-data (required by nocloud)
 	vendorDataFile := filepath.Join(noCloudDir, "vendor-data")
-	if err := os.WriteFile(vendorDataFile, []byte("#cloud-config\n{}\n"), 0644); err != nil {
+	if err := replaceFile(vendorDataFile, []byte("#cloud-config\n{}\n"), 0644); err != nil {
 		log.Errorf("error writing vendor-data file: %v", err)
 		return false
 	}
 
+	if err := generate_cloud_config.WritePayloads(filepath.Join(b.workDir(), generate_cloud_config.PayloadDir), b.payloads); err != nil {
+		log.Errorf("error writing payloads: %v", err)
+		return false
+	}
+
+	repoDir := filepath.Join(b.workDir(), aptrepo.Dir)
+	if err := os.RemoveAll(repoDir); err != nil {
+		log.Errorf("error removing apt repository: %v", err)
+		return false
+	}
+	if b.aptRepoDir != "" {
+		if err := linkTree(b.aptRepoDir, repoDir); err != nil {
+			log.Errorf("error adding apt repository: %v", err)
+			return false
+		}
+	}
+
+	imagesDir := filepath.Join(b.workDir(), images.Dir)
+	if err := os.RemoveAll(imagesDir); err != nil {
+		log.Errorf("error removing image archives: %v", err)
+		return false
+	}
+	if len(b.images) > 0 {
+		if err := os.MkdirAll(imagesDir, 0755); err != nil {
+			log.Errorf("error creating image directory: %v", err)
+			return false
+		}
+	}
+	for _, archive := range b.images {
+		target := filepath.Join(imagesDir, archive.Name())
+		if err := os.Link(archive.Path, target); err != nil {
+			if err = copyFile(archive.Path, target); err != nil {
+				log.Errorf("error adding image archive %s: %v", archive.Path, err)
+				return false
+			}
+		}
+	}
+
 	log.Infoln("✅ Configuration created")
 
 	return true
@@ -220,8 +295,8 @@ func (b *ISOBuilder) createAutoinstallConfigs() bool {
 func (b *ISOBuilder) modifyGrubConfig() bool {
 	log.Infof("⚙️  Modifying boot configuration...")
 
-	grubCfg := filepath.Join(b.extractDir(), "boot", "grub", "grub.cfg")
-	grubCfgBackup := filepath.Join(b.extractDir(), "boot", "grub", "grub.cfg.backup")
+	grubCfg := filepath.Join(b.workDir(), "boot", "grub", "grub.cfg")
+	grubCfgBackup := filepath.Join(b.workDir(), "boot", "grub", "grub.cfg.backup")
 	content, err := os.ReadFile(grubCfg)
 	if err != nil {
 		log.Errorf("error reading grub config file: %v", err)
@@ -230,7 +305,7 @@ func (b *ISOBuilder) modifyGrubConfig() bool {
 
 	data := string(content)
 
-	if err = os.WriteFile(grubCfgBackup, content, 0644); err != nil {
+	if err = replaceFile(grubCfgBackup, content, 0644); err != nil {
 		log.Errorf("error backing up grub config file: %v", err)
 		return false
 	}
@@ -238,7 +313,7 @@ func (b *ISOBuilder) modifyGrubConfig() bool {
 	data = strings.Replace(data, "---", "autoinstall ---", -1)
 	data = strings.Replace(data, "set timeout=30", "set timeout=5", -1)
 
-	if err = os.WriteFile(grubCfg, []byte(data), 0644); err != nil {
+	if err = replaceFile(grubCfg, []byte(data), 0644); err != nil {
 		log.Errorf("error writing modified grub config file: %v", err)
 		return false
 	}
@@ -247,31 +322,45 @@ func (b *ISOBuilder) modifyGrubConfig() bool {
 	return true
 }
 
-func (b *ISOBuilder) buildIso() bool {
-	log.Infoln("🔨 Building ISO image...")
-
+// prepareBootImages makes sure the MBR template and the EFI boot image are
+// present in the extracted tree. It returns the MBR template path, or an empty
+// string if it could not be extracted.
+func (b *ISOBuilder) prepareBootImages() (mbrFile string, ok bool) {
 	// Extract MBR template from the system area of the source ISO
-	mbrFile := filepath.Join(b.extractDir(), "isohdpfx.bin")
-	if err := b.extractMBRTemplate(mbrFile); err != nil {
+	mbrFile = filepath.Join(b.workDir(), "isohdpfx.bin")
+	if stat, err := os.Stat(mbrFile); err == nil && stat.Size() == 432 {
+		log.Debugf("MBR template already extracted")
+	} else if err := b.extractMBRTemplate(mbrFile); err != nil {
 		log.Warnf("⚠️  Could not extract MBR template: %v. ISO may not boot on legacy BIOS", err)
 		mbrFile = "" // Clear it so we don't try to use it
 	} else {
 		log.Infof("✅ MBR template extracted (%d bytes)", 432)
 	}
 
-	efiImg := filepath.Join(b.extractDir(), "boot", "grub", "efi.img")
+	efiImg := filepath.Join(b.workDir(), "boot", "grub", "efi.img")
 
 	// Check if efi.img already exists in extracted files
 	if stat, err := os.Stat(efiImg); err != nil || stat.Size() == 0 {
 		log.Infof("📀 Extracting EFI boot image from source ISO...")
 
 		if !b.extractEfiImage(efiImg) {
-			return false
+			return "", false
 		}
 	} else {
 		log.Infof("✅ EFI image found in extracted files (%d KB)", stat.Size()/1024)
 	}
 
+	return mbrFile, true
+}
+
+func (b *ISOBuilder) buildIso() bool {
+	log.Infoln("🔨 Building ISO image...")
+
+	mbrFile, ok := b.prepareBootImages()
+	if !ok {
+		return false
+	}
+
 	mkisofsCmdArgs := []string{
 		"-as", "mkisofs",
 		"-r", "-V", "Ubuntu-Autoinstall",
@@ -292,7 +381,7 @@ func (b *ISOBuilder) buildIso() bool {
 		mkisofsCmdArgs = append(mkisofsCmdArgs, "-isohybrid-mbr", mbrFile)
 	}
 
-	mkisofsCmdArgs = append(mkisofsCmdArgs, b.extractDir())
+	mkisofsCmdArgs = append(mkisofsCmdArgs, b.workDir())
 
 	cmd := exec.Command("xorriso", mkisofsCmdArgs...)
 	out, err := cmd.CombinedOutput()
@@ -444,6 +533,21 @@ func (b *ISOBuilder) Build() bool {
 	return true
 }
 
+// SetPayloads sets the files carried under /payload on the ISO.
+func (b *ISOBuilder) SetPayloads(payloads []generate_cloud_config.Payload) {
+	b.payloads = payloads
+}
+
+// SetAptRepo sets the apt repository carried under /apt on the ISO.
+func (b *ISOBuilder) SetAptRepo(dir string) {
+	b.aptRepoDir = dir
+}
+
+// SetImages sets the image archives carried under /images on the ISO.
+func (b *ISOBuilder) SetImages(archives []images.Archive) {
+	b.images = archives
+}
+
 func NewISOBuilder(cloudConfig, osType, version, outputPath string) *ISOBuilder {
 	return &ISOBuilder{
 		cloudConfig: cloudConfig,
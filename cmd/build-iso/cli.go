@@ -4,7 +4,10 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
+	"github.com/hunoz/ubuntu-iso-builder/aptrepo"
+	"github.com/hunoz/ubuntu-iso-builder/images"
 	"github.com/hunoz/ubuntu-iso-builder/utils"
 	log "github.com/sirupsen/logrus"
 
@@ -33,7 +36,18 @@ var BuildIsoCmd = &cobra.Command{
 		typeKey := FlagKey.Type.Retrieve(v)
 		version := FlagKey.Version.Retrieve(v)
 		outputPath := FlagKey.OutputPath.Retrieve(v)
+		aptSources := aptrepo.Sources{
+			DebDirs:      FlagKey.AptDebDirs.Retrieve(v),
+			Packages:     FlagKey.AptPackages.Retrieve(v),
+			Mirror:       FlagKey.AptMirror.Retrieve(v),
+			AllowMissing: FlagKey.AptAllowMissing.Retrieve(v),
+		}
+		preloadImages, err := images.Collect(FlagKey.ImageArchives.Retrieve(v), FlagKey.Images.Retrieve(v), filepath.Join(outputPath, "images-export"))
+		if err != nil {
+			log.Fatalf("error collecting images: %v", err)
+		}
 		var cloudConfig string
+		var payloads []generate_cloud_config.Payload
 		if cmd.Flags().Changed(FlagKey.CloudConfigFile.Long) {
 			absPath, err := filepath.Abs(cloudConfigFilepath)
 			if err != nil {
@@ -58,36 +72,132 @@ var BuildIsoCmd = &cobra.Command{
 			} else {
 				cloudConfig = string(cfg)
 			}
+
+			payloadDir := FlagKey.PayloadDir.Retrieve(v)
+			if payloadDir == "" {
+				payloadDir = filepath.Join(filepath.Dir(absPath), generate_cloud_config.PayloadDir)
+				if _, err := os.Stat(filepath.Join(payloadDir, generate_cloud_config.PayloadManifest)); err != nil {
+					payloadDir = ""
+				}
+			}
+			if payloadDir != "" {
+				if payloads, err = generate_cloud_config.LoadPayloads(payloadDir); err != nil {
+					log.Fatalf("error loading payloads: %v", err)
+				}
+				log.Infof("Loaded %d payloads from %s", len(payloads), payloadDir)
+			}
 		} else {
 			hostname := AlternateFlagKeys.Hostname.Retrieve(v)
 			adminUsername := AlternateFlagKeys.AdminUsername.Retrieve(v)
 			adminPassword := AlternateFlagKeys.AdminPassword.Retrieve(v)
 			rootPassword := AlternateFlagKeys.RootPassword.Retrieve(v)
 			sshKeys := AlternateFlagKeys.SSHKeys.Retrieve(v)
+			sshKeyFiles := AlternateFlagKeys.SSHKeyFiles.Retrieve(v)
+			authorizedKeysFiles := AlternateFlagKeys.AuthorizedKeysFiles.Retrieve(v)
+			hostKeysDir := AlternateFlagKeys.HostKeysDir.Retrieve(v)
+			generateHostKeys := AlternateFlagKeys.GenerateHostKeys.Retrieve(v)
+			knownHostsNames := AlternateFlagKeys.KnownHostsNames.Retrieve(v)
 			diskSerial := AlternateFlagKeys.DiskSerial.Retrieve(v)
 			plexClaim := AlternateFlagKeys.PlexClaim.Retrieve(v)
 			cloudflaredToken := AlternateFlagKeys.CloudflaredToken.Retrieve(v)
+			timezone := AlternateFlagKeys.Timezone.Retrieve(v)
+			locale := AlternateFlagKeys.Locale.Retrieve(v)
+			keyboardLayout := AlternateFlagKeys.KeyboardLayout.Retrieve(v)
+			keyboardVariant := AlternateFlagKeys.KeyboardVariant.Retrieve(v)
+			shutdown := AlternateFlagKeys.Shutdown.Retrieve(v)
+			passwordHash := AlternateFlagKeys.PasswordHash.Retrieve(v)
+			ageIdentity := AlternateFlagKeys.AgeIdentity.Retrieve(v)
+			modules := AlternateFlagKeys.Modules.Retrieve(v)
+			withoutModules := AlternateFlagKeys.WithoutModules.Retrieve(v)
+			filesDirs := AlternateFlagKeys.FilesDirs.Retrieve(v)
+			seed := AlternateFlagKeys.Seed.Retrieve(v)
+			inlineThreshold := AlternateFlagKeys.InlineThreshold.Retrieve(v)
+			// Environment values sit below the host spec, values files and
+			// --set override it.
+			envValues, err := generate_cloud_config.LoadValues(os.Environ(), nil, nil)
+			if err != nil {
+				log.Fatalf("error loading template values: %v", err)
+			}
+			values, err := generate_cloud_config.LoadValues(nil, AlternateFlagKeys.ValuesFiles.Retrieve(v), AlternateFlagKeys.SetValues.Retrieve(v))
+			if err != nil {
+				log.Fatalf("error loading template values: %v", err)
+			}
 
-			conf, err := generate_cloud_config.GenerateCloudConfig(
-				generate_cloud_config.CloudConfigContext{
-					Hostname:         hostname,
-					AdminUsername:    adminUsername,
-					AdminPassword:    adminPassword,
-					RootPassword:     rootPassword,
-					SSHKeys:          sshKeys,
-					DiskSerial:       diskSerial,
-					PlexClaim:        plexClaim,
-					CloudflaredToken: cloudflaredToken,
+			ctx := generate_cloud_config.CloudConfigContext{
+				Hostname:            hostname,
+				AdminUsername:       adminUsername,
+				AdminPassword:       adminPassword,
+				RootPassword:        rootPassword,
+				SSHKeys:             sshKeys,
+				SSHKeyFiles:         sshKeyFiles,
+				AuthorizedKeysFiles: authorizedKeysFiles,
+				HostKeysDir:         hostKeysDir,
+				GenerateHostKeys:    generateHostKeys,
+				KnownHostsNames:     knownHostsNames,
+				DiskSerial:          diskSerial,
+				PlexClaim:           plexClaim,
+				CloudflaredToken:    cloudflaredToken,
+				Timezone:            timezone,
+				Locale:              locale,
+				KeyboardLayout:      keyboardLayout,
+				KeyboardVariant:     keyboardVariant,
+				Shutdown:            shutdown,
+				PasswordHash:        passwordHash,
+				AgeIdentity:         ageIdentity,
+				Modules:             modules,
+				WithoutModules:      withoutModules,
+				FilesDirs:           filesDirs,
+				Seed:                seed,
+				InlineThreshold:     inlineThreshold,
+				OfflineRepo:         !aptSources.Empty(),
+				PreloadImages:       preloadImages,
+			}
+			specKeyChanged := utils.SpecKeyChanged(cmd)
+			host, err := generate_cloud_config.PrepareHost(&ctx, generate_cloud_config.HostOptions{
+				Spec: AlternateFlagKeys.Spec.Retrieve(v),
+				SpecKeySet: func(key string) bool {
+					return specKeyChanged(key) || (key == "offline-repo" && !aptSources.Empty())
 				},
-			)
+				EnvValues:         envValues,
+				Values:            values,
+				GeneratePasswords: AlternateFlagKeys.GeneratePasswords.Retrieve(v),
+				PasswordPrompt:    utils.PasswordPrompt(),
+				Redact:            utils.RedactSecrets,
+				OutputDir:         outputPath,
+				CredentialsFile:   AlternateFlagKeys.CredentialsFile.Retrieve(v),
+				KnownHostsFile:    AlternateFlagKeys.KnownHostsFile.Retrieve(v),
+				SSHFPFile:         AlternateFlagKeys.SSHFPFile.Retrieve(v),
+			})
+			for _, warning := range host.Warnings {
+				log.Warnln(warning)
+			}
+			if len(host.GeneratedHostKeys) > 0 {
+				log.Infof("generated %s host keys", strings.Join(host.GeneratedHostKeys, ", "))
+			}
 			if err != nil {
-				log.Fatalf("error generating cloud-config: %v", err)
+				log.Fatalf("%v", err)
+			}
+			if host.CredentialsFile != "" {
+				log.Infof("generated passwords written to %s", host.CredentialsFile)
+			}
+			if host.KnownHostsFile != "" {
+				log.Infof("known_hosts lines written to %s and SSHFP records to %s", host.KnownHostsFile, host.SSHFPFile)
 			}
 
-			cloudConfig = conf
+			cloudConfig = host.CloudConfig
+			payloads = host.Payloads
 		}
 
 		isoBuilder := builder.NewISOBuilder(cloudConfig, typeKey, version, outputPath)
+		isoBuilder.SetPayloads(payloads)
+		isoBuilder.SetImages(preloadImages)
+		if !aptSources.Empty() {
+			repoDir, err := builder.BuildAptRepo(aptSources, FlagKey.AptRepoKey.Retrieve(v), outputPath)
+			if err != nil {
+				log.Fatalf("error building offline apt repository: %v", err)
+			}
+			isoBuilder.SetAptRepo(repoDir)
+		}
 		if ok := isoBuilder.Build(); !ok {
 			os.Exit(1)
 		}
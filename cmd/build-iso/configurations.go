@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 
+	generate_cloud_config "github.com/hunoz/ubuntu-iso-builder/generate-cloud-config"
 	"github.com/hunoz/ubuntu-iso-builder/utils"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -11,9 +12,17 @@ import (
 
 var FlagKey = struct {
 	CloudConfigFile utils.FlagKey[string]
+	PayloadDir      utils.FlagKey[string]
 	Type            utils.FlagKey[string]
 	Version         utils.FlagKey[string]
 	OutputPath      utils.FlagKey[string]
+	AptDebDirs      utils.FlagKey[[]string]
+	AptPackages     utils.FlagKey[[]string]
+	AptMirror       utils.FlagKey[string]
+	AptRepoKey      utils.FlagKey[string]
+	AptAllowMissing utils.FlagKey[bool]
+	ImageArchives   utils.FlagKey[[]string]
+	Images          utils.FlagKey[[]string]
 }{
 	CloudConfigFile: utils.FlagKey[string]{
 		Long:        "cloud-config-file",
@@ -26,6 +35,17 @@ var FlagKey = struct {
 			return v.GetString("cloud-config-file")
 		},
 	},
+	PayloadDir: utils.FlagKey[string]{
+		Long:        "payload-dir",
+		Short:       "",
+		Description: "Directory of payloads for the cloud-config file. Defaults to the payload directory next to it",
+		Add: func(command *cobra.Command) {
+			command.Flags().String("payload-dir", "", "Directory of payloads for the cloud-config file. Defaults to the payload directory next to it")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("payload-dir")
+		},
+	},
 	Type: utils.FlagKey[string]{
 		Long:        "type",
 		Short:       "t",
@@ -61,17 +81,118 @@ var FlagKey = struct {
 			return v.GetString("version")
 		},
 	},
+	AptDebDirs: utils.FlagKey[[]string]{
+		Long:        "apt-deb-dir",
+		Short:       "",
+		Description: "Directory of .deb files added to the offline apt repository on the ISO",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("apt-deb-dir", []string{}, "Directory of .deb files added to the offline apt repository on the ISO")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("apt-deb-dir")
+		},
+	},
+	AptPackages: utils.FlagKey[[]string]{
+		Long:        "apt-package",
+		Short:       "",
+		Description: "Package added with its dependencies from --apt-mirror to the offline apt repository on the ISO",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("apt-package", []string{}, "Package added with its dependencies from --apt-mirror to the offline apt repository on the ISO")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("apt-package")
+		},
+	},
+	AptMirror: utils.FlagKey[string]{
+		Long:        "apt-mirror",
+		Short:       "",
+		Description: "Local apt mirror that --apt-package is resolved against",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("apt-mirror", "", "Local apt mirror that --apt-package is resolved against")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("apt-mirror")
+		},
+	},
+	AptRepoKey: utils.FlagKey[string]{
+		Long:        "apt-repo-key",
+		Short:       "",
+		Description: "Armored private key the offline apt repository is signed with. Created if missing, a new key is generated per build if unset",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("apt-repo-key", "", "Armored private key the offline apt repository is signed with. Created if missing, a new key is generated per build if unset")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("apt-repo-key")
+		},
+	},
+	AptAllowMissing: utils.FlagKey[bool]{
+		Long:        "apt-allow-missing",
+		Short:       "",
+		Description: "Build the offline apt repository even if dependencies of --apt-package are not in the mirror",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().Bool("apt-allow-missing", false, "Build the offline apt repository even if dependencies of --apt-package are not in the mirror")
+		},
+		Retrieve: func(v *viper.Viper) bool {
+			return v.GetBool("apt-allow-missing")
+		},
+	},
+	ImageArchives: utils.FlagKey[[]string]{
+		Long:        "image-archive",
+		Short:       "",
+		Description: "docker-archive or OCI image tarball loaded into docker at first boot",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("image-archive", []string{}, "docker-archive or OCI image tarball loaded into docker at first boot")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("image-archive")
+		},
+	},
+	Images: utils.FlagKey[[]string]{
+		Long:        "image",
+		Short:       "",
+		Description: "Image exported from the local docker daemon, pulled first if missing, and loaded into docker at first boot",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("image", []string{}, "Image exported from the local docker daemon, pulled first if missing, and loaded into docker at first boot")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("image")
+		},
+	},
 }
 
 var AlternateFlagKeys = struct {
-	Hostname         utils.FlagKey[string]
-	AdminUsername    utils.FlagKey[string]
-	AdminPassword    utils.FlagKey[string]
-	RootPassword     utils.FlagKey[string]
-	SSHKeys          utils.FlagKey[[]string]
-	DiskSerial       utils.FlagKey[string]
-	PlexClaim        utils.FlagKey[string]
-	CloudflaredToken utils.FlagKey[string]
+	Hostname            utils.FlagKey[string]
+	AdminUsername       utils.FlagKey[string]
+	AdminPassword       utils.FlagKey[string]
+	RootPassword        utils.FlagKey[string]
+	SSHKeys             utils.FlagKey[[]string]
+	SSHKeyFiles         utils.FlagKey[[]string]
+	AuthorizedKeysFiles utils.FlagKey[[]string]
+	HostKeysDir         utils.FlagKey[string]
+	GenerateHostKeys    utils.FlagKey[bool]
+	KnownHostsNames     utils.FlagKey[[]string]
+	KnownHostsFile      utils.FlagKey[string]
+	SSHFPFile           utils.FlagKey[string]
+	DiskSerial          utils.FlagKey[string]
+	PlexClaim           utils.FlagKey[string]
+	CloudflaredToken    utils.FlagKey[string]
+	Timezone            utils.FlagKey[string]
+	Locale              utils.FlagKey[string]
+	KeyboardLayout      utils.FlagKey[string]
+	KeyboardVariant     utils.FlagKey[string]
+	Shutdown            utils.FlagKey[string]
+	PasswordHash        utils.FlagKey[string]
+	GeneratePasswords   utils.FlagKey[bool]
+	CredentialsFile     utils.FlagKey[string]
+	AgeIdentity         utils.FlagKey[string]
+	Modules             utils.FlagKey[[]string]
+	WithoutModules      utils.FlagKey[[]string]
+	FilesDirs           utils.FlagKey[[]string]
+	SetValues           utils.FlagKey[[]string]
+	ValuesFiles         utils.FlagKey[[]string]
+	Seed                utils.FlagKey[string]
+	InlineThreshold     utils.FlagKey[int]
+	Spec                utils.FlagKey[string]
 }{
 	Hostname: utils.FlagKey[string]{
 		Long:        "hostname",
@@ -79,7 +200,6 @@ var AlternateFlagKeys = struct {
 		Description: "Hostname that the machine will have",
 		Add: func(cmd *cobra.Command) {
 			cmd.Flags().StringP("hostname", "n", "", "Hostname that the machine will have")
-			_ = cmd.MarkFlagRequired("hostname")
 		},
 		Retrieve: func(v *viper.Viper) string {
 			return v.GetString("hostname")
@@ -99,9 +219,9 @@ var AlternateFlagKeys = struct {
 	AdminPassword: utils.FlagKey[string]{
 		Long:        "admin-password",
 		Short:       "p",
-		Description: "Hashed password (e.g. with mkpasswd sha-512) that the admin user will have",
+		Description: "Password of the admin user, plaintext, a crypt hash or a secret source. Asked for on a terminal when not given, empty locks it",
 		Add: func(cmd *cobra.Command) {
-			cmd.Flags().StringP("admin-password", "p", "password", "Hashed password (e.g. with mkpasswd sha-512) that the admin user will have")
+			cmd.Flags().StringP("admin-password", "p", "", "Password of the admin user, plaintext, a crypt hash or a secret source. Asked for on a terminal when not given, empty locks it")
 		},
 		Retrieve: func(v *viper.Viper) string {
 			return v.GetString("admin-password")
@@ -110,9 +230,9 @@ var AlternateFlagKeys = struct {
 	RootPassword: utils.FlagKey[string]{
 		Long:        "root-password",
 		Short:       "r",
-		Description: "Password that the root user will have",
+		Description: "Password of root, plaintext, a crypt hash or a secret source. Asked for on a terminal when not given, empty locks it",
 		Add: func(cmd *cobra.Command) {
-			cmd.Flags().StringP("root-password", "r", "password", "Password that the root user will have")
+			cmd.Flags().StringP("root-password", "r", "", "Password of root, plaintext, a crypt hash or a secret source. Asked for on a terminal when not given, empty locks it")
 		},
 		Retrieve: func(v *viper.Viper) string {
 			return v.GetString("root-password")
@@ -129,13 +249,89 @@ var AlternateFlagKeys = struct {
 			return v.GetStringSlice("ssh-key")
 		},
 	},
+	SSHKeyFiles: utils.FlagKey[[]string]{
+		Long:        "ssh-key-file",
+		Short:       "",
+		Description: "Public key file or glob such as ~/.ssh/*.pub whose keys the admin user and root will have",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("ssh-key-file", []string{}, "Public key file or glob such as ~/.ssh/*.pub whose keys the admin user and root will have")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("ssh-key-file")
+		},
+	},
+	AuthorizedKeysFiles: utils.FlagKey[[]string]{
+		Long:        "authorized-keys-file",
+		Short:       "",
+		Description: "authorized_keys file, options included, whose keys the admin user and root will have",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("authorized-keys-file", []string{}, "authorized_keys file, options included, whose keys the admin user and root will have")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("authorized-keys-file")
+		},
+	},
+	HostKeysDir: utils.FlagKey[string]{
+		Long:        "host-keys-dir",
+		Short:       "",
+		Description: "Directory that keeps the SSH host keys between installs. Missing keys are generated into it",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("host-keys-dir", "", "Directory that keeps the SSH host keys between installs. Missing keys are generated into it")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("host-keys-dir")
+		},
+	},
+	GenerateHostKeys: utils.FlagKey[bool]{
+		Long:        "generate-host-keys",
+		Short:       "",
+		Description: "Generate the SSH host keys for this install without keeping them",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().Bool("generate-host-keys", false, "Generate the SSH host keys for this install without keeping them")
+		},
+		Retrieve: func(v *viper.Viper) bool {
+			return v.GetBool("generate-host-keys")
+		},
+	},
+	KnownHostsNames: utils.FlagKey[[]string]{
+		Long:        "known-hosts-name",
+		Short:       "",
+		Description: "Name the host is reached by in known_hosts lines and SSHFP records. Defaults to the hostname",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("known-hosts-name", []string{}, "Name the host is reached by in known_hosts lines and SSHFP records. Defaults to the hostname")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("known-hosts-name")
+		},
+	},
+	KnownHostsFile: utils.FlagKey[string]{
+		Long:        "known-hosts-file",
+		Short:       "",
+		Description: "File the known_hosts lines of the host keys are written to, - for stdout. Defaults to <hostname>.known_hosts in the output path",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("known-hosts-file", "", "File the known_hosts lines of the host keys are written to, - for stdout. Defaults to <hostname>.known_hosts in the output path")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("known-hosts-file")
+		},
+	},
+	SSHFPFile: utils.FlagKey[string]{
+		Long:        "sshfp-file",
+		Short:       "",
+		Description: "File the SSHFP records of the host keys are written to, - for stdout. Defaults to <hostname>.sshfp in the output path",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("sshfp-file", "", "File the SSHFP records of the host keys are written to, - for stdout. Defaults to <hostname>.sshfp in the output path")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("sshfp-file")
+		},
+	},
 	DiskSerial: utils.FlagKey[string]{
 		Long:        "disk-serial",
 		Short:       "s",
-		Description: "Serial of the disk where the OS will be installed",
+		Description: "Serial of the disk where the OS will be installed with the lvm layout, when the host spec has no storage section",
 		Add: func(cmd *cobra.Command) {
-			cmd.Flags().StringP("disk-serial", "s", "", "Serial of the disk where the OS will be installed")
-			_ = cmd.MarkFlagRequired("disk-serial")
+			cmd.Flags().StringP("disk-serial", "s", "", "Serial of the disk where the OS will be installed with the lvm layout, when the host spec has no storage section")
 		},
 		Retrieve: func(v *viper.Viper) string {
 			return v.GetString("disk-serial")
@@ -144,10 +340,9 @@ var AlternateFlagKeys = struct {
 	PlexClaim: utils.FlagKey[string]{
 		Long:        "plex-claim",
 		Short:       "c",
-		Description: "Plex claim that will be used to activate Plex",
+		Description: "Plex claim that will be used to activate Plex. Required by the media-stack module. May be a secret source",
 		Add: func(cmd *cobra.Command) {
-			cmd.Flags().StringP("plex-claim", "c", "", "Plex claim that will be used to activate Plex")
-			_ = cmd.MarkFlagRequired("plex-claim")
+			cmd.Flags().StringP("plex-claim", "c", "", "Plex claim that will be used to activate Plex. Required by the media-stack module. May be a secret source")
 		},
 		Retrieve: func(v *viper.Viper) string {
 			return v.GetString("plex-claim")
@@ -156,13 +351,199 @@ var AlternateFlagKeys = struct {
 	CloudflaredToken: utils.FlagKey[string]{
 		Long:        "cloudflared-token",
 		Short:       "d",
-		Description: "Cloudflared token that will be used to activate Cloudflared",
+		Description: "Cloudflared token that will be used to activate Cloudflared. Required by the media-stack module. May be a secret source",
 		Add: func(cmd *cobra.Command) {
-			cmd.Flags().StringP("cloudflared-token", "d", "", "Cloudflared token that will be used to activate Cloudflared")
-			_ = cmd.MarkFlagRequired("cloudflared-token")
+			cmd.Flags().StringP("cloudflared-token", "d", "", "Cloudflared token that will be used to activate Cloudflared. Required by the media-stack module. May be a secret source")
 		},
 		Retrieve: func(v *viper.Viper) string {
 			return v.GetString("cloudflared-token")
 		},
 	},
+	Timezone: utils.FlagKey[string]{
+		Long:        "timezone",
+		Short:       "",
+		Description: "Time zone of the installed system",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("timezone", "Etc/UTC", "Time zone of the installed system")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("timezone")
+		},
+	},
+	Locale: utils.FlagKey[string]{
+		Long:        "locale",
+		Short:       "",
+		Description: "Locale of the installed system",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("locale", "en_US.UTF-8", "Locale of the installed system")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("locale")
+		},
+	},
+	KeyboardLayout: utils.FlagKey[string]{
+		Long:        "keyboard-layout",
+		Short:       "",
+		Description: "XKB keyboard layout of the installed system",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("keyboard-layout", "us", "XKB keyboard layout of the installed system")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("keyboard-layout")
+		},
+	},
+	KeyboardVariant: utils.FlagKey[string]{
+		Long:        "keyboard-variant",
+		Short:       "",
+		Description: "XKB variant of the keyboard layout",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("keyboard-variant", "", "XKB variant of the keyboard layout")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("keyboard-variant")
+		},
+	},
+	Shutdown: utils.FlagKey[string]{
+		Long:        "shutdown",
+		Short:       "",
+		Description: "What the installer does when it is done: reboot or poweroff",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("shutdown", "reboot", "What the installer does when it is done: reboot or poweroff")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("shutdown")
+		},
+	},
+	PasswordHash: utils.FlagKey[string]{
+		Long:        "password-hash",
+		Short:       "",
+		Description: "Scheme plaintext passwords are hashed with: yescrypt or sha512",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("password-hash", generate_cloud_config.PasswordHashYescrypt, "Scheme plaintext passwords are hashed with: yescrypt or sha512")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("password-hash")
+		},
+	},
+	GeneratePasswords: utils.FlagKey[bool]{
+		Long:        "generate-passwords",
+		Short:       "",
+		Description: "Generate random passwords for the admin user and root when not given and write them to the credentials file",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().Bool("generate-passwords", false, "Generate random passwords for the admin user and root when not given and write them to the credentials file")
+		},
+		Retrieve: func(v *viper.Viper) bool {
+			return v.GetBool("generate-passwords")
+		},
+	},
+	CredentialsFile: utils.FlagKey[string]{
+		Long:        "credentials-file",
+		Short:       "",
+		Description: "File the generated passwords are written to. Defaults to <hostname>.credentials in the output path",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("credentials-file", "", "File the generated passwords are written to. Defaults to <hostname>.credentials in the output path")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("credentials-file")
+		},
+	},
+	AgeIdentity: utils.FlagKey[string]{
+		Long:        "age-identity",
+		Short:       "",
+		Description: "age identity file that age:PATH#KEY secret sources are decrypted with",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("age-identity", "", "age identity file that age:PATH#KEY secret sources are decrypted with")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("age-identity")
+		},
+	},
+	Modules: utils.FlagKey[[]string]{
+		Long:        "module",
+		Short:       "m",
+		Description: "Module to enable. Replaces the default modules (docker, nvidia, raid, media-stack) when given",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArrayP("module", "m", []string{}, "Module to enable. Replaces the default modules (docker, nvidia, raid, media-stack) when given")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("module")
+		},
+	},
+	WithoutModules: utils.FlagKey[[]string]{
+		Long:        "without-module",
+		Short:       "",
+		Description: "Module to disable",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("without-module", []string{}, "Module to disable")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("without-module")
+		},
+	},
+	FilesDirs: utils.FlagKey[[]string]{
+		Long:        "files-dir",
+		Short:       "",
+		Description: "Directory layered over the embedded files. Later directories win",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("files-dir", []string{}, "Directory layered over the embedded files. Later directories win")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("files-dir")
+		},
+	},
+	SetValues: utils.FlagKey[[]string]{
+		Long:        "set",
+		Short:       "",
+		Description: "Template value as key=value, exposed as .Values.key. Dotted keys create nested values",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("set", []string{}, "Template value as key=value, exposed as .Values.key. Dotted keys create nested values")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("set")
+		},
+	},
+	ValuesFiles: utils.FlagKey[[]string]{
+		Long:        "values",
+		Short:       "",
+		Description: "YAML file of template values. Later files win, --set wins over all files",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("values", []string{}, "YAML file of template values. Later files win, --set wins over all files")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("values")
+		},
+	},
+	Seed: utils.FlagKey[string]{
+		Long:        "seed",
+		Short:       "",
+		Description: "Secret seed that makes randomness in templates and password salts reproducible. Both are random when unset",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("seed", "", "Secret seed that makes randomness in templates and password salts reproducible. Both are random when unset")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("seed")
+		},
+	},
+	InlineThreshold: utils.FlagKey[int]{
+		Long:        "inline-threshold",
+		Short:       "",
+		Description: "Size in bytes from which files are carried on the ISO instead of inlined. Negative inlines every file",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().Int("inline-threshold", generate_cloud_config.DefaultInlineThreshold, "Size in bytes from which files are carried on the ISO instead of inlined. Negative inlines every file")
+		},
+		Retrieve: func(v *viper.Viper) int {
+			return v.GetInt("inline-threshold")
+		},
+	},
+	Spec: utils.FlagKey[string]{
+		Long:        "spec",
+		Short:       "",
+		Description: "Host spec file, written like an inventory host entry. Flags that are given override its values",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("spec", "", "Host spec file, written like an inventory host entry. Flags that are given override its values")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("spec")
+		},
+	},
 }
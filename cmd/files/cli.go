@@ -0,0 +1,76 @@
+package files
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	generate_cloud_config "github.com/hunoz/ubuntu-iso-builder/generate-cloud-config"
+	"github.com/hunoz/ubuntu-iso-builder/utils"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var v = viper.New()
+
+var FilesCmd = &cobra.Command{
+	Use:   "files",
+	Short: "Inspect the files installed on the target",
+}
+
+var lsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List the merged file tree and the layer each file came from",
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := generate_cloud_config.CloudConfigContext{
+			AdminUsername:  FlagKeys.AdminUsername.Retrieve(v),
+			FilesDirs:      FlagKeys.FilesDirs.Retrieve(v),
+			Modules:        FlagKeys.Modules.Retrieve(v),
+			WithoutModules: FlagKeys.WithoutModules.Retrieve(v),
+		}
+		// The host's modules and values decide which conditional files are
+		// installed.
+		envValues, err := generate_cloud_config.LoadValues(os.Environ(), nil, nil)
+		if err != nil {
+			log.Fatalf("error loading template values: %v", err)
+		}
+		values, err := generate_cloud_config.LoadValues(nil, FlagKeys.ValuesFiles.Retrieve(v), FlagKeys.SetValues.Retrieve(v))
+		if err != nil {
+			log.Fatalf("error loading template values: %v", err)
+		}
+		err = generate_cloud_config.LoadHost(&ctx, generate_cloud_config.HostOptions{
+			Spec:       FlagKeys.Spec.Retrieve(v),
+			SpecKeySet: utils.SpecKeyChanged(cmd),
+			EnvValues:  envValues,
+			Values:     values,
+		})
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		files, err := generate_cloud_config.ListFiles(ctx)
+		if err != nil {
+			log.Fatalf("error listing files: %v", err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "PATH\tMODE\tOWNER\tPHASE\tENABLED\tLAYER\tSOURCE")
+		for _, file := range files {
+			user, group := file.Meta.UserGroup()
+			_, _ = fmt.Fprintf(w, "%s\t%04o\t%s:%s\t%s\t%t\t%s\t%s\n", file.Target, file.Meta.FileMode(), user, group, file.Meta.InstallPhase(), file.Enabled, file.Layer, file.Source)
+		}
+		_ = w.Flush()
+	},
+}
+
+func init() {
+	err := utils.AddFlags(FlagKeys, lsCmd)
+	if err != nil {
+		log.Fatalf("error adding flags to files ls: %v", err)
+		os.Exit(1)
+	}
+
+	_ = v.BindPFlags(lsCmd.Flags())
+
+	FilesCmd.AddCommand(lsCmd)
+}
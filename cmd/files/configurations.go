@@ -0,0 +1,95 @@
+package files
+
+import (
+	"github.com/hunoz/ubuntu-iso-builder/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var FlagKeys = struct {
+	AdminUsername  utils.FlagKey[string]
+	FilesDirs      utils.FlagKey[[]string]
+	Modules        utils.FlagKey[[]string]
+	WithoutModules utils.FlagKey[[]string]
+	SetValues      utils.FlagKey[[]string]
+	ValuesFiles    utils.FlagKey[[]string]
+	Spec           utils.FlagKey[string]
+}{
+	AdminUsername: utils.FlagKey[string]{
+		Long:        "admin-username",
+		Short:       "u",
+		Description: "Username of the admin user whose home ~/ refers to",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringP("admin-username", "u", "localadmin", "Username of the admin user whose home ~/ refers to")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("admin-username")
+		},
+	},
+	FilesDirs: utils.FlagKey[[]string]{
+		Long:        "files-dir",
+		Short:       "",
+		Description: "Directory layered over the embedded files. Later directories win",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("files-dir", []string{}, "Directory layered over the embedded files. Later directories win")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("files-dir")
+		},
+	},
+	Modules: utils.FlagKey[[]string]{
+		Long:        "module",
+		Short:       "m",
+		Description: "Module to enable. Replaces the default modules (docker, nvidia, raid, media-stack) when given",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArrayP("module", "m", []string{}, "Module to enable. Replaces the default modules (docker, nvidia, raid, media-stack) when given")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("module")
+		},
+	},
+	WithoutModules: utils.FlagKey[[]string]{
+		Long:        "without-module",
+		Short:       "",
+		Description: "Module to disable",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("without-module", []string{}, "Module to disable")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("without-module")
+		},
+	},
+	SetValues: utils.FlagKey[[]string]{
+		Long:        "set",
+		Short:       "",
+		Description: "Template value as key=value, exposed as .Values.key. Dotted keys create nested values",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("set", []string{}, "Template value as key=value, exposed as .Values.key. Dotted keys create nested values")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("set")
+		},
+	},
+	ValuesFiles: utils.FlagKey[[]string]{
+		Long:        "values",
+		Short:       "",
+		Description: "YAML file of template values. Later files win, --set wins over all files",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("values", []string{}, "YAML file of template values. Later files win, --set wins over all files")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("values")
+		},
+	},
+	Spec: utils.FlagKey[string]{
+		Long:        "spec",
+		Short:       "",
+		Description: "Host spec file, written like an inventory host entry. Flags that are given override its values",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("spec", "", "Host spec file, written like an inventory host entry. Flags that are given override its values")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("spec")
+		},
+	},
+}
@@ -2,8 +2,11 @@ package generatecloudinit
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 
 	generate_cloud_config "github.com/hunoz/ubuntu-iso-builder/generate-cloud-config"
+	"github.com/hunoz/ubuntu-iso-builder/images"
 	"github.com/hunoz/ubuntu-iso-builder/utils"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -22,28 +25,115 @@ var GenerateCloudConfigCmd = &cobra.Command{
 		adminPassword := FlagKeys.AdminPassword.Retrieve(v)
 		rootPassword := FlagKeys.RootPassword.Retrieve(v)
 		sshKeys := FlagKeys.SSHKeys.Retrieve(v)
+		sshKeyFiles := FlagKeys.SSHKeyFiles.Retrieve(v)
+		authorizedKeysFiles := FlagKeys.AuthorizedKeysFiles.Retrieve(v)
+		hostKeysDir := FlagKeys.HostKeysDir.Retrieve(v)
+		generateHostKeys := FlagKeys.GenerateHostKeys.Retrieve(v)
+		knownHostsNames := FlagKeys.KnownHostsNames.Retrieve(v)
 		diskSerial := FlagKeys.DiskSerial.Retrieve(v)
 		plexClaim := FlagKeys.PlexClaim.Retrieve(v)
 		cloudflaredToken := FlagKeys.CloudflaredToken.Retrieve(v)
+		timezone := FlagKeys.Timezone.Retrieve(v)
+		locale := FlagKeys.Locale.Retrieve(v)
+		keyboardLayout := FlagKeys.KeyboardLayout.Retrieve(v)
+		keyboardVariant := FlagKeys.KeyboardVariant.Retrieve(v)
+		shutdown := FlagKeys.Shutdown.Retrieve(v)
+		passwordHash := FlagKeys.PasswordHash.Retrieve(v)
+		ageIdentity := FlagKeys.AgeIdentity.Retrieve(v)
+		modules := FlagKeys.Modules.Retrieve(v)
+		withoutModules := FlagKeys.WithoutModules.Retrieve(v)
+		filesDirs := FlagKeys.FilesDirs.Retrieve(v)
+		seed := FlagKeys.Seed.Retrieve(v)
+		inlineThreshold := FlagKeys.InlineThreshold.Retrieve(v)
+		offlineRepo := FlagKeys.OfflineRepo.Retrieve(v)
+		preloadImages, err := images.Collect(FlagKeys.ImageArchives.Retrieve(v), nil, "")
+		if err != nil {
+			log.Fatalf("error reading image archives: %v", err)
+		}
+		// Environment values sit below the host spec, values files and --set
+		// override it.
+		envValues, err := generate_cloud_config.LoadValues(os.Environ(), nil, nil)
+		if err != nil {
+			log.Fatalf("error loading template values: %v", err)
+		}
+		values, err := generate_cloud_config.LoadValues(nil, FlagKeys.ValuesFiles.Retrieve(v), FlagKeys.SetValues.Retrieve(v))
+		if err != nil {
+			log.Fatalf("error loading template values: %v", err)
+		}
 		outputPath := FlagKeys.OutputPath.Retrieve(v)
 
-		conf, err := generate_cloud_config.GenerateCloudConfig(
-			generate_cloud_config.CloudConfigContext{
-				Hostname:         hostname,
-				AdminUsername:    adminUsername,
-				AdminPassword:    adminPassword,
-				RootPassword:     rootPassword,
-				SSHKeys:          sshKeys,
-				DiskSerial:       diskSerial,
-				PlexClaim:        plexClaim,
-				CloudflaredToken: cloudflaredToken,
-			},
-		)
+		ctx := generate_cloud_config.CloudConfigContext{
+			Hostname:            hostname,
+			AdminUsername:       adminUsername,
+			AdminPassword:       adminPassword,
+			RootPassword:        rootPassword,
+			SSHKeys:             sshKeys,
+			SSHKeyFiles:         sshKeyFiles,
+			AuthorizedKeysFiles: authorizedKeysFiles,
+			HostKeysDir:         hostKeysDir,
+			GenerateHostKeys:    generateHostKeys,
+			KnownHostsNames:     knownHostsNames,
+			DiskSerial:          diskSerial,
+			PlexClaim:           plexClaim,
+			CloudflaredToken:    cloudflaredToken,
+			Timezone:            timezone,
+			Locale:              locale,
+			KeyboardLayout:      keyboardLayout,
+			KeyboardVariant:     keyboardVariant,
+			Shutdown:            shutdown,
+			PasswordHash:        passwordHash,
+			AgeIdentity:         ageIdentity,
+			Modules:             modules,
+			WithoutModules:      withoutModules,
+			FilesDirs:           filesDirs,
+			Seed:                seed,
+			InlineThreshold:     inlineThreshold,
+			OfflineRepo:         offlineRepo,
+			PreloadImages:       preloadImages,
+		}
+		dir := "."
+		if outputPath != "-" {
+			dir = filepath.Dir(outputPath)
+		}
+		knownHostsFile := FlagKeys.KnownHostsFile.Retrieve(v)
+		sshfpFile := FlagKeys.SSHFPFile.Retrieve(v)
+		if outputPath == "-" && (knownHostsFile == "-" || sshfpFile == "-") {
+			log.Fatalf("the cloud-config is written to stdout, write the known_hosts lines and SSHFP records to files")
+		}
+		host, err := generate_cloud_config.PrepareHost(&ctx, generate_cloud_config.HostOptions{
+			Spec:              FlagKeys.Spec.Retrieve(v),
+			SpecKeySet:        utils.SpecKeyChanged(cmd),
+			EnvValues:         envValues,
+			Values:            values,
+			GeneratePasswords: FlagKeys.GeneratePasswords.Retrieve(v),
+			PasswordPrompt:    utils.PasswordPrompt(),
+			Redact:            utils.RedactSecrets,
+			OutputDir:         dir,
+			CredentialsFile:   FlagKeys.CredentialsFile.Retrieve(v),
+			KnownHostsFile:    knownHostsFile,
+			SSHFPFile:         sshfpFile,
+		})
+		for _, warning := range host.Warnings {
+			log.Warnln(warning)
+		}
+		if len(host.GeneratedHostKeys) > 0 {
+			log.Infof("generated %s host keys", strings.Join(host.GeneratedHostKeys, ", "))
+		}
 		if err != nil {
-			log.Fatalf("error generating cloud-config: %v", err)
+			log.Fatalf("%v", err)
+		}
+		if host.CredentialsFile != "" {
+			log.Infof("generated passwords written to %s", host.CredentialsFile)
 		}
+		if host.KnownHostsFile != "" {
+			log.Infof("known_hosts lines written to %s and SSHFP records to %s", host.KnownHostsFile, host.SSHFPFile)
+		}
+		conf, payloads := host.CloudConfig, host.Payloads
 
 		if outputPath == "-" {
+			if len(payloads) > 0 {
+				log.Fatalf("cloud-config carries %d payloads that cannot be written to stdout, write it to a file or raise --inline-threshold", len(payloads))
+			}
 			if _, err := os.Stdout.WriteString(conf); err != nil {
 				log.Fatalf("error writing cloud-config to stdout: %v", err)
 			}
@@ -52,6 +142,13 @@ var GenerateCloudConfigCmd = &cobra.Command{
 				log.Fatalf(err.Error())
 			}
 			log.Infof("cloud-config written to %s", outputPath)
+			if len(payloads) > 0 {
+				payloadDir := filepath.Join(filepath.Dir(outputPath), generate_cloud_config.PayloadDir)
+				if err = generate_cloud_config.WritePayloads(payloadDir, payloads); err != nil {
+					log.Fatalf(err.Error())
+				}
+				log.Infof("%d payloads written to %s", len(payloads), payloadDir)
+			}
 		}
 
 		return nil
@@ -0,0 +1,205 @@
+package inventory
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hunoz/ubuntu-iso-builder/aptrepo"
+	"github.com/hunoz/ubuntu-iso-builder/builder"
+	generate_cloud_config "github.com/hunoz/ubuntu-iso-builder/generate-cloud-config"
+	"github.com/hunoz/ubuntu-iso-builder/images"
+	"github.com/hunoz/ubuntu-iso-builder/utils"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var v = viper.New()
+
+type hostResult struct {
+	name        string
+	cloudConfig string
+	isoPath     string
+	duration    time.Duration
+	err         error
+}
+
+var InventoryCmd = &cobra.Command{
+	Use:     "inventory",
+	Aliases: []string{"inv", "i"},
+	Short:   "Generate cloud-config files and optionally ISOs for every host in an inventory",
+	Run: func(cmd *cobra.Command, args []string) {
+		inventoryFile := FlagKeys.InventoryFile.Retrieve(v)
+		outputPath := FlagKeys.OutputPath.Retrieve(v)
+		buildIso := FlagKeys.BuildIso.Retrieve(v)
+		typeKey := FlagKeys.Type.Retrieve(v)
+		version := FlagKeys.Version.Retrieve(v)
+		jobs := FlagKeys.Jobs.Retrieve(v)
+		generatePasswords := FlagKeys.GeneratePasswords.Retrieve(v)
+		ageIdentity := FlagKeys.AgeIdentity.Retrieve(v)
+		hostKeysDir := FlagKeys.HostKeysDir.Retrieve(v)
+		aptSources := aptrepo.Sources{
+			DebDirs:      FlagKeys.AptDebDirs.Retrieve(v),
+			Packages:     FlagKeys.AptPackages.Retrieve(v),
+			Mirror:       FlagKeys.AptMirror.Retrieve(v),
+			AllowMissing: FlagKeys.AptAllowMissing.Retrieve(v),
+		}
+
+		preloadImages, err := images.Collect(FlagKeys.ImageArchives.Retrieve(v), FlagKeys.Images.Retrieve(v), filepath.Join(outputPath, "images-export"))
+		if err != nil {
+			log.Fatalf("error collecting images: %v", err)
+		}
+
+		hosts, err := generate_cloud_config.LoadInventory(inventoryFile)
+		if err != nil {
+			log.Fatalf("error loading inventory: %v", err)
+		}
+		log.Infof("Loaded %d hosts from %s", len(hosts), inventoryFile)
+
+		// Environment values sit below the inventory, values files and --set
+		// override it.
+		envValues, err := generate_cloud_config.LoadValues(os.Environ(), nil, nil)
+		if err != nil {
+			log.Fatalf("error loading template values: %v", err)
+		}
+		overrideValues, err := generate_cloud_config.LoadValues(nil, FlagKeys.ValuesFiles.Retrieve(v), FlagKeys.SetValues.Retrieve(v))
+		if err != nil {
+			log.Fatalf("error loading template values: %v", err)
+		}
+
+		passwordPrompt := utils.PasswordPrompt()
+		var results []*hostResult
+		var items []builder.BatchItem
+		// The known_hosts lines and SSHFP records of all hosts go into one
+		// file each as well.
+		var allKnownHosts, allSSHFP strings.Builder
+		for _, host := range hosts {
+			start := time.Now()
+			result := &hostResult{name: host.Name}
+			results = append(results, result)
+
+			if !aptSources.Empty() {
+				host.Context.OfflineRepo = true
+			}
+			host.Context.PreloadImages = preloadImages
+			if host.Context.AgeIdentity == "" {
+				host.Context.AgeIdentity = ageIdentity
+			}
+			if host.Context.HostKeysDir == "" && hostKeysDir != "" {
+				host.Context.HostKeysDir = filepath.Join(hostKeysDir, host.Name)
+			}
+
+			prepared, err := generate_cloud_config.PrepareHost(&host.Context, generate_cloud_config.HostOptions{
+				EnvValues:         envValues,
+				Values:            overrideValues,
+				GeneratePasswords: generatePasswords,
+				PasswordPrompt:    passwordPrompt,
+				Redact:            utils.RedactSecrets,
+				OutputDir:         outputPath,
+			})
+			for _, warning := range prepared.Warnings {
+				log.Warnf("%s: %s", host.Name, warning)
+			}
+			if len(prepared.GeneratedHostKeys) > 0 {
+				log.Infof("%s: generated %s host keys", host.Name, strings.Join(prepared.GeneratedHostKeys, ", "))
+			}
+			conf, payloads := prepared.CloudConfig, prepared.Payloads
+			if err == nil {
+				result.cloudConfig = filepath.Join(outputPath, fmt.Sprintf("%s.yaml", host.Name))
+				err = generate_cloud_config.WriteCloudConfig(conf, result.cloudConfig)
+			}
+			if err == nil {
+				err = generate_cloud_config.WritePayloads(filepath.Join(outputPath, fmt.Sprintf("%s-%s", host.Name, generate_cloud_config.PayloadDir)), payloads)
+			}
+			result.duration = time.Since(start)
+			if err != nil {
+				result.err = err
+				continue
+			}
+			log.Infof("cloud-config for %s written to %s", host.Name, result.cloudConfig)
+			allKnownHosts.WriteString(host.Context.KnownHosts())
+			allSSHFP.WriteString(host.Context.SSHFPRecords())
+
+			if buildIso {
+				items = append(items, builder.BatchItem{Name: host.Name, CloudConfig: conf, Payloads: payloads})
+			}
+		}
+
+		if allKnownHosts.Len() > 0 {
+			if err := utils.WriteOutput(filepath.Join(outputPath, "known_hosts"), allKnownHosts.String()); err != nil {
+				log.Fatalf("error writing known_hosts lines: %v", err)
+			}
+			if err := utils.WriteOutput(filepath.Join(outputPath, "sshfp"), allSSHFP.String()); err != nil {
+				log.Fatalf("error writing SSHFP records: %v", err)
+			}
+			log.Infof("known_hosts lines of all hosts written to %s", filepath.Join(outputPath, "known_hosts"))
+		}
+
+		if len(items) > 0 {
+			batch := builder.NewBatchBuilder(typeKey, version, outputPath, jobs)
+			if !aptSources.Empty() {
+				repoDir, err := builder.BuildAptRepo(aptSources, FlagKeys.AptRepoKey.Retrieve(v), outputPath)
+				if err != nil {
+					log.Fatalf("error building offline apt repository: %v", err)
+				}
+				batch.SetAptRepo(repoDir)
+			}
+			batch.SetImages(preloadImages)
+			for _, built := range batch.Build(items) {
+				for _, result := range results {
+					if result.name == built.Name {
+						result.isoPath = built.IsoPath
+						result.duration += built.Duration
+						result.err = built.Err
+					}
+				}
+			}
+		}
+
+		if failed := printSummary(results); failed > 0 {
+			log.Errorf("%d of %d hosts failed", failed, len(results))
+			os.Exit(1)
+		}
+	},
+}
+
+// printSummary writes a table with one row per host and returns the number of
+// hosts that failed.
+func printSummary(results []*hostResult) (failed int) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "HOST\tSTATUS\tDURATION\tCLOUD-CONFIG\tISO")
+	for _, result := range results {
+		status := "ok"
+		iso := result.isoPath
+		if result.err != nil {
+			failed++
+			status = "failed"
+			iso = result.err.Error()
+		}
+		if iso == "" {
+			iso = "-"
+		}
+		cloudConfig := result.cloudConfig
+		if cloudConfig == "" {
+			cloudConfig = "-"
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", result.name, status, result.duration.Round(time.Second), cloudConfig, iso)
+	}
+	_ = w.Flush()
+
+	return
+}
+
+func init() {
+	err := utils.AddFlags(FlagKeys, InventoryCmd)
+	if err != nil {
+		log.Fatalf("error adding flags to inventory: %v", err)
+		os.Exit(1)
+	}
+
+	_ = v.BindPFlags(InventoryCmd.Flags())
+}
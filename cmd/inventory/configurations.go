@@ -0,0 +1,234 @@
+package inventory
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/hunoz/ubuntu-iso-builder/utils"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var FlagKeys = struct {
+	InventoryFile     utils.FlagKey[string]
+	OutputPath        utils.FlagKey[string]
+	BuildIso          utils.FlagKey[bool]
+	Type              utils.FlagKey[string]
+	Version           utils.FlagKey[string]
+	Jobs              utils.FlagKey[int]
+	AptDebDirs        utils.FlagKey[[]string]
+	AptPackages       utils.FlagKey[[]string]
+	AptMirror         utils.FlagKey[string]
+	AptRepoKey        utils.FlagKey[string]
+	AptAllowMissing   utils.FlagKey[bool]
+	ImageArchives     utils.FlagKey[[]string]
+	Images            utils.FlagKey[[]string]
+	SetValues         utils.FlagKey[[]string]
+	ValuesFiles       utils.FlagKey[[]string]
+	GeneratePasswords utils.FlagKey[bool]
+	AgeIdentity       utils.FlagKey[string]
+	HostKeysDir       utils.FlagKey[string]
+}{
+	InventoryFile: utils.FlagKey[string]{
+		Long:        "inventory-file",
+		Short:       "i",
+		Description: "Path to the YAML or CSV inventory file",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringP("inventory-file", "i", "", "Path to the YAML or CSV inventory file")
+			_ = cmd.MarkFlagRequired("inventory-file")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("inventory-file")
+		},
+	},
+	OutputPath: utils.FlagKey[string]{
+		Long:        "output-path",
+		Short:       "o",
+		Description: "Directory where the cloud-config files and ISOs will be written to",
+		Add: func(cmd *cobra.Command) {
+			tmpDir := os.TempDir()
+			outputPath := filepath.Join(tmpDir, "iso-builder-inventory")
+			cmd.Flags().StringP("output-path", "o", outputPath, "Directory where the cloud-config files and ISOs will be written to")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("output-path")
+		},
+	},
+	BuildIso: utils.FlagKey[bool]{
+		Long:        "build-iso",
+		Short:       "b",
+		Description: "Build one ISO per host in addition to the cloud-config files",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().BoolP("build-iso", "b", false, "Build one ISO per host in addition to the cloud-config files")
+		},
+		Retrieve: func(v *viper.Viper) bool {
+			return v.GetBool("build-iso")
+		},
+	},
+	Type: utils.FlagKey[string]{
+		Long:        "type",
+		Short:       "t",
+		Description: "Type of the machine that the machine using the ISO will have",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringP("type", "t", "server", "Type of the machine that the machines using the ISOs will have [server, desktop]")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("type")
+		},
+	},
+	Version: utils.FlagKey[string]{
+		Long:        "version",
+		Short:       "",
+		Description: "Version of Ubuntu that will be used. Example: 24.04.3",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("version", "24.04.3", "Version of Ubuntu that will be used. Example: 24.04.3")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("version")
+		},
+	},
+	Jobs: utils.FlagKey[int]{
+		Long:        "jobs",
+		Short:       "j",
+		Description: "Maximum number of ISOs built in parallel",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().IntP("jobs", "j", runtime.NumCPU(), "Maximum number of ISOs built in parallel")
+		},
+		Retrieve: func(v *viper.Viper) int {
+			return v.GetInt("jobs")
+		},
+	},
+	AptDebDirs: utils.FlagKey[[]string]{
+		Long:        "apt-deb-dir",
+		Short:       "",
+		Description: "Directory of .deb files added to the offline apt repository on the ISO",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("apt-deb-dir", []string{}, "Directory of .deb files added to the offline apt repository on the ISO")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("apt-deb-dir")
+		},
+	},
+	AptPackages: utils.FlagKey[[]string]{
+		Long:        "apt-package",
+		Short:       "",
+		Description: "Package added with its dependencies from --apt-mirror to the offline apt repository on the ISO",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("apt-package", []string{}, "Package added with its dependencies from --apt-mirror to the offline apt repository on the ISO")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("apt-package")
+		},
+	},
+	AptMirror: utils.FlagKey[string]{
+		Long:        "apt-mirror",
+		Short:       "",
+		Description: "Local apt mirror that --apt-package is resolved against",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("apt-mirror", "", "Local apt mirror that --apt-package is resolved against")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("apt-mirror")
+		},
+	},
+	AptRepoKey: utils.FlagKey[string]{
+		Long:        "apt-repo-key",
+		Short:       "",
+		Description: "Armored private key the offline apt repository is signed with. Created if missing, a new key is generated per build if unset",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("apt-repo-key", "", "Armored private key the offline apt repository is signed with. Created if missing, a new key is generated per build if unset")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("apt-repo-key")
+		},
+	},
+	AptAllowMissing: utils.FlagKey[bool]{
+		Long:        "apt-allow-missing",
+		Short:       "",
+		Description: "Build the offline apt repository even if dependencies of --apt-package are not in the mirror",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().Bool("apt-allow-missing", false, "Build the offline apt repository even if dependencies of --apt-package are not in the mirror")
+		},
+		Retrieve: func(v *viper.Viper) bool {
+			return v.GetBool("apt-allow-missing")
+		},
+	},
+	ImageArchives: utils.FlagKey[[]string]{
+		Long:        "image-archive",
+		Short:       "",
+		Description: "docker-archive or OCI image tarball loaded into docker at first boot",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("image-archive", []string{}, "docker-archive or OCI image tarball loaded into docker at first boot")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("image-archive")
+		},
+	},
+	Images: utils.FlagKey[[]string]{
+		Long:        "image",
+		Short:       "",
+		Description: "Image exported from the local docker daemon, pulled first if missing, and loaded into docker at first boot",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("image", []string{}, "Image exported from the local docker daemon, pulled first if missing, and loaded into docker at first boot")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("image")
+		},
+	},
+	SetValues: utils.FlagKey[[]string]{
+		Long:        "set",
+		Short:       "",
+		Description: "Template value as key=value, exposed as .Values.key. Dotted keys create nested values",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("set", []string{}, "Template value as key=value, exposed as .Values.key. Dotted keys create nested values")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("set")
+		},
+	},
+	ValuesFiles: utils.FlagKey[[]string]{
+		Long:        "values",
+		Short:       "",
+		Description: "YAML file of template values. Later files win, --set wins over all files",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().StringArray("values", []string{}, "YAML file of template values. Later files win, --set wins over all files")
+		},
+		Retrieve: func(v *viper.Viper) []string {
+			return v.GetStringSlice("values")
+		},
+	},
+	GeneratePasswords: utils.FlagKey[bool]{
+		Long:        "generate-passwords",
+		Short:       "",
+		Description: "Generate random passwords for hosts without an admin or root password and write them to <host>.credentials",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().Bool("generate-passwords", false, "Generate random passwords for hosts without an admin or root password and write them to <host>.credentials")
+		},
+		Retrieve: func(v *viper.Viper) bool {
+			return v.GetBool("generate-passwords")
+		},
+	},
+	AgeIdentity: utils.FlagKey[string]{
+		Long:        "age-identity",
+		Short:       "",
+		Description: "age identity file that age:PATH#KEY secret sources are decrypted with, for hosts that name none",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("age-identity", "", "age identity file that age:PATH#KEY secret sources are decrypted with, for hosts that name none")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("age-identity")
+		},
+	},
+	HostKeysDir: utils.FlagKey[string]{
+		Long:        "host-keys-dir",
+		Short:       "",
+		Description: "Directory with a subdirectory per host that keeps its SSH host keys between installs, for hosts that name no host-keys-dir",
+		Add: func(cmd *cobra.Command) {
+			cmd.Flags().String("host-keys-dir", "", "Directory with a subdirectory per host that keeps its SSH host keys between installs, for hosts that name no host-keys-dir")
+		},
+		Retrieve: func(v *viper.Viper) string {
+			return v.GetString("host-keys-dir")
+		},
+	},
+}
@@ -0,0 +1,46 @@
+package probe
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	generate_cloud_config "github.com/hunoz/ubuntu-iso-builder/generate-cloud-config"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var ProbeCmd = &cobra.Command{
+	Use:   "probe",
+	Short: "Print the disks of this machine in the disk match vocabulary of the storage section",
+	Run: func(cmd *cobra.Command, args []string) {
+		disks, err := generate_cloud_config.ProbeDisks("/")
+		if err != nil {
+			log.Fatalf("error probing disks: %v", err)
+		}
+		if len(disks) == 0 {
+			log.Warnln("No disks found")
+			return
+		}
+
+		var list yaml.Node
+		if err = list.Encode(disks); err != nil {
+			log.Fatalf("error writing disks: %v", err)
+		}
+		for i, disk := range disks {
+			comment := []string{fmt.Sprintf("%d bytes (%.1fG)", disk.Size, float64(disk.Size)/(1<<30))}
+			comment = append(comment, disk.Links...)
+			list.Content[i].HeadComment = strings.Join(comment, "\n")
+		}
+
+		hostname, _ := os.Hostname()
+		fmt.Printf("# Disks of %s. Text keys match as shell globs, sizes with min-size and max-size.\n", hostname)
+		encoder := yaml.NewEncoder(os.Stdout)
+		encoder.SetIndent(2)
+		document := yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{{Kind: yaml.ScalarNode, Value: "disks"}, &list}}
+		if err = encoder.Encode(&document); err != nil {
+			log.Fatalf("error writing disks: %v", err)
+		}
+	},
+}
@@ -4,7 +4,10 @@ import (
 	"os"
 
 	buildiso "github.com/hunoz/ubuntu-iso-builder/cmd/build-iso"
+	"github.com/hunoz/ubuntu-iso-builder/cmd/files"
 	generatecloudinit "github.com/hunoz/ubuntu-iso-builder/cmd/generate-cloud-config"
+	"github.com/hunoz/ubuntu-iso-builder/cmd/inventory"
+	"github.com/hunoz/ubuntu-iso-builder/cmd/probe"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/spf13/cobra"
@@ -51,6 +54,9 @@ func init() {
 	commands := []*cobra.Command{
 		generatecloudinit.GenerateCloudConfigCmd,
 		buildiso.BuildIsoCmd,
+		inventory.InventoryCmd,
+		files.FilesCmd,
+		probe.ProbeCmd,
 		versionCmd,
 	}
 
@@ -0,0 +1,22 @@
+package crypt
+
+import (
+	"crypto/rand"
+	"io"
+)
+
+// NewSalt returns a salt of length characters from the crypt(3) alphabet read
+// from r, or from crypto/rand if r is nil.
+func NewSalt(r io.Reader, length int) (string, error) {
+	if r == nil {
+		r = rand.Reader
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	for i, b := range buf {
+		buf[i] = itoa64[int(b)%len(itoa64)]
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,159 @@
+package crypt
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	sha512Prefix        = "$6$"
+	sha512DefaultRounds = 5000
+	sha512MinRounds     = 1000
+	sha512MaxRounds     = 999999999
+	sha512MaxSaltLength = 16
+)
+
+// itoa64 is the alphabet of the crypt(3) base64 variant.
+const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// sha512Permutation is the order in which the digest bytes are encoded, three
+// at a time, as defined by the SHA-crypt specification.
+var sha512Permutation = [][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+	{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+	{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+	{62, 20, 41},
+}
+
+// SHA512 hashes password with the SHA-512 based crypt(3) scheme ("$6$"), the
+// format accepted by /etc/shadow and cloud-init's passwd. Salts longer than 16
+// characters are truncated. A rounds value of 0 uses the default of 5000 and
+// leaves it out of the result, like mkpasswd does.
+func SHA512(password, salt string, rounds int) string {
+	if len(salt) > sha512MaxSaltLength {
+		salt = salt[:sha512MaxSaltLength]
+	}
+	customRounds := rounds != 0
+	if !customRounds {
+		rounds = sha512DefaultRounds
+	}
+	rounds = max(sha512MinRounds, min(rounds, sha512MaxRounds))
+
+	p, s := []byte(password), []byte(salt)
+
+	b := sha512.New()
+	b.Write(p)
+	b.Write(s)
+	b.Write(p)
+	digestB := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(p)
+	a.Write(s)
+	i := len(p)
+	for ; i > 64; i -= 64 {
+		a.Write(digestB)
+	}
+	a.Write(digestB[:i])
+	for i = len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(digestB)
+		} else {
+			a.Write(p)
+		}
+	}
+	digestA := a.Sum(nil)
+
+	dp := sha512.New()
+	for range p {
+		dp.Write(p)
+	}
+	pSeq := repeatDigest(dp.Sum(nil), len(p))
+
+	ds := sha512.New()
+	for j := 0; j < 16+int(digestA[0]); j++ {
+		ds.Write(s)
+	}
+	sSeq := repeatDigest(ds.Sum(nil), len(s))
+
+	c := digestA
+	for r := 0; r < rounds; r++ {
+		h := sha512.New()
+		if r&1 != 0 {
+			h.Write(pSeq)
+		} else {
+			h.Write(c)
+		}
+		if r%3 != 0 {
+			h.Write(sSeq)
+		}
+		if r%7 != 0 {
+			h.Write(pSeq)
+		}
+		if r&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(pSeq)
+		}
+		c = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(sha512Prefix)
+	if customRounds {
+		out.WriteString(fmt.Sprintf("rounds=%d$", rounds))
+	}
+	out.WriteString(salt)
+	out.WriteString("$")
+	for _, group := range sha512Permutation {
+		encode24(&out, c[group[0]], c[group[1]], c[group[2]], 4)
+	}
+	encode24(&out, 0, 0, c[63], 2)
+
+	return out.String()
+}
+
+// IsSHA512 reports whether hash looks like a SHA-512 crypt(3) hash.
+func IsSHA512(hash string) bool {
+	return strings.HasPrefix(hash, sha512Prefix)
+}
+
+// VerifySHA512 reports whether password matches the SHA-512 crypt(3) hash.
+func VerifySHA512(password, hash string) bool {
+	if !IsSHA512(hash) {
+		return false
+	}
+	fields := strings.Split(strings.TrimPrefix(hash, sha512Prefix), "$")
+	rounds := 0
+	if len(fields) == 3 && strings.HasPrefix(fields[0], "rounds=") {
+		n, err := strconv.Atoi(strings.TrimPrefix(fields[0], "rounds="))
+		if err != nil {
+			return false
+		}
+		rounds = n
+		fields = fields[1:]
+	}
+	if len(fields) != 2 {
+		return false
+	}
+	return SHA512(password, fields[0], rounds) == hash
+}
+
+func repeatDigest(digest []byte, length int) []byte {
+	seq := make([]byte, 0, length)
+	for len(seq)+len(digest) <= length {
+		seq = append(seq, digest...)
+	}
+	return append(seq, digest[:length-len(seq)]...)
+}
+
+func encode24(out *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for ; n > 0; n-- {
+		out.WriteByte(itoa64[w&0x3f])
+		w >>= 6
+	}
+}
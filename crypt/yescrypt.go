@@ -0,0 +1,341 @@
+package crypt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+	"strings"
+)
+
+const (
+	yescryptPrefix = "$y$"
+	// yescryptParams encode YESCRYPT_DEFAULTS with N = 4096 and r = 32, the
+	// parameters mkpasswd and Ubuntu's passwd use.
+	yescryptParams = "j9T"
+	yescryptN      = 4096
+	yescryptR      = 32
+	// YescryptSaltLength is the length of the raw salt mkpasswd draws.
+	YescryptSaltLength = 16
+
+	yescryptRW      = 0x002
+	yescryptPrehash = 0x10000000
+
+	// pwxform parameters of YESCRYPT_DEFAULTS: 6 rounds, 4-way gather, 2-way
+	// simple and three S-boxes of 4 KiB.
+	pwxSimple = 2
+	pwxGather = 4
+	pwxRounds = 6
+	sWidth    = 8
+	pwxWords  = pwxGather * pwxSimple * 2
+	sPairs    = (1 << sWidth) * pwxSimple
+	sWords    = 3 * sPairs * 2
+	sMask     = ((1 << sWidth) - 1) * pwxSimple * 8
+)
+
+// Yescrypt hashes password with yescrypt ("$y$"), the default of Ubuntu's
+// /etc/shadow since 22.04. salt holds raw bytes, YescryptSaltLength of them
+// for hashes like mkpasswd's.
+func Yescrypt(password string, salt []byte) string {
+	passwd := []byte(password)
+	// Large costs hash the password with a 64th of N first, like yescrypt_kdf
+	// does, so the final pass cannot be computed cheaply with less memory.
+	if yescryptN >= 0x100 && yescryptN*yescryptR >= 0x20000 {
+		passwd = yescryptBody(passwd, salt, yescryptRW|yescryptPrehash, yescryptN>>6, yescryptR)
+	}
+	hash := yescryptBody(passwd, salt, yescryptRW, yescryptN, yescryptR)
+
+	var out strings.Builder
+	out.WriteString(yescryptPrefix + yescryptParams + "$")
+	encode64(&out, salt)
+	out.WriteString("$")
+	encode64(&out, hash)
+	return out.String()
+}
+
+// IsYescrypt reports whether hash looks like a yescrypt crypt(3) hash.
+func IsYescrypt(hash string) bool {
+	return strings.HasPrefix(hash, yescryptPrefix)
+}
+
+// yescryptBody is yescrypt_kdf_body for p = 1, t = 0 and no ROM. It returns
+// 32 bytes.
+func yescryptBody(passwd, salt []byte, flags uint32, n uint64, r int) []byte {
+	key := "yescrypt-prehash"
+	if flags&yescryptPrehash == 0 {
+		key = key[:8]
+	}
+	passwd = hmacSHA256([]byte(key), passwd)
+
+	s := 32 * r
+	b := pbkdf2SHA256(passwd, salt, 4*s)
+	// The password is replaced with the first 32 bytes of B, which smix
+	// updates in place.
+	passwd = append([]byte(nil), b[:32]...)
+
+	words := make([]uint32, s)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(b[4*i:])
+	}
+	smix(words, r, n, flags, passwd)
+	for i, w := range words {
+		binary.LittleEndian.PutUint32(b[4*i:], w)
+	}
+
+	dk := pbkdf2SHA256(passwd, b, 32)
+	if flags&yescryptPrehash != 0 {
+		return dk
+	}
+	// ClientKey and StoredKey as in SCRAM (RFC 5802).
+	storedKey := sha256.Sum256(hmacSHA256(dk, []byte("Client Key")))
+	return storedKey[:]
+}
+
+// pwxformCtx holds the S-boxes of pwxform, which are rotated after every
+// use. s0, s1 and s2 are offsets into s, w is the pair S2 is written at next.
+type pwxformCtx struct {
+	s          []uint32
+	s0, s1, s2 int
+	w          int
+}
+
+// smix is yescrypt's SMix for p = 1 and t = 0.
+func smix(b []uint32, r int, n uint64, flags uint32, passwd []byte) {
+	s := 32 * r
+	nloop := n
+	if flags&yescryptRW != 0 {
+		nloop = (nloop + 2) / 3
+	}
+	nloop = (nloop + 1) &^ 1
+	v := make([]uint32, uint64(s)*n)
+	xy := make([]uint32, 2*s)
+
+	var ctx *pwxformCtx
+	if flags&yescryptRW != 0 {
+		sbox := make([]uint32, sWords)
+		smix1(b, 1, sWords/32, 0, sbox, xy, nil)
+		ctx = &pwxformCtx{s: sbox, s2: 0, s1: 2 * sPairs, s0: 4 * sPairs}
+
+		key := make([]byte, 64)
+		for i, w := range b[s-16:] {
+			binary.LittleEndian.PutUint32(key[4*i:], w)
+		}
+		copy(passwd, hmacSHA256(key, passwd))
+	}
+	smix1(b, r, n, flags, v, xy, ctx)
+	smix2(b, r, p2floor(n), nloop, flags, v, xy, ctx)
+}
+
+func smix1(b []uint32, r int, n uint64, flags uint32, v, xy []uint32, ctx *pwxformCtx) {
+	s := 32 * r
+	x, y := xy[:s], xy[s:]
+	for k := 0; k < 2*r; k++ {
+		for i := 0; i < 16; i++ {
+			x[k*16+i] = b[k*16+i*5%16]
+		}
+	}
+	for i := uint64(0); i < n; i++ {
+		copy(v[i*uint64(s):], x)
+		if flags&yescryptRW != 0 && i > 1 {
+			j := wrap(integerify(x, r), i)
+			blockXor(x, v[j*uint64(s):])
+		}
+		blockmix(x, y, r, ctx)
+	}
+	for k := 0; k < 2*r; k++ {
+		for i := 0; i < 16; i++ {
+			b[k*16+i*5%16] = x[k*16+i]
+		}
+	}
+}
+
+func smix2(b []uint32, r int, n, nloop uint64, flags uint32, v, xy []uint32, ctx *pwxformCtx) {
+	if nloop == 0 {
+		return
+	}
+	s := 32 * r
+	x, y := xy[:s], xy[s:]
+	for k := 0; k < 2*r; k++ {
+		for i := 0; i < 16; i++ {
+			x[k*16+i] = b[k*16+i*5%16]
+		}
+	}
+	for i := uint64(0); i < nloop; i++ {
+		j := integerify(x, r) & (n - 1)
+		vj := v[j*uint64(s) : (j+1)*uint64(s)]
+		blockXor(x, vj)
+		if flags&yescryptRW != 0 {
+			copy(vj, x)
+		}
+		blockmix(x, y, r, ctx)
+	}
+	for k := 0; k < 2*r; k++ {
+		for i := 0; i < 16; i++ {
+			b[k*16+i*5%16] = x[k*16+i]
+		}
+	}
+}
+
+// blockmix mixes b with pwxform when there are S-boxes and with Salsa20/8 as
+// scrypt does otherwise. The words of every 64-byte block are in the SIMD
+// shuffled order of the reference implementation.
+func blockmix(b, y []uint32, r int, ctx *pwxformCtx) {
+	if ctx == nil {
+		blockmixSalsa8(b, y, r)
+		return
+	}
+	r1 := 2 * r
+	x := make([]uint32, pwxWords)
+	copy(x, b[(r1-1)*pwxWords:])
+	for i := 0; i < r1; i++ {
+		if r1 > 1 {
+			blockXor(x, b[i*pwxWords:])
+		}
+		pwxform(x, ctx)
+		copy(b[i*pwxWords:], x)
+	}
+	salsa20(b[(r1-1)*16:r1*16], 2)
+}
+
+func blockmixSalsa8(b, y []uint32, r int) {
+	x := make([]uint32, 16)
+	copy(x, b[(2*r-1)*16:])
+	for i := 0; i < 2*r; i++ {
+		blockXor(x, b[i*16:])
+		salsa20(x, 8)
+		copy(y[i*16:], x)
+	}
+	for i := 0; i < r; i++ {
+		copy(b[i*16:], y[2*i*16:(2*i+1)*16])
+		copy(b[(i+r)*16:], y[(2*i+1)*16:(2*i+2)*16])
+	}
+}
+
+func pwxform(x []uint32, ctx *pwxformCtx) {
+	sbox, w := ctx.s, ctx.w
+	for i := 0; i < pwxRounds; i++ {
+		for j := 0; j < pwxGather; j++ {
+			lane := x[j*pwxSimple*2:]
+			p0 := ctx.s0 + int(lane[0]&sMask)/4
+			p1 := ctx.s1 + int(lane[1]&sMask)/4
+			for k := 0; k < pwxSimple; k++ {
+				s0 := uint64(sbox[p0+2*k+1])<<32 | uint64(sbox[p0+2*k])
+				s1 := uint64(sbox[p1+2*k+1])<<32 | uint64(sbox[p1+2*k])
+				v := uint64(lane[2*k+1])*uint64(lane[2*k]) + s0
+				v ^= s1
+				lane[2*k], lane[2*k+1] = uint32(v), uint32(v>>32)
+			}
+			if i != 0 && i != pwxRounds-1 {
+				for k := 0; k < pwxSimple; k++ {
+					sbox[ctx.s2+2*w], sbox[ctx.s2+2*w+1] = lane[2*k], lane[2*k+1]
+					w++
+				}
+			}
+		}
+	}
+	ctx.s0, ctx.s1, ctx.s2 = ctx.s2, ctx.s0, ctx.s1
+	ctx.w = w & (sPairs - 1)
+}
+
+// salsa20 applies the Salsa20 core with the given number of rounds to a block
+// in shuffled order.
+func salsa20(b []uint32, rounds int) {
+	var x [16]uint32
+	for i := 0; i < 16; i++ {
+		x[i*5%16] = b[i]
+	}
+	for i := 0; i < rounds; i += 2 {
+		x[4] ^= bits.RotateLeft32(x[0]+x[12], 7)
+		x[8] ^= bits.RotateLeft32(x[4]+x[0], 9)
+		x[12] ^= bits.RotateLeft32(x[8]+x[4], 13)
+		x[0] ^= bits.RotateLeft32(x[12]+x[8], 18)
+		x[9] ^= bits.RotateLeft32(x[5]+x[1], 7)
+		x[13] ^= bits.RotateLeft32(x[9]+x[5], 9)
+		x[1] ^= bits.RotateLeft32(x[13]+x[9], 13)
+		x[5] ^= bits.RotateLeft32(x[1]+x[13], 18)
+		x[14] ^= bits.RotateLeft32(x[10]+x[6], 7)
+		x[2] ^= bits.RotateLeft32(x[14]+x[10], 9)
+		x[6] ^= bits.RotateLeft32(x[2]+x[14], 13)
+		x[10] ^= bits.RotateLeft32(x[6]+x[2], 18)
+		x[3] ^= bits.RotateLeft32(x[15]+x[11], 7)
+		x[7] ^= bits.RotateLeft32(x[3]+x[15], 9)
+		x[11] ^= bits.RotateLeft32(x[7]+x[3], 13)
+		x[15] ^= bits.RotateLeft32(x[11]+x[7], 18)
+
+		x[1] ^= bits.RotateLeft32(x[0]+x[3], 7)
+		x[2] ^= bits.RotateLeft32(x[1]+x[0], 9)
+		x[3] ^= bits.RotateLeft32(x[2]+x[1], 13)
+		x[0] ^= bits.RotateLeft32(x[3]+x[2], 18)
+		x[6] ^= bits.RotateLeft32(x[5]+x[4], 7)
+		x[7] ^= bits.RotateLeft32(x[6]+x[5], 9)
+		x[4] ^= bits.RotateLeft32(x[7]+x[6], 13)
+		x[5] ^= bits.RotateLeft32(x[4]+x[7], 18)
+		x[11] ^= bits.RotateLeft32(x[10]+x[9], 7)
+		x[8] ^= bits.RotateLeft32(x[11]+x[10], 9)
+		x[9] ^= bits.RotateLeft32(x[8]+x[11], 13)
+		x[10] ^= bits.RotateLeft32(x[9]+x[8], 18)
+		x[12] ^= bits.RotateLeft32(x[15]+x[14], 7)
+		x[13] ^= bits.RotateLeft32(x[12]+x[15], 9)
+		x[14] ^= bits.RotateLeft32(x[13]+x[12], 13)
+		x[15] ^= bits.RotateLeft32(x[14]+x[13], 18)
+	}
+	for i := 0; i < 16; i++ {
+		b[i] += x[i*5%16]
+	}
+}
+
+// integerify returns the first 64 bits of the last 64-byte block of x.
+func integerify(x []uint32, r int) uint64 {
+	last := x[(2*r-1)*16:]
+	return uint64(last[13])<<32 | uint64(last[0])
+}
+
+func wrap(x, i uint64) uint64 {
+	n := p2floor(i)
+	return x&(n-1) + (i - n)
+}
+
+func p2floor(x uint64) uint64 {
+	return 1 << (bits.Len64(x) - 1)
+}
+
+func blockXor(dst, src []uint32) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+func hmacSHA256(key, message []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(message)
+	return h.Sum(nil)
+}
+
+// pbkdf2SHA256 is PBKDF2-HMAC-SHA256 with a single iteration.
+func pbkdf2SHA256(passwd, salt []byte, length int) []byte {
+	out := make([]byte, 0, length+sha256.Size)
+	for block := uint32(1); len(out) < length; block++ {
+		h := hmac.New(sha256.New, passwd)
+		h.Write(salt)
+		h.Write(binary.BigEndian.AppendUint32(nil, block))
+		out = h.Sum(out)
+	}
+	return out[:length]
+}
+
+// encode64 appends src in yescrypt's base64, which encodes little-endian
+// groups of three bytes.
+func encode64(out *strings.Builder, src []byte) {
+	for i := 0; i < len(src); {
+		var value uint32
+		n := 0
+		for ; n < 24 && i < len(src); n += 8 {
+			value |= uint32(src[i]) << n
+			i++
+		}
+		for ; n > 0; n -= 6 {
+			out.WriteByte(itoa64[value&0x3f])
+			value >>= 6
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package crypt
+
+import "testing"
+
+// The expected hashes are libxcrypt's crypt(3) for the same passwords and
+// settings.
+func TestYescrypt(t *testing.T) {
+	tests := []struct {
+		password string
+		salt     []byte
+		want     string
+	}{
+		{"password", []byte("0123456789abcdef"), "$y$j9T$k2XAnEHBqQ1Ct2aMXFKNa/$OVYXzjlkiQpWT/F1CUE0JrvV4phLY8FB.ofDttnrSQ7"},
+		{"", []byte{1, 2, 3}, "$y$j9T$/6k.$.oE98GKXf.uAT2i36R6irYqZ.nB2FtYtAAsM3kMSIvA"},
+		{"correct horse battery staple ünïcode", []byte("sixteen byte slt"), "$y$j9T$nZ4SoJKNi/WMtFLNUA5Po/$ZeK2lX2UbX/LMbB7gUMnq0CMznwUyne.JTEscET7nN2"},
+	}
+	for _, test := range tests {
+		if got := Yescrypt(test.password, test.salt); got != test.want {
+			t.Errorf("Yescrypt(%q, %q) = %s, want %s", test.password, test.salt, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package generate_cloud_config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// aptKeyringDir holds the keys of the host spec's repositories in the
+// installed system.
+const aptKeyringDir = "/etc/apt/keyrings"
+
+// AptSpec is the apt section of a host spec.
+type AptSpec struct {
+	// Mirror replaces the primary Ubuntu archive, both for the install and in
+	// the installed system.
+	Mirror         string `yaml:"mirror"`
+	SecurityMirror string `yaml:"security-mirror"`
+	// Proxy is the http or https proxy apt uses.
+	Proxy        string          `yaml:"proxy"`
+	Repositories []AptRepository `yaml:"repositories"`
+}
+
+// AptRepository is a third-party repository, written to the installed system
+// as a deb822 source signed by its own key.
+type AptRepository struct {
+	// Name names the source and key files.
+	Name  string   `yaml:"name"`
+	Types []string `yaml:"types"`
+	URIs  []string `yaml:"uris"`
+	// Suites default to the release codename of the installed system. A suite
+	// ending in / is a flat repository, which has no components.
+	Suites        []string `yaml:"suites"`
+	Components    []string `yaml:"components"`
+	Architectures []string `yaml:"architectures"`
+	// Key is a local file with the repository's OpenPGP public key, armored or
+	// binary.
+	Key string `yaml:"key"`
+	// keys is where Key is read from when it is not the local filesystem.
+	keys fs.FS
+}
+
+// AutoInstallApt is the autoinstall apt section.
+type AutoInstallApt struct {
+	Geoip    *bool       `yaml:"geoip,omitempty"`
+	Primary  []AptMirror `yaml:"primary,omitempty"`
+	Security []AptMirror `yaml:"security,omitempty"`
+	Proxy    string      `yaml:"proxy,omitempty"`
+	// Sources are added to the installer's apt configuration, keyed by the
+	// file name they are written to.
+	Sources map[string]AutoInstallAptSource `yaml:"sources,omitempty"`
+}
+
+// AutoInstallAptSource is a one-line apt source of the installer.
+type AutoInstallAptSource struct {
+	Source string `yaml:"source"`
+}
+
+type AptMirror struct {
+	Arches []string `yaml:"arches"`
+	URI    string   `yaml:"uri"`
+}
+
+// AptConfig is what the apt section adds to the autoinstall config.
+type AptConfig struct {
+	// Autoinstall is nil when the section leaves the mirrors and proxy alone.
+	Autoinstall  *AutoInstallApt
+	Sources      []AptSource
+	LateCommands []string
+}
+
+var (
+	aptRepositoryName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+	aptTypes          = []string{"deb", "deb-src"}
+)
+
+// IsZero reports whether the host spec leaves apt as the installer sets it up.
+func (s AptSpec) IsZero() bool {
+	return s.Mirror == "" && s.SecurityMirror == "" && s.Proxy == "" && len(s.Repositories) == 0
+}
+
+// Config validates the apt section, reads the repository keys and returns
+// what the section adds to the autoinstall config.
+func (s AptSpec) Config() (config AptConfig, err error) {
+	if s.Mirror != "" || s.SecurityMirror != "" || s.Proxy != "" {
+		config.Autoinstall = &AutoInstallApt{}
+	}
+	if s.Mirror != "" {
+		if err = checkAptURL("mirror", s.Mirror, "http", "https"); err != nil {
+			return
+		}
+		geoip := false
+		config.Autoinstall.Geoip = &geoip
+		config.Autoinstall.Primary = []AptMirror{{Arches: []string{"default"}, URI: s.Mirror}}
+	}
+	if s.SecurityMirror != "" {
+		if err = checkAptURL("security-mirror", s.SecurityMirror, "http", "https"); err != nil {
+			return
+		}
+		config.Autoinstall.Security = []AptMirror{{Arches: []string{"default"}, URI: s.SecurityMirror}}
+	}
+	if s.Proxy != "" {
+		if err = checkAptURL("proxy", s.Proxy, "http", "https"); err != nil {
+			return
+		}
+		config.Autoinstall.Proxy = s.Proxy
+	}
+
+	var names []string
+	for _, repository := range s.Repositories {
+		if !aptRepositoryName.MatchString(repository.Name) {
+			return config, fmt.Errorf("invalid apt repository name %q", repository.Name)
+		}
+		if slices.Contains(names, repository.Name) {
+			return config, fmt.Errorf("apt repository %s is defined twice", repository.Name)
+		}
+		names = append(names, repository.Name)
+
+		var source AptSource
+		var keyCommand string
+		if source, keyCommand, err = repository.source(); err != nil {
+			return config, fmt.Errorf("apt repository %s: %w", repository.Name, err)
+		}
+		config.Sources = append(config.Sources, source)
+		config.LateCommands = append(config.LateCommands, keyCommand)
+	}
+	return
+}
+
+// source returns the deb822 source of the repository and the command that
+// installs its key.
+func (r AptRepository) source() (source AptSource, keyCommand string, err error) {
+	types := r.Types
+	if len(types) == 0 {
+		types = []string{"deb"}
+	}
+	for _, t := range types {
+		if !slices.Contains(aptTypes, t) {
+			return source, "", fmt.Errorf("unsupported type %q, expected deb or deb-src", t)
+		}
+	}
+	if len(r.URIs) == 0 {
+		return source, "", fmt.Errorf("no uris")
+	}
+	for _, uri := range r.URIs {
+		if err = checkAptURL("uri", uri, "http", "https", "file"); err != nil {
+			return
+		}
+	}
+	suites := r.Suites
+	if len(suites) == 0 {
+		suites = []string{"@CODENAME@"}
+	}
+	flat := false
+	for _, suite := range suites {
+		if suite == "" || strings.ContainsAny(suite, " \t") {
+			return source, "", fmt.Errorf("invalid suite %q", suite)
+		}
+		flat = flat || strings.HasSuffix(suite, "/")
+	}
+	if flat && len(r.Components) > 0 {
+		return source, "", fmt.Errorf("a flat repository suite cannot have components")
+	}
+	if !flat && len(r.Components) == 0 {
+		return source, "", fmt.Errorf("no components")
+	}
+	for _, field := range [][]string{r.Components, r.Architectures} {
+		for _, value := range field {
+			if value == "" || strings.ContainsAny(value, " \t") {
+				return source, "", fmt.Errorf("invalid component or architecture %q", value)
+			}
+		}
+	}
+
+	if r.Key == "" {
+		return source, "", fmt.Errorf("no key")
+	}
+	var key []byte
+	if r.keys != nil {
+		key, err = fs.ReadFile(r.keys, r.Key)
+	} else {
+		key, err = os.ReadFile(r.Key)
+	}
+	if err != nil {
+		return source, "", fmt.Errorf("error reading key: %w", err)
+	}
+	armored := bytes.HasPrefix(bytes.TrimSpace(key), []byte("-----BEGIN PGP"))
+	if err = checkAptKey(key, armored); err != nil {
+		return source, "", fmt.Errorf("key %s: %w", r.Key, err)
+	}
+	keyring := aptKeyringDir + "/" + r.Name + ".gpg"
+	if armored {
+		keyring = aptKeyringDir + "/" + r.Name + ".asc"
+	}
+
+	lines := []string{
+		"Types: " + strings.Join(types, " "),
+		"URIs: " + strings.Join(r.URIs, " "),
+		"Suites: " + strings.Join(suites, " "),
+	}
+	if len(r.Components) > 0 {
+		lines = append(lines, "Components: "+strings.Join(r.Components, " "))
+	}
+	if len(r.Architectures) > 0 {
+		lines = append(lines, "Architectures: "+strings.Join(r.Architectures, " "))
+	}
+	lines = append(lines, "Signed-By: "+keyring)
+	source = AptSource{Filename: r.Name + ".sources", Content: strings.Join(lines, "\n") + "\n"}
+	keyCommand = fmt.Sprintf(
+		`curtin in-target -- sh -c 'install -d -m 0755 %s && echo "%s" | base64 -d > %s && chmod 0644 %s'`,
+		aptKeyringDir, base64.StdEncoding.EncodeToString(key), keyring, keyring,
+	)
+	return
+}
+
+// checkAptKey checks that key holds OpenPGP public keys and nothing secret.
+func checkAptKey(key []byte, armored bool) error {
+	var entities openpgp.EntityList
+	var err error
+	if armored {
+		entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(key))
+	} else {
+		entities, err = openpgp.ReadKeyRing(bytes.NewReader(key))
+	}
+	if err != nil {
+		return fmt.Errorf("not an OpenPGP key: %w", err)
+	}
+	if len(entities) == 0 {
+		return fmt.Errorf("holds no OpenPGP key")
+	}
+	for _, entity := range entities {
+		if entity.PrivateKey != nil {
+			return fmt.Errorf("holds a private key, expected only public keys")
+		}
+	}
+	return nil
+}
+
+func checkAptURL(field, value string, schemes ...string) error {
+	u, err := url.Parse(value)
+	if err != nil || !slices.Contains(schemes, u.Scheme) || (u.Scheme != "file" && u.Host == "") || strings.ContainsAny(value, " \t") {
+		return fmt.Errorf("apt %s %q is not a %s URL", field, value, strings.Join(schemes, " or "))
+	}
+	return nil
+}
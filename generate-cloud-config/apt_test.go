@@ -0,0 +1,198 @@
+package generate_cloud_config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// aptTestKeys returns a fresh OpenPGP key as a binary and an armored public
+// key and a binary and an armored private key.
+func aptTestKeys(t *testing.T) (public, armoredPublic, private, armoredPrivate []byte) {
+	t.Helper()
+
+	entity, err := openpgp.NewEntity("Repository", "", "repo@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	armorKey := func(blockType string, key []byte) []byte {
+		var buf bytes.Buffer
+		w, err := armor.Encode(&buf, blockType, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write(key); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	var publicBuf, privateBuf bytes.Buffer
+	if err = entity.Serialize(&publicBuf); err != nil {
+		t.Fatal(err)
+	}
+	if err = entity.SerializePrivate(&privateBuf, nil); err != nil {
+		t.Fatal(err)
+	}
+	public, private = publicBuf.Bytes(), privateBuf.Bytes()
+	return public, armorKey(openpgp.PublicKeyType, public), private, armorKey(openpgp.PrivateKeyType, private)
+}
+
+var aptKeyCommandPattern = regexp.MustCompile(`echo "([A-Za-z0-9+/=]+)" \| base64 -d > (\S+) `)
+
+func TestAptRepositorySource(t *testing.T) {
+	public, armoredPublic, private, armoredPrivate := aptTestKeys(t)
+	keys := fstest.MapFS{
+		"keys/repo.gpg":     {Data: public},
+		"keys/repo.asc":     {Data: armoredPublic},
+		"keys/private.gpg":  {Data: private},
+		"keys/private.asc":  {Data: armoredPrivate},
+		"keys/garbage.gpg":  {Data: []byte("not a key\n")},
+		"keys/garbage.asc":  {Data: []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----\n\nnot base64\n-----END PGP PUBLIC KEY BLOCK-----\n")},
+		"keys/empty.gpg":    {Data: []byte{}},
+		"keys/unreadable/x": {Data: []byte{}},
+	}
+
+	tests := []struct {
+		name       string
+		repository AptRepository
+		source     string
+		keyring    string
+		key        []byte
+		err        string
+	}{
+		{
+			name:       "armored public key",
+			repository: AptRepository{Name: "docker", URIs: []string{"https://download.docker.com/linux/ubuntu"}, Components: []string{"stable"}, Key: "keys/repo.asc"},
+			source:     "Types: deb\nURIs: https://download.docker.com/linux/ubuntu\nSuites: @CODENAME@\nComponents: stable\nSigned-By: /etc/apt/keyrings/docker.asc\n",
+			keyring:    "/etc/apt/keyrings/docker.asc",
+			key:        armoredPublic,
+		},
+		{
+			name: "binary public key of a flat repository",
+			repository: AptRepository{Name: "nvidia", Types: []string{"deb", "deb-src"}, URIs: []string{"https://nvidia.github.io/libnvidia-container/stable/deb/$(ARCH)"},
+				Suites: []string{"/"}, Architectures: []string{"amd64", "arm64"}, Key: "keys/repo.gpg"},
+			source:  "Types: deb deb-src\nURIs: https://nvidia.github.io/libnvidia-container/stable/deb/$(ARCH)\nSuites: /\nArchitectures: amd64 arm64\nSigned-By: /etc/apt/keyrings/nvidia.gpg\n",
+			keyring: "/etc/apt/keyrings/nvidia.gpg",
+			key:     public,
+		},
+		{name: "binary private key", repository: AptRepository{Name: "r", URIs: []string{"https://r.example.com"}, Components: []string{"main"}, Key: "keys/private.gpg"}, err: "holds a private key"},
+		{name: "armored private key", repository: AptRepository{Name: "r", URIs: []string{"https://r.example.com"}, Components: []string{"main"}, Key: "keys/private.asc"}, err: "holds a private key"},
+		{name: "garbage", repository: AptRepository{Name: "r", URIs: []string{"https://r.example.com"}, Components: []string{"main"}, Key: "keys/garbage.gpg"}, err: "key keys/garbage.gpg: not an OpenPGP key"},
+		{name: "armored garbage", repository: AptRepository{Name: "r", URIs: []string{"https://r.example.com"}, Components: []string{"main"}, Key: "keys/garbage.asc"}, err: "key keys/garbage.asc: not an OpenPGP key"},
+		{name: "empty key", repository: AptRepository{Name: "r", URIs: []string{"https://r.example.com"}, Components: []string{"main"}, Key: "keys/empty.gpg"}, err: "holds no OpenPGP key"},
+		{name: "missing key", repository: AptRepository{Name: "r", URIs: []string{"https://r.example.com"}, Components: []string{"main"}, Key: "keys/missing.gpg"}, err: "error reading key"},
+		{name: "unreadable key", repository: AptRepository{Name: "r", URIs: []string{"https://r.example.com"}, Components: []string{"main"}, Key: "keys/unreadable"}, err: "error reading key"},
+		{name: "no key", repository: AptRepository{Name: "r", URIs: []string{"https://r.example.com"}, Components: []string{"main"}}, err: "no key"},
+		{name: "type", repository: AptRepository{Name: "r", Types: []string{"rpm"}, URIs: []string{"https://r.example.com"}, Components: []string{"main"}, Key: "keys/repo.gpg"}, err: `unsupported type "rpm"`},
+		{name: "no uris", repository: AptRepository{Name: "r", Components: []string{"main"}, Key: "keys/repo.gpg"}, err: "no uris"},
+		{name: "uri scheme", repository: AptRepository{Name: "r", URIs: []string{"ftp://r.example.com"}, Components: []string{"main"}, Key: "keys/repo.gpg"}, err: "is not a http or https or file URL"},
+		{name: "flat with components", repository: AptRepository{Name: "r", URIs: []string{"https://r.example.com"}, Suites: []string{"./"}, Components: []string{"main"}, Key: "keys/repo.gpg"}, err: "cannot have components"},
+		{name: "no components", repository: AptRepository{Name: "r", URIs: []string{"https://r.example.com"}, Key: "keys/repo.gpg"}, err: "no components"},
+		{name: "suite", repository: AptRepository{Name: "r", URIs: []string{"https://r.example.com"}, Suites: []string{"noble main"}, Components: []string{"main"}, Key: "keys/repo.gpg"}, err: `invalid suite "noble main"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.repository.keys = keys
+			source, keyCommand, err := test.repository.source()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if source.Filename != test.repository.Name+".sources" || source.Content != test.source {
+				t.Errorf("source %s is\n%s\nwant\n%s", source.Filename, source.Content, test.source)
+			}
+
+			match := aptKeyCommandPattern.FindStringSubmatch(keyCommand)
+			if match == nil {
+				t.Fatalf("key command %q does not write a key", keyCommand)
+			}
+			key, err := base64.StdEncoding.DecodeString(match[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(key, test.key) || match[2] != test.keyring {
+				t.Errorf("key command writes %d bytes to %s, want the key at %s", len(key), match[2], test.keyring)
+			}
+		})
+	}
+}
+
+func TestAptRepositoryLocalKey(t *testing.T) {
+	_, armoredPublic, _, _ := aptTestKeys(t)
+	keyFile := filepath.Join(t.TempDir(), "repo.asc")
+	if err := os.WriteFile(keyFile, armoredPublic, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	repository := AptRepository{Name: "local", URIs: []string{"file:///srv/repo"}, Suites: []string{"./"}, Key: keyFile}
+	source, _, err := repository.source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(source.Content, "Signed-By: /etc/apt/keyrings/local.asc\n") {
+		t.Errorf("unexpected source %q", source.Content)
+	}
+}
+
+func TestModuleAptKeys(t *testing.T) {
+	for _, module := range BuiltinModules() {
+		for _, repository := range module.AptRepositories(RenderContext{}) {
+			if _, _, err := repository.source(); err != nil {
+				t.Errorf("module %s: apt repository %s: %v", module.Name(), repository.Name, err)
+			}
+		}
+	}
+}
+
+func TestAptSpecConfig(t *testing.T) {
+	_, armoredPublic, _, _ := aptTestKeys(t)
+	keyFile := filepath.Join(t.TempDir(), "repo.asc")
+	if err := os.WriteFile(keyFile, armoredPublic, 0644); err != nil {
+		t.Fatal(err)
+	}
+	repository := AptRepository{Name: "repo", URIs: []string{"https://repo.example.com"}, Components: []string{"main"}, Key: keyFile}
+
+	config, err := AptSpec{Mirror: "http://mirror.lan/ubuntu", Proxy: "http://proxy.lan:3128", Repositories: []AptRepository{repository}}.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Autoinstall == nil || config.Autoinstall.Primary[0].URI != "http://mirror.lan/ubuntu" || config.Autoinstall.Proxy != "http://proxy.lan:3128" ||
+		config.Autoinstall.Geoip == nil || *config.Autoinstall.Geoip {
+		t.Errorf("unexpected autoinstall apt section %+v", config.Autoinstall)
+	}
+	if len(config.Sources) != 1 || len(config.LateCommands) != 1 {
+		t.Errorf("got %d sources and %d key commands, want one each", len(config.Sources), len(config.LateCommands))
+	}
+
+	errors := map[string]AptSpec{
+		"mirror scheme":       {Mirror: "ftp://mirror.lan/ubuntu"},
+		"proxy without host":  {Proxy: "http://"},
+		"repository name":     {Repositories: []AptRepository{{Name: "Repo"}}},
+		"duplicate name":      {Repositories: []AptRepository{repository, repository}},
+		"security mirror URL": {SecurityMirror: "mirror.lan"},
+	}
+	for name, spec := range errors {
+		if _, err := spec.Config(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package generate_cloud_config
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	// diskAlertHook is the program mdadm and smartd run for an alert.
+	diskAlertHook = "/usr/local/sbin/disk-alert"
+	// defaultSmartSchedule runs a short self-test every night at 2 and a long
+	// one on Saturdays at 3.
+	defaultSmartSchedule = "(S/../.././02|L/../../6/03)"
+)
+
+// DiskAlertsSpec is the disk-alerts section of a host spec. Failing arrays
+// and disks are reported to a webhook, by email, or both. Test the alerts
+// with mdadm --monitor --scan --oneshot --test.
+type DiskAlertsSpec struct {
+	// Webhook receives a JSON object with the host, source, event, device,
+	// subject and message of every alert.
+	Webhook string `yaml:"webhook"`
+	Email   string `yaml:"email"`
+	// Relay is the SMTP relay email is sent through, host[:port] or an
+	// smtp:// or smtps:// URL. Email needs it, as the host has no MTA.
+	Relay string `yaml:"relay"`
+	// From is the sender of the email, disk-alerts@<hostname> by default.
+	From string `yaml:"from"`
+	// SmartSchedule is the smartd self-test schedule, a regular expression
+	// as smartd.conf's -s takes it.
+	SmartSchedule string `yaml:"smart-schedule"`
+	// SmartDevices are the devices smartd watches, every device it finds by
+	// default.
+	SmartDevices []string `yaml:"smart-devices"`
+}
+
+// DiskAlerts is the disk-alerts section with its defaults filled in, as the
+// module's files are rendered with it. mdadm and smartd run the hook, which
+// sends to Webhook and to Email through Relay.
+type DiskAlerts struct {
+	Webhook       string
+	Email         string
+	Relay         string
+	From          string
+	Hook          string
+	SmartSchedule string
+	SmartDevices  []string
+}
+
+var smartDevicePattern = regexp.MustCompile(`^(DEVICESCAN|/dev/\S+)$`)
+
+// Alerts validates the disk-alerts section and fills in its defaults.
+func (s DiskAlertsSpec) Alerts(hostname string) (alerts DiskAlerts, err error) {
+	alerts = DiskAlerts{
+		Hook:          diskAlertHook,
+		From:          firstNonEmpty(s.From, "disk-alerts@"+hostname),
+		SmartSchedule: firstNonEmpty(s.SmartSchedule, defaultSmartSchedule),
+		SmartDevices:  s.SmartDevices,
+	}
+	if len(alerts.SmartDevices) == 0 {
+		alerts.SmartDevices = []string{"DEVICESCAN"}
+	}
+
+	if s.Webhook == "" && s.Email == "" {
+		return alerts, fmt.Errorf("disk alerts need a webhook or an email")
+	}
+	if s.Webhook != "" {
+		webhook, err := url.Parse(s.Webhook)
+		if err != nil || (webhook.Scheme != "http" && webhook.Scheme != "https") || webhook.Host == "" {
+			return alerts, fmt.Errorf("disk alerts webhook %q is not an http or https URL", s.Webhook)
+		}
+	}
+	alerts.Webhook = s.Webhook
+	if s.Email != "" {
+		address, err := mail.ParseAddress(s.Email)
+		if err != nil {
+			return alerts, fmt.Errorf("invalid disk alerts email %q: %w", s.Email, err)
+		}
+		alerts.Email = address.Address
+	}
+	if _, err = mail.ParseAddress(alerts.From); err != nil {
+		return alerts, fmt.Errorf("invalid disk alerts sender %q: %w", alerts.From, err)
+	}
+	switch {
+	case s.Relay != "" && alerts.Email == "":
+		return alerts, fmt.Errorf("disk alerts relay is set but no email")
+	case s.Relay == "" && alerts.Email != "":
+		return alerts, fmt.Errorf("disk alerts email needs a relay, the host has no MTA to send it")
+	case s.Relay != "":
+		if alerts.Relay, err = relayURL(s.Relay); err != nil {
+			return alerts, err
+		}
+	}
+
+	if strings.ContainsAny(alerts.SmartSchedule, " \t\n") {
+		return alerts, fmt.Errorf("smart-schedule %q cannot contain whitespace", alerts.SmartSchedule)
+	}
+	if _, err = regexp.Compile(alerts.SmartSchedule); err != nil {
+		return alerts, fmt.Errorf("invalid smart-schedule %q: %w", alerts.SmartSchedule, err)
+	}
+	for _, device := range alerts.SmartDevices {
+		if !smartDevicePattern.MatchString(device) || (device != "DEVICESCAN" && path.Clean(device) != device) {
+			return alerts, fmt.Errorf("smart device %q must be DEVICESCAN or a path below /dev", device)
+		}
+	}
+	return alerts, nil
+}
+
+// relayURL returns the curl URL of an SMTP relay.
+func relayURL(relay string) (string, error) {
+	withScheme := relay
+	if !strings.Contains(relay, "://") {
+		withScheme = "smtp://" + relay
+	}
+	u, err := url.Parse(withScheme)
+	if err != nil || (u.Scheme != "smtp" && u.Scheme != "smtps") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+		return "", fmt.Errorf("disk alerts relay %q must be host[:port] or an smtp:// or smtps:// URL", relay)
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
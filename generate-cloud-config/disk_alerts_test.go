@@ -0,0 +1,292 @@
+package generate_cloud_config
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// renderDiskAlerts renders the files of the disk-alerts module for spec.
+func renderDiskAlerts(t *testing.T, spec DiskAlertsSpec) map[string]string {
+	t.Helper()
+
+	alerts, err := spec.Alerts("host1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	module, _ := lookupModule("disk-alerts")
+	files, err := MergeLayers([]FileLayer{{Name: "module:disk-alerts", FS: module.Files()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	renderCtx := RenderContext{
+		CloudConfigContext: CloudConfigContext{Hostname: "host1", AdminUsername: "admin"},
+		EnabledModules:     []string{"disk-alerts"},
+		DiskAlerts:         alerts,
+	}
+	installFiles, err := prepareFiles(renderCtx, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery, err := deliverFiles(renderCtx, installFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rendered := map[string]string{}
+	for path, contents := range delivery.Contents {
+		rendered[path] = string(contents)
+	}
+	return rendered
+}
+
+// alertCall is one run of a fake curl.
+type alertCall struct {
+	Program string
+	Args    []string
+	Stdin   string
+}
+
+// runDiskAlertHook runs the rendered hook with curl, logger and hostname
+// replaced by scripts that record how they were called.
+func runDiskAlertHook(t *testing.T, hook string, env []string, args ...string) (calls []alertCall) {
+	t.Helper()
+
+	bin := t.TempDir()
+	callsDir := t.TempDir()
+	recorder := "#!/bin/bash\nn=$(ls " + shellQuote(callsDir) + " | wc -l)\n" +
+		"{ basename \"$0\"; printf '%s\\n' \"$@\"; } > " + shellQuote(callsDir) + "/$n.args\n" +
+		"cat > " + shellQuote(callsDir) + "/$n.stdin\n"
+	scripts := map[string]string{
+		"curl":     recorder,
+		"logger":   "#!/bin/sh\n",
+		"hostname": "#!/bin/sh\necho host1.example.com\n",
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hookPath := filepath.Join(t.TempDir(), "disk-alert")
+	if err := os.WriteFile(hookPath, []byte(hook), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(hookPath, args...)
+	cmd.Env = append([]string{"PATH=" + bin + string(os.PathListSeparator) + os.Getenv("PATH")}, env...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("disk-alert failed: %v\n%s", err, out)
+	}
+
+	for n := 0; ; n += 2 {
+		// Every call leaves an .args and a .stdin file.
+		args, err := os.ReadFile(filepath.Join(callsDir, strconv.Itoa(n)+".args"))
+		if os.IsNotExist(err) {
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdin, err := os.ReadFile(filepath.Join(callsDir, strconv.Itoa(n)+".stdin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(args), "\n"), "\n")
+		calls = append(calls, alertCall{Program: lines[0], Args: lines[1:], Stdin: string(stdin)})
+	}
+}
+
+// webhookPayload decodes the JSON a curl call posted.
+func webhookPayload(t *testing.T, call alertCall) map[string]string {
+	t.Helper()
+
+	i := slices.Index(call.Args, "-d")
+	if i < 0 || i+1 >= len(call.Args) {
+		t.Fatalf("curl was not given a payload: %q", call.Args)
+	}
+	var payload map[string]string
+	if err := json.Unmarshal([]byte(call.Args[i+1]), &payload); err != nil {
+		t.Fatalf("payload %q is not JSON: %v", call.Args[i+1], err)
+	}
+	return payload
+}
+
+func TestDiskAlertsFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		spec DiskAlertsSpec
+		// smartd and mdadm are lines expected in smartd.conf and in the
+		// mdadm.conf lines the first-boot script writes.
+		smartd []string
+		mdadm  []string
+		// hook are the destination lines expected in the hook.
+		hook []string
+	}{
+		{
+			name:   "webhook",
+			spec:   DiskAlertsSpec{Webhook: "https://hooks.example.com/disks"},
+			smartd: []string{"DEVICESCAN -a -o on -S on -n standby,q -s (S/../.././02|L/../../6/03) -m <nomailer> -M exec /usr/local/sbin/disk-alert"},
+			mdadm:  []string{`echo "PROGRAM /usr/local/sbin/disk-alert" >> "$CONF"`},
+			hook:   []string{"WEBHOOK='https://hooks.example.com/disks'", "EMAIL=''", "RELAY=''"},
+		},
+		{
+			name:   "email",
+			spec:   DiskAlertsSpec{Email: "Ops <ops@example.com>", Relay: "mail.example.com:2525", From: "nas@example.com"},
+			smartd: []string{"DEVICESCAN -a -o on -S on -n standby,q -s (S/../.././02|L/../../6/03) -m <nomailer> -M exec /usr/local/sbin/disk-alert"},
+			mdadm:  []string{`echo "PROGRAM /usr/local/sbin/disk-alert" >> "$CONF"`},
+			hook:   []string{"WEBHOOK=''", "EMAIL='ops@example.com'", "RELAY='smtp://mail.example.com:2525'", "FROM='nas@example.com'"},
+		},
+		{
+			name:   "webhook and email",
+			spec:   DiskAlertsSpec{Webhook: "http://alerts.lan/hook", Email: "ops@example.com", Relay: "smtp://mail.lan"},
+			smartd: []string{"DEVICESCAN -a -o on -S on -n standby,q -s (S/../.././02|L/../../6/03) -m <nomailer> -M exec /usr/local/sbin/disk-alert"},
+			mdadm:  []string{`echo "PROGRAM /usr/local/sbin/disk-alert" >> "$CONF"`},
+			hook:   []string{"WEBHOOK='http://alerts.lan/hook'", "EMAIL='ops@example.com'", "RELAY='smtp://mail.lan'"},
+		},
+		{
+			name: "smart devices and schedule",
+			spec: DiskAlertsSpec{
+				Webhook:       "https://hooks.example.com/disks",
+				Email:         "ops@example.com",
+				Relay:         "smtps://mail.example.com",
+				SmartSchedule: "L/../../7/04",
+				SmartDevices:  []string{"/dev/sda", "/dev/disk/by-id/ata-WDC_1"},
+			},
+			smartd: []string{
+				"/dev/sda -a -o on -S on -n standby,q -s L/../../7/04 -m <nomailer> -M exec /usr/local/sbin/disk-alert",
+				"/dev/disk/by-id/ata-WDC_1 -a -o on -S on -n standby,q -s L/../../7/04 -m <nomailer> -M exec /usr/local/sbin/disk-alert",
+			},
+			mdadm: []string{`echo "PROGRAM /usr/local/sbin/disk-alert" >> "$CONF"`},
+			hook:  []string{"WEBHOOK='https://hooks.example.com/disks'", "EMAIL='ops@example.com'", "RELAY='smtps://mail.example.com'"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			files := renderDiskAlerts(t, test.spec)
+
+			smartd := strings.Split(strings.TrimSpace(files["/etc/smartd.conf"]), "\n")
+			var rules []string
+			for _, line := range smartd {
+				if !strings.HasPrefix(line, "#") {
+					rules = append(rules, line)
+				}
+			}
+			if !slices.Equal(rules, test.smartd) {
+				t.Errorf("smartd.conf rules are %q, want %q", rules, test.smartd)
+			}
+
+			configure := files["/usr/local/sbin/configure-disk-alerts"]
+			var alertLines []string
+			for _, line := range strings.Split(configure, "\n") {
+				if strings.HasPrefix(line, `echo "MAIL`) || strings.HasPrefix(line, `echo "PROGRAM`) {
+					alertLines = append(alertLines, line)
+				}
+			}
+			if !slices.Equal(alertLines, test.mdadm) {
+				t.Errorf("mdadm.conf alert lines are %q, want %q", alertLines, test.mdadm)
+			}
+
+			hook := files["/usr/local/sbin/disk-alert"]
+			for _, line := range test.hook {
+				if !slices.Contains(strings.Split(hook, "\n"), line) {
+					t.Errorf("disk-alert is missing %q", line)
+				}
+			}
+		})
+	}
+}
+
+func TestDiskAlertHookSendsMdadmEvents(t *testing.T) {
+	files := renderDiskAlerts(t, DiskAlertsSpec{Webhook: "https://hooks.example.com/disks", Email: "ops@example.com", Relay: "mail.example.com"})
+	hook := files["/usr/local/sbin/disk-alert"]
+
+	calls := runDiskAlertHook(t, hook, nil, "Fail", "/dev/md0", "/dev/sdb")
+	if len(calls) != 2 {
+		t.Fatalf("expected a webhook and an email call, got %+v", calls)
+	}
+
+	payload := webhookPayload(t, calls[0])
+	want := map[string]string{
+		"host":    "host1.example.com",
+		"source":  "mdadm",
+		"event":   "Fail",
+		"device":  "/dev/md0",
+		"subject": "mdadm on host1.example.com: Fail /dev/md0",
+		"message": "Fail event on /dev/md0, member /dev/sdb",
+	}
+	for key, value := range want {
+		if payload[key] != value {
+			t.Errorf("payload %s is %q, want %q", key, payload[key], value)
+		}
+	}
+	if calls[0].Args[len(calls[0].Args)-1] != "https://hooks.example.com/disks" {
+		t.Errorf("webhook was posted to %q", calls[0].Args[len(calls[0].Args)-1])
+	}
+
+	mail := calls[1]
+	if mail.Program != "curl" || !slices.Contains(mail.Args, "smtp://mail.example.com") || !slices.Contains(mail.Args, "ops@example.com") {
+		t.Errorf("email was not sent through the relay: %q", mail.Args)
+	}
+	if !strings.Contains(mail.Stdin, "Subject: mdadm on host1.example.com: Fail /dev/md0\n") || !strings.Contains(mail.Stdin, "From: disk-alerts@host1\n") {
+		t.Errorf("unexpected email %q", mail.Stdin)
+	}
+
+	if calls = runDiskAlertHook(t, hook, nil, "NewArray", "/dev/md0"); len(calls) != 0 {
+		t.Errorf("informational mdadm events should not alert, got %+v", calls)
+	}
+}
+
+func TestDiskAlertHookSendsSmartdEvents(t *testing.T) {
+	files := renderDiskAlerts(t, DiskAlertsSpec{Webhook: "https://hooks.example.com/disks", Email: "ops@example.com", Relay: "smtps://mail.example.com:465"})
+	hook := files["/usr/local/sbin/disk-alert"]
+
+	calls := runDiskAlertHook(t, hook, []string{
+		"SMARTD_DEVICE=/dev/sda",
+		"SMARTD_FAILTYPE=CurrentPendingSector",
+		"SMARTD_FULLMESSAGE=Device: /dev/sda, 8 \"Currently unreadable\" sectors\n\tsee smartctl -a",
+	})
+	if len(calls) != 2 {
+		t.Fatalf("expected a webhook and an email call, got %+v", calls)
+	}
+
+	payload := webhookPayload(t, calls[0])
+	if payload["source"] != "smartd" || payload["event"] != "CurrentPendingSector" || payload["device"] != "/dev/sda" {
+		t.Errorf("unexpected payload %v", payload)
+	}
+	if payload["message"] != "Device: /dev/sda, 8 \"Currently unreadable\" sectors\n\tsee smartctl -a" {
+		t.Errorf("message was not escaped faithfully: %q", payload["message"])
+	}
+
+	mail := calls[1]
+	if mail.Program != "curl" || !slices.Contains(mail.Args, "smtps://mail.example.com:465") || !slices.Contains(mail.Args, "disk-alerts@host1") {
+		t.Errorf("email was not sent through the relay: %q", mail.Args)
+	}
+}
+
+func TestDiskAlertsSpecErrors(t *testing.T) {
+	tests := map[string]DiskAlertsSpec{
+		"no destination":         {},
+		"webhook scheme":         {Webhook: "ftp://example.com/hook"},
+		"webhook without host":   {Webhook: "https:///hook"},
+		"email":                  {Email: "not an address"},
+		"sender":                 {Email: "ops@example.com", From: "nobody"},
+		"relay without email":    {Webhook: "https://hooks.example.com", Relay: "mail.example.com"},
+		"email without relay":    {Email: "ops@example.com"},
+		"relay scheme":           {Email: "ops@example.com", Relay: "http://mail.example.com"},
+		"schedule whitespace":    {Webhook: "https://hooks.example.com", SmartSchedule: "S/../.././02 L"},
+		"schedule regexp":        {Webhook: "https://hooks.example.com", SmartSchedule: "(S/../.././02"},
+		"smart device":           {Webhook: "https://hooks.example.com", SmartDevices: []string{"sda"}},
+		"smart device not clean": {Webhook: "https://hooks.example.com", SmartDevices: []string{"/dev/../etc/passwd"}},
+	}
+	for name, spec := range tests {
+		if _, err := spec.Alerts("host1"); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package generate_cloud_config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// HomePrefix marks a top-level directory of the files tree as a user's home
+// directory. ~/ is the home of the admin user and ~name/ the home of name, so
+// ~/.ssh/authorized_keys is installed at /home/<admin>/.ssh/authorized_keys.
+const HomePrefix = "~"
+
+// targetRoot is where the installer mounts the installed system.
+const targetRoot = "/target"
+
+// WriteFile is a cloud-init write_files entry of the installed system.
+type WriteFile struct {
+	Path        string `yaml:"path"`
+	Content     string `yaml:"content"`
+	Encoding    string `yaml:"encoding,omitempty"`
+	Owner       string `yaml:"owner,omitempty"`
+	Permissions string `yaml:"permissions,omitempty"`
+	Defer       bool   `yaml:"defer,omitempty"`
+}
+
+// installFile is a merged file with its metadata resolved and front-matter
+// removed.
+type installFile struct {
+	MergedFile
+	Target string
+	Body   []byte
+	Meta   FileMetadata
+}
+
+// fileDelivery holds what installs the files of a host in each phase.
+type fileDelivery struct {
+	EarlyCommands []string
+	LateCommands  []string
+	WriteFiles    []WriteFile
+	Payloads      []Payload
+	// Bundle are the files that go into the secrets bundle.
+	Bundle []bundledFile
+	// Contents are the rendered files by installed path.
+	Contents map[string][]byte
+}
+
+// homeTarget maps a path under ~/ or ~name/ to the user's home directory.
+func homeTarget(adminUsername, p string) (target, user string, ok bool) {
+	first, rest, _ := strings.Cut(strings.TrimPrefix(p, "/"), "/")
+	if !strings.HasPrefix(first, HomePrefix) {
+		return p, "", false
+	}
+
+	user = strings.TrimPrefix(first, HomePrefix)
+	if user == "" {
+		user = adminUsername
+	}
+	return path.Join(homeDir(user), rest), user, true
+}
+
+// homeDir returns the home directory of a user created by the config.
+func homeDir(user string) string {
+	if user == "root" {
+		return "/root"
+	}
+	return "/home/" + user
+}
+
+// resolveTarget returns the installed path of a file. Files in a user's home
+// directory are owned by the user and installed at first boot unless their
+// metadata says otherwise, since the installer does not create the user.
+func resolveTarget(ctx CloudConfigContext, p string, meta FileMetadata) (string, FileMetadata) {
+	target, user, ok := homeTarget(ctx.AdminUsername, p)
+	if !ok {
+		return p, meta
+	}
+	return target, FileMetadata{Owner: user, Phase: PhaseFirstBoot}.merge(meta)
+}
+
+// prepareFiles loads every merged file and drops the ones whose condition
+// does not hold for ctx.
+func prepareFiles(ctx RenderContext, files []MergedFile) (prepared []installFile, err error) {
+	for _, file := range files {
+		body, meta, err := loadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !meta.enabled(ctx) {
+			continue
+		}
+
+		target, meta := resolveTarget(ctx.CloudConfigContext, file.Path, meta)
+		user, _ := meta.UserGroup()
+		if meta.InstallPhase() != PhaseFirstBoot && user == ctx.AdminUsername {
+			return nil, fmt.Errorf("error installing %s from %s: %s is created at first boot, set phase to %s", file.Source, file.Layer, user, PhaseFirstBoot)
+		}
+
+		prepared = append(prepared, installFile{MergedFile: file, Target: target, Body: body, Meta: meta})
+	}
+	return
+}
+
+// deliverFiles renders the files and returns how each is installed. Installer
+// files are written by early-commands, target files by late-commands into the
+// mounted target, and first-boot files by cloud-init's deferred write_files.
+// Installer and target files from the inline threshold up are carried on the
+// ISO as payloads and copied from there, since the ISO is no longer mounted at
+// first boot. Files that carry a secret go into the secrets bundle of hosts
+// that have one.
+func deliverFiles(ctx RenderContext, files []installFile) (delivery fileDelivery, err error) {
+	renderer, err := newTemplateRenderer(ctx, files)
+	if err != nil {
+		return
+	}
+
+	delivery.Contents = map[string][]byte{}
+	for _, file := range files {
+		contents := file.Body
+		if file.isTemplate(file.Meta) {
+			if contents, err = renderer.render(file); err != nil {
+				return fileDelivery{}, err
+			}
+		}
+		delivery.Contents[file.Target] = contents
+
+		user, group := file.Meta.UserGroup()
+		mode := file.Meta.FileMode()
+		if !ctx.SecretsBundle.IsZero() && ctx.carriesSecret(file.Meta, contents) {
+			if file.Meta.InstallPhase() == PhaseInstaller {
+				return fileDelivery{}, fmt.Errorf("error installing %s from %s: it carries a secret and the secrets bundle is only opened at first boot, set phase to %s or %s", file.Source, file.Layer, PhaseTarget, PhaseFirstBoot)
+			}
+			bundled := bundledFile{Target: file.Target, Contents: contents, Mode: mode, User: user, Group: group}
+			if _, homeUser, ok := homeTarget(ctx.AdminUsername, file.Path); ok {
+				bundled.Home = homeDir(homeUser)
+			}
+			delivery.Bundle = append(delivery.Bundle, bundled)
+			continue
+		}
+		switch file.Meta.InstallPhase() {
+		case PhaseInstaller:
+			delivery.EarlyCommands = append(delivery.EarlyCommands, delivery.writeCommands(ctx, "", file.Target, contents, mode)...)
+			if user != "root" || group != "root" {
+				delivery.EarlyCommands = append(delivery.EarlyCommands, fmt.Sprintf("chown %s:%s %s", user, group, shellQuote(file.Target)))
+			}
+		case PhaseTarget:
+			delivery.LateCommands = append(delivery.LateCommands, delivery.writeCommands(ctx, targetRoot, file.Target, contents, mode)...)
+			if user != "root" || group != "root" {
+				delivery.LateCommands = append(delivery.LateCommands, fmt.Sprintf("curtin in-target -- chown %s:%s %s", user, group, shellQuote(file.Target)))
+			}
+		case PhaseFirstBoot:
+			delivery.WriteFiles = append(delivery.WriteFiles, WriteFile{
+				Path:        file.Target,
+				Content:     base64.StdEncoding.EncodeToString(contents),
+				Encoding:    "b64",
+				Owner:       user + ":" + group,
+				Permissions: fmt.Sprintf("%04o", mode.Perm()),
+				Defer:       true,
+			})
+		}
+	}
+
+	delivery.Payloads = dedupePayloads(delivery.Payloads)
+	return
+}
+
+// writeCommands writes contents to root+target inline or, from the inline
+// threshold up, by copying a payload.
+func (d *fileDelivery) writeCommands(ctx RenderContext, root, target string, contents []byte, mode fs.FileMode) []string {
+	if !ctx.usePayload(contents) {
+		return writeFileCommands(root, target, contents, mode)
+	}
+	payload := newPayload(contents)
+	d.Payloads = append(d.Payloads, payload)
+	return copyPayloadCommands(root, target, payload, mode)
+}
+
+// writeFileCommands writes contents to root+target with the given mode. The
+// commands run in the installer, so root is where the target's / is mounted.
+func writeFileCommands(root, target string, contents []byte, mode fs.FileMode) []string {
+	destination := shellQuote(root + target)
+	return []string{
+		fmt.Sprintf("mkdir -p %s", shellQuote(root+path.Dir(target))),
+		fmt.Sprintf(`echo "%s" | base64 -d > %s`, base64.StdEncoding.EncodeToString(contents), destination),
+		fmt.Sprintf("chmod %04o %s", mode.Perm(), destination),
+	}
+}
+
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -1,3 +0,0 @@
-{{ range .SSHKeys }}
-{{ . }}
-{{ end }}
\ No newline at end of file
@@ -1,4 +1,6 @@
-#executable
+#meta
+mode: "0755"
+#/meta
 #!/usr/bin/env bash
 # System-wide custom settings
 export HISTSIZE=10000
@@ -1,3 +1,6 @@
+#meta
+mode: "0755"
+#/meta
 #!/bin/bash
 
 # Logging
@@ -10,7 +13,7 @@ echo 'Running first boot configuration...'
 
 # Fix ownership of user home directory
 echo 'Fixing ownership of user home directory...'
-chown -R {{ .AdminUsername }}:{{ .AdminUsername }} /home/{{ .AdminUsername }}
+chown -R {{ .AdminUsername }}: /home/{{ .AdminUsername }}
 echo 'Finished fixing ownership of user home directory.'
 echo 'Disabling motd...'
 chmod -x /etc/update-motd.d/*
@@ -26,13 +29,11 @@ apt-get update
 apt-get upgrade -y
 echo 'Finished updating packages.'
 
-echo "Configuring docker"
-/usr/local/bin/setup-raid
-echo "Docker has been configured"
-
-echo "Setting up raid"
-/usr/local/bin/setup-raid
-echo "Raid setup is complete"
+{{ range .FirstBootSteps }}
+echo "{{ .Description }}"
+{{ .Command }}
+echo "Finished: {{ .Description }}"
+{{ end }}
 
 # Disable this service after first run
 echo "Creating systemd signal file to not run again"
@@ -0,0 +1,6 @@
+#meta
+mode: "0600"
+#/meta
+{{ range .SSHKeys -}}
+{{ . }}
+{{ end -}}
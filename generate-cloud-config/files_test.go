@@ -0,0 +1,212 @@
+package generate_cloud_config
+
+import (
+	"encoding/base64"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// runInFakeTarget runs late-commands with the target mounted at root and the
+// ISO at cdrom. curtin is replaced by a script that logs its arguments, since
+// chown into the target needs the real installer.
+func runInFakeTarget(t *testing.T, root, cdrom string, commands []string) []string {
+	t.Helper()
+
+	bin := t.TempDir()
+	curtinLog := filepath.Join(t.TempDir(), "curtin.log")
+	script := "#!/bin/sh\necho \"$@\" >> " + shellQuote(curtinLog) + "\n"
+	if err := os.WriteFile(filepath.Join(bin, "curtin"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mounts := strings.NewReplacer(targetRoot+"/", root+"/", "/cdrom/", cdrom+"/")
+	for _, command := range commands {
+		command = mounts.Replace(command)
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Env = append(os.Environ(), "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("command %q failed: %v\n%s", command, err, out)
+		}
+	}
+
+	logged, err := os.ReadFile(curtinLog)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(logged)), "\n")
+}
+
+func deliverTestFiles(t *testing.T, ctx CloudConfigContext, tree fstest.MapFS) fileDelivery {
+	t.Helper()
+
+	files, err := MergeLayers([]FileLayer{{Name: "test", FS: tree}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	renderCtx := RenderContext{CloudConfigContext: ctx}
+	installFiles, err := prepareFiles(renderCtx, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery, err := deliverFiles(renderCtx, installFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return delivery
+}
+
+func TestDeliverFilesToTarget(t *testing.T) {
+	ctx := CloudConfigContext{Hostname: "host1", AdminUsername: "admin"}
+	delivery := deliverTestFiles(t, ctx, fstest.MapFS{
+		"etc/hostname.tpl":         {Data: []byte("{{ .Hostname }}\n")},
+		"usr/local/bin/run":        {Data: []byte("#meta\nmode: \"0755\"\n#/meta\n#!/bin/sh\necho 'it''s'\n")},
+		"etc/syslog.conf":          {Data: []byte("*.* /var/log/all\n")},
+		"etc/syslog.conf.meta":     {Data: []byte("owner: syslog:adm\nmode: \"0640\"\n")},
+		"etc/installer.conf":       {Data: []byte("#meta\nphase: installer\n#/meta\nlive\n")},
+		"etc/only-with-nvidia.tpl": {Data: []byte("#meta\nwhen:\n  module: nvidia\n#/meta\nnvidia\n")},
+	})
+
+	root := t.TempDir()
+	curtin := runInFakeTarget(t, root, t.TempDir(), delivery.LateCommands)
+
+	expected := map[string]struct {
+		contents string
+		mode     os.FileMode
+	}{
+		"etc/hostname":      {"host1\n", 0644},
+		"usr/local/bin/run": {"#!/bin/sh\necho 'it''s'\n", 0755},
+		"etc/syslog.conf":   {"*.* /var/log/all\n", 0640},
+	}
+	for name, want := range expected {
+		path := filepath.Join(root, name)
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%s was not written: %v", name, err)
+		}
+		if string(contents) != want.contents {
+			t.Errorf("%s contains %q, want %q", name, contents, want.contents)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != want.mode {
+			t.Errorf("%s has mode %04o, want %04o", name, info.Mode().Perm(), want.mode)
+		}
+	}
+
+	for _, name := range []string{"etc/installer.conf", "etc/only-with-nvidia"} {
+		if _, err := os.Stat(filepath.Join(root, name)); !os.IsNotExist(err) {
+			t.Errorf("%s should not be written to the target", name)
+		}
+	}
+
+	if len(curtin) != 1 || curtin[0] != "in-target -- chown syslog:adm /etc/syslog.conf" {
+		t.Errorf("unexpected curtin calls %q", curtin)
+	}
+
+	if len(delivery.EarlyCommands) == 0 || !strings.Contains(strings.Join(delivery.EarlyCommands, "\n"), "> '/etc/installer.conf'") {
+		t.Errorf("installer file is not written by early-commands: %q", delivery.EarlyCommands)
+	}
+}
+
+func TestDeliverFilesAsPayloads(t *testing.T) {
+	large := strings.Repeat("x", 64)
+	ctx := CloudConfigContext{InlineThreshold: 64}
+	delivery := deliverTestFiles(t, ctx, fstest.MapFS{
+		"opt/large.bin":   {Data: []byte(large)},
+		"opt/copy.bin":    {Data: []byte(large)},
+		"etc/small.conf":  {Data: []byte("small\n")},
+		"~/large-at-boot": {Data: []byte(large)},
+	})
+
+	if len(delivery.Payloads) != 1 {
+		t.Fatalf("got %d payloads, want identical files carried once", len(delivery.Payloads))
+	}
+	if len(delivery.WriteFiles) != 1 {
+		t.Errorf("first-boot files should always be inlined, got %d write_files entries", len(delivery.WriteFiles))
+	}
+
+	cdrom := t.TempDir()
+	if err := WritePayloads(filepath.Join(cdrom, PayloadDir), delivery.Payloads); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPayloads(filepath.Join(cdrom, PayloadDir)); err != nil {
+		t.Fatalf("payloads do not match their manifest: %v", err)
+	}
+
+	root := t.TempDir()
+	runInFakeTarget(t, root, cdrom, append([]string{verifyPayloadsCommand()}, delivery.LateCommands...))
+	for name, want := range map[string]string{"opt/large.bin": large, "opt/copy.bin": large, "etc/small.conf": "small\n"} {
+		contents, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			t.Fatalf("%s was not written: %v", name, err)
+		}
+		if string(contents) != want {
+			t.Errorf("%s contains %q, want %q", name, contents, want)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(cdrom, PayloadDir, delivery.Payloads[0].Name), []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPayloads(filepath.Join(cdrom, PayloadDir)); err == nil {
+		t.Error("expected a corrupt payload to fail verification")
+	}
+}
+
+func TestDeliverFilesToHomeDirectories(t *testing.T) {
+	ctx := CloudConfigContext{AdminUsername: "admin", SSHKeys: []string{"ssh-ed25519 AAAA one", "ssh-ed25519 BBBB two"}}
+	delivery := deliverTestFiles(t, ctx, fstest.MapFS{
+		"~/.ssh/authorized_keys.tpl": {Data: []byte("#meta\nmode: \"0600\"\n#/meta\n{{ range .SSHKeys -}}\n{{ . }}\n{{ end -}}\n")},
+		"~root/.vimrc":               {Data: []byte("set number\n")},
+	})
+
+	if len(delivery.LateCommands) != 0 {
+		t.Errorf("home files should not be written by late-commands: %q", delivery.LateCommands)
+	}
+
+	want := map[string]WriteFile{
+		"/home/admin/.ssh/authorized_keys": {Owner: "admin:admin", Permissions: "0600", Content: "ssh-ed25519 AAAA one\nssh-ed25519 BBBB two\n"},
+		"/root/.vimrc":                     {Owner: "root:root", Permissions: "0644", Content: "set number\n"},
+	}
+	if len(delivery.WriteFiles) != len(want) {
+		t.Fatalf("got %d write_files entries, want %d", len(delivery.WriteFiles), len(want))
+	}
+	for _, file := range delivery.WriteFiles {
+		expected, ok := want[file.Path]
+		if !ok {
+			t.Errorf("unexpected write_files entry %s", file.Path)
+			continue
+		}
+		contents, err := base64.StdEncoding.DecodeString(file.Content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != expected.Content {
+			t.Errorf("%s contains %q, want %q", file.Path, contents, expected.Content)
+		}
+		if file.Owner != expected.Owner || file.Permissions != expected.Permissions || !file.Defer || file.Encoding != "b64" {
+			t.Errorf("%s has owner %s, permissions %s, defer %v, encoding %s", file.Path, file.Owner, file.Permissions, file.Defer, file.Encoding)
+		}
+	}
+}
+
+func TestAdminOwnedTargetFileIsRejected(t *testing.T) {
+	files, err := MergeLayers([]FileLayer{{Name: "test", FS: fstest.MapFS{
+		"srv/data.txt": {Data: []byte("#meta\nowner: admin\n#/meta\ndata\n")},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = prepareFiles(RenderContext{CloudConfigContext: CloudConfigContext{AdminUsername: "admin"}}, files); err == nil {
+		t.Fatal("expected an error for a target file owned by the admin user")
+	}
+}
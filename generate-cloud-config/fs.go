@@ -4,5 +4,18 @@ import (
 	"embed"
 )
 
-//go:embed files
+//go:embed all:files
 var filesFS embed.FS
+
+//go:embed all:modules
+var modulesFS embed.FS
+
+// aptKeysFS holds the keys of the builtin modules' apt repositories.
+//
+//go:embed keys
+var aptKeysFS embed.FS
+
+// dataFS holds the lists host spec values are checked against.
+//
+//go:embed data
+var dataFS embed.FS
@@ -1,37 +1,55 @@
 package generate_cloud_config
 
 import (
-	"bytes"
 	"encoding/base64"
 	"fmt"
-	"io/fs"
 	"os"
 	"path/filepath"
 	"slices"
-	"strings"
-	"text/template"
 
+	"filippo.io/age"
+	"github.com/hunoz/ubuntu-iso-builder/aptrepo"
+	"github.com/hunoz/ubuntu-iso-builder/images"
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	// offlineRepoDir holds the ISO's apt repository in the installed system.
+	offlineRepoDir     = "/var/lib/iso-builder/apt"
+	offlineRepoKeyring = "/etc/apt/keyrings/iso-builder-offline.gpg"
+	offlineRepoSource  = "iso-builder-offline.sources"
+	// offlineRepoInstallerSource points the installer at the repository on
+	// the ISO.
+	offlineRepoInstallerSource = "iso-builder-cdrom.list"
+)
+
 type AutoInstallKeyboard struct {
-	Layout string `yaml:"layout"`
+	Layout  string `yaml:"layout"`
+	Variant string `yaml:"variant,omitempty"`
 }
 
 type User struct {
 	Name              string   `yaml:"name"`
-	Passwd            string   `yaml:"passwd"`
+	Gecos             string   `yaml:"gecos,omitempty"`
+	Passwd            string   `yaml:"passwd,omitempty"`
 	PrimaryGroup      string   `yaml:"primary_group,omitempty"`
 	Groups            []string `yaml:"groups,omitempty"`
-	LockPasswd        bool     `yaml:"lock_passwd,omitempty"`
+	LockPasswd        bool     `yaml:"lock_passwd"`
 	SshAuthorizedKeys []string `yaml:"ssh_authorized_keys,omitempty"`
-	Sudo              string   `yaml:"sudo,omitempty"`
+	Sudo              []string `yaml:"sudo,omitempty"`
 	Shell             string   `yaml:"shell,omitempty"`
+	UID               int      `yaml:"uid,omitempty"`
+	System            bool     `yaml:"system,omitempty"`
+	Homedir           string   `yaml:"homedir,omitempty"`
 }
 
 type UserData struct {
-	Hostname string `yaml:"hostname"`
-	Users    []User `yaml:"users"`
+	Hostname   string      `yaml:"hostname"`
+	Users      []User      `yaml:"users"`
+	WriteFiles []WriteFile `yaml:"write_files,omitempty"`
+	// SSHDeleteKeys false keeps cloud-init from replacing the host keys at
+	// first boot.
+	SSHDeleteKeys *bool `yaml:"ssh_deletekeys,omitempty"`
 }
 
 type SSH struct {
@@ -40,24 +58,13 @@ type SSH struct {
 	AuthorizedKeys []string `yaml:"authorized-keys,omitempty"`
 }
 
-type StorageLayoutMatch struct {
-	Serial *string `yaml:"serial"`
-}
-
-type StorageLayout struct {
-	Name  string             `yaml:"name"`
-	Match StorageLayoutMatch `yaml:"match"`
-}
-
-type Storage struct {
-	Layout StorageLayout `yaml:"layout"`
-}
-
 type AutoInstall struct {
 	Version       int                 `yaml:"version"`
 	Timezone      string              `yaml:"timezone"`
 	Locale        string              `yaml:"locale"`
 	Keyboard      AutoInstallKeyboard `yaml:"keyboard"`
+	Network       *Network            `yaml:"network,omitempty"`
+	Apt           *AutoInstallApt     `yaml:"apt,omitempty"`
 	UserData      UserData            `yaml:"user-data"`
 	Ssh           SSH                 `yaml:"ssh"`
 	Storage       Storage             `yaml:"storage"`
@@ -71,188 +78,416 @@ type CloudConfig struct {
 	AutoInstall AutoInstall `yaml:"autoinstall"`
 }
 
+// CloudConfigContext is the host spec a cloud-config is rendered from. The yaml
+// keys match the CLI flag names so the same spec can come from flags or from an
+// inventory file.
 type CloudConfigContext struct {
-	Hostname         string
-	AdminUsername    string
-	AdminPassword    string
-	RootPassword     string
-	SSHKeys          []string
-	DiskSerial       string
-	PlexClaim        string
-	CloudflaredToken string
+	Hostname      string `yaml:"hostname"`
+	AdminUsername string `yaml:"admin-username"`
+	AdminPassword string `yaml:"admin-password"`
+	RootPassword  string `yaml:"root-password"`
+	// SSHKeys are authorized_keys lines, which may start with options such
+	// as from= or command=.
+	SSHKeys []string `yaml:"ssh-keys"`
+	// SSHKeyFiles are public key files or globs such as ~/.ssh/*.pub, and
+	// AuthorizedKeysFiles authorized_keys files, whose keys are added to
+	// SSHKeys.
+	SSHKeyFiles         []string `yaml:"ssh-key-files"`
+	AuthorizedKeysFiles []string `yaml:"authorized-keys-files"`
+	// HostKeysDir holds the ssh host keys of the host between installs. Keys
+	// missing from it are generated into it. GenerateHostKeys generates the
+	// host keys without keeping them.
+	HostKeysDir      string `yaml:"host-keys-dir"`
+	GenerateHostKeys bool   `yaml:"generate-host-keys"`
+	// KnownHostsNames are the names the host is reached by in known_hosts
+	// lines and SSHFP records, the hostname by default. The static addresses
+	// of the network section are added to the known_hosts lines.
+	KnownHostsNames []string `yaml:"known-hosts-names"`
+	// DiskSerial selects the disk for subiquity's lvm layout when Storage is
+	// empty.
+	DiskSerial       string   `yaml:"disk-serial"`
+	PlexClaim        string   `yaml:"plex-claim"`
+	CloudflaredToken string   `yaml:"cloudflared-token"`
+	Modules          []string `yaml:"modules"`
+	WithoutModules   []string `yaml:"without-modules"`
+	FilesDirs        []string `yaml:"files-dirs"`
+	// Values are exposed to templates as .Values.
+	Values  map[string]interface{} `yaml:"values"`
+	Storage StorageSpec            `yaml:"storage"`
+	Raid    RaidSpec               `yaml:"raid"`
+	// Network is the netplan configuration of the host, DHCP when it is
+	// empty.
+	Network Network `yaml:"network"`
+	// Apt sets the mirrors and proxy and adds third-party repositories.
+	Apt AptSpec `yaml:"apt"`
+	// DiskAlerts configures the disk-alerts module.
+	DiskAlerts DiskAlertsSpec `yaml:"disk-alerts"`
+	// Hardening selects the profile of the hardening module.
+	Hardening HardeningSpec `yaml:"hardening"`
+	// Timezone, Locale and the keyboard default to Etc/UTC, en_US.UTF-8 and
+	// the us layout.
+	Timezone        string `yaml:"timezone"`
+	Locale          string `yaml:"locale"`
+	KeyboardLayout  string `yaml:"keyboard-layout"`
+	KeyboardVariant string `yaml:"keyboard-variant"`
+	// Shutdown is what the installer does when it is done, reboot by default
+	// or poweroff.
+	Shutdown string `yaml:"shutdown"`
+	// Users are accounts next to root and the admin user, or replace them when
+	// named alike.
+	Users  []UserSpec  `yaml:"users"`
+	Groups []GroupSpec `yaml:"groups"`
+	// LockRoot locks root's password and gives it no ssh keys.
+	LockRoot bool `yaml:"lock-root"`
+	// PasswordHash is the scheme plaintext passwords are hashed with,
+	// yescrypt by default or sha512.
+	PasswordHash string `yaml:"password-hash"`
+	// AgeIdentity is the local identity file age: secret sources are
+	// decrypted with.
+	AgeIdentity string `yaml:"age-identity"`
+	// SecretValues are dotted keys of Values that hold secrets. They may name a
+	// secret source.
+	SecretValues []string `yaml:"secret-values"`
+	// SecretsBundle moves the files that carry secrets into an encrypted
+	// bundle that is opened at first boot.
+	SecretsBundle SecretsBundleSpec `yaml:"secrets-bundle"`
+	// Seed makes randomness in templates and the salts of password hashes
+	// reproducible. Anyone who knows it can predict them, so it is a secret
+	// and may name a secret source. Both are random when it is empty, and
+	// every generation renders different values.
+	Seed string `yaml:"seed"`
+	// InlineThreshold is the size in bytes from which files are carried on the
+	// ISO instead of inlined. Zero selects DefaultInlineThreshold and a
+	// negative value inlines every file.
+	InlineThreshold int `yaml:"inline-threshold"`
+	// OfflineRepo adds the signed apt repository carried on the ISO as a
+	// source of the installer and of the installed system.
+	OfflineRepo bool `yaml:"offline-repo"`
+	// PreloadImages are image archives carried on the ISO and loaded into
+	// docker at first boot, before the compose applications start. They come
+	// from the build, not the host spec.
+	PreloadImages []images.Archive `yaml:"-"`
+
+	// secrets holds the resolved secret sources, nil until ResolveSecrets
+	// ran, and secretValues every secret of the host.
+	secrets      map[SecretSource]string
+	secretValues []string
+	// hostKeys are the host keys loaded by LoadHostKeys.
+	hostKeys []HostKey
 }
 
-func getEarlyCommands(ctx CloudConfigContext) (commands []string, err error) {
-	err = fs.WalkDir(filesFS, ".", func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if d.IsDir() {
-			// Create the directory in the temporary location
-			return nil
-		} else {
-			// Open the embedded file
-			srcFile, err := filesFS.Open(path)
-			if err != nil {
-				return fmt.Errorf("error opening embedded file %s: %w", path, err)
-			}
-			defer func(srcFile fs.File) {
-				e := srcFile.Close()
-				if e != nil {
-					err = e
-				}
-			}(srcFile)
-
-			pathSplit := strings.Split(path, "/")
-			var pathWithoutPrefix string
-			if pathSplit[0] == "files" {
-				pathWithoutPrefix = "/" + strings.TrimSuffix(strings.Join(pathSplit[1:], "/"), ".tpl")
-			} else {
-				pathWithoutPrefix = "/" + strings.TrimSuffix(strings.Join(pathSplit[:len(pathSplit)-1], "/"), ".tpl")
-			}
-			dir := filepath.Dir(pathWithoutPrefix)
-			baseName := pathSplit[len(pathSplit)-1]
-			var contents bytes.Buffer
-			if strings.HasSuffix(path, ".tpl") {
-				tmpl, err := template.ParseFS(filesFS, path)
-				if err != nil {
-					return fmt.Errorf("error parsing template %s: %w", path, err)
-				}
-				if err = tmpl.ExecuteTemplate(&contents, filepath.Base(path), ctx); err != nil {
-					return fmt.Errorf("error executing template %s: %w", path, err)
-				}
-				baseName = strings.TrimSuffix(baseName, ".tpl")
-			} else {
-				if content, err := filesFS.ReadFile(path); err != nil {
-					return err
-				} else {
-					buf := bytes.NewBuffer(content)
-					contents = *buf
-				}
-			}
-
-			base64Content := base64.StdEncoding.EncodeToString([]byte(strings.Replace(contents.String(), "#executable\n", "", 1)))
-			var outputFile string
-			if baseName == "authorized_keys.tpl" {
-				outputFile = fmt.Sprintf("/home/%s/.ssh/authorized_keys", ctx.AdminUsername)
-				command := fmt.Sprintf(`curtin in-target -- echo "%s" | base64 -d > %s`, base64Content, "home/root/.ssh/authorized_keys")
-				commands = append(commands, "curtin in-target -- mkdir -p /home/root/.ssh", command)
-			} else {
-				outputFile = pathWithoutPrefix
-			}
+// getAptSourceCommands writes the apt sources of the enabled modules into the
+// target, substituting the release codename of the installed system.
+func getAptSourceCommands(sources []AptSource) (commands []string) {
+	for _, source := range sources {
+		base64Content := base64.StdEncoding.EncodeToString([]byte(source.Content))
+		commands = append(commands, fmt.Sprintf(
+			`curtin in-target -- sh -c 'echo "%s" | base64 -d | sed "s/@CODENAME@/$(. /etc/os-release && echo ${UBUNTU_CODENAME:-$VERSION_CODENAME})/" > /etc/apt/sources.list.d/%s'`,
+			base64Content, source.Filename,
+		))
+	}
 
-			command := fmt.Sprintf(`curtin in-target -- echo "%s" | base64 -d > %s`, base64Content, outputFile)
-			if !slices.Contains(commands, fmt.Sprintf("curtin in-target -- mkdir -p '%s'", dir)) {
-				commands = append(commands, fmt.Sprintf("curtin in-target -- mkdir -p '%s'", dir))
-			}
-			commands = append(commands, command)
-			if strings.HasPrefix(contents.String(), "#executable") {
-				commands = append(commands, fmt.Sprintf("curtin in-target -- chmod +x %s", outputFile))
-			}
+	return
+}
 
-			return nil
-		}
-	})
+// offlineRepoInstallerSources make the installer resolve the packages of the
+// autoinstall config from the apt repository of the ISO, which is mounted in
+// the target while they are installed.
+func offlineRepoInstallerSources() map[string]AutoInstallAptSource {
+	isoDir := "/cdrom/" + aptrepo.Dir
+	return map[string]AutoInstallAptSource{
+		offlineRepoInstallerSource: {
+			Source: fmt.Sprintf("deb [signed-by=%s/%s] file://%s ./", isoDir, aptrepo.KeyringFile, isoDir),
+		},
+	}
+}
 
+// getOfflineRepoCommands copies the apt repository of the ISO into the target,
+// where it stays available after the installer unmounts the ISO, and returns
+// the source that points apt at it. The installer's source of the ISO is
+// removed from the target.
+func getOfflineRepoCommands() (commands []string, source AptSource) {
+	isoDir := "/cdrom/" + aptrepo.Dir
+	commands = []string{
+		fmt.Sprintf("rm -f %s", targetRoot+"/etc/apt/sources.list.d/"+offlineRepoInstallerSource),
+		fmt.Sprintf("mkdir -p %s", targetRoot+offlineRepoDir),
+		fmt.Sprintf("cp -a %s/. %s/", isoDir, targetRoot+offlineRepoDir),
+		fmt.Sprintf("install -D -m 0644 %s/%s %s", isoDir, aptrepo.KeyringFile, targetRoot+offlineRepoKeyring),
+	}
+	source = AptSource{
+		Filename: offlineRepoSource,
+		Content: fmt.Sprintf("Types: deb\nURIs: file://%s\nSuites: ./\nSigned-By: %s\n",
+			offlineRepoDir, offlineRepoKeyring),
+	}
 	return
 }
 
-func getDockerCommands() []string {
-	return []string{
-		"curtin in-target -- apt update",
-		"curtin in-target -- chmod a+r /etc/apt/keyrings/docker.asc",
-		`curtin in-target -- bash -c 'DEBIAN_FRONTEND=noninteractive apt install -y docker-ce docker-ce-cli containerd.io docker-buildx-plugin docker-compose-plugin'`,
+// aptUpdateCommand refreshes the package lists before a module installs
+// packages. With the offline repository only its index is read, so an
+// air-gapped install does not wait on the online sources.
+func aptUpdateCommand(ctx CloudConfigContext) string {
+	if ctx.OfflineRepo {
+		return "curtin in-target -- apt-get update -o Dir::Etc::SourceList=/etc/apt/sources.list.d/" + offlineRepoSource +
+			" -o Dir::Etc::SourceParts=- -o APT::Get::List-Cleanup=0"
 	}
+	return "curtin in-target -- apt update"
 }
 
-func getNvidiaCommands() []string {
-	return []string{
-		"curtin in-target -- update-initramfs -u",
-		"curtin in-target -- apt update",
-		"curtin in-target -- bash -c 'DEBIAN_FRONTEND=noninteractive ubuntu-drivers install --gpgpu'",
-		"curtin in-target -- apt update",
-		"curtin in-target -- bash -c 'DEBIAN_FRONTEND=noninteractive apt install -y nvidia-container-toolkit'",
-		"curtin in-target -- nvidia-ctk runtime configure --runtime=docker",
+func getBaseAutoinstall(ctx CloudConfigContext) (autoInstall CloudConfig, payloads []Payload, err error) {
+	if ctx.Hostname == "" {
+		err = fmt.Errorf("a hostname is required")
+		return
+	}
+	storage, err := getStorage(ctx)
+	if err != nil {
+		return
+	}
+	modules, err := resolveModules(ctx)
+	if err != nil {
+		return
+	}
+	if err = validateModuleInputs(ctx, modules); err != nil {
+		return
+	}
+
+	var network *Network
+	if !ctx.Network.IsZero() {
+		config, configErr := ctx.Network.Config()
+		if configErr != nil {
+			err = fmt.Errorf("error in network section: %w", configErr)
+			return
+		}
+		network = &config
+	}
+
+	settings, err := getInstallSettings(ctx)
+	if err != nil {
+		return
+	}
+	apt, err := ctx.Apt.Config()
+	if err != nil {
+		err = fmt.Errorf("error in apt section: %w", err)
+		return
+	}
+	if ctx.OfflineRepo {
+		if apt.Autoinstall == nil {
+			apt.Autoinstall = &AutoInstallApt{}
+		}
+		apt.Autoinstall.Sources = offlineRepoInstallerSources()
 	}
-}
 
-func getBaseAutoinstall(ctx CloudConfigContext) (autoInstall CloudConfig, err error) {
-	ssh := SSH{InstallServer: true}
+	users, groupCommands, err := getUsers(ctx)
+	if err != nil {
+		err = fmt.Errorf("error in users section: %w", err)
+		return
+	}
+
+	ssh := SSH{InstallServer: true, AllowPw: true}
 	if len(ctx.SSHKeys) > 0 {
-		ssh.AllowPw = false
 		ssh.AuthorizedKeys = ctx.SSHKeys
-	} else {
-		ssh.AllowPw = true
+	}
+	for _, user := range users {
+		if len(user.SshAuthorizedKeys) > 0 {
+			ssh.AllowPw = false
+		}
+	}
+
+	renderCtx := RenderContext{CloudConfigContext: ctx}
+	for _, module := range modules {
+		renderCtx.EnabledModules = append(renderCtx.EnabledModules, module.Name())
+	}
+	if len(ctx.PreloadImages) > 0 && !renderCtx.HasModule("docker") {
+		err = fmt.Errorf("preloading images requires the docker module")
+		return
+	}
+	var bundleRecipients []age.Recipient
+	if !ctx.SecretsBundle.IsZero() {
+		if bundleRecipients, err = ctx.SecretsBundle.validate(); err != nil {
+			err = fmt.Errorf("error in secrets-bundle section: %w", err)
+			return
+		}
+		renderCtx.FirstBootSteps = append([]FirstBootStep{openSecretsBundleStep()}, renderCtx.FirstBootSteps...)
+		if ctx.managesHostKeys() {
+			// sshd started with the host keys the installer generated.
+			renderCtx.FirstBootSteps = append([]FirstBootStep{renderCtx.FirstBootSteps[0], restartSSHStep()}, renderCtx.FirstBootSteps[1:]...)
+		}
+	}
+	if renderCtx.HasModule("raid") {
+		if renderCtx.RaidArray, err = ctx.Raid.Array(); err != nil {
+			err = fmt.Errorf("error in raid section: %w", err)
+			return
+		}
+	}
+	if renderCtx.HasModule("disk-alerts") {
+		if renderCtx.DiskAlerts, err = ctx.DiskAlerts.Alerts(ctx.Hostname); err != nil {
+			err = fmt.Errorf("error in disk-alerts section: %w", err)
+			return
+		}
+	}
+	if renderCtx.HasModule("hardening") {
+		if renderCtx.Hardening, err = ctx.Hardening.Resolve(renderCtx, users); err != nil {
+			err = fmt.Errorf("error in hardening section: %w", err)
+			return
+		}
 	}
 
-	earlyCommands, err := getEarlyCommands(ctx)
+	packages := []string{
+		"vim",
+		"curl",
+		"git",
+		"htop",
+		"net-tools",
+		"ca-certificates",
+	}
+	layers, err := fileLayers(ctx, modules)
+	if err != nil {
+		return
+	}
+	files, err := MergeLayers(layers)
 	if err != nil {
 		return
 	}
+	installFiles, err := prepareFiles(renderCtx, files)
+	if err != nil {
+		return
+	}
+	installFiles = append(installFiles, hostKeyFiles(ctx.hostKeys, ctx.Hostname)...)
+	installFiles = append(installFiles, imageFiles(ctx.PreloadImages)...)
+
+	var aptSources []AptSource
+	var offlineRepoCommands []string
+	if ctx.OfflineRepo {
+		var source AptSource
+		offlineRepoCommands, source = getOfflineRepoCommands()
+		aptSources = append(aptSources, source)
+	}
+	if bundleRecipients != nil {
+		packages = append(packages, "age")
+	}
+	for _, pkg := range storage.Packages {
+		if !slices.Contains(packages, pkg) {
+			packages = append(packages, pkg)
+		}
+	}
+	aptSources = append(aptSources, apt.Sources...)
+	aptKeyCommands := apt.LateCommands
+	var moduleCommands []string
+	for _, module := range modules {
+		for _, pkg := range module.Packages(renderCtx) {
+			if !slices.Contains(packages, pkg) {
+				packages = append(packages, pkg)
+			}
+		}
+		// The offline repository carries the packages of the modules'
+		// online sources.
+		if !ctx.OfflineRepo {
+			for _, repository := range module.AptRepositories(renderCtx) {
+				var source AptSource
+				var keyCommand string
+				if source, keyCommand, err = repository.source(); err != nil {
+					err = fmt.Errorf("module %s: apt repository %s: %w", module.Name(), repository.Name, err)
+					return
+				}
+				aptSources = append(aptSources, source)
+				aptKeyCommands = append(aptKeyCommands, keyCommand)
+			}
+		}
+		moduleCommands = append(moduleCommands, module.LateCommands(renderCtx)...)
+		renderCtx.FirstBootSteps = append(renderCtx.FirstBootSteps, module.FirstBootSteps(renderCtx)...)
+	}
+
+	var sourceFiles []string
+	for _, source := range aptSources {
+		if slices.Contains(sourceFiles, source.Filename) {
+			err = fmt.Errorf("apt source %s is written twice, rename the apt repository", source.Filename)
+			return
+		}
+		sourceFiles = append(sourceFiles, source.Filename)
+	}
 
-	lateCommands := []string{
+	delivery, err := deliverFiles(renderCtx, installFiles)
+	if err != nil {
+		return
+	}
+	if err = checkComposeImages(delivery.Contents, ctx.PreloadImages); err != nil {
+		return
+	}
+	var bundleCommands []string
+	if bundleRecipients != nil {
+		if bundleCommands, err = delivery.bundleCommands(renderCtx, bundleRecipients); err != nil {
+			return
+		}
+	}
+
+	payloads = dedupePayloads(append(delivery.Payloads, storage.Payloads...))
+	earlyCommands := append(storage.EarlyCommands, delivery.EarlyCommands...)
+	if len(payloads) > 0 {
+		earlyCommands = append([]string{verifyPayloadsCommand()}, earlyCommands...)
+	}
+
+	lateCommands := append(delivery.LateCommands, bundleCommands...)
+	lateCommands = append(lateCommands,
 		`curtin in-target -- sed -i 's|GRUB_CMDLINE_LINUX_DEFAULT=|GRUB_CMDLINE_LINUX_DEFAULT=\"nosplash usb-storage.quirks=2109:0715:j\" /etc/default/grub'`,
 		"curtin in-target -- update-grub",
+	)
+	lateCommands = append(lateCommands, storage.LateCommands...)
+	// Groups come before the modules, whose packages may create groups of
+	// their own.
+	lateCommands = append(lateCommands, groupCommands...)
+	lateCommands = append(lateCommands, getImageCommands(ctx.PreloadImages)...)
+	lateCommands = append(lateCommands, offlineRepoCommands...)
+	lateCommands = append(lateCommands, aptKeyCommands...)
+	lateCommands = append(lateCommands, getAptSourceCommands(aptSources)...)
+	lateCommands = append(lateCommands, moduleCommands...)
+
+	var sshDeleteKeys *bool
+	if len(ctx.hostKeys) > 0 {
+		sshDeleteKeys = new(bool)
 	}
-	lateCommands = append(lateCommands, getDockerCommands()...)
-	lateCommands = append(lateCommands, getNvidiaCommands()...)
-
-	serialMatch := fmt.Sprintf("*%s*", ctx.DiskSerial)
 
 	autoInstall = CloudConfig{
 		AutoInstall: AutoInstall{
 			Version:  1,
-			Timezone: "Etc/UTC",
-			Locale:   "en_US.UTF-8",
-			Keyboard: AutoInstallKeyboard{Layout: "us"},
+			Timezone: settings.Timezone,
+			Locale:   settings.Locale,
+			Keyboard: settings.Keyboard,
+			Network:  network,
+			Apt:      apt.Autoinstall,
 			UserData: UserData{
-				Hostname: ctx.Hostname,
-				Users: []User{
-					{
-						Name:              "root",
-						Passwd:            ctx.RootPassword,
-						LockPasswd:        false,
-						SshAuthorizedKeys: ctx.SSHKeys,
-					},
-					{
-						Name:              ctx.AdminUsername,
-						Passwd:            ctx.AdminPassword,
-						PrimaryGroup:      ctx.AdminUsername,
-						Groups:            []string{"sudo"},
-						LockPasswd:        false,
-						SshAuthorizedKeys: ctx.SSHKeys,
-						Sudo:              "ALL=(ALL) NOPASSWD:ALL",
-						Shell:             "/bin/bash",
-					},
-				},
-			},
-			Ssh:     ssh,
-			Storage: Storage{Layout: StorageLayout{Name: "lvm", Match: StorageLayoutMatch{Serial: &serialMatch}}},
-			Packages: []string{
-				"vim",
-				"curl",
-				"git",
-				"htop",
-				"net-tools",
-				"mdadm",
-				"ca-certificates",
-				"ubuntu-drivers-common",
-				"build-essential",
-				"dkms",
-				"linux-headers-generic",
+				Hostname:      ctx.Hostname,
+				WriteFiles:    delivery.WriteFiles,
+				Users:         users,
+				SSHDeleteKeys: sshDeleteKeys,
 			},
+			Ssh:           ssh,
+			Storage:       storage.Storage,
+			Packages:      packages,
 			EarlyCommands: earlyCommands,
 			LateCommands:  lateCommands,
-			Shutdown:      "reboot",
+			Shutdown:      settings.Shutdown,
 		},
 	}
 
 	return
 }
 
-func GenerateCloudConfig(ctx CloudConfigContext) (config string, err error) {
-	cfg, err := getBaseAutoinstall(ctx)
+// GenerateCloudConfig renders the cloud-config of a host and the payloads it
+// expects under /payload on the ISO.
+func GenerateCloudConfig(ctx CloudConfigContext) (config string, payloads []Payload, err error) {
+	if ctx.secrets == nil {
+		if _, err = ctx.ResolveSecrets(); err != nil {
+			return
+		}
+	}
+	if _, err = ctx.LoadSSHKeys(); err != nil {
+		return
+	}
+	if ctx.hostKeys == nil {
+		if _, err = ctx.LoadHostKeys(); err != nil {
+			return
+		}
+	}
+	cfg, payloads, err := getBaseAutoinstall(ctx)
 	if err != nil {
 		return
 	}
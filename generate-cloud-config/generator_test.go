@@ -0,0 +1,54 @@
+package generate_cloud_config
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestOfflineRepo(t *testing.T) {
+	for _, offline := range []bool{false, true} {
+		ctx := CloudConfigContext{
+			Hostname:      "host1",
+			AdminUsername: "admin",
+			SSHKeys:       []string{ed25519AuthorizedKey(t)},
+			DiskSerial:    "ABC",
+			Modules:       []string{"docker", "nvidia"},
+			OfflineRepo:   offline,
+		}
+		config, _, err := GenerateCloudConfig(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cfg CloudConfig
+		if err = yaml.Unmarshal([]byte(config), &cfg); err != nil {
+			t.Fatal(err)
+		}
+		commands := strings.Join(cfg.AutoInstall.LateCommands, "\n")
+
+		for _, online := range []string{"docker.sources", "nvidia-container-toolkit.sources", "docker.asc", "-- apt update"} {
+			if got := strings.Contains(commands, online); got == offline {
+				t.Errorf("offline-repo %v: late-commands contain %q is %v, want %v", offline, online, got, !offline)
+			}
+		}
+		if strings.Contains(commands, "SourceList=/etc/apt/sources.list.d/"+offlineRepoSource) != offline {
+			t.Errorf("offline-repo %v: the package lists are not read from the offline repository", offline)
+		}
+
+		var installerSource string
+		if cfg.AutoInstall.Apt != nil {
+			installerSource = cfg.AutoInstall.Apt.Sources[offlineRepoInstallerSource].Source
+		}
+		want := ""
+		if offline {
+			want = "deb [signed-by=/cdrom/apt/archive-keyring.gpg] file:///cdrom/apt ./"
+		}
+		if installerSource != want {
+			t.Errorf("offline-repo %v: got installer source %q, want %q", offline, installerSource, want)
+		}
+		if strings.Contains(commands, "rm -f /target/etc/apt/sources.list.d/"+offlineRepoInstallerSource) != offline {
+			t.Errorf("offline-repo %v: the installer source is not removed from the target", offline)
+		}
+	}
+}
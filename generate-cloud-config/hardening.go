@@ -0,0 +1,293 @@
+package generate_cloud_config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	// HardeningLevel1 holds the controls that suit every host.
+	HardeningLevel1 = "level-1"
+	// HardeningLevel2 adds the controls that may get in the way of some
+	// uses, such as disabling ssh password logins and locking the audit
+	// rules until the next boot.
+	HardeningLevel2 = "level-2"
+
+	defaultMaxAuthTries      = 4
+	defaultPasswordMinLength = 14
+	defaultBanner            = "Authorized uses only. All activity may be monitored and reported.\n"
+
+	// pwqualityConf holds the password policy of PWD-01.
+	pwqualityConf = "/etc/security/pwquality.conf.d/60-hardening.conf"
+)
+
+// HardeningSpec is the hardening section of a host spec. The controls of the
+// profile are applied by the hardening module and checked on the installed
+// system by hardening-report, which prints the result of every control by its
+// identifier.
+type HardeningSpec struct {
+	// Profile is level-1, the default, or level-2, which includes level-1.
+	Profile string `yaml:"profile"`
+	// Exclude are the identifiers of controls not to apply, such as SSH-06.
+	Exclude []string `yaml:"exclude"`
+	// AllowGroups are the groups whose members may log in over ssh. Without
+	// them every user may.
+	AllowGroups []string `yaml:"allow-groups"`
+	// MaxAuthTries are the ssh authentication attempts per connection, 4 by
+	// default.
+	MaxAuthTries int `yaml:"max-auth-tries"`
+	// Banner is shown before console and ssh logins.
+	Banner string `yaml:"banner"`
+	// PasswordMinLength is the shortest password a user may set, 14 by
+	// default.
+	PasswordMinLength int `yaml:"password-min-length"`
+}
+
+// HardeningControl is a hardening measure with the identifier it is reported
+// by. The sshd options, sysctl settings and audit rules of the controls are
+// rendered into the module's files. Check is a shell command that succeeds on
+// a system that complies with the control.
+type HardeningControl struct {
+	ID         string
+	Level      int
+	Title      string
+	SSHD       []string
+	Sysctls    []string
+	AuditRules []string
+	Check      string
+}
+
+// SkippedControl is a control of the profile that is not applied.
+type SkippedControl struct {
+	HardeningControl
+	Reason string
+}
+
+// Hardening is the hardening section resolved into the controls of the
+// profile, as the module's files are rendered with it.
+type Hardening struct {
+	Profile  string
+	Controls []HardeningControl
+	Skipped  []SkippedControl
+	// PasswordMinLength and Banner are the values of the PWD-01 and BNR-01
+	// controls.
+	PasswordMinLength int
+	Banner            string
+}
+
+// Has reports whether the control with the given identifier is applied.
+func (h Hardening) Has(id string) bool {
+	return slices.ContainsFunc(h.Controls, func(control HardeningControl) bool { return control.ID == id })
+}
+
+const (
+	sshCiphers = "chacha20-poly1305@openssh.com,aes256-gcm@openssh.com,aes128-gcm@openssh.com,aes256-ctr,aes192-ctr,aes128-ctr"
+	sshMACs    = "hmac-sha2-512-etm@openssh.com,hmac-sha2-256-etm@openssh.com,umac-128-etm@openssh.com"
+	sshKex     = "sntrup761x25519-sha512@openssh.com,curve25519-sha256,curve25519-sha256@libssh.org,diffie-hellman-group16-sha512,diffie-hellman-group18-sha512,diffie-hellman-group-exchange-sha256"
+)
+
+// hardeningControls returns every control in the order it is applied and
+// reported, with the options of spec, whose defaults are filled in.
+func hardeningControls(spec HardeningSpec) []HardeningControl {
+	controls := []HardeningControl{
+		{ID: "SSH-01", Level: 1, Title: "Disable root login over ssh", SSHD: []string{"PermitRootLogin no"}},
+		{ID: "SSH-02", Level: 1, Title: "Limit ssh authentication attempts", SSHD: []string{fmt.Sprintf("MaxAuthTries %d", spec.MaxAuthTries)}},
+		{ID: "SSH-03", Level: 1, Title: "Restrict ssh ciphers to authenticated and counter modes", SSHD: []string{"Ciphers " + sshCiphers}},
+		{ID: "SSH-04", Level: 1, Title: "Restrict ssh MACs to encrypt-then-MAC SHA-2 and UMAC", SSHD: []string{"MACs " + sshMACs}},
+		{ID: "SSH-05", Level: 1, Title: "Restrict ssh key exchange to curve25519 and large DH groups", SSHD: []string{"KexAlgorithms " + sshKex}},
+		{
+			ID: "SSH-06", Level: 1, Title: "Allow ssh logins only to members of the allowed groups",
+			SSHD:  []string{"AllowGroups " + strings.Join(spec.AllowGroups, " ")},
+			Check: sshdGroupsCheck(spec.AllowGroups),
+		},
+		{ID: "SSH-07", Level: 1, Title: "Disable empty passwords and host-based authentication over ssh", SSHD: []string{"PermitEmptyPasswords no", "HostbasedAuthentication no", "IgnoreRhosts yes"}},
+		{ID: "SSH-08", Level: 1, Title: "Disable X11 forwarding over ssh", SSHD: []string{"X11Forwarding no"}},
+		{ID: "SSH-09", Level: 1, Title: "Drop idle and unauthenticated ssh connections", SSHD: []string{"LoginGraceTime 60", "ClientAliveInterval 300", "ClientAliveCountMax 3"}},
+		{ID: "SSH-10", Level: 2, Title: "Disable password logins over ssh", SSHD: []string{"PasswordAuthentication no", "KbdInteractiveAuthentication no"}},
+		{ID: "SSH-11", Level: 2, Title: "Disable TCP and agent forwarding over ssh", SSHD: []string{"AllowTcpForwarding no", "AllowAgentForwarding no"}},
+
+		{ID: "NET-01", Level: 1, Title: "Disable IP forwarding", Sysctls: []string{"net.ipv4.ip_forward=0", "net.ipv6.conf.all.forwarding=0"}},
+		{ID: "NET-02", Level: 1, Title: "Do not send ICMP redirects", Sysctls: []string{"net.ipv4.conf.all.send_redirects=0", "net.ipv4.conf.default.send_redirects=0"}},
+		{ID: "NET-03", Level: 1, Title: "Reject source-routed packets", Sysctls: []string{
+			"net.ipv4.conf.all.accept_source_route=0", "net.ipv4.conf.default.accept_source_route=0",
+			"net.ipv6.conf.all.accept_source_route=0", "net.ipv6.conf.default.accept_source_route=0",
+		}},
+		{ID: "NET-04", Level: 1, Title: "Ignore ICMP redirects", Sysctls: []string{
+			"net.ipv4.conf.all.accept_redirects=0", "net.ipv4.conf.default.accept_redirects=0",
+			"net.ipv4.conf.all.secure_redirects=0", "net.ipv4.conf.default.secure_redirects=0",
+			"net.ipv6.conf.all.accept_redirects=0", "net.ipv6.conf.default.accept_redirects=0",
+		}},
+		{ID: "NET-05", Level: 1, Title: "Log packets with impossible addresses", Sysctls: []string{"net.ipv4.conf.all.log_martians=1", "net.ipv4.conf.default.log_martians=1"}},
+		{ID: "NET-06", Level: 1, Title: "Ignore broadcast pings and bogus ICMP errors", Sysctls: []string{"net.ipv4.icmp_echo_ignore_broadcasts=1", "net.ipv4.icmp_ignore_bogus_error_responses=1"}},
+		{ID: "NET-07", Level: 1, Title: "Enable reverse path filtering", Sysctls: []string{"net.ipv4.conf.all.rp_filter=1", "net.ipv4.conf.default.rp_filter=1"}},
+		{ID: "NET-08", Level: 1, Title: "Enable TCP SYN cookies", Sysctls: []string{"net.ipv4.tcp_syncookies=1"}},
+		{ID: "NET-09", Level: 2, Title: "Ignore IPv6 router advertisements", Sysctls: []string{"net.ipv6.conf.all.accept_ra=0", "net.ipv6.conf.default.accept_ra=0"}},
+
+		{ID: "AUD-01", Level: 1, Title: "Run auditd", Check: "systemctl is-active --quiet auditd.service"},
+		{ID: "AUD-02", Level: 1, Title: "Audit changes of the system time", AuditRules: []string{
+			"-a always,exit -F arch=b64 -S adjtimex,settimeofday,clock_settime -k time-change",
+			"-a always,exit -F arch=b32 -S adjtimex,settimeofday,clock_settime -k time-change",
+			"-w /etc/localtime -p wa -k time-change",
+		}},
+		{ID: "AUD-03", Level: 1, Title: "Audit changes of users and groups", AuditRules: []string{
+			"-w /etc/passwd -p wa -k identity", "-w /etc/group -p wa -k identity",
+			"-w /etc/shadow -p wa -k identity", "-w /etc/gshadow -p wa -k identity",
+			"-w /etc/security/opasswd -p wa -k identity",
+		}},
+		{ID: "AUD-04", Level: 1, Title: "Audit changes of the sudo rules", AuditRules: []string{"-w /etc/sudoers -p wa -k scope", "-w /etc/sudoers.d -p wa -k scope"}},
+		{ID: "AUD-05", Level: 1, Title: "Audit logins", AuditRules: []string{"-w /var/log/lastlog -p wa -k logins", "-w /var/run/faillock -p wa -k logins"}},
+		{ID: "AUD-06", Level: 1, Title: "Audit changes of the ssh server configuration", AuditRules: []string{"-w /etc/ssh/sshd_config -p wa -k sshd", "-w /etc/ssh/sshd_config.d -p wa -k sshd"}},
+		{ID: "AUD-07", Level: 2, Title: "Audit kernel module loading", AuditRules: []string{
+			"-a always,exit -F arch=b64 -S init_module,finit_module,delete_module -k modules",
+			"-w /usr/bin/kmod -p x -k modules",
+		}},
+		{ID: "AUD-08", Level: 2, Title: "Lock the audit rules until the next boot", Check: "auditctl -s | grep -qx 'enabled 2'"},
+
+		{
+			ID: "BNR-01", Level: 1, Title: "Show a login banner on the console and over ssh", SSHD: []string{"Banner /etc/issue.net"},
+			// The banner must not give away the release as Ubuntu's escapes do.
+			Check: "sshd -T | grep -qix 'banner /etc/issue.net' && ! grep -q '\\\\[mrsv]' /etc/issue /etc/issue.net",
+		},
+
+		{
+			ID: "PWD-01", Level: 1, Title: "Require long passwords of every character class",
+			Check: fmt.Sprintf("grep -qs pam_pwquality /etc/pam.d/common-password && grep -qx 'minlen = %d' %s", spec.PasswordMinLength, pwqualityConf),
+		},
+		{ID: "PWD-02", Level: 2, Title: "Expire passwords after a year", Check: "grep -Eq '^PASS_MAX_DAYS[[:space:]]+365$' /etc/login.defs"},
+	}
+
+	for i, control := range controls {
+		if control.Check != "" {
+			continue
+		}
+		var checks []string
+		for _, option := range control.SSHD {
+			checks = append(checks, fmt.Sprintf("sshd -T | grep -qix %s", shellQuote(option)))
+		}
+		for _, setting := range control.Sysctls {
+			key, value, _ := strings.Cut(setting, "=")
+			checks = append(checks, fmt.Sprintf(`[ "$(sysctl -n %s)" = %s ]`, key, value))
+		}
+		if len(control.AuditRules) > 0 {
+			// The rules of a control share their key.
+			rule := control.AuditRules[0]
+			key := rule[strings.LastIndex(rule, " -k ")+len(" -k "):]
+			checks = append(checks, fmt.Sprintf("auditctl -l | grep -Eq -- '(-k |key=)%s( |$)'", key))
+		}
+		controls[i].Check = strings.Join(checks, " && ")
+	}
+	return controls
+}
+
+// sshdGroupsCheck checks that sshd allows exactly the given groups. sshd -T
+// prints every allowed group on a line of its own.
+func sshdGroupsCheck(groups []string) string {
+	var lines []string
+	for _, group := range groups {
+		lines = append(lines, "allowgroups "+group)
+	}
+	slices.Sort(lines)
+	return fmt.Sprintf(`[ "$(sshd -T | grep -i '^allowgroups ' | sort)" = %s ]`, shellQuote(strings.Join(lines, "\n")))
+}
+
+// Resolve validates the hardening section and selects the controls of the
+// profile. users are the accounts of the host, which must keep a way to log
+// in over ssh.
+func (s HardeningSpec) Resolve(ctx RenderContext, users []User) (hardening Hardening, err error) {
+	hardening = Hardening{Profile: firstNonEmpty(s.Profile, HardeningLevel1)}
+	level := 1
+	switch hardening.Profile {
+	case HardeningLevel1:
+	case HardeningLevel2:
+		level = 2
+	default:
+		return hardening, fmt.Errorf("unknown profile %q, expected %s or %s", s.Profile, HardeningLevel1, HardeningLevel2)
+	}
+
+	if s.MaxAuthTries == 0 {
+		s.MaxAuthTries = defaultMaxAuthTries
+	}
+	if s.MaxAuthTries < 1 {
+		return hardening, fmt.Errorf("max-auth-tries must be at least 1")
+	}
+	if s.PasswordMinLength == 0 {
+		s.PasswordMinLength = defaultPasswordMinLength
+	}
+	if s.PasswordMinLength < 8 {
+		return hardening, fmt.Errorf("password-min-length must be at least 8")
+	}
+	hardening.PasswordMinLength = s.PasswordMinLength
+	hardening.Banner = firstNonEmpty(s.Banner, defaultBanner)
+	if !strings.HasSuffix(hardening.Banner, "\n") {
+		hardening.Banner += "\n"
+	}
+	for _, group := range s.AllowGroups {
+		if !accountName.MatchString(group) {
+			return hardening, fmt.Errorf("invalid allow-groups group %q", group)
+		}
+	}
+
+	controls := hardeningControls(s)
+	for _, id := range s.Exclude {
+		if !slices.ContainsFunc(controls, func(control HardeningControl) bool { return control.ID == id }) {
+			return hardening, fmt.Errorf("unknown control %s in exclude", id)
+		}
+	}
+	for _, control := range controls {
+		if control.Level > level {
+			continue
+		}
+		reason := ""
+		switch {
+		case slices.Contains(s.Exclude, control.ID):
+			reason = "excluded by the host spec"
+		case control.ID == "SSH-06" && len(s.AllowGroups) == 0:
+			reason = "no allow-groups are given"
+		case control.ID == "NET-01" && ctx.HasModule("docker"):
+			reason = "docker forwards the traffic of its containers"
+		}
+		if reason != "" {
+			hardening.Skipped = append(hardening.Skipped, SkippedControl{HardeningControl: control, Reason: reason})
+			continue
+		}
+		hardening.Controls = append(hardening.Controls, control)
+	}
+
+	// The ssh controls must leave a user who can log in.
+	canLogIn := func(user User, needsKey bool) bool {
+		if user.Name == "root" && hardening.Has("SSH-01") {
+			return false
+		}
+		if len(user.SshAuthorizedKeys) == 0 && (needsKey || user.LockPasswd) {
+			return false
+		}
+		if !hardening.Has("SSH-06") {
+			return true
+		}
+		groups := append([]string{firstNonEmpty(user.PrimaryGroup, user.Name)}, user.Groups...)
+		return slices.ContainsFunc(groups, func(group string) bool { return slices.Contains(s.AllowGroups, group) })
+	}
+	if !slices.ContainsFunc(users, func(user User) bool { return canLogIn(user, hardening.Has("SSH-10")) }) {
+		if hardening.Has("SSH-10") {
+			return hardening, fmt.Errorf("nobody could log in over ssh: SSH-10 disables password logins and no user with an ssh key is allowed to log in")
+		}
+		return hardening, fmt.Errorf("nobody could log in over ssh: no user with a password or an ssh key is allowed to log in")
+	}
+	return hardening, nil
+}
+
+// hardeningLateCommands applies the controls that change files of the
+// installed system rather than adding their own.
+func hardeningLateCommands(ctx RenderContext) (commands []string) {
+	if ctx.Hardening.Has("BNR-01") {
+		commands = append(commands, writeFileCommands(targetRoot, "/etc/issue", []byte(ctx.Hardening.Banner), 0644)...)
+		commands = append(commands, writeFileCommands(targetRoot, "/etc/issue.net", []byte(ctx.Hardening.Banner), 0644)...)
+	}
+	if ctx.Hardening.Has("PWD-02") {
+		commands = append(commands,
+			`curtin in-target -- sed -i -E 's/^(PASS_MAX_DAYS)[[:space:]].*/\1 365/; s/^(PASS_MIN_DAYS)[[:space:]].*/\1 1/; s/^(PASS_WARN_AGE)[[:space:]].*/\1 7/' /etc/login.defs`,
+		)
+	}
+	return
+}
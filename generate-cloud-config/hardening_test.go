@@ -0,0 +1,173 @@
+package generate_cloud_config
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// hardeningUsers are the accounts of a host with an ssh key.
+var hardeningUsers = []User{
+	{Name: "root", LockPasswd: true},
+	{Name: "admin", PrimaryGroup: "admin", Groups: []string{"sudo"}, LockPasswd: true, SshAuthorizedKeys: []string{"ssh-ed25519 AAAA"}},
+}
+
+func TestHardeningResolve(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    HardeningSpec
+		modules []string
+		users   []User
+		has     []string
+		skipped []string
+		err     string
+	}{
+		{
+			name:    "level-1 by default",
+			has:     []string{"SSH-01", "NET-01", "AUD-06", "BNR-01", "PWD-01"},
+			skipped: []string{"SSH-06"},
+		},
+		{
+			name:    "level-2 with allowed groups",
+			spec:    HardeningSpec{Profile: HardeningLevel2, AllowGroups: []string{"sudo"}, Exclude: []string{"NET-09"}},
+			modules: []string{"docker"},
+			has:     []string{"SSH-06", "SSH-10", "AUD-08", "PWD-02"},
+			skipped: []string{"NET-01", "NET-09"},
+		},
+		{
+			name: "unknown profile",
+			spec: HardeningSpec{Profile: "level-3"},
+			err:  "unknown profile",
+		},
+		{
+			name: "unknown control",
+			spec: HardeningSpec{Exclude: []string{"SSH-99"}},
+			err:  "unknown control SSH-99",
+		},
+		{
+			name: "admin not in the allowed groups",
+			spec: HardeningSpec{AllowGroups: []string{"ssh-users"}},
+			err:  "nobody could log in over ssh",
+		},
+		{
+			name:  "level-2 without ssh keys",
+			spec:  HardeningSpec{Profile: HardeningLevel2},
+			users: []User{{Name: "root"}, {Name: "admin", Passwd: "$6$salt$hash"}},
+			err:   "SSH-10 disables password logins",
+		},
+		{
+			name:    "level-2 without ssh keys and SSH-10",
+			spec:    HardeningSpec{Profile: HardeningLevel2, Exclude: []string{"SSH-10"}},
+			users:   []User{{Name: "root"}, {Name: "admin", Passwd: "$6$salt$hash"}},
+			has:     []string{"SSH-11"},
+			skipped: []string{"SSH-06", "SSH-10"},
+		},
+	}
+	for _, test := range tests {
+		users := test.users
+		if users == nil {
+			users = hardeningUsers
+		}
+		hardening, err := test.spec.Resolve(RenderContext{EnabledModules: append(test.modules, "hardening")}, users)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want one containing %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		for _, id := range test.has {
+			if !hardening.Has(id) {
+				t.Errorf("%s: control %s is not applied", test.name, id)
+			}
+		}
+		var skipped []string
+		for _, control := range hardening.Skipped {
+			skipped = append(skipped, control.ID)
+		}
+		if strings.Join(skipped, " ") != strings.Join(test.skipped, " ") {
+			t.Errorf("%s: got skipped controls %q, want %q", test.name, skipped, test.skipped)
+		}
+	}
+}
+
+// TestHardeningReport checks that the files of the hardening module satisfy
+// the checks of hardening-report. sshd, sysctl and auditctl are replaced by
+// scripts that answer from the rendered files.
+func TestHardeningReport(t *testing.T) {
+	spec := HardeningSpec{
+		Profile:     HardeningLevel2,
+		AllowGroups: []string{"sudo", "admin"},
+		// They check files outside the module.
+		Exclude: []string{"BNR-01", "PWD-01", "PWD-02"},
+	}
+	renderCtx := RenderContext{
+		CloudConfigContext: CloudConfigContext{Hostname: "host1", AdminUsername: "admin"},
+		EnabledModules:     []string{"docker", "hardening"},
+	}
+	hardening, err := spec.Resolve(renderCtx, hardeningUsers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	renderCtx.Hardening = hardening
+	module, _ := lookupModule("hardening")
+	files, err := MergeLayers([]FileLayer{{Name: "module:hardening", FS: module.Files()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	installFiles, err := prepareFiles(renderCtx, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery, err := deliverFiles(renderCtx, installFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	for target, contents := range delivery.Contents {
+		if err = os.MkdirAll(filepath.Join(dir, filepath.Dir(target)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(filepath.Join(dir, target), contents, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bin := t.TempDir()
+	scripts := map[string]string{
+		"sshd": "#!/bin/sh\nawk '!/^#/ && NF { k = tolower($1); if (k == \"allowgroups\") { for (i = 2; i <= NF; i++) print k \" \" $i } else { $1 = k; print } }' " +
+			shellQuote(filepath.Join(dir, "etc/ssh/sshd_config.d/10-hardening.conf")) + "\n",
+		"sysctl": "#!/bin/sh\nawk -F= -v key=\"$2\" '$1 == key { print $2 }' " + shellQuote(filepath.Join(dir, "etc/sysctl.d/60-hardening.conf")) + "\n",
+		"auditctl": "#!/bin/sh\nif [ \"$1\" = -s ]; then\n    grep -qx -- '-e 2' " + shellQuote(filepath.Join(dir, "etc/audit/rules.d/99-finalize.rules")) + " && echo 'enabled 2'\n" +
+			"else\n    grep '^-' " + shellQuote(filepath.Join(dir, "etc/audit/rules.d/60-hardening.rules")) + "\nfi\n",
+		"systemctl": "#!/bin/sh\n",
+	}
+	for name, script := range scripts {
+		if err = os.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := exec.Command(filepath.Join(dir, "usr/local/sbin/hardening-report"))
+	cmd.Env = append(os.Environ(), "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Errorf("hardening-report failed: %v\n%s", err, out)
+	}
+	report := string(out)
+	for _, control := range hardening.Controls {
+		if !strings.Contains(report, control.ID+"\tpass\t") {
+			t.Errorf("control %s does not pass:\n%s", control.ID, report)
+		}
+	}
+	for _, line := range []string{"NET-01\tskip\t", "BNR-01\tskip\t"} {
+		if !strings.Contains(report, line) {
+			t.Errorf("report does not list %q:\n%s", line, report)
+		}
+	}
+}
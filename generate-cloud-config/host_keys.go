@@ -0,0 +1,261 @@
+package generate_cloud_config
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hostKeysLayer names the generated host keys in errors about files.
+const hostKeysLayer = "host keys"
+
+// hostKeyTypes are the types of the host keys, named as in
+// /etc/ssh/ssh_host_<type>_key.
+var hostKeyTypes = []string{"ed25519", "ecdsa", "rsa"}
+
+// hostKeyAlgorithms are the public key algorithms of hostKeyTypes.
+var hostKeyAlgorithms = map[string][]string{
+	"ed25519": {ssh.KeyAlgoED25519},
+	"ecdsa":   {ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521},
+	"rsa":     {ssh.KeyAlgoRSA},
+}
+
+// sshfpAlgorithms are the SSHFP algorithm numbers of hostKeyTypes (RFC 4255,
+// RFC 6594 and RFC 7479).
+var sshfpAlgorithms = map[string]int{"rsa": 1, "ecdsa": 3, "ed25519": 4}
+
+// HostKey is an ssh host key of the host.
+type HostKey struct {
+	// Type is ed25519, ecdsa or rsa.
+	Type string
+	// Private is the private key file as sshd reads it.
+	Private []byte
+	Public  ssh.PublicKey
+}
+
+// fileName returns the name of the private key file in /etc/ssh and in the
+// host keys dir. The public key file adds .pub.
+func (k HostKey) fileName() string {
+	return "ssh_host_" + k.Type + "_key"
+}
+
+// managesHostKeys reports whether the host keys are generated instead of
+// being left to the installed system.
+func (c CloudConfigContext) managesHostKeys() bool {
+	return c.HostKeysDir != "" || c.GenerateHostKeys
+}
+
+// LoadHostKeys reads the host keys from the host keys dir and generates the
+// ones that are missing, saving them to the dir so the next install reuses
+// them. Without a dir the keys are generated for this install only. It
+// returns the types of the generated keys. GenerateCloudConfig calls it when
+// it has not been called yet, so calling it first is only needed for the
+// known_hosts lines and SSHFP records.
+func (c *CloudConfigContext) LoadHostKeys() (generated []string, err error) {
+	c.hostKeys = nil
+	if !c.managesHostKeys() {
+		return nil, nil
+	}
+	if c.Hostname == "" {
+		return nil, fmt.Errorf("a hostname is required")
+	}
+	if _, err = c.knownHostsNames(); err != nil {
+		return nil, err
+	}
+
+	dir := expandHome(c.HostKeysDir)
+	if dir != "" {
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("error creating host keys dir %s: %w", dir, err)
+		}
+	}
+	for _, keyType := range hostKeyTypes {
+		key := HostKey{Type: keyType}
+		keyPath := filepath.Join(dir, key.fileName())
+		if dir != "" {
+			key.Private, err = os.ReadFile(keyPath)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("error reading host key %s: %w", keyPath, err)
+			}
+		}
+
+		if key.Private != nil {
+			if key.Public, err = parseHostKey(keyType, key.Private); err != nil {
+				return nil, fmt.Errorf("host key %s: %w", keyPath, err)
+			}
+		} else {
+			if key, err = generateHostKey(keyType, "root@"+c.Hostname); err != nil {
+				return nil, err
+			}
+			generated = append(generated, keyType)
+			if dir != "" {
+				if err = writeHostKey(keyPath, key, "root@"+c.Hostname); err != nil {
+					return nil, err
+				}
+			}
+		}
+		c.hostKeys = append(c.hostKeys, key)
+	}
+	return generated, nil
+}
+
+// parseHostKey returns the public key of a private key file of the given
+// type.
+func parseHostKey(keyType string, private []byte) (ssh.PublicKey, error) {
+	signer, err := ssh.ParsePrivateKey(private)
+	var missingPassphrase *ssh.PassphraseMissingError
+	if errors.As(err, &missingPassphrase) {
+		return nil, fmt.Errorf("is encrypted, sshd cannot read a host key with a passphrase")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("is not a private key: %w", err)
+	}
+	if algorithm := signer.PublicKey().Type(); !slices.Contains(hostKeyAlgorithms[keyType], algorithm) {
+		return nil, fmt.Errorf("is a %s key, expected %s", algorithm, keyType)
+	}
+	return signer.PublicKey(), nil
+}
+
+// generateHostKey generates a host key as ssh-keygen -A would.
+func generateHostKey(keyType, comment string) (key HostKey, err error) {
+	var private crypto.Signer
+	switch keyType {
+	case "ed25519":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case "ecdsa":
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		private, err = rsa.GenerateKey(rand.Reader, minRSABits)
+	default:
+		return key, fmt.Errorf("unknown host key type %s", keyType)
+	}
+	if err != nil {
+		return key, fmt.Errorf("error generating %s host key: %w", keyType, err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(private, comment)
+	if err != nil {
+		return key, fmt.Errorf("error encoding %s host key: %w", keyType, err)
+	}
+	public, err := ssh.NewPublicKey(private.Public())
+	if err != nil {
+		return key, fmt.Errorf("error encoding %s host key: %w", keyType, err)
+	}
+	return HostKey{Type: keyType, Private: pem.EncodeToMemory(block), Public: public}, nil
+}
+
+// writeHostKey saves a generated key and its public key to the host keys dir.
+func writeHostKey(keyPath string, key HostKey, comment string) error {
+	if err := os.WriteFile(keyPath, key.Private, 0600); err != nil {
+		return fmt.Errorf("error writing host key %s: %w", keyPath, err)
+	}
+	if err := os.WriteFile(keyPath+".pub", []byte(authorizedKeyLine(key.Public, comment)+"\n"), 0644); err != nil {
+		return fmt.Errorf("error writing host key %s.pub: %w", keyPath, err)
+	}
+	return nil
+}
+
+// authorizedKeyLine returns a public key as ssh writes it to key files, with
+// an optional comment.
+func authorizedKeyLine(key ssh.PublicKey, comment string) string {
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	if comment != "" {
+		line += " " + comment
+	}
+	return line
+}
+
+// hostKeyFiles returns the host keys as files of /etc/ssh. The private keys
+// carry a secret, so they go into the secrets bundle of hosts that have one.
+func hostKeyFiles(keys []HostKey, hostname string) (files []installFile) {
+	for _, key := range keys {
+		target := path.Join("/etc/ssh", key.fileName())
+		files = append(files,
+			installFile{
+				MergedFile: MergedFile{Path: target, Source: key.fileName(), Layer: hostKeysLayer},
+				Target:     target,
+				Body:       key.Private,
+				Meta:       FileMetadata{Mode: "0600", Phase: PhaseTarget, Secret: true},
+			},
+			installFile{
+				MergedFile: MergedFile{Path: target + ".pub", Source: key.fileName() + ".pub", Layer: hostKeysLayer},
+				Target:     target + ".pub",
+				Body:       []byte(authorizedKeyLine(key.Public, "root@"+hostname) + "\n"),
+				Meta:       FileMetadata{Mode: "0644", Phase: PhaseTarget},
+			},
+		)
+	}
+	return
+}
+
+// knownHostsNames returns the names and addresses the host is reached by: the
+// known-hosts-names or the hostname, and the static addresses of the network
+// section.
+func (c CloudConfigContext) knownHostsNames() (names []string, err error) {
+	names = slices.Clone(c.KnownHostsNames)
+	if len(names) == 0 {
+		names = []string{c.Hostname}
+	}
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, " \t\n,#") {
+			return nil, fmt.Errorf("invalid known-hosts name %q", name)
+		}
+	}
+	for _, address := range c.Network.staticAddresses() {
+		if !slices.Contains(names, address) {
+			names = append(names, address)
+		}
+	}
+	return names, nil
+}
+
+// KnownHosts returns the known_hosts lines of the host keys loaded by
+// LoadHostKeys.
+func (c CloudConfigContext) KnownHosts() string {
+	names, _ := c.knownHostsNames()
+	var out strings.Builder
+	for _, key := range c.hostKeys {
+		fmt.Fprintf(&out, "%s %s\n", strings.Join(names, ","), authorizedKeyLine(key.Public, ""))
+	}
+	return out.String()
+}
+
+// SSHFPRecords returns the SSHFP records of the host keys loaded by
+// LoadHostKeys for every name that is not an address, in zone file syntax as
+// ssh-keygen -r prints them.
+func (c CloudConfigContext) SSHFPRecords() string {
+	names, _ := c.knownHostsNames()
+	var out strings.Builder
+	for _, name := range names {
+		if _, err := netip.ParseAddr(name); err == nil {
+			continue
+		}
+		for _, key := range c.hostKeys {
+			wire := key.Public.Marshal()
+			fmt.Fprintf(&out, "%s IN SSHFP %d 1 %x\n", name, sshfpAlgorithms[key.Type], sha1.Sum(wire))
+			fmt.Fprintf(&out, "%s IN SSHFP %d 2 %x\n", name, sshfpAlgorithms[key.Type], sha256.Sum256(wire))
+		}
+	}
+	return out.String()
+}
+
+// restartSSHStep makes sshd serve the host keys of the secrets bundle.
+func restartSSHStep() FirstBootStep {
+	return FirstBootStep{Description: "Restarting sshd with the host keys", Command: "systemctl try-restart ssh.service"}
+}
@@ -0,0 +1,117 @@
+package generate_cloud_config
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"gopkg.in/yaml.v3"
+)
+
+func TestLoadHostKeys(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "host1")
+	ctx := CloudConfigContext{
+		Hostname:        "host1",
+		HostKeysDir:     dir,
+		KnownHostsNames: []string{"host1.lan"},
+		Network: Network{Ethernets: map[string]Ethernet{
+			"eno1": {InterfaceConfig: InterfaceConfig{Addresses: []string{"192.168.1.10/24", "fd00::10/64"}}},
+		}},
+	}
+	generated, err := ctx.LoadHostKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(generated, " ") != "ed25519 ecdsa rsa" {
+		t.Errorf("got generated host keys %q, want all types", generated)
+	}
+	info, err := os.Stat(filepath.Join(dir, "ssh_host_ed25519_key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("private host key has mode %v, want 0600", info.Mode().Perm())
+	}
+
+	knownHosts := ctx.KnownHosts()
+	lines := strings.Split(strings.TrimSpace(knownHosts), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "host1.lan,192.168.1.10,fd00::10 ssh-ed25519 ") {
+		t.Errorf("got known_hosts lines %q", knownHosts)
+	}
+	records := ctx.SSHFPRecords()
+	if strings.Count(records, "host1.lan IN SSHFP ") != 6 || strings.Contains(records, "192.168.1.10") {
+		t.Errorf("got SSHFP records %q, want two per key for the name only", records)
+	}
+
+	reloaded := ctx
+	if generated, err = reloaded.LoadHostKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if len(generated) != 0 || reloaded.KnownHosts() != knownHosts {
+		t.Errorf("host keys are not reused from the host keys dir, generated %q", generated)
+	}
+
+	if err = os.Rename(filepath.Join(dir, "ssh_host_ed25519_key"), filepath.Join(dir, "ssh_host_rsa_key")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = reloaded.LoadHostKeys(); err == nil || !strings.Contains(err.Error(), "is a ssh-ed25519 key, expected rsa") {
+		t.Errorf("got error %v, want one about the key type", err)
+	}
+}
+
+// inlineFile matches the contents of a file written by a late-command.
+var inlineFile = regexp.MustCompile(`echo "([A-Za-z0-9+/=]+)" \| base64 -d`)
+
+func TestHostKeysInSecretsBundle(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := CloudConfigContext{
+		Hostname:         "host1",
+		AdminUsername:    "admin",
+		SSHKeys:          []string{ed25519AuthorizedKey(t)},
+		DiskSerial:       "ABC",
+		Modules:          []string{"docker"},
+		GenerateHostKeys: true,
+		SecretsBundle:    SecretsBundleSpec{Recipients: []string{identity.Recipient().String()}},
+		InlineThreshold:  -1,
+	}
+	if _, err = ctx.LoadHostKeys(); err != nil {
+		t.Fatal(err)
+	}
+	config, _, err := GenerateCloudConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg CloudConfig
+	if err = yaml.Unmarshal([]byte(config), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if deleteKeys := cfg.AutoInstall.UserData.SSHDeleteKeys; deleteKeys == nil || *deleteKeys {
+		t.Errorf("cloud-init replaces the host keys at first boot")
+	}
+	for _, key := range ctx.hostKeys {
+		if strings.Contains(config, b64enc(string(key.Private))) {
+			t.Errorf("the private %s host key is in the cloud-config", key.Type)
+		}
+		if !strings.Contains(config, b64enc(authorizedKeyLine(key.Public, "root@host1")+"\n")) {
+			t.Errorf("the public %s host key is not in the cloud-config", key.Type)
+		}
+	}
+	restarted := false
+	for _, match := range inlineFile.FindAllStringSubmatch(config, -1) {
+		contents, err := base64.StdEncoding.DecodeString(match[1])
+		if err == nil && strings.Contains(string(contents), "systemctl try-restart ssh.service") {
+			restarted = true
+		}
+	}
+	if !restarted {
+		t.Errorf("sshd is not restarted after the bundle is opened")
+	}
+}
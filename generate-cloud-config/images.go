@@ -0,0 +1,181 @@
+package generate_cloud_config
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/hunoz/ubuntu-iso-builder/images"
+	"gopkg.in/yaml.v3"
+)
+
+// preloadedImagesDir holds the image archives in the installed system until
+// preload-images.service loads them at first boot.
+const preloadedImagesDir = "/var/lib/iso-builder/images"
+
+// composeFileNames are the file names docker compose looks for.
+var composeFileNames = []string{"compose.yaml", "compose.yml", "docker-compose.yaml", "docker-compose.yml"}
+
+// getImageCommands copies the image archives from the ISO into the target and
+// verifies them.
+func getImageCommands(archives []images.Archive) (commands []string) {
+	if len(archives) == 0 {
+		return
+	}
+
+	commands = append(commands, fmt.Sprintf("mkdir -p %s", shellQuote(targetRoot+preloadedImagesDir)))
+	for _, archive := range archives {
+		destination := targetRoot + preloadedImagesDir + "/" + archive.Name()
+		commands = append(commands,
+			fmt.Sprintf("cp %s %s", shellQuote("/cdrom/"+images.Dir+"/"+archive.Name()), shellQuote(destination)),
+			fmt.Sprintf("echo %s | sha256sum -c --quiet -", shellQuote(archive.SHA256+"  "+destination)),
+		)
+	}
+	return
+}
+
+// preloadImagesLayer is the layer of the files that load the preloaded
+// images.
+const preloadImagesLayer = "preloaded images"
+
+// preloadImagesUnit loads the image archives after docker starts and before
+// the compose applications do. Units of other compose applications order
+// themselves after it.
+const preloadImagesUnit = `[Unit]
+Description=Load the preloaded container images
+Requires=docker.service
+After=docker.service
+Before=containers.service
+ConditionDirectoryNotEmpty=` + preloadedImagesDir + `
+
+[Service]
+Type=oneshot
+RemainAfterExit=yes
+ExecStart=/usr/local/sbin/load-preloaded-images
+TimeoutStartSec=0
+
+[Install]
+WantedBy=multi-user.target
+`
+
+// imageFiles returns the unit, its preset and the script that load the image
+// archives. The script checks that every reference they carry resolves to the
+// image that was preloaded and fails otherwise, leaving the archive in place.
+// Docker's classic image store reports the config digest as the image ID and
+// the containerd image store the manifest digest, so either is accepted.
+func imageFiles(archives []images.Archive) (files []installFile) {
+	if len(archives) == 0 {
+		return
+	}
+
+	lines := []string{"#!/bin/sh", "set -e"}
+	for _, archive := range archives {
+		archivePath := preloadedImagesDir + "/" + archive.Name()
+		lines = append(lines, "", fmt.Sprintf("docker load -i %s", shellQuote(archivePath)))
+		for _, image := range archive.Images {
+			ids := append([]string{image.ID}, image.Digests...)
+			for _, ref := range image.Refs {
+				lines = append(lines, fmt.Sprintf(
+					`case "$(docker image inspect --format '{{.Id}}' %s)" in %s) ;; *) echo "Image %s does not match the preloaded image %s" >&2; exit 1 ;; esac`,
+					shellQuote(ref), strings.Join(ids, "|"), ref, image.ID))
+			}
+		}
+		lines = append(lines, fmt.Sprintf("rm -f %s", shellQuote(archivePath)))
+	}
+
+	for _, file := range []struct {
+		target string
+		body   string
+		mode   string
+	}{
+		{"/etc/systemd/system/preload-images.service", preloadImagesUnit, "0644"},
+		{"/etc/systemd/system-preset/90-preload-images.preset", "enable preload-images.service\n", "0644"},
+		{"/usr/local/sbin/load-preloaded-images", strings.Join(lines, "\n") + "\n", "0755"},
+	} {
+		files = append(files, installFile{
+			MergedFile: MergedFile{Path: file.target, Source: path.Base(file.target), Layer: preloadImagesLayer},
+			Target:     file.target,
+			Body:       []byte(file.body),
+			Meta:       FileMetadata{Mode: file.mode, Phase: PhaseTarget},
+		})
+	}
+	return
+}
+
+// checkComposeImages checks the images of the compose files among the
+// installed files against the preloaded images. A service whose image is
+// preloaded under the same name must use a preloaded tag or digest. Images
+// that are not preloaded are pulled at first boot.
+func checkComposeImages(contents map[string][]byte, archives []images.Archive) error {
+	if len(archives) == 0 {
+		return nil
+	}
+
+	targets := make([]string, 0, len(contents))
+	for target := range contents {
+		if slices.Contains(composeFileNames, path.Base(target)) {
+			targets = append(targets, target)
+		}
+	}
+	sort.Strings(targets)
+
+	for _, target := range targets {
+		var compose struct {
+			Services map[string]struct {
+				Image string `yaml:"image"`
+			} `yaml:"services"`
+		}
+		if err := yaml.Unmarshal(contents[target], &compose); err != nil {
+			return fmt.Errorf("error parsing compose file %s: %w", target, err)
+		}
+
+		services := make([]string, 0, len(compose.Services))
+		for service := range compose.Services {
+			services = append(services, service)
+		}
+		sort.Strings(services)
+
+		for _, service := range services {
+			image := compose.Services[service].Image
+			if image == "" {
+				continue
+			}
+			if err := matchPreloadedImage(images.ParseRef(image), archives); err != nil {
+				return fmt.Errorf("service %s in %s: %w", service, target, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func matchPreloadedImage(ref images.Ref, archives []images.Archive) error {
+	var preloaded []string
+	for _, archive := range archives {
+		for _, image := range archive.Images {
+			for _, imageRef := range image.Refs {
+				candidate := images.ParseRef(imageRef)
+				if candidate.Name != ref.Name {
+					continue
+				}
+				if ref.Digest != "" && slices.Contains(image.Digests, ref.Digest) {
+					return nil
+				}
+				if ref.Digest == "" && candidate.Tag == ref.Tag {
+					return nil
+				}
+				preloaded = append(preloaded, imageRef)
+				for _, digest := range image.Digests {
+					preloaded = append(preloaded, candidate.Name+"@"+digest)
+				}
+			}
+		}
+	}
+
+	if len(preloaded) == 0 {
+		return nil
+	}
+	return fmt.Errorf("image %s does not match the preloaded %s", ref, strings.Join(preloaded, ", "))
+}
@@ -0,0 +1,71 @@
+package generate_cloud_config
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hunoz/ubuntu-iso-builder/images"
+)
+
+// TestImageFiles runs the script that loads the preloaded images with docker
+// replaced by a script that reports the image ID in $IMAGE_ID.
+func TestImageFiles(t *testing.T) {
+	archive := images.Archive{
+		Path:   "/images/app.tar",
+		SHA256: "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+		Images: []images.Image{{ID: "sha256:aaa", Digests: []string{"sha256:bbb"}, Refs: []string{"app:1.0"}}},
+	}
+	files := imageFiles([]images.Archive{archive})
+	contents := map[string]string{}
+	for _, file := range files {
+		contents[file.Target] = string(file.Body)
+	}
+	unit := contents["/etc/systemd/system/preload-images.service"]
+	for _, line := range []string{"After=docker.service", "Before=containers.service", "ConditionDirectoryNotEmpty=" + preloadedImagesDir} {
+		if !strings.Contains(unit, line+"\n") {
+			t.Errorf("preload-images.service does not contain %q:\n%s", line, unit)
+		}
+	}
+	if contents["/etc/systemd/system-preset/90-preload-images.preset"] != "enable preload-images.service\n" {
+		t.Errorf("preload-images.service is not enabled")
+	}
+
+	bin := t.TempDir()
+	log := filepath.Join(bin, "log")
+	docker := "#!/bin/sh\necho \"$*\" >> " + shellQuote(log) + "\n[ \"$1\" = image ] && echo \"$IMAGE_ID\"\nexit 0\n"
+	if err := os.WriteFile(filepath.Join(bin, "docker"), []byte(docker), 0755); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(bin, "load-preloaded-images")
+	if err := os.WriteFile(script, []byte(contents["/usr/local/sbin/load-preloaded-images"]), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		id     string
+		failed bool
+	}{
+		{"sha256:aaa", false},
+		{"sha256:bbb", false},
+		{"sha256:ccc", true},
+	} {
+		_ = os.Remove(log)
+		cmd := exec.Command(script)
+		cmd.Env = append(os.Environ(), "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"), "IMAGE_ID="+test.id)
+		out, err := cmd.CombinedOutput()
+		if (err != nil) != test.failed {
+			t.Errorf("image ID %s: got error %v, want failure %v\n%s", test.id, err, test.failed, out)
+		}
+		calls, _ := os.ReadFile(log)
+		want := "load -i " + preloadedImagesDir + "/" + archive.Name() + "\nimage inspect --format {{.Id}} app:1.0\n"
+		if string(calls) != want {
+			t.Errorf("image ID %s: got docker calls\n%s\nwant\n%s", test.id, calls, want)
+		}
+		if test.failed && !strings.Contains(string(out), "Image app:1.0 does not match the preloaded image sha256:aaa") {
+			t.Errorf("image ID %s: got output %q", test.id, out)
+		}
+	}
+}
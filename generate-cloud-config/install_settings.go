@@ -0,0 +1,80 @@
+package generate_cloud_config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Shutdown actions the installer takes once it is done.
+const (
+	ShutdownReboot   = "reboot"
+	ShutdownPoweroff = "poweroff"
+)
+
+// installSettings are the locale, time zone, keyboard and shutdown settings of
+// the autoinstall config.
+type installSettings struct {
+	Timezone string
+	Locale   string
+	Keyboard AutoInstallKeyboard
+	Shutdown string
+}
+
+// getInstallSettings fills in the defaults of the host spec's settings and
+// checks them against the embedded lists in data.
+func getInstallSettings(ctx CloudConfigContext) (settings installSettings, err error) {
+	settings = installSettings{
+		Timezone: firstNonEmpty(ctx.Timezone, "Etc/UTC"),
+		Locale:   firstNonEmpty(ctx.Locale, "en_US.UTF-8"),
+		Keyboard: AutoInstallKeyboard{
+			Layout:  firstNonEmpty(ctx.KeyboardLayout, "us"),
+			Variant: ctx.KeyboardVariant,
+		},
+		Shutdown: firstNonEmpty(ctx.Shutdown, ShutdownReboot),
+	}
+
+	if err = checkListed("timezones.txt", "timezone", settings.Timezone); err != nil {
+		return
+	}
+	if err = checkListed("locales.txt", "locale", settings.Locale); err != nil {
+		return
+	}
+	if err = checkListed("keyboards.txt", "keyboard layout", settings.Keyboard.Layout); err != nil {
+		return
+	}
+	if settings.Keyboard.Variant != "" {
+		variant := settings.Keyboard.Layout + " " + settings.Keyboard.Variant
+		if err = checkListed("keyboards.txt", "keyboard variant", variant); err != nil {
+			return
+		}
+	}
+	if settings.Shutdown != ShutdownReboot && settings.Shutdown != ShutdownPoweroff {
+		err = fmt.Errorf("unsupported shutdown %q, expected %s or %s", settings.Shutdown, ShutdownReboot, ShutdownPoweroff)
+	}
+	return
+}
+
+// checkListed checks that value is an entry of the list in data, whose # lines
+// are comments. A value that only differs in case is suggested.
+func checkListed(list, kind, value string) error {
+	content, err := dataFS.ReadFile("data/" + list)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", list, err)
+	}
+	var entries []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			entries = append(entries, line)
+		}
+	}
+	if slices.Contains(entries, value) {
+		return nil
+	}
+	for _, entry := range entries {
+		if strings.EqualFold(entry, value) {
+			return fmt.Errorf("unknown %s %q, did you mean %q?", kind, value, entry)
+		}
+	}
+	return fmt.Errorf("unknown %s %q", kind, value)
+}
@@ -0,0 +1,69 @@
+package generate_cloud_config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetInstallSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		ctx      CloudConfigContext
+		settings installSettings
+		err      string
+	}{
+		{
+			name:     "defaults",
+			settings: installSettings{Timezone: "Etc/UTC", Locale: "en_US.UTF-8", Keyboard: AutoInstallKeyboard{Layout: "us"}, Shutdown: ShutdownReboot},
+		},
+		{
+			name: "listed settings",
+			ctx:  CloudConfigContext{Timezone: "Europe/Berlin", Locale: "de_DE.UTF-8", KeyboardLayout: "de", KeyboardVariant: "nodeadkeys", Shutdown: ShutdownPoweroff},
+			settings: installSettings{Timezone: "Europe/Berlin", Locale: "de_DE.UTF-8",
+				Keyboard: AutoInstallKeyboard{Layout: "de", Variant: "nodeadkeys"}, Shutdown: ShutdownPoweroff},
+		},
+		{
+			name:     "timezone link",
+			ctx:      CloudConfigContext{Timezone: "US/Eastern"},
+			settings: installSettings{Timezone: "US/Eastern", Locale: "en_US.UTF-8", Keyboard: AutoInstallKeyboard{Layout: "us"}, Shutdown: ShutdownReboot},
+		},
+		{name: "timezone in another case", ctx: CloudConfigContext{Timezone: "europe/berlin"}, err: `unknown timezone "europe/berlin", did you mean "Europe/Berlin"?`},
+		{name: "unknown timezone", ctx: CloudConfigContext{Timezone: "Mars/Olympus_Mons"}, err: `unknown timezone "Mars/Olympus_Mons"`},
+		{name: "locale in another case", ctx: CloudConfigContext{Locale: "en_us.utf-8"}, err: `unknown locale "en_us.utf-8", did you mean "en_US.UTF-8"?`},
+		{name: "locale without UTF-8", ctx: CloudConfigContext{Locale: "en_US"}, err: `unknown locale "en_US"`},
+		{name: "keyboard layout in another case", ctx: CloudConfigContext{KeyboardLayout: "DE"}, err: `unknown keyboard layout "DE", did you mean "de"?`},
+		{name: "keyboard variant", ctx: CloudConfigContext{KeyboardLayout: "us", KeyboardVariant: "nodeadkeys"}, err: `unknown keyboard variant "us nodeadkeys"`},
+		{name: "keyboard variant in another case", ctx: CloudConfigContext{KeyboardLayout: "us", KeyboardVariant: "Dvorak"}, err: `did you mean "us dvorak"?`},
+		{name: "shutdown", ctx: CloudConfigContext{Shutdown: "halt"}, err: `unsupported shutdown "halt", expected reboot or poweroff`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings, err := getInstallSettings(test.ctx)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if settings != test.settings {
+				t.Errorf("settings are %+v, want %+v", settings, test.settings)
+			}
+		})
+	}
+}
+
+func TestCheckListedComments(t *testing.T) {
+	comment := "# Time zones of tzdata 2025b, zones and links from tzdata.zi"
+	for _, value := range []string{comment, strings.ToUpper(comment), "#", ""} {
+		err := checkListed("timezones.txt", "timezone", value)
+		if err == nil {
+			t.Errorf("%q: comment and empty lines should not be accepted", value)
+		} else if strings.Contains(err.Error(), "did you mean") {
+			t.Errorf("%q: comment lines should not be suggested: %v", value, err)
+		}
+	}
+}
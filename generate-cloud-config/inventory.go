@@ -0,0 +1,322 @@
+package generate_cloud_config
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Inventory describes a fleet of hosts. Values are layered in the order
+// defaults, then each of the host's groups in the order they are listed, then
+// the host entry itself, so later layers override earlier ones.
+type Inventory struct {
+	Defaults yaml.Node            `yaml:"defaults"`
+	Groups   map[string]yaml.Node `yaml:"groups"`
+	Hosts    []yaml.Node          `yaml:"hosts"`
+}
+
+type InventoryHost struct {
+	Name    string
+	Groups  []string
+	Context CloudConfigContext
+}
+
+type inventoryHostGroups struct {
+	Group  string   `yaml:"group"`
+	Groups []string `yaml:"groups"`
+}
+
+// LoadInventory reads a YAML or CSV inventory file and resolves every host to
+// its fully merged CloudConfigContext. CSV files use the host spec keys as
+// column headers, a "group" column for group membership and ";" to separate
+// list values; dotted headers address nested keys. A CSV row without a
+// hostname holds the settings of the group in its group column, or the
+// defaults when that group is "defaults".
+func LoadInventory(path string) (hosts []InventoryHost, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening inventory %s: %w", path, err)
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	var inventory Inventory
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		inventory, err = parseCsvInventory(file)
+	case ".yaml", ".yml":
+		err = yaml.NewDecoder(file).Decode(&inventory)
+	default:
+		return nil, fmt.Errorf("unsupported inventory format %s, expected .yaml, .yml or .csv", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing inventory %s: %w", path, err)
+	}
+
+	return inventory.Resolve()
+}
+
+// Resolve merges the defaults and group layers into each host and decodes the
+// result. Every group a host lists must be defined, even if only as an empty
+// entry.
+func (i Inventory) Resolve() (hosts []InventoryHost, err error) {
+	seen := map[string]bool{}
+	for index, hostNode := range i.Hosts {
+		var membership inventoryHostGroups
+		if err = hostNode.Decode(&membership); err != nil {
+			return nil, fmt.Errorf("host #%d: %w", index+1, err)
+		}
+		groups := membership.Groups
+		if membership.Group != "" {
+			groups = append([]string{membership.Group}, groups...)
+		}
+
+		merged := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		mergeNodes(merged, &i.Defaults)
+		for _, group := range groups {
+			groupNode, ok := i.Groups[group]
+			if !ok {
+				return nil, fmt.Errorf("host #%d references unknown group %q", index+1, group)
+			}
+			mergeNodes(merged, &groupNode)
+		}
+		mergeNodes(merged, &hostNode)
+		removeKeys(merged, "group", "groups")
+
+		var ctx CloudConfigContext
+		if err = merged.Decode(&ctx); err != nil {
+			return nil, fmt.Errorf("host #%d: %w", index+1, err)
+		}
+		if ctx.Hostname == "" {
+			return nil, fmt.Errorf("host #%d has no hostname", index+1)
+		}
+		if seen[ctx.Hostname] {
+			return nil, fmt.Errorf("host %s is listed more than once", ctx.Hostname)
+		}
+		seen[ctx.Hostname] = true
+		if ctx.AdminUsername == "" {
+			ctx.AdminUsername = "localadmin"
+		}
+
+		hosts = append(hosts, InventoryHost{Name: ctx.Hostname, Groups: groups, Context: ctx})
+	}
+
+	return
+}
+
+// mergeNodes deep-merges the mapping src into dst. Nested mappings are merged
+// key by key, any other value in src replaces the one in dst.
+func mergeNodes(dst, src *yaml.Node) {
+	if src.Kind == yaml.DocumentNode && len(src.Content) > 0 {
+		src = src.Content[0]
+	}
+	if src.Kind != yaml.MappingNode {
+		return
+	}
+
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+		existing := lookupNode(dst, key.Value)
+		switch {
+		case existing != nil && existing.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode:
+			mergeNodes(existing, value)
+		case existing != nil:
+			*existing = *cloneNode(value)
+		default:
+			dst.Content = append(dst.Content, cloneNode(key), cloneNode(value))
+		}
+	}
+}
+
+func lookupNode(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func removeKeys(mapping *yaml.Node, keys ...string) {
+	var content []*yaml.Node
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if slices.Contains(keys, mapping.Content[i].Value) {
+			continue
+		}
+		content = append(content, mapping.Content[i], mapping.Content[i+1])
+	}
+	mapping.Content = content
+}
+
+func cloneNode(node *yaml.Node) *yaml.Node {
+	clone := *node
+	clone.Content = make([]*yaml.Node, len(node.Content))
+	for i, child := range node.Content {
+		clone.Content[i] = cloneNode(child)
+	}
+	return &clone
+}
+
+// csvDefaultsGroup names the CSV row that holds the defaults.
+const csvDefaultsGroup = "defaults"
+
+// parseCsvInventory turns a CSV file into an Inventory with one host per row
+// that has a hostname. The other rows define the defaults and groups.
+func parseCsvInventory(r io.Reader) (inventory Inventory, err error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	records, err := reader.ReadAll()
+	if err != nil {
+		return
+	}
+	if len(records) == 0 {
+		return inventory, fmt.Errorf("inventory is empty")
+	}
+
+	header := records[0]
+	hasDefaults := false
+	for index, record := range records[1:] {
+		row := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for column, value := range record {
+			if value == "" {
+				continue
+			}
+			path := strings.Split(strings.TrimSpace(header[column]), ".")
+			setCsvValue(row, reflect.TypeOf(CloudConfigContext{}), path, value)
+		}
+		if lookupNode(row, "hostname") != nil {
+			inventory.Hosts = append(inventory.Hosts, *row)
+			continue
+		}
+
+		group := lookupNode(row, "group")
+		if group == nil {
+			return inventory, fmt.Errorf("row %d has neither a hostname nor a group", index+2)
+		}
+		if lookupNode(row, "groups") != nil {
+			return inventory, fmt.Errorf("row %d of group %s lists groups, which only hosts can", index+2, group.Value)
+		}
+		removeKeys(row, "group")
+		if group.Value == csvDefaultsGroup {
+			if hasDefaults {
+				return inventory, fmt.Errorf("row %d: the defaults are defined twice", index+2)
+			}
+			hasDefaults = true
+			inventory.Defaults = *row
+			continue
+		}
+		if inventory.Groups == nil {
+			inventory.Groups = map[string]yaml.Node{}
+		}
+		if _, ok := inventory.Groups[group.Value]; ok {
+			return inventory, fmt.Errorf("row %d: group %s is defined twice", index+2, group.Value)
+		}
+		inventory.Groups[group.Value] = *row
+	}
+
+	return
+}
+
+// setCsvValue stores a CSV cell under the dotted path in mapping. Cells whose
+// host spec field is a list are split on ";", everything else is kept as a
+// plain scalar so the decoder can convert it to the field type.
+func setCsvValue(mapping *yaml.Node, t reflect.Type, path []string, value string) {
+	key := path[0]
+	fieldType := yamlFieldType(t, key)
+	if key == "groups" {
+		fieldType = reflect.TypeOf([]string{})
+	}
+
+	if len(path) > 1 {
+		child := lookupNode(mapping, key)
+		if child == nil {
+			child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, child)
+		}
+		setCsvValue(child, fieldType, path[1:], value)
+		return
+	}
+
+	var node *yaml.Node
+	if fieldType != nil && fieldType.Kind() == reflect.Slice {
+		node = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, item := range strings.Split(value, ";") {
+			if item = strings.TrimSpace(item); item != "" {
+				node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: item})
+			}
+		}
+	} else {
+		node = &yaml.Node{Kind: yaml.ScalarNode, Value: value}
+	}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, node)
+}
+
+// yamlFieldType returns the type of the field of struct t that is serialized
+// under key, or nil if there is none.
+func yamlFieldType(t reflect.Type, key string) reflect.Type {
+	for t != nil && (t.Kind() == reflect.Pointer || t.Kind() == reflect.Map) {
+		if t.Kind() == reflect.Map {
+			return t.Elem()
+		}
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == key {
+			return field.Type
+		}
+	}
+	return nil
+}
+
+// LoadHostSpec reads a host spec file, written like an inventory host entry,
+// and lays the fields of overrides whose keys isSet reports over it. The
+// template values of overrides are always merged over the spec's key by key.
+func LoadHostSpec(path string, overrides CloudConfigContext, isSet func(key string) bool) (ctx CloudConfigContext, err error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return ctx, fmt.Errorf("error reading host spec %s: %w", path, err)
+	}
+	spec := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	var document yaml.Node
+	if err = yaml.Unmarshal(content, &document); err != nil {
+		return ctx, fmt.Errorf("error parsing host spec %s: %w", path, err)
+	}
+	mergeNodes(spec, &document)
+
+	var flags yaml.Node
+	if err = flags.Encode(overrides); err != nil {
+		return ctx, err
+	}
+	var unset []string
+	for i := 0; i+1 < len(flags.Content); i += 2 {
+		if key := flags.Content[i].Value; key != "values" && !isSet(key) {
+			unset = append(unset, key)
+		}
+	}
+	removeKeys(&flags, unset...)
+	mergeNodes(spec, &flags)
+
+	if err = spec.Decode(&ctx); err != nil {
+		return ctx, fmt.Errorf("error parsing host spec %s: %w", path, err)
+	}
+	if ctx.AdminUsername == "" {
+		ctx.AdminUsername = "localadmin"
+	}
+	ctx.PreloadImages = overrides.PreloadImages
+	return
+}
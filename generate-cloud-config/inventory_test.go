@@ -0,0 +1,82 @@
+package generate_cloud_config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadCsvInventory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts.csv")
+	csv := "hostname,group,groups,modules,timezone,apt.mirror\n" +
+		",defaults,,,Etc/UTC,http://mirror.lan/ubuntu\n" +
+		",web,,docker,,\n" +
+		",edge,,,Europe/Berlin,\n" +
+		",lan,,,,\n" +
+		"host1,web,edge;lan,docker;media-stack,,\n" +
+		"host2,,,,,\n"
+	if err := os.WriteFile(path, []byte(csv), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := LoadInventory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 {
+		t.Fatalf("got %d hosts, want 2", len(hosts))
+	}
+	if !slices.Equal(hosts[0].Groups, []string{"web", "edge", "lan"}) {
+		t.Errorf("got groups %q, want web edge lan", hosts[0].Groups)
+	}
+	if !slices.Equal(hosts[0].Context.Modules, []string{"docker", "media-stack"}) {
+		t.Errorf("got modules %q", hosts[0].Context.Modules)
+	}
+	if hosts[0].Context.Timezone != "Europe/Berlin" {
+		t.Errorf("got timezone %q of host1, want the one of group edge", hosts[0].Context.Timezone)
+	}
+	if len(hosts[1].Groups) != 0 || hosts[1].Context.AdminUsername != "localadmin" || hosts[1].Context.Timezone != "Etc/UTC" {
+		t.Errorf("got host2 %+v", hosts[1])
+	}
+	if hosts[1].Context.Apt.Mirror != "http://mirror.lan/ubuntu" {
+		t.Errorf("got apt mirror %q of host2, want the default", hosts[1].Context.Apt.Mirror)
+	}
+}
+
+func TestLoadCsvInventoryErrors(t *testing.T) {
+	tests := []struct {
+		csv string
+		err string
+	}{
+		{"hostname,group\nhost1,web\n", `unknown group "web"`},
+		{"hostname,group,timezone\n,,UTC\n", "row 2 has neither a hostname nor a group"},
+		{"hostname,group,groups\n,web,lan\n", "row 2 of group web lists groups"},
+		{"hostname,group\n,web\n,web\n", "row 3: group web is defined twice"},
+		{"hostname,group\n,defaults\n,defaults\n", "row 3: the defaults are defined twice"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "hosts.csv")
+		if err := os.WriteFile(path, []byte(test.csv), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadInventory(path); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: got error %v, want one containing %q", test.csv, err, test.err)
+		}
+	}
+}
+
+func TestInventoryUnknownGroup(t *testing.T) {
+	for _, inventory := range []string{
+		"groups:\n  web:\n    timezone: UTC\nhosts:\n  - hostname: host1\n    group: wbe\n",
+		"hosts:\n  - hostname: host1\n    groups: [wbe]\n",
+	} {
+		path := filepath.Join(t.TempDir(), "hosts.yaml")
+		if err := os.WriteFile(path, []byte(inventory), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadInventory(path); err == nil || !strings.Contains(err.Error(), `unknown group "wbe"`) {
+			t.Errorf("%q: got error %v, want one about the unknown group", inventory, err)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package generate_cloud_config
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// FrontMatterStart and FrontMatterEnd delimit the optional YAML metadata
+	// block at the very top of a file. The block is removed before the file is
+	// rendered or installed.
+	FrontMatterStart = "#meta"
+	FrontMatterEnd   = "#/meta"
+	// SidecarSuffix names a metadata file that describes the file of the same
+	// name without the suffix, e.g. daemon.json.meta. Sidecars are the only way
+	// to attach metadata to binary files.
+	SidecarSuffix = ".meta"
+)
+
+// FilePhase is the point of the installation at which a file is written.
+type FilePhase string
+
+const (
+	// PhaseInstaller writes the file into the live installer environment
+	// before the installation starts.
+	PhaseInstaller FilePhase = "installer"
+	// PhaseTarget writes the file into the installed system during the
+	// installer's late-commands.
+	PhaseTarget FilePhase = "target"
+	// PhaseFirstBoot writes the file through cloud-init's write_files when the
+	// installed system first boots, after the users and groups it may be owned
+	// by were created.
+	PhaseFirstBoot FilePhase = "first-boot"
+)
+
+// FileCondition limits a file to hosts with a module enabled or a template
+// value set. All given criteria must hold.
+type FileCondition struct {
+	Module string `yaml:"module,omitempty"`
+	// Value is a dotted key into .Values that must be set, or equal Equals if
+	// that is given.
+	Value  string  `yaml:"value,omitempty"`
+	Equals *string `yaml:"equals,omitempty"`
+}
+
+// FileMetadata controls how a file of the merged tree is installed.
+type FileMetadata struct {
+	Mode  string         `yaml:"mode,omitempty"`
+	Owner string         `yaml:"owner,omitempty"`
+	Phase FilePhase      `yaml:"phase,omitempty"`
+	When  *FileCondition `yaml:"when,omitempty"`
+	// Template overrides whether the file is rendered, which otherwise
+	// follows the .tpl suffix.
+	Template *bool `yaml:"template,omitempty"`
+	// Secret moves the file into the secrets bundle of hosts that have one,
+	// as files that contain a secret of the host are. Files that carry secrets
+	// shorter than minDetectedSecretLength need it.
+	Secret bool `yaml:"secret,omitempty"`
+}
+
+// merge overlays the fields set in other onto m.
+func (m FileMetadata) merge(other FileMetadata) FileMetadata {
+	if other.Mode != "" {
+		m.Mode = other.Mode
+	}
+	if other.Owner != "" {
+		m.Owner = other.Owner
+	}
+	if other.Phase != "" {
+		m.Phase = other.Phase
+	}
+	if other.When != nil {
+		m.When = other.When
+	}
+	if other.Template != nil {
+		m.Template = other.Template
+	}
+	m.Secret = m.Secret || other.Secret
+	return m
+}
+
+func (m FileMetadata) validate() error {
+	if m.Mode != "" {
+		if _, err := strconv.ParseUint(m.Mode, 8, 32); err != nil {
+			return fmt.Errorf("invalid mode %q, expected an octal mode such as 0644", m.Mode)
+		}
+	}
+	if m.Owner != "" {
+		user, group, _ := strings.Cut(m.Owner, ":")
+		if user == "" || strings.Contains(group, ":") {
+			return fmt.Errorf("invalid owner %q, expected user or user:group", m.Owner)
+		}
+	}
+	switch m.Phase {
+	case "", PhaseInstaller, PhaseTarget, PhaseFirstBoot:
+	default:
+		return fmt.Errorf("invalid phase %q, expected %s, %s or %s", m.Phase, PhaseInstaller, PhaseTarget, PhaseFirstBoot)
+	}
+	return nil
+}
+
+// FileMode returns the mode of the file, 0644 unless set.
+func (m FileMetadata) FileMode() fs.FileMode {
+	if m.Mode == "" {
+		return 0644
+	}
+	mode, _ := strconv.ParseUint(m.Mode, 8, 32)
+	return fs.FileMode(mode)
+}
+
+// UserGroup returns the owning user and group, root:root unless set. A missing
+// group defaults to the user's name.
+func (m FileMetadata) UserGroup() (user, group string) {
+	if m.Owner == "" {
+		return "root", "root"
+	}
+	user, group, ok := strings.Cut(m.Owner, ":")
+	if !ok || group == "" {
+		group = user
+	}
+	return
+}
+
+// InstallPhase returns the phase of the file, PhaseTarget unless set.
+func (m FileMetadata) InstallPhase() FilePhase {
+	if m.Phase == "" {
+		return PhaseTarget
+	}
+	return m.Phase
+}
+
+// enabled evaluates the file's condition for ctx.
+func (m FileMetadata) enabled(ctx RenderContext) bool {
+	if m.When == nil {
+		return true
+	}
+	if m.When.Module != "" && !ctx.HasModule(m.When.Module) {
+		return false
+	}
+	if m.When.Value != "" {
+		value := lookupValue(ctx.Values, m.When.Value)
+		if m.When.Equals != nil {
+			return fmt.Sprint(value) == *m.When.Equals
+		}
+		return !isEmpty(value)
+	}
+	return true
+}
+
+// lookupValue resolves a dotted key such as "raid.level" in values.
+func lookupValue(values map[string]interface{}, key string) interface{} {
+	var current interface{} = values
+	for _, part := range strings.Split(key, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = m[part]
+	}
+	return current
+}
+
+// setValue sets a dotted key in values, creating the nested maps it needs.
+func setValue(values map[string]interface{}, key string, value interface{}) {
+	parts := strings.Split(key, ".")
+	current := values
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := current[part].(map[string]interface{})
+		if !ok {
+			next = map[string]interface{}{}
+			current[part] = next
+		}
+		current = next
+	}
+	current[parts[len(parts)-1]] = value
+}
+
+// splitFrontMatter separates a leading metadata block from the file body.
+func splitFrontMatter(content []byte) (meta FileMetadata, body []byte, err error) {
+	firstLine, rest, _ := bytes.Cut(content, []byte("\n"))
+	if string(bytes.TrimSpace(firstLine)) != FrontMatterStart {
+		return meta, content, nil
+	}
+
+	var block []byte
+	for len(rest) > 0 {
+		var line []byte
+		line, rest, _ = bytes.Cut(rest, []byte("\n"))
+		if string(bytes.TrimSpace(line)) == FrontMatterEnd {
+			if err = yaml.Unmarshal(block, &meta); err != nil {
+				return meta, nil, fmt.Errorf("invalid front-matter: %w", err)
+			}
+			return meta, rest, meta.validate()
+		}
+		block = append(append(block, line...), '\n')
+	}
+
+	return meta, nil, fmt.Errorf("front-matter is missing the closing %s line", FrontMatterEnd)
+}
+
+// loadFile reads a merged file and returns its body with any front-matter
+// removed, and its metadata with the front-matter taking precedence over a
+// sidecar file.
+func loadFile(file MergedFile) (body []byte, meta FileMetadata, err error) {
+	if file.SidecarFS != nil {
+		sidecar, err := fs.ReadFile(file.SidecarFS, file.Sidecar)
+		if err != nil {
+			return nil, meta, fmt.Errorf("error reading %s from %s: %w", file.Sidecar, file.SidecarLayer, err)
+		}
+		if err = yaml.Unmarshal(sidecar, &meta); err != nil {
+			return nil, meta, fmt.Errorf("invalid metadata in %s from %s: %w", file.Sidecar, file.SidecarLayer, err)
+		}
+		if err = meta.validate(); err != nil {
+			return nil, meta, fmt.Errorf("invalid metadata in %s from %s: %w", file.Sidecar, file.SidecarLayer, err)
+		}
+	}
+
+	content, err := fs.ReadFile(file.FS, file.Source)
+	if err != nil {
+		return nil, meta, fmt.Errorf("error reading %s from %s: %w", file.Source, file.Layer, err)
+	}
+	frontMatter, body, err := splitFrontMatter(content)
+	if err != nil {
+		return nil, meta, fmt.Errorf("error reading %s from %s: %w", file.Source, file.Layer, err)
+	}
+
+	return body, meta.merge(frontMatter), nil
+}
+
+// isTemplate reports whether the file is rendered before it is installed.
+func (f MergedFile) isTemplate(meta FileMetadata) bool {
+	if meta.Template != nil {
+		return *meta.Template
+	}
+	return f.Template
+}
@@ -0,0 +1,168 @@
+package generate_cloud_config
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestSplitFrontMatter(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		meta    FileMetadata
+		body    string
+		err     string
+	}{
+		{
+			name:    "no front-matter",
+			content: "#!/bin/sh\necho hi\n",
+			body:    "#!/bin/sh\necho hi\n",
+		},
+		{
+			name:    "front-matter",
+			content: "#meta\nmode: \"0755\"\nowner: app:staff\nphase: first-boot\n#/meta\n#!/bin/sh\n",
+			meta:    FileMetadata{Mode: "0755", Owner: "app:staff", Phase: PhaseFirstBoot},
+			body:    "#!/bin/sh\n",
+		},
+		{
+			name:    "front-matter not on the first line",
+			content: "\n#meta\nmode: \"0755\"\n#/meta\n",
+			body:    "\n#meta\nmode: \"0755\"\n#/meta\n",
+		},
+		{
+			name:    "missing end",
+			content: "#meta\nmode: \"0755\"\n#!/bin/sh\n",
+			err:     "missing the closing #/meta line",
+		},
+		{
+			name:    "invalid YAML",
+			content: "#meta\nmode: [\n#/meta\n",
+			err:     "invalid front-matter",
+		},
+		{
+			name:    "invalid mode",
+			content: "#meta\nmode: \"0799\"\n#/meta\n",
+			err:     "invalid mode",
+		},
+		{
+			name:    "invalid owner",
+			content: "#meta\nowner: app:staff:extra\n#/meta\n",
+			err:     "invalid owner",
+		},
+		{
+			name:    "owner without user",
+			content: "#meta\nowner: :staff\n#/meta\n",
+			err:     "invalid owner",
+		},
+		{
+			name:    "invalid phase",
+			content: "#meta\nphase: reboot\n#/meta\n",
+			err:     "invalid phase",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			meta, body, err := splitFrontMatter([]byte(test.content))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.Mode != test.meta.Mode || meta.Owner != test.meta.Owner || meta.Phase != test.meta.Phase {
+				t.Errorf("metadata is %+v, want %+v", meta, test.meta)
+			}
+			if string(body) != test.body {
+				t.Errorf("body is %q, want %q", body, test.body)
+			}
+		})
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	tree := fstest.MapFS{
+		"etc/both":           {Data: []byte("#meta\nmode: \"0700\"\n#/meta\nbody\n")},
+		"etc/both.meta":      {Data: []byte("mode: \"0600\"\nowner: app\nsecret: true\n")},
+		"etc/sidecar":        {Data: []byte("body\n")},
+		"etc/sidecar.meta":   {Data: []byte("phase: installer\n")},
+		"etc/bad-owner":      {Data: []byte("body\n")},
+		"etc/bad-owner.meta": {Data: []byte("owner: \"a:b:c\"\n")},
+		"etc/bad-yaml":       {Data: []byte("body\n")},
+		"etc/bad-yaml.meta":  {Data: []byte("mode: [\n")},
+		"etc/unclosed":       {Data: []byte("#meta\nmode: \"0700\"\n")},
+	}
+	files, err := MergeLayers([]FileLayer{{Name: "test", FS: tree}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	byPath := map[string]MergedFile{}
+	for _, file := range files {
+		byPath[file.Path] = file
+	}
+
+	// The front-matter wins over the sidecar field by field.
+	body, meta, err := loadFile(byPath["/etc/both"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "body\n" || meta.Mode != "0700" || meta.Owner != "app" || !meta.Secret {
+		t.Errorf("/etc/both loaded as %q with %+v", body, meta)
+	}
+
+	if _, meta, err = loadFile(byPath["/etc/sidecar"]); err != nil {
+		t.Fatal(err)
+	}
+	if meta.InstallPhase() != PhaseInstaller || meta.FileMode() != 0644 {
+		t.Errorf("/etc/sidecar loaded with %+v", meta)
+	}
+
+	for path, want := range map[string]string{
+		"/etc/bad-owner": "invalid metadata in etc/bad-owner.meta from test",
+		"/etc/bad-yaml":  "invalid metadata in etc/bad-yaml.meta from test",
+		"/etc/unclosed":  "error reading etc/unclosed from test",
+	} {
+		if _, _, err = loadFile(byPath[path]); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected an error containing %q, got %v", path, want, err)
+		}
+	}
+}
+
+func TestFileConditions(t *testing.T) {
+	beta := "beta"
+	three := "3"
+	ctx := RenderContext{
+		CloudConfigContext: CloudConfigContext{Values: map[string]interface{}{
+			"feature": map[string]interface{}{"channel": "beta", "replicas": 3, "empty": ""},
+		}},
+		EnabledModules: []string{"docker"},
+	}
+
+	tests := []struct {
+		name    string
+		when    *FileCondition
+		enabled bool
+	}{
+		{name: "no condition", enabled: true},
+		{name: "module enabled", when: &FileCondition{Module: "docker"}, enabled: true},
+		{name: "module disabled", when: &FileCondition{Module: "raid"}},
+		{name: "value set", when: &FileCondition{Value: "feature.channel"}, enabled: true},
+		{name: "value empty", when: &FileCondition{Value: "feature.empty"}},
+		{name: "value missing", when: &FileCondition{Value: "feature.missing"}},
+		{name: "value below a scalar", when: &FileCondition{Value: "feature.channel.name"}},
+		{name: "value equals", when: &FileCondition{Value: "feature.channel", Equals: &beta}, enabled: true},
+		{name: "value differs", when: &FileCondition{Value: "feature.replicas", Equals: &beta}},
+		{name: "number equals", when: &FileCondition{Value: "feature.replicas", Equals: &three}, enabled: true},
+		{name: "module and value", when: &FileCondition{Module: "docker", Value: "feature.channel", Equals: &beta}, enabled: true},
+		{name: "module fails with value", when: &FileCondition{Module: "raid", Value: "feature.channel"}},
+	}
+	for _, test := range tests {
+		if enabled := (FileMetadata{When: test.when}).enabled(ctx); enabled != test.enabled {
+			t.Errorf("%s: enabled is %t, want %t", test.name, enabled, test.enabled)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package generate_cloud_config
+
+import (
+	"fmt"
+	"io/fs"
+	"slices"
+	"strings"
+)
+
+// AptSource is an apt source list written to /etc/apt/sources.list.d. The
+// placeholder @CODENAME@ in Content is replaced with the release codename of
+// the installed system.
+type AptSource struct {
+	Filename string
+	Content  string
+}
+
+// FirstBootStep is a command run once by first-boot.service on the installed
+// system.
+type FirstBootStep struct {
+	Description string
+	Command     string
+}
+
+// ModuleInput is a host spec value that must be set when a module is enabled.
+type ModuleInput struct {
+	Name  string
+	Value func(ctx CloudConfigContext) string
+}
+
+// Module is a self-contained piece of host configuration. The generator merges
+// the contributions of every enabled module into the base autoinstall config.
+type Module interface {
+	Name() string
+	Description() string
+	// Requires lists the modules that must be enabled alongside this one.
+	Requires() []string
+	Packages(ctx RenderContext) []string
+	AptRepositories(ctx RenderContext) []AptRepository
+	// Files is a tree rooted at the target's / that is installed on the target,
+	// or nil if the module has no files.
+	Files() fs.FS
+	LateCommands(ctx RenderContext) []string
+	FirstBootSteps(ctx RenderContext) []FirstBootStep
+	RequiredInputs() []ModuleInput
+}
+
+// RenderContext is what modules and .tpl files are rendered with. It embeds the
+// host spec so templates can keep using fields such as .Hostname directly.
+type RenderContext struct {
+	CloudConfigContext
+	EnabledModules []string
+	FirstBootSteps []FirstBootStep
+	// RaidArray is the data array of the raid module.
+	RaidArray RaidArray
+	// DiskAlerts are the destinations of the disk-alerts module.
+	DiskAlerts DiskAlerts
+	// Hardening are the controls of the hardening module.
+	Hardening Hardening
+}
+
+func (r RenderContext) HasModule(name string) bool {
+	return slices.Contains(r.EnabledModules, name)
+}
+
+// builtinModule is a Module assembled from static values and optional
+// callbacks for the parts that depend on the host spec.
+type builtinModule struct {
+	name            string
+	description     string
+	requires        []string
+	packages        []string
+	aptRepositories []AptRepository
+	lateCommands    func(ctx RenderContext) []string
+	firstBootSteps  []FirstBootStep
+	requiredInputs  []ModuleInput
+}
+
+func (m builtinModule) Name() string        { return m.name }
+func (m builtinModule) Description() string { return m.description }
+func (m builtinModule) Requires() []string  { return m.requires }
+
+func (m builtinModule) Packages(RenderContext) []string {
+	return m.packages
+}
+
+func (m builtinModule) AptRepositories(RenderContext) []AptRepository {
+	return m.aptRepositories
+}
+
+func (m builtinModule) Files() fs.FS {
+	tree, err := fs.Sub(modulesFS, "modules/"+m.name)
+	if err != nil {
+		return nil
+	}
+	if _, err = fs.Stat(tree, "."); err != nil {
+		return nil
+	}
+	return tree
+}
+
+func (m builtinModule) LateCommands(ctx RenderContext) []string {
+	if m.lateCommands == nil {
+		return nil
+	}
+	return m.lateCommands(ctx)
+}
+
+func (m builtinModule) FirstBootSteps(RenderContext) []FirstBootStep {
+	return m.firstBootSteps
+}
+
+func (m builtinModule) RequiredInputs() []ModuleInput {
+	return m.requiredInputs
+}
+
+// builtinModules are listed in the order their contributions are applied.
+var builtinModules = []Module{
+	builtinModule{
+		name:        "docker",
+		description: "Docker Engine and the compose plugin from the Docker apt repository",
+		aptRepositories: []AptRepository{
+			{
+				Name:       "docker",
+				URIs:       []string{"https://download.docker.com/linux/ubuntu"},
+				Components: []string{"stable"},
+				Key:        "keys/docker.asc",
+				keys:       aptKeysFS,
+			},
+		},
+		lateCommands: func(ctx RenderContext) []string {
+			return []string{
+				aptUpdateCommand(ctx.CloudConfigContext),
+				`curtin in-target -- bash -c 'DEBIAN_FRONTEND=noninteractive apt install -y docker-ce docker-ce-cli containerd.io docker-buildx-plugin docker-compose-plugin'`,
+			}
+		},
+	},
+	builtinModule{
+		name:        "nvidia",
+		description: "NVIDIA GPU drivers and, with docker, the NVIDIA container toolkit",
+		packages: []string{
+			"ubuntu-drivers-common",
+			"build-essential",
+			"dkms",
+			"linux-headers-generic",
+		},
+		aptRepositories: []AptRepository{
+			{
+				Name:   "nvidia-container-toolkit",
+				URIs:   []string{"https://nvidia.github.io/libnvidia-container/stable/deb/$(ARCH)"},
+				Suites: []string{"/"},
+				Key:    "keys/nvidia-container-toolkit.gpg",
+				keys:   aptKeysFS,
+			},
+		},
+		lateCommands: func(ctx RenderContext) []string {
+			commands := []string{
+				"curtin in-target -- update-initramfs -u",
+				aptUpdateCommand(ctx.CloudConfigContext),
+				"curtin in-target -- bash -c 'DEBIAN_FRONTEND=noninteractive ubuntu-drivers install --gpgpu'",
+			}
+			if ctx.HasModule("docker") {
+				commands = append(commands,
+					aptUpdateCommand(ctx.CloudConfigContext),
+					"curtin in-target -- bash -c 'DEBIAN_FRONTEND=noninteractive apt install -y nvidia-container-toolkit'",
+					"curtin in-target -- nvidia-ctk runtime configure --runtime=docker",
+				)
+			}
+			return commands
+		},
+	},
+	builtinModule{
+		name:        "raid",
+		description: "Assembles or creates the data RAID array on first boot",
+		packages:    []string{"mdadm"},
+		firstBootSteps: []FirstBootStep{
+			{Description: "Setting up raid", Command: "/usr/local/bin/setup-raid"},
+		},
+	},
+	builtinModule{
+		name:        "disk-alerts",
+		description: "Alerts from mdadm and smartd about failing arrays and disks, sent to a webhook or by email",
+		packages:    []string{"mdadm", "smartmontools", "curl"},
+		firstBootSteps: []FirstBootStep{
+			// After setup-raid, so the data array is recorded in mdadm.conf.
+			{Description: "Configuring disk alerts", Command: "/usr/local/sbin/configure-disk-alerts"},
+		},
+	},
+	builtinModule{
+		name:         "hardening",
+		description:  "sshd, network, audit, banner and password policy controls of a level-1 or level-2 profile",
+		packages:     []string{"auditd", "libpam-pwquality"},
+		lateCommands: hardeningLateCommands,
+		firstBootSteps: []FirstBootStep{
+			{Description: "Checking the hardening controls", Command: "/usr/local/sbin/hardening-report"},
+		},
+	},
+	builtinModule{
+		name:        "media-stack",
+		description: "Plex, the *arr apps and Cloudflared as a docker compose application",
+		requires:    []string{"docker"},
+		requiredInputs: []ModuleInput{
+			{Name: "plex-claim", Value: func(ctx CloudConfigContext) string { return ctx.PlexClaim }},
+			{Name: "cloudflared-token", Value: func(ctx CloudConfigContext) string { return ctx.CloudflaredToken }},
+		},
+	},
+}
+
+// DefaultModules are enabled when a host spec does not list its modules.
+var DefaultModules = []string{"docker", "nvidia", "raid", "media-stack"}
+
+// BuiltinModules returns every module the generator knows about.
+func BuiltinModules() []Module {
+	return builtinModules
+}
+
+func lookupModule(name string) (Module, bool) {
+	for _, module := range builtinModules {
+		if module.Name() == name {
+			return module, true
+		}
+	}
+	return nil, false
+}
+
+// resolveModules returns the modules enabled for ctx in application order. The
+// host's module list, or DefaultModules if it has none, is extended with the
+// modules they require, and then the excluded modules are removed.
+func resolveModules(ctx CloudConfigContext) (modules []Module, err error) {
+	requested := ctx.Modules
+	if len(requested) == 0 {
+		requested = DefaultModules
+	}
+
+	enabled := map[string]bool{}
+	var enable func(name string, requiredBy string) error
+	enable = func(name string, requiredBy string) error {
+		if enabled[name] {
+			return nil
+		}
+		module, ok := lookupModule(name)
+		if !ok {
+			return fmt.Errorf("unknown module %q", name)
+		}
+		if slices.Contains(ctx.WithoutModules, name) {
+			if requiredBy != "" {
+				return fmt.Errorf("module %s requires module %s, which is excluded", requiredBy, name)
+			}
+			return nil
+		}
+		enabled[name] = true
+		for _, dependency := range module.Requires() {
+			if err := enable(dependency, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, name := range requested {
+		if err = enable(name, ""); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range ctx.WithoutModules {
+		if _, ok := lookupModule(name); !ok {
+			return nil, fmt.Errorf("unknown module %q", name)
+		}
+	}
+
+	for _, module := range builtinModules {
+		if enabled[module.Name()] {
+			modules = append(modules, module)
+		}
+	}
+	return
+}
+
+// validateModuleInputs checks that every input required by an enabled module
+// is set and reports all missing inputs at once.
+func validateModuleInputs(ctx CloudConfigContext, modules []Module) error {
+	var missing []string
+	for _, module := range modules {
+		for _, input := range module.RequiredInputs() {
+			if strings.TrimSpace(input.Value(ctx)) == "" {
+				missing = append(missing, fmt.Sprintf("%s (required by module %s)", input.Name, module.Name()))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required inputs: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+# smartd watches the disks and runs self-tests. Rendered from the disk-alerts
+# section of the host spec.
+{{- with .DiskAlerts }}
+{{- range .SmartDevices }}
+{{ . }} -a -o on -S on -n standby,q -s {{ $.DiskAlerts.SmartSchedule }} -m <nomailer> -M exec {{ $.DiskAlerts.Hook }}
+{{- end }}
+{{- end }}
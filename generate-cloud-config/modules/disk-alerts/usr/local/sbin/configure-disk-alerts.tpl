@@ -0,0 +1,33 @@
+#meta
+mode: "0755"
+#/meta
+#!/usr/bin/env bash
+#
+# Points mdadm's monitor at the disk alerts of the host spec and records the
+# arrays assembled by now, so the monitor watches them from the next boot on
+#
+
+set -e
+
+CONF=/etc/mdadm/mdadm.conf
+mkdir -p /etc/mdadm
+touch "$CONF"
+
+echo "Configuring mdadm alerts..."
+sed -i '/^[[:space:]]*\(MAILADDR\|MAILFROM\|PROGRAM\)[[:space:]]/d' "$CONF"
+echo "PROGRAM {{ .DiskAlerts.Hook }}" >> "$CONF"
+
+echo "Recording assembled arrays..."
+mdadm --detail --scan | while read -r line; do
+    uuid=$(sed -n 's/.*UUID=\([^ ]*\).*/\1/p' <<< "$line")
+    if [ -n "$uuid" ] && ! grep -qs "UUID=$uuid" "$CONF"; then
+        echo "$line" >> "$CONF"
+        echo "Added: $line"
+    fi
+done
+update-initramfs -u
+
+systemctl restart mdmonitor.service || true
+systemctl enable smartmontools.service
+systemctl restart smartmontools.service
+echo "Disk alerts configured"
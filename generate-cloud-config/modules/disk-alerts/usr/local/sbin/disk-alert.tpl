@@ -0,0 +1,68 @@
+#meta
+mode: "0755"
+#/meta
+#!/usr/bin/env bash
+#
+# Sends an mdadm or smartd alert to the destinations of the disk-alerts
+# section of the host spec. mdadm runs it as its PROGRAM with the event, the
+# array and the member. smartd runs it with -M exec and the SMARTD_ variables
+#
+
+set -u
+{{ with .DiskAlerts }}
+WEBHOOK={{ shellQuote .Webhook }}
+EMAIL={{ shellQuote .Email }}
+RELAY={{ shellQuote .Relay }}
+FROM={{ shellQuote .From }}
+{{- end }}
+HOST=$(hostname -f 2>/dev/null || hostname)
+
+if [ -n "${SMARTD_DEVICE:-}" ]; then
+    SOURCE=smartd
+    EVENT=${SMARTD_FAILTYPE:-Unknown}
+    DEVICE=$SMARTD_DEVICE
+    MESSAGE=${SMARTD_FULLMESSAGE:-${SMARTD_MESSAGE:-}}
+else
+    SOURCE=mdadm
+    EVENT=${1:-}
+    DEVICE=${2:-}
+    MESSAGE="$EVENT event on $DEVICE${3:+, member $3}"
+    # The events mdadm would mail about
+    case $EVENT in
+        Fail|FailSpare|DegradedArray|SparesMissing|DeviceDisappeared|TestMessage) ;;
+        *) exit 0 ;;
+    esac
+fi
+SUBJECT="$SOURCE on $HOST: $EVENT $DEVICE"
+logger -t disk-alert "$SUBJECT" 2>/dev/null || true
+
+json_string() {
+    local s=$1
+    s=${s//\\/\\\\}
+    s=${s//\"/\\\"}
+    s=${s//$'\n'/\\n}
+    s=${s//$'\t'/\\t}
+    s=${s//$'\r'/}
+    printf '"%s"' "$s"
+}
+
+status=0
+if [ -n "$WEBHOOK" ]; then
+    payload=$(printf '{"host":%s,"source":%s,"event":%s,"device":%s,"subject":%s,"message":%s}' \
+        "$(json_string "$HOST")" "$(json_string "$SOURCE")" "$(json_string "$EVENT")" \
+        "$(json_string "$DEVICE")" "$(json_string "$SUBJECT")" "$(json_string "$MESSAGE")")
+    if ! curl -fsS --max-time 30 --retry 3 -H 'Content-Type: application/json' -d "$payload" "$WEBHOOK" > /dev/null; then
+        echo "disk-alert: sending to the webhook failed" >&2
+        status=1
+    fi
+fi
+
+if [ -n "$EMAIL" ]; then
+    mail=$(printf 'From: %s\nTo: %s\nSubject: %s\nDate: %s\n\n%s\n' "$FROM" "$EMAIL" "$SUBJECT" "$(date -R)" "$MESSAGE")
+    if ! curl -fsS --max-time 30 --url "$RELAY" --mail-from "$FROM" --mail-rcpt "$EMAIL" --crlf -T - <<< "$mail"; then
+        echo "disk-alert: sending the email failed" >&2
+        status=1
+    fi
+fi
+
+exit $status
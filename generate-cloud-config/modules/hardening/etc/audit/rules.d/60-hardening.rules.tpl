@@ -0,0 +1,10 @@
+# Audit controls of the {{ .Hardening.Profile }} hardening profile.
+{{- range .Hardening.Controls }}
+{{- if .AuditRules }}
+
+# {{ .ID }} {{ .Title }}
+{{- range .AuditRules }}
+{{ . }}
+{{- end }}
+{{- end }}
+{{- end }}
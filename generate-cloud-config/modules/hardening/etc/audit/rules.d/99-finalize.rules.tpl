@@ -0,0 +1,6 @@
+# Loaded after every other rules file.
+{{- if .Hardening.Has "AUD-08" }}
+
+# AUD-08 Lock the audit rules until the next boot
+-e 2
+{{- end }}
@@ -0,0 +1,7 @@
+# Password policy of the {{ .Hardening.Profile }} hardening profile.
+{{- if .Hardening.Has "PWD-01" }}
+
+# PWD-01 Require long passwords of every character class
+minlen = {{ .Hardening.PasswordMinLength }}
+minclass = 4
+{{- end }}
@@ -0,0 +1,11 @@
+# sshd controls of the {{ .Hardening.Profile }} hardening profile. sshd keeps the
+# first value it reads, so this file sorts before cloud-init's 50-cloud-init.conf.
+{{- range .Hardening.Controls }}
+{{- if .SSHD }}
+
+# {{ .ID }} {{ .Title }}
+{{- range .SSHD }}
+{{ . }}
+{{- end }}
+{{- end }}
+{{- end }}
@@ -0,0 +1,10 @@
+# Network controls of the {{ .Hardening.Profile }} hardening profile.
+{{- range .Hardening.Controls }}
+{{- if .Sysctls }}
+
+# {{ .ID }} {{ .Title }}
+{{- range .Sysctls }}
+{{ . }}
+{{- end }}
+{{- end }}
+{{- end }}
@@ -0,0 +1,33 @@
+#meta
+mode: "0755"
+#/meta
+#!/usr/bin/env bash
+#
+# Checks the controls of the {{ .Hardening.Profile }} hardening profile and prints
+# one tab-separated line per control: its identifier, pass, fail or skip, and
+# its title. Exits with 1 when a control fails.
+#
+
+failed=0
+
+check() {
+    local id=$1 title=$2 condition=$3
+    if bash -c "$condition" > /dev/null 2>&1; then
+        printf '%s\tpass\t%s\n' "$id" "$title"
+    else
+        printf '%s\tfail\t%s\n' "$id" "$title"
+        failed=1
+    fi
+}
+
+skip() {
+    printf '%s\tskip\t%s (%s)\n' "$1" "$2" "$3"
+}
+
+{{ range .Hardening.Controls -}}
+check {{ shellQuote .ID }} {{ shellQuote .Title }} {{ shellQuote .Check }}
+{{ end -}}
+{{ range .Hardening.Skipped -}}
+skip {{ shellQuote .ID }} {{ shellQuote .Title }} {{ shellQuote .Reason }}
+{{ end }}
+exit $failed
@@ -1,4 +1,3 @@
-{{ define "compose.yml" }}
 ---
 
 services:
@@ -69,7 +68,9 @@ services:
     plex:
         image: plexinc/pms-docker
         container_name: plex
+{{- if .HasModule "nvidia" }}
         runtime: nvidia
+{{- end }}
         restart: unless-stopped
         networks:
             - docker-bridge
@@ -84,8 +85,10 @@ services:
             - "32469:32469"
         environment:
             - TZ=Etc/UTC
+{{- if .HasModule "nvidia" }}
             - NVIDIA_VISIBLE_DEVICES=all
             - NVIDIA_DRIVER_CAPABILITIES=all
+{{- end }}
             - PLEX_CLAIM={{ .PlexClaim }}
         volumes:
             - plex-config:/config
@@ -127,4 +130,3 @@ volumes:
         external: true
     television:
         external: true
-{{ end }}
\ No newline at end of file
@@ -0,0 +1,224 @@
+#meta
+mode: "0755"
+#/meta
+#!/usr/bin/env bash
+#
+# RAID Auto-Setup Script
+# This script assembles the data array from the disks that match the raid
+# section of the host spec, or creates it when none of them belong to an array
+#
+
+set -e
+
+LOG_FILE="/var/log/setup-raid.log"
+exec 1> >(tee -a "$LOG_FILE")
+exec 2>&1
+
+# Configuration, rendered from the raid section of the host spec
+{{- with .RaidArray }}
+RAID_DEVICE={{ shellQuote .Device }}
+RAID_LEVEL={{ .Level }}
+RAID_DEVICES={{ .Devices }}
+SPARE_DEVICES={{ .Spares }}
+CHUNK_KIB={{ .ChunkKiB }}
+FILESYSTEM={{ shellQuote .Filesystem }}
+MOUNT_POINT={{ shellQuote .Mount }}
+MOUNT_OPTIONS={{ shellQuote .Options }}
+MEMBER_CRITERIA=({{ range $i, $criterion := .Criteria }}{{ if $i }} {{ end }}{{ shellQuote $criterion }}{{ end }})
+{{- end }}
+
+{{ diskMatchFunctions }}
+echo "========================================="
+echo "RAID Setup Script Started: $(date)"
+echo "========================================="
+
+# Check if running as root
+if [[ $EUID -ne 0 ]]; then
+   echo "ERROR: This script must be run as root"
+   exit 1
+fi
+
+# Install mdadm if not present
+if ! command -v mdadm &> /dev/null; then
+    echo "mdadm not found. Installing..."
+    apt-get update
+    apt-get install -y mdadm
+fi
+
+# Function to list the disks that match the member criteria. Disks that hold
+# anything mounted outside the mount point, such as the OS disks, are left out
+find_member_disks() {
+    local sys disk
+    for sys in /sys/block/*; do
+        disk=${sys##*/}
+        [ -e "$sys/device" ] || continue
+        if lsblk -nro MOUNTPOINT "/dev/$disk" | grep -qvxF -e "" -e "$MOUNT_POINT"; then
+            continue
+        fi
+        if disk_matches "$disk" "${MEMBER_CRITERIA[@]}"; then
+            echo "/dev/$disk"
+        fi
+    done
+}
+
+# Function to record an array in mdadm.conf so it assembles at boot
+save_array() {
+    local device=$1 uuid
+    uuid=$(mdadm --detail --export "$device" | sed -n 's/^MD_UUID=//p')
+    if ! grep -qs "UUID=$uuid" /etc/mdadm/mdadm.conf; then
+        echo "Adding $device to /etc/mdadm/mdadm.conf..."
+        mdadm --detail --brief "$device" >> /etc/mdadm/mdadm.conf
+    fi
+    update-initramfs -u
+}
+
+# Function to add an array to fstab and mount it
+mount_raid() {
+    local device=$1 fstype=$2 uuid
+    uuid=$(blkid -s UUID -o value "$device")
+    if ! grep -q "UUID=$uuid" /etc/fstab; then
+        echo "Adding $device to /etc/fstab..."
+        echo "UUID=$uuid $MOUNT_POINT $fstype $MOUNT_OPTIONS 0 2" >> /etc/fstab
+    else
+        echo "Already present in /etc/fstab"
+    fi
+
+    mkdir -p "$MOUNT_POINT"
+    if mountpoint -q "$MOUNT_POINT"; then
+        echo "RAID array already mounted at $MOUNT_POINT"
+    else
+        echo "Mounting RAID array at $MOUNT_POINT..."
+        mount "$MOUNT_POINT"
+    fi
+}
+
+# Function to assemble the existing array with the given UUID
+assemble_raid() {
+    local uuid=$1 device fstype
+    device=/dev/disk/by-id/md-uuid-$uuid
+    if [ ! -e "$device" ]; then
+        echo "Assembling RAID array $uuid..."
+        mdadm --assemble --scan --uuid="$uuid"
+        udevadm settle
+    fi
+    device=$(readlink -f "$device")
+    echo "RAID array $uuid is $device"
+    mdadm --detail "$device"
+    save_array "$device"
+
+    fstype=$(blkid -s TYPE -o value "$device" 2>/dev/null || true)
+    if [ -z "$fstype" ]; then
+        echo "ERROR: No filesystem found on $device, not mounting it"
+        exit 1
+    fi
+    mount_raid "$device" "$fstype"
+    echo "RAID assembly completed successfully"
+}
+
+# Function to create a new array. It refuses unless the member disks are as
+# many as the host spec expects and about the same size
+create_raid() {
+    local disks=("$@") expected disk size smallest=0 largest=0 args
+    if [ "$RAID_DEVICES" -eq 0 ]; then
+        echo "ERROR: The host spec sets no raid devices, refusing to create an array"
+        exit 1
+    fi
+
+    expected=$((RAID_DEVICES + SPARE_DEVICES))
+    if [ ${#disks[@]} -ne "$expected" ]; then
+        echo "ERROR: $expected disks should match the raid members (${MEMBER_CRITERIA[*]}), ${#disks[@]} do: ${disks[*]}"
+        echo "Refusing to create the array"
+        exit 1
+    fi
+    for disk in "${disks[@]}"; do
+        size=$(blockdev --getsize64 "$disk")
+        echo "$disk: $size bytes"
+        if [ "$smallest" -eq 0 ] || [ "$size" -lt "$smallest" ]; then
+            smallest=$size
+        fi
+        if [ "$size" -gt "$largest" ]; then
+            largest=$size
+        fi
+    done
+    if [ $(( (largest - smallest) * 100 )) -gt "$smallest" ]; then
+        echo "ERROR: The member disks differ in size by more than 1%, refusing to create the array"
+        exit 1
+    fi
+
+    echo "Creating new RAID $RAID_LEVEL array $RAID_DEVICE from ${disks[*]}..."
+    echo "Wiping existing metadata from disks..."
+    for disk in "${disks[@]}"; do
+        mdadm --zero-superblock "$disk" 2>/dev/null || true
+        wipefs -a "$disk"
+    done
+
+    args=(--create "$RAID_DEVICE" --run --level="$RAID_LEVEL" --raid-devices="$RAID_DEVICES")
+    if [ "$SPARE_DEVICES" -gt 0 ]; then
+        args+=(--spare-devices="$SPARE_DEVICES")
+    fi
+    if [ "$CHUNK_KIB" -gt 0 ]; then
+        args+=(--chunk="$CHUNK_KIB")
+    fi
+    mdadm "${args[@]}" "${disks[@]}"
+    udevadm settle
+    echo "RAID array created successfully"
+
+    echo "Creating $FILESYSTEM filesystem on $RAID_DEVICE..."
+    case $FILESYSTEM in
+        ext4)
+            mkfs.ext4 -F "$RAID_DEVICE"
+            ;;
+        xfs)
+            mkfs.xfs -f "$RAID_DEVICE"
+            ;;
+        btrfs)
+            mkfs.btrfs -f "$RAID_DEVICE"
+            ;;
+    esac
+
+    save_array "$RAID_DEVICE"
+    mount_raid "$RAID_DEVICE" "$FILESYSTEM"
+
+    echo "RAID array created, formatted, and mounted successfully"
+    echo "Note: Array may be syncing in the background. Check status with: cat /proc/mdstat"
+}
+
+# Main logic
+mapfile -t MEMBER_DISKS < <(find_member_disks)
+echo "Member disks: ${MEMBER_DISKS[*]:-none}"
+
+UUIDS=()
+for disk in "${MEMBER_DISKS[@]}"; do
+    uuid=$(mdadm --examine --export "$disk" 2>/dev/null | sed -n 's/^MD_UUID=//p')
+    if [ -n "$uuid" ] && [[ " ${UUIDS[*]} " != *" $uuid "* ]]; then
+        UUIDS+=("$uuid")
+    fi
+done
+
+case ${#UUIDS[@]} in
+    0)
+        echo "No existing RAID array found on the member disks. Creating new array..."
+        create_raid "${MEMBER_DISKS[@]}"
+        ;;
+    1)
+        echo "Existing RAID array ${UUIDS[0]} found on the member disks. Attempting to assemble..."
+        assemble_raid "${UUIDS[0]}"
+        ;;
+    *)
+        echo "ERROR: The member disks belong to more than one RAID array: ${UUIDS[*]}"
+        exit 1
+        ;;
+esac
+
+echo ""
+echo "========================================="
+echo "RAID Setup Completed: $(date)"
+echo "========================================="
+echo ""
+echo "Current RAID status:"
+cat /proc/mdstat
+echo ""
+if mountpoint -q "$MOUNT_POINT" 2>/dev/null; then
+    echo "Mount status:"
+    df -h "$MOUNT_POINT"
+fi
@@ -0,0 +1,103 @@
+package generate_cloud_config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestResolveModules(t *testing.T) {
+	tests := []struct {
+		name     string
+		modules  []string
+		without  []string
+		resolved []string
+		err      string
+	}{
+		{
+			name:     "defaults",
+			resolved: []string{"docker", "nvidia", "raid", "media-stack"},
+		},
+		{
+			name:     "defaults without a module",
+			without:  []string{"nvidia"},
+			resolved: []string{"docker", "raid", "media-stack"},
+		},
+		{
+			name:     "listed modules replace the defaults",
+			modules:  []string{"raid", "disk-alerts"},
+			resolved: []string{"raid", "disk-alerts"},
+		},
+		{
+			name:     "required modules are added in application order",
+			modules:  []string{"media-stack"},
+			resolved: []string{"docker", "media-stack"},
+		},
+		{
+			name:     "a module listed twice",
+			modules:  []string{"docker", "docker"},
+			resolved: []string{"docker"},
+		},
+		{
+			name:     "excluding a listed module",
+			modules:  []string{"docker", "hardening"},
+			without:  []string{"hardening"},
+			resolved: []string{"docker"},
+		},
+		{
+			name:    "excluding a required module",
+			modules: []string{"media-stack"},
+			without: []string{"docker"},
+			err:     "module media-stack requires module docker, which is excluded",
+		},
+		{
+			name:    "excluding a module the defaults require",
+			without: []string{"docker"},
+			err:     "module media-stack requires module docker, which is excluded",
+		},
+		{
+			name:    "unknown module",
+			modules: []string{"docker", "kubernetes"},
+			err:     `unknown module "kubernetes"`,
+		},
+		{
+			name:    "unknown excluded module",
+			modules: []string{"docker"},
+			without: []string{"kubernetes"},
+			err:     `unknown module "kubernetes"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			modules, err := resolveModules(CloudConfigContext{Modules: test.modules, WithoutModules: test.without})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, module := range modules {
+				names = append(names, module.Name())
+			}
+			if !slices.Equal(names, test.resolved) {
+				t.Errorf("resolved %q, want %q", names, test.resolved)
+			}
+		})
+	}
+}
+
+func TestValidateModuleInputs(t *testing.T) {
+	module, _ := lookupModule("media-stack")
+	err := validateModuleInputs(CloudConfigContext{PlexClaim: "claim-1"}, []Module{module})
+	if err == nil || err.Error() != "missing required inputs: cloudflared-token (required by module media-stack)" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if err = validateModuleInputs(CloudConfigContext{PlexClaim: "claim-1", CloudflaredToken: "token"}, []Module{module}); err != nil {
+		t.Error(err)
+	}
+}
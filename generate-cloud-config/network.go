@@ -0,0 +1,361 @@
+package generate_cloud_config
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Network is the network section of a host spec, a netplan v2 configuration.
+// It configures the live installer through the nocloud network-config and the
+// installed system through the autoinstall network section. Hosts without it
+// use DHCP.
+type Network struct {
+	// Version is the netplan version, 2 when it is empty.
+	Version   int                 `yaml:"version"`
+	Ethernets map[string]Ethernet `yaml:"ethernets,omitempty"`
+	Bonds     map[string]Bond     `yaml:"bonds,omitempty"`
+	Vlans     map[string]Vlan     `yaml:"vlans,omitempty"`
+	Bridges   map[string]Bridge   `yaml:"bridges,omitempty"`
+}
+
+// InterfaceConfig holds the addressing every kind of interface shares.
+type InterfaceConfig struct {
+	DHCP4 *bool `yaml:"dhcp4,omitempty"`
+	DHCP6 *bool `yaml:"dhcp6,omitempty"`
+	// Addresses are static addresses in CIDR notation.
+	Addresses   []string     `yaml:"addresses,omitempty"`
+	Routes      []Route      `yaml:"routes,omitempty"`
+	Nameservers *Nameservers `yaml:"nameservers,omitempty"`
+	MTU         int          `yaml:"mtu,omitempty"`
+	// Optional keeps boot from waiting for the interface.
+	Optional bool `yaml:"optional,omitempty"`
+}
+
+// Route is a static route. To is a CIDR prefix or default.
+type Route struct {
+	To     string `yaml:"to"`
+	Via    string `yaml:"via"`
+	Metric int    `yaml:"metric,omitempty"`
+	OnLink bool   `yaml:"on-link,omitempty"`
+}
+
+type Nameservers struct {
+	Addresses []string `yaml:"addresses,omitempty"`
+	Search    []string `yaml:"search,omitempty"`
+}
+
+// Ethernet is a physical interface. Without a match the interface is the one
+// named like its id.
+type Ethernet struct {
+	Match *EthernetMatch `yaml:"match,omitempty"`
+	// SetName renames the matched interface.
+	SetName         string `yaml:"set-name,omitempty"`
+	WakeOnLan       bool   `yaml:"wakeonlan,omitempty"`
+	InterfaceConfig `yaml:",inline"`
+}
+
+// EthernetMatch selects an interface by MAC address, by name or both. The
+// name may be a glob.
+type EthernetMatch struct {
+	MACAddress string `yaml:"macaddress,omitempty"`
+	Name       string `yaml:"name,omitempty"`
+	Driver     string `yaml:"driver,omitempty"`
+}
+
+type Bond struct {
+	// Interfaces are the ids of the ethernets in the bond.
+	Interfaces      []string        `yaml:"interfaces"`
+	Parameters      *BondParameters `yaml:"parameters,omitempty"`
+	InterfaceConfig `yaml:",inline"`
+}
+
+type BondParameters struct {
+	Mode               string `yaml:"mode,omitempty"`
+	LACPRate           string `yaml:"lacp-rate,omitempty"`
+	MIIMonitorInterval int    `yaml:"mii-monitor-interval,omitempty"`
+	TransmitHashPolicy string `yaml:"transmit-hash-policy,omitempty"`
+	Primary            string `yaml:"primary,omitempty"`
+}
+
+type Vlan struct {
+	ID int `yaml:"id"`
+	// Link is the id of the interface the VLAN is on.
+	Link            string `yaml:"link"`
+	InterfaceConfig `yaml:",inline"`
+}
+
+type Bridge struct {
+	// Interfaces are the ids of the interfaces in the bridge.
+	Interfaces      []string          `yaml:"interfaces"`
+	Parameters      *BridgeParameters `yaml:"parameters,omitempty"`
+	InterfaceConfig `yaml:",inline"`
+}
+
+type BridgeParameters struct {
+	STP          *bool `yaml:"stp,omitempty"`
+	ForwardDelay int   `yaml:"forward-delay,omitempty"`
+}
+
+var (
+	bondModes            = []string{"balance-rr", "active-backup", "balance-xor", "broadcast", "802.3ad", "balance-tlb", "balance-alb"}
+	bondLACPRates        = []string{"slow", "fast"}
+	bondTransmitPolicies = []string{"layer2", "layer3+4", "layer2+3", "encap2+3", "encap3+4"}
+)
+
+// IsZero reports whether the host spec leaves the network to DHCP.
+func (n Network) IsZero() bool {
+	return n.Version == 0 && len(n.Ethernets) == 0 && len(n.Bonds) == 0 && len(n.Vlans) == 0 && len(n.Bridges) == 0
+}
+
+// Config validates the network section and returns it as netplan writes it.
+func (n Network) Config() (config Network, err error) {
+	config = n
+	if config.Version == 0 {
+		config.Version = 2
+	}
+	if config.Version != 2 {
+		return config, fmt.Errorf("unsupported netplan version %d, expected 2", config.Version)
+	}
+
+	kinds := map[string]string{}
+	addKind := func(kind string, ids []string) error {
+		for _, id := range ids {
+			if id == "" || strings.ContainsAny(id, " \t/") {
+				return fmt.Errorf("invalid %s id %q", kind, id)
+			}
+			if other, ok := kinds[id]; ok {
+				return fmt.Errorf("%s %s has the same id as %s %s", kind, id, other, id)
+			}
+			kinds[id] = kind
+		}
+		return nil
+	}
+	if err = addKind("ethernet", sortedKeys(n.Ethernets)); err != nil {
+		return
+	}
+	if err = addKind("bond", sortedKeys(n.Bonds)); err != nil {
+		return
+	}
+	if err = addKind("vlan", sortedKeys(n.Vlans)); err != nil {
+		return
+	}
+	if err = addKind("bridge", sortedKeys(n.Bridges)); err != nil {
+		return
+	}
+	if len(kinds) == 0 {
+		return config, fmt.Errorf("the network section defines no interfaces")
+	}
+
+	// members maps every interface in a bond or bridge to the one it is in.
+	members := map[string]string{}
+	addMembers := func(kind, id string, interfaces []string, allowed ...string) error {
+		if len(interfaces) == 0 {
+			return fmt.Errorf("%s %s has no interfaces", kind, id)
+		}
+		for _, member := range interfaces {
+			memberKind, ok := kinds[member]
+			if !ok {
+				return fmt.Errorf("%s %s: interface %s is not defined", kind, id, member)
+			}
+			if !slices.Contains(allowed, memberKind) {
+				return fmt.Errorf("%s %s: %s %s cannot be a member, expected a %s", kind, id, memberKind, member, strings.Join(allowed, " or "))
+			}
+			if other, ok := members[member]; ok {
+				return fmt.Errorf("%s %s: %s is already in %s", kind, id, member, other)
+			}
+			members[member] = id
+		}
+		return nil
+	}
+
+	for _, id := range sortedKeys(n.Bonds) {
+		bond := n.Bonds[id]
+		if err = addMembers("bond", id, bond.Interfaces, "ethernet"); err != nil {
+			return
+		}
+		if err = bond.Parameters.validate(bond.Interfaces); err != nil {
+			return config, fmt.Errorf("bond %s: %w", id, err)
+		}
+	}
+	for _, id := range sortedKeys(n.Bridges) {
+		if err = addMembers("bridge", id, n.Bridges[id].Interfaces, "ethernet", "bond", "vlan"); err != nil {
+			return
+		}
+	}
+	for _, id := range sortedKeys(n.Vlans) {
+		vlan := n.Vlans[id]
+		if vlan.ID < 1 || vlan.ID > 4094 {
+			return config, fmt.Errorf("vlan %s: id %d is not between 1 and 4094", id, vlan.ID)
+		}
+		if kind, ok := kinds[vlan.Link]; !ok || kind == "vlan" {
+			return config, fmt.Errorf("vlan %s: link %q is not an ethernet, bond or bridge", id, vlan.Link)
+		}
+	}
+
+	for _, id := range sortedKeys(n.Ethernets) {
+		ethernet := n.Ethernets[id]
+		if err = ethernet.validate(); err != nil {
+			return config, fmt.Errorf("ethernet %s: %w", id, err)
+		}
+	}
+
+	interfaces := map[string]InterfaceConfig{}
+	for id, ethernet := range n.Ethernets {
+		interfaces[id] = ethernet.InterfaceConfig
+	}
+	for id, bond := range n.Bonds {
+		interfaces[id] = bond.InterfaceConfig
+	}
+	for id, vlan := range n.Vlans {
+		interfaces[id] = vlan.InterfaceConfig
+	}
+	for id, bridge := range n.Bridges {
+		interfaces[id] = bridge.InterfaceConfig
+	}
+	for _, id := range sortedKeys(interfaces) {
+		iface := interfaces[id]
+		if owner, ok := members[id]; ok && iface.addressed() {
+			return config, fmt.Errorf("%s %s is in %s, which is addressed instead", kinds[id], id, owner)
+		}
+		if err = iface.validate(); err != nil {
+			return config, fmt.Errorf("%s %s: %w", kinds[id], id, err)
+		}
+	}
+
+	return config, nil
+}
+
+// addressed reports whether an interface gets an address.
+func (c InterfaceConfig) addressed() bool {
+	return (c.DHCP4 != nil && *c.DHCP4) || (c.DHCP6 != nil && *c.DHCP6) || len(c.Addresses) > 0 || len(c.Routes) > 0
+}
+
+// staticAddresses returns the static addresses of every interface without
+// their prefix length.
+func (n Network) staticAddresses() (addresses []string) {
+	var configs []InterfaceConfig
+	for _, id := range sortedKeys(n.Ethernets) {
+		configs = append(configs, n.Ethernets[id].InterfaceConfig)
+	}
+	for _, id := range sortedKeys(n.Bonds) {
+		configs = append(configs, n.Bonds[id].InterfaceConfig)
+	}
+	for _, id := range sortedKeys(n.Vlans) {
+		configs = append(configs, n.Vlans[id].InterfaceConfig)
+	}
+	for _, id := range sortedKeys(n.Bridges) {
+		configs = append(configs, n.Bridges[id].InterfaceConfig)
+	}
+	for _, config := range configs {
+		for _, address := range config.Addresses {
+			if prefix, err := netip.ParsePrefix(address); err == nil {
+				addresses = append(addresses, prefix.Addr().String())
+			}
+		}
+	}
+	return
+}
+
+func (c InterfaceConfig) validate() error {
+	for _, address := range c.Addresses {
+		if _, err := netip.ParsePrefix(address); err != nil {
+			return fmt.Errorf("address %q is not in CIDR notation", address)
+		}
+	}
+	for _, route := range c.Routes {
+		if err := route.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Nameservers != nil {
+		for _, address := range c.Nameservers.Addresses {
+			if _, err := netip.ParseAddr(address); err != nil {
+				return fmt.Errorf("nameserver %q is not an IP address", address)
+			}
+		}
+	}
+	if c.MTU != 0 && (c.MTU < 68 || c.MTU > 65535) {
+		return fmt.Errorf("mtu %d is not between 68 and 65535", c.MTU)
+	}
+	return nil
+}
+
+func (r Route) validate() error {
+	via, err := netip.ParseAddr(r.Via)
+	if err != nil {
+		return fmt.Errorf("route to %s: via %q is not an IP address", r.To, r.Via)
+	}
+	if r.Metric < 0 {
+		return fmt.Errorf("route to %s: metric cannot be negative", r.To)
+	}
+	if r.To == "default" {
+		return nil
+	}
+	to, err := netip.ParsePrefix(r.To)
+	if err != nil {
+		return fmt.Errorf("route to %q: expected default or a prefix in CIDR notation", r.To)
+	}
+	if to.Addr().Is4() != via.Is4() {
+		return fmt.Errorf("route to %s: via %s is from another address family", r.To, r.Via)
+	}
+	return nil
+}
+
+func (e Ethernet) validate() error {
+	if e.Match == nil {
+		if e.SetName != "" {
+			return fmt.Errorf("set-name needs a match")
+		}
+		return nil
+	}
+	if *e.Match == (EthernetMatch{}) {
+		return fmt.Errorf("match needs a macaddress, a name or a driver")
+	}
+	if e.Match.MACAddress != "" {
+		mac, err := net.ParseMAC(e.Match.MACAddress)
+		if err != nil || len(mac) != 6 {
+			return fmt.Errorf("match macaddress %q is not a MAC address", e.Match.MACAddress)
+		}
+	}
+	if len(e.SetName) > 15 || strings.ContainsAny(e.SetName, " \t/") {
+		return fmt.Errorf("invalid set-name %q", e.SetName)
+	}
+	return nil
+}
+
+func (p *BondParameters) validate(interfaces []string) error {
+	if p == nil {
+		return nil
+	}
+	if p.Mode != "" && !slices.Contains(bondModes, p.Mode) {
+		return fmt.Errorf("unsupported mode %q, expected one of %s", p.Mode, strings.Join(bondModes, ", "))
+	}
+	if p.LACPRate != "" {
+		if p.Mode != "802.3ad" {
+			return fmt.Errorf("lacp-rate only applies to mode 802.3ad")
+		}
+		if !slices.Contains(bondLACPRates, p.LACPRate) {
+			return fmt.Errorf("unsupported lacp-rate %q, expected slow or fast", p.LACPRate)
+		}
+	}
+	if p.TransmitHashPolicy != "" && !slices.Contains(bondTransmitPolicies, p.TransmitHashPolicy) {
+		return fmt.Errorf("unsupported transmit-hash-policy %q, expected one of %s", p.TransmitHashPolicy, strings.Join(bondTransmitPolicies, ", "))
+	}
+	if p.MIIMonitorInterval < 0 {
+		return fmt.Errorf("mii-monitor-interval cannot be negative")
+	}
+	if p.Primary != "" && !slices.Contains(interfaces, p.Primary) {
+		return fmt.Errorf("primary %s is not one of its interfaces", p.Primary)
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of a map in order, so validation errors are
+// reproducible.
+func sortedKeys[V any](m map[string]V) []string {
+	return slices.Sorted(maps.Keys(m))
+}
@@ -0,0 +1,216 @@
+package generate_cloud_config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// networkConfig decodes a network section and renders it the way the
+// network-config of the live installer is written.
+func networkConfig(t *testing.T, spec string) (string, error) {
+	t.Helper()
+
+	var network Network
+	if err := yaml.Unmarshal([]byte(spec), &network); err != nil {
+		t.Fatal(err)
+	}
+	config, err := network.Config()
+	if err != nil {
+		return "", err
+	}
+	rendered, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(rendered), nil
+}
+
+func TestNetworkConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		spec   string
+		config string
+	}{
+		{
+			name: "static addresses, routes and DNS",
+			spec: `
+ethernets:
+  eno1:
+    addresses: [192.0.2.10/24, "2001:db8::10/64"]
+    routes:
+      - to: default
+        via: 192.0.2.1
+      - to: 198.51.100.0/24
+        via: 192.0.2.254
+        metric: 100
+    nameservers:
+      addresses: [192.0.2.53, "2001:db8::53"]
+      search: [example.com]
+`,
+			config: `version: 2
+ethernets:
+    eno1:
+        addresses:
+            - 192.0.2.10/24
+            - 2001:db8::10/64
+        routes:
+            - to: default
+              via: 192.0.2.1
+            - to: 198.51.100.0/24
+              via: 192.0.2.254
+              metric: 100
+        nameservers:
+            addresses:
+                - 192.0.2.53
+                - 2001:db8::53
+            search:
+                - example.com
+`,
+		},
+		{
+			name: "bond, VLAN and bridge",
+			spec: `
+ethernets:
+  eth0:
+    match: {macaddress: "00:11:22:33:44:55"}
+    set-name: lan0
+  eth1:
+    match: {macaddress: "00:11:22:33:44:66"}
+  eth2: {}
+bonds:
+  bond0:
+    interfaces: [eth0, eth1]
+    parameters:
+      mode: 802.3ad
+      lacp-rate: fast
+      mii-monitor-interval: 100
+      transmit-hash-policy: layer3+4
+    addresses: [10.0.0.5/24]
+vlans:
+  vlan20:
+    id: 20
+    link: bond0
+    mtu: 9000
+bridges:
+  br0:
+    interfaces: [vlan20, eth2]
+    dhcp4: true
+    parameters:
+      stp: false
+`,
+			config: `version: 2
+ethernets:
+    eth0:
+        match:
+            macaddress: "00:11:22:33:44:55"
+        set-name: lan0
+    eth1:
+        match:
+            macaddress: 00:11:22:33:44:66
+    eth2: {}
+bonds:
+    bond0:
+        interfaces:
+            - eth0
+            - eth1
+        parameters:
+            mode: 802.3ad
+            lacp-rate: fast
+            mii-monitor-interval: 100
+            transmit-hash-policy: layer3+4
+        addresses:
+            - 10.0.0.5/24
+vlans:
+    vlan20:
+        id: 20
+        link: bond0
+        mtu: 9000
+bridges:
+    br0:
+        interfaces:
+            - vlan20
+            - eth2
+        parameters:
+            stp: false
+        dhcp4: true
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := networkConfig(t, test.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config != test.config {
+				t.Errorf("network-config is\n%s\nwant\n%s", config, test.config)
+			}
+		})
+	}
+}
+
+func TestNetworkConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		err  string
+	}{
+		{name: "version", spec: "version: 1\nethernets: {eth0: {}}", err: "unsupported netplan version 1"},
+		{name: "no interfaces", spec: "version: 2", err: "defines no interfaces"},
+		{name: "invalid id", spec: "ethernets: {\"eth 0\": {}}", err: `invalid ethernet id "eth 0"`},
+		{name: "shared id", spec: "ethernets: {eth0: {}}\nbonds: {eth0: {interfaces: [eth0]}}", err: "bond eth0 has the same id as ethernet eth0"},
+		{name: "address without prefix", spec: "ethernets: {eth0: {addresses: [192.0.2.10]}}", err: `ethernet eth0: address "192.0.2.10" is not in CIDR notation`},
+		{name: "invalid address", spec: "ethernets: {eth0: {addresses: [192.0.2.300/24]}}", err: "is not in CIDR notation"},
+		{name: "route via", spec: "ethernets: {eth0: {routes: [{to: default, via: gateway}]}}", err: `via "gateway" is not an IP address`},
+		{name: "route to", spec: "ethernets: {eth0: {routes: [{to: 10.0.0.0, via: 192.0.2.1}]}}", err: "expected default or a prefix in CIDR notation"},
+		{name: "route family", spec: "ethernets: {eth0: {routes: [{to: \"2001:db8::/32\", via: 192.0.2.1}]}}", err: "from another address family"},
+		{name: "route metric", spec: "ethernets: {eth0: {routes: [{to: default, via: 192.0.2.1, metric: -1}]}}", err: "metric cannot be negative"},
+		{name: "nameserver", spec: "ethernets: {eth0: {nameservers: {addresses: [dns.example.com]}}}", err: `nameserver "dns.example.com" is not an IP address`},
+		{name: "mtu", spec: "ethernets: {eth0: {mtu: 20}}", err: "mtu 20 is not between 68 and 65535"},
+		{name: "set-name without match", spec: "ethernets: {eth0: {set-name: lan0}}", err: "set-name needs a match"},
+		{name: "empty match", spec: "ethernets: {eth0: {match: {}}}", err: "match needs a macaddress"},
+		{name: "mac address", spec: "ethernets: {eth0: {match: {macaddress: \"00:11:22\"}}}", err: "is not a MAC address"},
+		{name: "bond without interfaces", spec: "bonds: {bond0: {}}", err: "bond bond0 has no interfaces"},
+		{name: "bond of an undefined interface", spec: "bonds: {bond0: {interfaces: [eth0]}}", err: "interface eth0 is not defined"},
+		{name: "bond of a bond", spec: "ethernets: {eth0: {}}\nbonds: {bond0: {interfaces: [eth0]}, bond1: {interfaces: [bond0]}}", err: "bond bond0 cannot be a member, expected a ethernet"},
+		{name: "interface in two bonds", spec: "ethernets: {eth0: {}}\nbonds: {bond0: {interfaces: [eth0]}, bond1: {interfaces: [eth0]}}", err: "eth0 is already in bond0"},
+		{name: "bond mode", spec: "ethernets: {eth0: {}}\nbonds: {bond0: {interfaces: [eth0], parameters: {mode: lacp}}}", err: `unsupported mode "lacp"`},
+		{name: "lacp-rate without 802.3ad", spec: "ethernets: {eth0: {}}\nbonds: {bond0: {interfaces: [eth0], parameters: {mode: active-backup, lacp-rate: fast}}}", err: "lacp-rate only applies to mode 802.3ad"},
+		{name: "bond primary", spec: "ethernets: {eth0: {}, eth1: {}}\nbonds: {bond0: {interfaces: [eth0], parameters: {primary: eth1}}}", err: "primary eth1 is not one of its interfaces"},
+		{name: "addressed bond member", spec: "ethernets: {eth0: {dhcp4: true}}\nbonds: {bond0: {interfaces: [eth0]}}", err: "ethernet eth0 is in bond0, which is addressed instead"},
+		{name: "vlan id", spec: "ethernets: {eth0: {}}\nvlans: {vlan0: {id: 4095, link: eth0}}", err: "id 4095 is not between 1 and 4094"},
+		{name: "vlan link", spec: "ethernets: {eth0: {}}\nvlans: {vlan10: {id: 10, link: eth1}}", err: `link "eth1" is not an ethernet, bond or bridge`},
+		{name: "vlan on a vlan", spec: "ethernets: {eth0: {}}\nvlans: {vlan10: {id: 10, link: eth0}, vlan20: {id: 20, link: vlan10}}", err: `vlan vlan20: link "vlan10"`},
+		{name: "bridge of a bridge", spec: "ethernets: {eth0: {}}\nbridges: {br0: {interfaces: [eth0]}, br1: {interfaces: [br0]}}", err: "bridge br0 cannot be a member"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := networkConfig(t, test.spec); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestNetworkStaticAddresses(t *testing.T) {
+	var network Network
+	spec := `
+ethernets:
+  eth0: {addresses: [192.0.2.10/24, "2001:db8::10/64"]}
+  eth1: {dhcp4: true}
+vlans:
+  vlan10: {id: 10, link: eth1, addresses: [10.10.0.2/16]}
+`
+	if err := yaml.Unmarshal([]byte(spec), &network); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"192.0.2.10", "2001:db8::10", "10.10.0.2"}
+	if addresses := network.staticAddresses(); !slices.Equal(addresses, want) {
+		t.Errorf("static addresses are %q, want %q", addresses, want)
+	}
+}
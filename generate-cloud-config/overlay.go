@@ -0,0 +1,172 @@
+package generate_cloud_config
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// WhiteoutPrefix marks a file in an overlay layer that deletes the path of the
+// same name, without the prefix, from the layers below it. Deleting a
+// directory removes everything under it.
+const WhiteoutPrefix = ".wh."
+
+// FileLayer is one tree of files rooted at the target's /.
+type FileLayer struct {
+	Name string
+	FS   fs.FS
+}
+
+// MergedFile is a file of the merged tree and the layer it came from.
+type MergedFile struct {
+	// Path is the absolute path of the file on the target.
+	Path string
+	// Source is the path of the file inside its layer, including any .tpl
+	// suffix.
+	Source   string
+	Layer    string
+	FS       fs.FS
+	Template bool
+	// Sidecar is the metadata file describing this file, if there is one.
+	Sidecar      string
+	SidecarLayer string
+	SidecarFS    fs.FS
+}
+
+// MergeLayers overlays the layers in order, later layers winning. A file and
+// its .tpl variant share a target path, so either can replace the other.
+// Sidecar metadata files are attached to the file they describe, whichever
+// layer that file comes from.
+func MergeLayers(layers []FileLayer) (files []MergedFile, err error) {
+	merged := map[string]MergedFile{}
+	sidecars := map[string]MergedFile{}
+	for _, layer := range layers {
+		err = fs.WalkDir(layer.FS, ".", func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+
+			dir, name := path.Split(p)
+			if strings.HasPrefix(name, WhiteoutPrefix) {
+				removed := "/" + strings.TrimSuffix(path.Join(dir, strings.TrimPrefix(name, WhiteoutPrefix)), ".tpl")
+				for _, tree := range []map[string]MergedFile{merged, sidecars} {
+					for target := range tree {
+						if target == removed || strings.HasPrefix(target, removed+"/") {
+							delete(tree, target)
+						}
+					}
+				}
+				return nil
+			}
+
+			if strings.HasSuffix(name, SidecarSuffix) {
+				target := "/" + strings.TrimSuffix(strings.TrimSuffix(p, SidecarSuffix), ".tpl")
+				sidecars[target] = MergedFile{Path: target, Source: p, Layer: layer.Name, FS: layer.FS}
+				return nil
+			}
+
+			target := "/" + strings.TrimSuffix(p, ".tpl")
+			merged[target] = MergedFile{
+				Path:     target,
+				Source:   p,
+				Layer:    layer.Name,
+				FS:       layer.FS,
+				Template: strings.HasSuffix(p, ".tpl"),
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error reading layer %s: %w", layer.Name, err)
+		}
+	}
+
+	for target, file := range merged {
+		if sidecar, ok := sidecars[target]; ok {
+			file.Sidecar = sidecar.Source
+			file.SidecarLayer = sidecar.Layer
+			file.SidecarFS = sidecar.FS
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	return
+}
+
+// fileLayers returns the embedded base tree, the trees of the enabled modules
+// and the host's overlay directories, in the order they are merged.
+func fileLayers(ctx CloudConfigContext, modules []Module) (layers []FileLayer, err error) {
+	baseFiles, err := fs.Sub(filesFS, "files")
+	if err != nil {
+		return
+	}
+	layers = append(layers, FileLayer{Name: "embedded", FS: baseFiles})
+
+	for _, module := range modules {
+		if tree := module.Files(); tree != nil {
+			layers = append(layers, FileLayer{Name: "module:" + module.Name(), FS: tree})
+		}
+	}
+
+	for _, dir := range ctx.FilesDirs {
+		stat, statErr := os.Stat(dir)
+		if statErr != nil {
+			return nil, fmt.Errorf("error reading files directory %s: %w", dir, statErr)
+		}
+		if !stat.IsDir() {
+			return nil, fmt.Errorf("files directory %s is not a directory", dir)
+		}
+		layers = append(layers, FileLayer{Name: dir, FS: os.DirFS(dir)})
+	}
+
+	return
+}
+
+// ListedFile is a file of the merged tree as it is installed on a host.
+type ListedFile struct {
+	MergedFile
+	Target string
+	Meta   FileMetadata
+	// Enabled is false when the file's condition does not hold for the host.
+	Enabled bool
+}
+
+// ListFiles returns the merged file tree of ctx and whether each file is
+// installed on the host.
+func ListFiles(ctx CloudConfigContext) (listed []ListedFile, err error) {
+	modules, err := resolveModules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	renderCtx := RenderContext{CloudConfigContext: ctx}
+	for _, module := range modules {
+		renderCtx.EnabledModules = append(renderCtx.EnabledModules, module.Name())
+	}
+
+	layers, err := fileLayers(ctx, modules)
+	if err != nil {
+		return nil, err
+	}
+	files, err := MergeLayers(layers)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		_, meta, err := loadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		target, resolved := resolveTarget(ctx, file.Path, meta)
+		listed = append(listed, ListedFile{MergedFile: file, Target: target, Meta: resolved, Enabled: meta.enabled(renderCtx)})
+	}
+	return
+}
@@ -0,0 +1,137 @@
+package generate_cloud_config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMergeLayers(t *testing.T) {
+	layers := []FileLayer{
+		{Name: "base", FS: fstest.MapFS{
+			"etc/motd":             {Data: []byte("base")},
+			"etc/hostname.tpl":     {Data: []byte("{{ .Hostname }}")},
+			"etc/issue":            {Data: []byte("base")},
+			"etc/issue.meta":       {Data: []byte("mode: \"0600\"\n")},
+			"etc/app/app.conf":     {Data: []byte("base")},
+			"etc/app/conf.d/a":     {Data: []byte("base")},
+			"etc/apparmor/profile": {Data: []byte("base")},
+			"etc/cron.tpl":         {Data: []byte("base")},
+			"etc/cron.tpl.meta":    {Data: []byte("mode: \"0600\"\n")},
+			"etc/keep":             {Data: []byte("base")},
+		}},
+		{Name: "middle", FS: fstest.MapFS{
+			"etc/motd":       {Data: []byte("middle")},
+			"etc/hostname":   {Data: []byte("static")},
+			"etc/issue.meta": {Data: []byte("mode: \"0640\"\n")},
+			"etc/.wh.app":    {},
+			"etc/.wh.cron":   {},
+		}},
+		{Name: "top", FS: fstest.MapFS{
+			"etc/motd.tpl":     {Data: []byte("top")},
+			"etc/app/app.conf": {Data: []byte("top")},
+			"etc/cron":         {Data: []byte("top")},
+		}},
+	}
+
+	files, err := MergeLayers(layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []MergedFile{
+		// A layer above a whiteout can add the path back, without the
+		// removed directory's other files.
+		{Path: "/etc/app/app.conf", Source: "etc/app/app.conf", Layer: "top"},
+		// Whiteouts only remove the named path, not others sharing its prefix.
+		{Path: "/etc/apparmor/profile", Source: "etc/apparmor/profile", Layer: "base"},
+		// The whiteout removed the sidecar with its file.
+		{Path: "/etc/cron", Source: "etc/cron", Layer: "top"},
+		// A plain file replaces the template of the same target.
+		{Path: "/etc/hostname", Source: "etc/hostname", Layer: "middle"},
+		// The sidecar of a later layer describes the file of an earlier one.
+		{Path: "/etc/issue", Source: "etc/issue", Layer: "base", Sidecar: "etc/issue.meta", SidecarLayer: "middle"},
+		{Path: "/etc/keep", Source: "etc/keep", Layer: "base"},
+		// A template replaces the plain file of the same target.
+		{Path: "/etc/motd", Source: "etc/motd.tpl", Layer: "top", Template: true},
+	}
+	if len(files) != len(want) {
+		var paths []string
+		for _, file := range files {
+			paths = append(paths, file.Path)
+		}
+		t.Fatalf("merged tree is %q, want %d files", paths, len(want))
+	}
+	for i, file := range files {
+		w := want[i]
+		if file.Path != w.Path || file.Source != w.Source || file.Layer != w.Layer || file.Template != w.Template ||
+			file.Sidecar != w.Sidecar || file.SidecarLayer != w.SidecarLayer {
+			t.Errorf("file %d is %+v, want %+v", i, file, w)
+		}
+	}
+
+	for _, file := range files {
+		if file.Path != "/etc/issue" {
+			continue
+		}
+		_, meta, err := loadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.FileMode() != 0640 {
+			t.Errorf("/etc/issue has mode %04o, want the later sidecar's 0640", meta.FileMode())
+		}
+	}
+}
+
+func TestListFilesConditions(t *testing.T) {
+	dir := t.TempDir()
+	tree := map[string]string{
+		"etc/docker-only":   "#meta\nwhen:\n  module: docker\n#/meta\n",
+		"etc/raid-only":     "#meta\nwhen:\n  module: raid\n#/meta\n",
+		"etc/feature":       "#meta\nwhen:\n  value: feature.enabled\n#/meta\n",
+		"etc/feature-beta":  "#meta\nwhen:\n  value: feature.channel\n  equals: beta\n#/meta\n",
+		"etc/unconditional": "plain\n",
+	}
+	for name, content := range tree {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := CloudConfigContext{
+		AdminUsername: "admin",
+		Modules:       []string{"docker"},
+		FilesDirs:     []string{dir},
+		Values:        map[string]interface{}{"feature": map[string]interface{}{"enabled": true, "channel": "stable"}},
+	}
+	files, err := ListFiles(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]bool{
+		"/etc/docker-only":   true,
+		"/etc/raid-only":     false,
+		"/etc/feature":       true,
+		"/etc/feature-beta":  false,
+		"/etc/unconditional": true,
+	}
+	for _, file := range files {
+		enabled, ok := want[file.Target]
+		if !ok {
+			continue
+		}
+		delete(want, file.Target)
+		if file.Enabled != enabled || file.Layer != dir {
+			t.Errorf("%s is enabled %t from %s, want %t from %s", file.Target, file.Enabled, file.Layer, enabled, dir)
+		}
+	}
+	if len(want) > 0 {
+		t.Errorf("files missing from the list: %v", want)
+	}
+}
@@ -0,0 +1,130 @@
+package generate_cloud_config
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/hunoz/ubuntu-iso-builder/crypt"
+)
+
+// Schemes plaintext passwords are hashed with.
+const (
+	PasswordHashYescrypt = "yescrypt"
+	PasswordHashSHA512   = "sha512"
+)
+
+// generatedPasswordLength gives generated passwords about 143 bits.
+const generatedPasswordLength = 24
+
+var cryptHash = regexp.MustCompile(`^\$(1|5|6|y|gy|7|2[abxy])\$[./A-Za-z0-9$=,-]+$`)
+
+// Credential is a generated password of an account.
+type Credential struct {
+	User     string
+	Password string
+}
+
+// FillPasswords sets the passwords of the admin user and root when the host
+// spec leaves them empty, with generated ones when generate is set and with
+// prompt's answers otherwise. prompt may be nil and may return an empty
+// password, which locks the account. The generated passwords are returned.
+func (c *CloudConfigContext) FillPasswords(generate bool, prompt func(user string) (string, error)) (generated []Credential, err error) {
+	accounts := []*string{&c.AdminPassword}
+	users := []string{c.AdminUsername}
+	rootConfigured := slices.ContainsFunc(c.Users, func(user UserSpec) bool { return user.Name == "root" })
+	if !c.LockRoot && !rootConfigured {
+		accounts = append(accounts, &c.RootPassword)
+		users = append(users, "root")
+	}
+
+	for i, password := range accounts {
+		if *password != "" {
+			continue
+		}
+		switch {
+		case generate:
+			if *password, err = NewPassword(); err != nil {
+				return nil, err
+			}
+			generated = append(generated, Credential{User: users[i], Password: *password})
+		case prompt != nil:
+			if *password, err = prompt(users[i]); err != nil {
+				return nil, fmt.Errorf("error reading the password of %s: %w", users[i], err)
+			}
+		}
+	}
+	return
+}
+
+// NewPassword returns a random password of letters and digits.
+func NewPassword() (string, error) {
+	out := make([]byte, generatedPasswordLength)
+	for i := range out {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphaNum))))
+		if err != nil {
+			return "", fmt.Errorf("error generating password: %w", err)
+		}
+		out[i] = alphaNum[n.Int64()]
+	}
+	return string(out), nil
+}
+
+// WriteCredentials writes generated passwords to a file only its owner can
+// read.
+func WriteCredentials(path, hostname string, credentials []Credential) error {
+	var out strings.Builder
+	fmt.Fprintf(&out, "# Generated passwords of %s\n", hostname)
+	for _, credential := range credentials {
+		fmt.Fprintf(&out, "%s: %s\n", credential.User, credential.Password)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("error creating credentials file %s: %w", path, err)
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	// The file may have existed with a wider mode.
+	if err = f.Chmod(0600); err != nil {
+		return fmt.Errorf("error restricting credentials file %s: %w", path, err)
+	}
+	if _, err = f.WriteString(out.String()); err != nil {
+		return fmt.Errorf("error writing credentials file %s: %w", path, err)
+	}
+	return nil
+}
+
+// hashPassword returns password as is when it already is a crypt hash and
+// hashes it otherwise. The salt is random, or derived from the seed and the
+// account when the host spec sets a seed, so the same host spec renders the
+// same hash.
+func hashPassword(ctx CloudConfigContext, user, password string) (string, error) {
+	if password == "" || cryptHash.MatchString(password) {
+		return password, nil
+	}
+	salt := make([]byte, 16)
+	if ctx.Seed != "" {
+		sum := sha256.Sum256([]byte(ctx.Seed + "\x00password\x00" + user))
+		copy(salt, sum[:])
+	} else if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("error generating salt: %w", err)
+	}
+	switch firstNonEmpty(ctx.PasswordHash, PasswordHashYescrypt) {
+	case PasswordHashYescrypt:
+		return crypt.Yescrypt(password, salt), nil
+	case PasswordHashSHA512:
+		encoded, err := crypt.NewSalt(bytes.NewReader(salt), len(salt))
+		if err != nil {
+			return "", err
+		}
+		return crypt.SHA512(password, encoded, 0), nil
+	}
+	return "", fmt.Errorf("unsupported password-hash %q, expected %s or %s", ctx.PasswordHash, PasswordHashYescrypt, PasswordHashSHA512)
+}
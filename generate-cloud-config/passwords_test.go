@@ -0,0 +1,49 @@
+package generate_cloud_config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashPasswordSalt(t *testing.T) {
+	for _, scheme := range []string{PasswordHashYescrypt, PasswordHashSHA512} {
+		random := CloudConfigContext{PasswordHash: scheme}
+		first, err := hashPassword(random, "admin", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := hashPassword(random, "admin", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == second {
+			t.Errorf("%s: two hashes without a seed share the salt: %s", scheme, first)
+		}
+
+		seeded := CloudConfigContext{PasswordHash: scheme, Seed: "s3cret"}
+		first, _ = hashPassword(seeded, "admin", "secret")
+		second, _ = hashPassword(seeded, "admin", "secret")
+		if first != second {
+			t.Errorf("%s: hashes with a seed differ: %s and %s", scheme, first, second)
+		}
+		if other, _ := hashPassword(seeded, "root", "secret"); other == first {
+			t.Errorf("%s: accounts share the salt: %s", scheme, first)
+		}
+	}
+}
+
+func TestAdminWithoutCredentials(t *testing.T) {
+	ctx := CloudConfigContext{Hostname: "host1", AdminUsername: "admin", DiskSerial: "ABC", Modules: []string{"docker"}}
+	if _, err := ctx.FillPasswords(false, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := GenerateCloudConfig(ctx)
+	if err == nil || !strings.Contains(err.Error(), "admin user admin has neither a password nor ssh keys") {
+		t.Errorf("got error %v, want one about the admin user", err)
+	}
+
+	ctx.SSHKeys = []string{ed25519AuthorizedKey(t)}
+	if _, _, err = GenerateCloudConfig(ctx); err != nil {
+		t.Errorf("with an ssh key: %v", err)
+	}
+}
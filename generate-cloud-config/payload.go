@@ -0,0 +1,150 @@
+package generate_cloud_config
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// PayloadDir is the directory at the root of the ISO that holds payloads.
+	PayloadDir = "payload"
+	// PayloadManifest lists the SHA-256 sum of every payload in sha256sum's
+	// format, so the whole directory can be checked with sha256sum -c.
+	PayloadManifest = "SHA256SUMS"
+	// DefaultInlineThreshold is the size in bytes from which a target file is
+	// carried on the ISO instead of being inlined into the autoinstall config.
+	DefaultInlineThreshold = 32 * 1024
+)
+
+// payloadMountDir is where the installer mounts the payload directory of the
+// ISO it booted from.
+const payloadMountDir = "/cdrom/" + PayloadDir
+
+// Payload is a file carried on the ISO and copied into the target by the
+// late-commands. Payloads are named by their SHA-256 sum, so identical files
+// are only carried once.
+type Payload struct {
+	Name     string
+	Contents []byte
+}
+
+func newPayload(contents []byte) Payload {
+	sum := sha256.Sum256(contents)
+	return Payload{Name: hex.EncodeToString(sum[:]), Contents: contents}
+}
+
+// inlineThreshold returns the payload threshold of a host. Zero selects the
+// default and a negative threshold inlines every file.
+func (c CloudConfigContext) inlineThreshold() int {
+	if c.InlineThreshold == 0 {
+		return DefaultInlineThreshold
+	}
+	return c.InlineThreshold
+}
+
+// usePayload reports whether contents are carried on the ISO.
+func (c CloudConfigContext) usePayload(contents []byte) bool {
+	threshold := c.inlineThreshold()
+	return threshold > 0 && len(contents) >= threshold
+}
+
+// copyPayloadCommands copies a payload into root+target and verifies the copy
+// against the sum it was generated with.
+func copyPayloadCommands(root, target string, payload Payload, mode fs.FileMode) []string {
+	destination := shellQuote(root + target)
+	return []string{
+		fmt.Sprintf("mkdir -p %s", shellQuote(root+path.Dir(target))),
+		fmt.Sprintf("cp %s %s", shellQuote(payloadMountDir+"/"+payload.Name), destination),
+		fmt.Sprintf("echo %s | sha256sum -c --quiet -", shellQuote(payload.Name+"  "+root+target)),
+		fmt.Sprintf("chmod %04o %s", mode.Perm(), destination),
+	}
+}
+
+// verifyPayloadsCommand checks every payload on the ISO before the
+// installation starts.
+func verifyPayloadsCommand() string {
+	return fmt.Sprintf("cd %s && sha256sum -c --quiet %s", payloadMountDir, PayloadManifest)
+}
+
+// dedupePayloads drops repeated payloads and sorts them by name.
+func dedupePayloads(payloads []Payload) (unique []Payload) {
+	seen := map[string]bool{}
+	for _, payload := range payloads {
+		if seen[payload.Name] {
+			continue
+		}
+		seen[payload.Name] = true
+		unique = append(unique, payload)
+	}
+	sort.Slice(unique, func(i, j int) bool { return unique[i].Name < unique[j].Name })
+	return
+}
+
+// WritePayloads replaces dir with the payloads and their manifest.
+func WritePayloads(dir string, payloads []Payload) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("error removing payload directory %s: %w", dir, err)
+	}
+	if len(payloads) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating payload directory %s: %w", dir, err)
+	}
+
+	var manifest bytes.Buffer
+	for _, payload := range payloads {
+		if err := os.WriteFile(filepath.Join(dir, payload.Name), payload.Contents, 0644); err != nil {
+			return fmt.Errorf("error writing payload %s: %w", payload.Name, err)
+		}
+		_, _ = fmt.Fprintf(&manifest, "%s  %s\n", payload.Name, payload.Name)
+	}
+	if err := os.WriteFile(filepath.Join(dir, PayloadManifest), manifest.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error writing payload manifest: %w", err)
+	}
+
+	return nil
+}
+
+// LoadPayloads reads the payloads listed in the manifest of dir and verifies
+// their sums.
+func LoadPayloads(dir string) (payloads []Payload, err error) {
+	manifest, err := os.Open(filepath.Join(dir, PayloadManifest))
+	if err != nil {
+		return nil, fmt.Errorf("error opening payload manifest: %w", err)
+	}
+	defer func(manifest *os.File) {
+		_ = manifest.Close()
+	}(manifest)
+
+	scanner := bufio.NewScanner(manifest)
+	for scanner.Scan() {
+		sum, name, ok := strings.Cut(scanner.Text(), "  ")
+		if !ok {
+			return nil, fmt.Errorf("invalid payload manifest line %q", scanner.Text())
+		}
+		contents, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("error reading payload %s: %w", name, err)
+		}
+		payload := newPayload(contents)
+		if payload.Name != sum {
+			return nil, fmt.Errorf("payload %s does not match its sum in the manifest", name)
+		}
+		payloads = append(payloads, Payload{Name: name, Contents: contents})
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading payload manifest: %w", err)
+	}
+
+	return
+}
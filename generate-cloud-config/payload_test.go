@@ -0,0 +1,163 @@
+package generate_cloud_config
+
+import (
+	"encoding/base64"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestNewPayload(t *testing.T) {
+	payload := newPayload([]byte("hello\n"))
+	if payload.Name != "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03" {
+		t.Errorf("payload is named %s, want the SHA-256 sum of its contents", payload.Name)
+	}
+}
+
+func TestUsePayload(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+		size      int
+		payload   bool
+	}{
+		{name: "below the default", size: DefaultInlineThreshold - 1},
+		{name: "at the default", size: DefaultInlineThreshold, payload: true},
+		{name: "below a custom threshold", threshold: 100, size: 99},
+		{name: "at a custom threshold", threshold: 100, size: 100, payload: true},
+		{name: "negative inlines everything", threshold: -1, size: DefaultInlineThreshold * 4},
+	}
+	for _, test := range tests {
+		ctx := CloudConfigContext{InlineThreshold: test.threshold}
+		if payload := ctx.usePayload(make([]byte, test.size)); payload != test.payload {
+			t.Errorf("%s: payload is %t, want %t", test.name, payload, test.payload)
+		}
+	}
+}
+
+func TestDeliverFilesAtDefaultThreshold(t *testing.T) {
+	large := strings.Repeat("x", DefaultInlineThreshold)
+	small := strings.Repeat("x", DefaultInlineThreshold-1)
+	delivery := deliverTestFiles(t, CloudConfigContext{}, fstest.MapFS{
+		"opt/large": {Data: []byte(large)},
+		"opt/small": {Data: []byte(small)},
+	})
+
+	if len(delivery.Payloads) != 1 || string(delivery.Payloads[0].Contents) != large {
+		t.Fatalf("want only the large file as a payload, got %d payloads", len(delivery.Payloads))
+	}
+	commands := strings.Join(delivery.LateCommands, "\n")
+	if strings.Contains(commands, base64.StdEncoding.EncodeToString([]byte(large))) {
+		t.Error("large file is inlined into the late-commands")
+	}
+	if !strings.Contains(commands, base64.StdEncoding.EncodeToString([]byte(small))) {
+		t.Error("small file is not inlined into the late-commands")
+	}
+
+	cdrom := t.TempDir()
+	if err := WritePayloads(filepath.Join(cdrom, PayloadDir), delivery.Payloads); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	runInFakeTarget(t, root, cdrom, delivery.LateCommands)
+	for name, want := range map[string]string{"opt/large": large, "opt/small": small} {
+		contents, err := os.ReadFile(filepath.Join(root, name))
+		if err != nil {
+			t.Fatalf("%s was not written: %v", name, err)
+		}
+		if string(contents) != want {
+			t.Errorf("%s was not written intact", name)
+		}
+	}
+}
+
+func TestWritePayloads(t *testing.T) {
+	payloads := dedupePayloads([]Payload{
+		newPayload([]byte("second\n")),
+		newPayload([]byte("first\n")),
+		newPayload([]byte("second\n")),
+	})
+	if len(payloads) != 2 || payloads[0].Name > payloads[1].Name {
+		t.Fatalf("payloads are not deduplicated and sorted: %+v", payloads)
+	}
+
+	cdrom := t.TempDir()
+	dir := filepath.Join(cdrom, PayloadDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "stale"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WritePayloads(dir, payloads); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := os.ReadFile(filepath.Join(dir, PayloadManifest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := payloads[0].Name + "  " + payloads[0].Name + "\n" + payloads[1].Name + "  " + payloads[1].Name + "\n"
+	if string(manifest) != want {
+		t.Errorf("manifest is %q, want %q", manifest, want)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "stale")); !os.IsNotExist(err) {
+		t.Error("files of an earlier build were left in the payload directory")
+	}
+
+	// The installer checks the manifest with sha256sum before it installs.
+	runInFakeTarget(t, t.TempDir(), cdrom, []string{verifyPayloadsCommand()})
+
+	loaded, err := LoadPayloads(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != len(payloads) {
+		t.Fatalf("loaded %d payloads, want %d", len(loaded), len(payloads))
+	}
+	for i := range loaded {
+		if loaded[i].Name != payloads[i].Name || string(loaded[i].Contents) != string(payloads[i].Contents) {
+			t.Errorf("payload %d loaded as %+v, want %+v", i, loaded[i], payloads[i])
+		}
+	}
+
+	if err = os.WriteFile(filepath.Join(dir, payloads[0].Name), []byte("tampered\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	verify := strings.Replace(verifyPayloadsCommand(), payloadMountDir, dir, 1)
+	if out, err := exec.Command("sh", "-c", verify).CombinedOutput(); err == nil {
+		t.Errorf("sha256sum accepted a tampered payload: %s", out)
+	}
+	if _, err = LoadPayloads(dir); err == nil {
+		t.Error("expected an error for a tampered payload")
+	}
+
+	if err = WritePayloads(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(dir); !os.IsNotExist(err) {
+		t.Error("payload directory should be removed when there are no payloads")
+	}
+}
+
+func TestLoadPayloadsErrors(t *testing.T) {
+	tests := map[string]map[string]string{
+		"no manifest":     {},
+		"malformed line":  {PayloadManifest: "abc\n"},
+		"missing payload": {PayloadManifest: "abc  abc\n"},
+	}
+	for name, files := range tests {
+		dir := t.TempDir()
+		for file, contents := range files {
+			if err := os.WriteFile(filepath.Join(dir, file), []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := LoadPayloads(dir); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package generate_cloud_config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hunoz/ubuntu-iso-builder/utils"
+)
+
+// HostOptions are what a command adds to a host spec on its way to a
+// cloud-config.
+type HostOptions struct {
+	// Spec is a host spec file laid under the fields SpecKeySet reports.
+	Spec       string
+	SpecKeySet func(key string) bool
+	// EnvValues are the template values of the environment, which sit below
+	// the host spec's, and Values those of values files and --set, which
+	// override them.
+	EnvValues map[string]interface{}
+	Values    map[string]interface{}
+	// GeneratePasswords fills missing passwords with generated ones instead of
+	// asking PasswordPrompt, which may be nil.
+	GeneratePasswords bool
+	PasswordPrompt    func(user string) (string, error)
+	// Redact keeps the secrets of the host out of the log.
+	Redact func(secrets ...string)
+	// OutputDir receives <hostname>.credentials, .known_hosts and .sshfp
+	// unless CredentialsFile, KnownHostsFile or SSHFPFile name other files.
+	OutputDir       string
+	CredentialsFile string
+	KnownHostsFile  string
+	SSHFPFile       string
+}
+
+// PreparedHost is the cloud-config of a host and what generating it wrote and
+// found.
+type PreparedHost struct {
+	CloudConfig string
+	Payloads    []Payload
+	// Warnings are problems of the ssh keys that did not stop generation.
+	Warnings []string
+	// GeneratedHostKeys are the types of the host keys generated.
+	GeneratedHostKeys []string
+	// CredentialsFile, KnownHostsFile and SSHFPFile are the files written,
+	// empty when there was nothing to write.
+	CredentialsFile string
+	KnownHostsFile  string
+	SSHFPFile       string
+}
+
+// LoadHost loads the host spec into ctx and merges the template values.
+func LoadHost(ctx *CloudConfigContext, opts HostOptions) (err error) {
+	if opts.Spec != "" {
+		if *ctx, err = LoadHostSpec(opts.Spec, *ctx, opts.SpecKeySet); err != nil {
+			return fmt.Errorf("error loading host spec: %w", err)
+		}
+	}
+	values := map[string]interface{}{}
+	MergeValues(values, opts.EnvValues)
+	MergeValues(values, ctx.Values)
+	MergeValues(values, opts.Values)
+	ctx.Values = values
+	return nil
+}
+
+// PrepareHost loads the host, fills the passwords, resolves and redacts the
+// secrets, loads the ssh and host keys and generates the cloud-config. The
+// generated passwords, known_hosts lines and SSHFP records are written once
+// the cloud-config is generated.
+func PrepareHost(ctx *CloudConfigContext, opts HostOptions) (host PreparedHost, err error) {
+	if err = LoadHost(ctx, opts); err != nil {
+		return host, err
+	}
+
+	credentials, err := ctx.FillPasswords(opts.GeneratePasswords, opts.PasswordPrompt)
+	if err != nil {
+		return host, fmt.Errorf("error setting passwords: %w", err)
+	}
+	secrets, err := ctx.ResolveSecrets()
+	if err != nil {
+		return host, fmt.Errorf("error reading secrets: %w", err)
+	}
+	if opts.Redact != nil {
+		opts.Redact(secrets...)
+	}
+	if host.Warnings, err = ctx.LoadSSHKeys(); err != nil {
+		return host, fmt.Errorf("error loading ssh keys: %w", err)
+	}
+	if host.GeneratedHostKeys, err = ctx.LoadHostKeys(); err != nil {
+		return host, fmt.Errorf("error loading host keys: %w", err)
+	}
+
+	if host.CloudConfig, host.Payloads, err = GenerateCloudConfig(*ctx); err != nil {
+		return host, fmt.Errorf("error generating cloud-config: %w", err)
+	}
+
+	if len(credentials) > 0 {
+		host.CredentialsFile = firstNonEmpty(opts.CredentialsFile, filepath.Join(opts.OutputDir, ctx.Hostname+".credentials"))
+		if err = os.MkdirAll(filepath.Dir(host.CredentialsFile), 0755); err != nil {
+			return host, fmt.Errorf("error creating directory of credentials file: %w", err)
+		}
+		if err = WriteCredentials(host.CredentialsFile, ctx.Hostname, credentials); err != nil {
+			return host, err
+		}
+	}
+	if knownHosts := ctx.KnownHosts(); knownHosts != "" {
+		host.KnownHostsFile = firstNonEmpty(opts.KnownHostsFile, filepath.Join(opts.OutputDir, ctx.Hostname+".known_hosts"))
+		host.SSHFPFile = firstNonEmpty(opts.SSHFPFile, filepath.Join(opts.OutputDir, ctx.Hostname+".sshfp"))
+		if err = utils.WriteOutput(host.KnownHostsFile, knownHosts); err != nil {
+			return host, fmt.Errorf("error writing known_hosts lines: %w", err)
+		}
+		if err = utils.WriteOutput(host.SSHFPFile, ctx.SSHFPRecords()); err != nil {
+			return host, fmt.Errorf("error writing SSHFP records: %w", err)
+		}
+	}
+	return
+}
@@ -0,0 +1,55 @@
+package generate_cloud_config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrepareHost(t *testing.T) {
+	dir := t.TempDir()
+	spec := filepath.Join(dir, "host1.yaml")
+	err := os.WriteFile(spec, []byte("hostname: host1\ndisk-serial: ABC\nmodules: [docker]\ngenerate-host-keys: true\nvalues:\n  spec: spec\n  both: spec\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := CloudConfigContext{AdminUsername: "admin", SSHKeys: []string{ed25519AuthorizedKey(t)}}
+	var redacted []string
+	host, err := PrepareHost(&ctx, HostOptions{
+		Spec:              spec,
+		SpecKeySet:        func(key string) bool { return key == "admin-username" || key == "ssh-keys" },
+		EnvValues:         map[string]interface{}{"env": "env", "both": "env"},
+		Values:            map[string]interface{}{"set": "set", "both": "set"},
+		GeneratePasswords: true,
+		Redact:            func(secrets ...string) { redacted = append(redacted, secrets...) },
+		OutputDir:         filepath.Join(dir, "out"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]string{"env": "env", "spec": "spec", "set": "set", "both": "set"} {
+		if got := ctx.Values[key]; got != want {
+			t.Errorf("got value %s %v, want %s", key, got, want)
+		}
+	}
+	if len(redacted) != 2 {
+		t.Errorf("got %d redacted secrets, want the two generated passwords", len(redacted))
+	}
+	credentials, err := os.ReadFile(host.CredentialsFile)
+	if err != nil || !strings.Contains(string(credentials), "admin: "+ctx.AdminPassword) {
+		t.Errorf("credentials file %s holds %q: %v", host.CredentialsFile, credentials, err)
+	}
+	for _, file := range []string{host.KnownHostsFile, host.SSHFPFile} {
+		if !strings.HasPrefix(file, filepath.Join(dir, "out", "host1.")) {
+			t.Errorf("got output file %s", file)
+		}
+		if info, err := os.Stat(file); err != nil || info.Size() == 0 {
+			t.Errorf("%s was not written: %v", file, err)
+		}
+	}
+	if len(host.GeneratedHostKeys) == 0 {
+		t.Errorf("no host keys were generated")
+	}
+}
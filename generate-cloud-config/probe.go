@@ -0,0 +1,119 @@
+package generate_cloud_config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ProbedDisk is a disk of the local machine, described with the keys of
+// DiskMatch so entries can be copied into the disks of a storage section.
+type ProbedDisk struct {
+	Path   string `yaml:"path"`
+	Serial string `yaml:"serial,omitempty"`
+	Model  string `yaml:"model,omitempty"`
+	Vendor string `yaml:"vendor,omitempty"`
+	WWN    string `yaml:"wwn,omitempty"`
+	SSD    bool   `yaml:"ssd"`
+	// Size and Links are not match keys. Match on the size with min-size and
+	// max-size, and on a link with path.
+	Size  StorageSize `yaml:"-"`
+	Links []string    `yaml:"-"`
+}
+
+// ProbeDisks reads the disks below root from sysfs and the udev database, as
+// the installer's disk resolver sees them. Virtual block devices such as loop
+// and zram devices are left out.
+func ProbeDisks(root string) (disks []ProbedDisk, err error) {
+	entries, err := os.ReadDir(filepath.Join(root, "sys", "block"))
+	if err != nil {
+		return nil, fmt.Errorf("error reading block devices: %w", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		sys := filepath.Join(root, "sys", "block", name)
+		if _, err := os.Stat(filepath.Join(sys, "device")); err != nil {
+			continue
+		}
+
+		sectors, err := strconv.ParseInt(readSysValue(filepath.Join(sys, "size")), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error reading size of %s: %w", name, err)
+		}
+		disk := ProbedDisk{
+			Path: "/dev/" + name,
+			Size: StorageSize(sectors * 512),
+			SSD:  readSysValue(filepath.Join(sys, "queue", "rotational")) == "0",
+		}
+
+		properties, links, err := readUdevData(root, readSysValue(filepath.Join(sys, "dev")))
+		if err != nil {
+			return nil, fmt.Errorf("error reading udev data of %s: %w", name, err)
+		}
+		disk.Serial = properties["ID_SERIAL"]
+		disk.Model = firstNonEmpty(properties["ID_MODEL"], readSysValue(filepath.Join(sys, "device", "model")))
+		disk.Vendor = firstNonEmpty(properties["ID_VENDOR"], readSysValue(filepath.Join(sys, "device", "vendor")))
+		disk.WWN = firstNonEmpty(properties["ID_WWN_WITH_EXTENSION"], properties["ID_WWN"])
+		disk.Links = links
+
+		disks = append(disks, disk)
+	}
+
+	return
+}
+
+// readUdevData reads the properties and /dev links udev recorded for the
+// device numbers dev. Devices udev has no record of have neither.
+func readUdevData(root, dev string) (properties map[string]string, links []string, err error) {
+	properties = map[string]string{}
+	f, err := os.Open(filepath.Join(root, "run", "udev", "data", "b"+dev))
+	if os.IsNotExist(err) {
+		return properties, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		kind, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		switch kind {
+		case "E":
+			if key, property, ok := strings.Cut(value, "="); ok {
+				properties[key] = property
+			}
+		case "S":
+			links = append(links, "/dev/"+value)
+		}
+	}
+	sort.Strings(links)
+	return properties, links, scanner.Err()
+}
+
+func readSysValue(path string) string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
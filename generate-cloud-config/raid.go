@@ -0,0 +1,118 @@
+package generate_cloud_config
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// raidFilesystems are the file systems setup-raid can create on the array.
+var raidFilesystems = []string{"ext4", "xfs", "btrfs"}
+
+// RaidSpec is the raid section of a host spec. It describes the data array
+// the raid module assembles, or creates when none of the member disks belong
+// to an array yet.
+type RaidSpec struct {
+	// Device is the md device a new array is created as, /dev/md0 by default.
+	Device string `yaml:"device"`
+	// Level is the RAID level of a new array, 5 by default.
+	Level *int `yaml:"level"`
+	// Members selects the member disks among the disks that hold nothing the
+	// installed system has mounted. Without criteria every such disk is a
+	// candidate.
+	Members DiskMatch `yaml:"members"`
+	// Devices is the number of active members. An array is only created when
+	// exactly Devices plus Spares disks match, so without it existing arrays
+	// are assembled but none is created.
+	Devices int `yaml:"devices"`
+	Spares  int `yaml:"spares"`
+	// Filesystem is the file system of a new array, ext4 by default.
+	Filesystem string `yaml:"filesystem"`
+	// Mount is where the array is mounted, /mnt/raid by default.
+	Mount   string `yaml:"mount"`
+	Options string `yaml:"options"`
+	// Chunk is the chunk size of a new striped array. mdadm's default is used
+	// when it is empty.
+	Chunk StorageSize `yaml:"chunk"`
+}
+
+// RaidArray is the raid section with its defaults filled in, as setup-raid
+// is rendered with it.
+type RaidArray struct {
+	Device     string
+	Level      int
+	Criteria   []string
+	Devices    int
+	Spares     int
+	Filesystem string
+	Mount      string
+	Options    string
+	// ChunkKiB is the chunk size in KiB, 0 for mdadm's default.
+	ChunkKiB int64
+}
+
+// Array validates the raid section and fills in its defaults.
+func (s RaidSpec) Array() (array RaidArray, err error) {
+	array = RaidArray{
+		Device:     firstNonEmpty(s.Device, "/dev/md0"),
+		Level:      5,
+		Devices:    s.Devices,
+		Spares:     s.Spares,
+		Filesystem: firstNonEmpty(s.Filesystem, "ext4"),
+		Mount:      firstNonEmpty(s.Mount, "/mnt/raid"),
+		Options:    firstNonEmpty(s.Options, "defaults"),
+		ChunkKiB:   int64(s.Chunk) >> 10,
+	}
+	if s.Level != nil {
+		array.Level = *s.Level
+	}
+
+	if !strings.HasPrefix(array.Device, "/dev/md") {
+		return array, fmt.Errorf("raid device %s is not an md device", array.Device)
+	}
+	minDevices, ok := raidMinDevices[array.Level]
+	if !ok {
+		return array, fmt.Errorf("unsupported raid level %d", array.Level)
+	}
+	if s.Devices < 0 || s.Spares < 0 {
+		return array, fmt.Errorf("raid devices and spares cannot be negative")
+	}
+	if s.Devices > 0 && s.Devices < minDevices {
+		return array, fmt.Errorf("raid%d needs at least %d devices, %d are given", array.Level, minDevices, s.Devices)
+	}
+	if s.Spares > 0 && array.Level == 0 {
+		return array, fmt.Errorf("raid0 cannot have spares")
+	}
+
+	if s.Members != (DiskMatch{}) {
+		if err = s.Members.validate(); err != nil {
+			return array, fmt.Errorf("raid members: %w", err)
+		}
+	}
+	if s.Members.Size != "" {
+		return array, fmt.Errorf("raid members are every disk that matches, they cannot pick the %s", s.Members.Size)
+	}
+	if s.Devices > 0 && s.Members.MinSize == 0 {
+		return array, fmt.Errorf("raid members need a min-size so the disk sizes are checked before an array is created")
+	}
+	array.Criteria = s.Members.criteria()
+
+	if !slices.Contains(raidFilesystems, array.Filesystem) {
+		return array, fmt.Errorf("unsupported raid filesystem %q, expected one of %s", array.Filesystem, strings.Join(raidFilesystems, ", "))
+	}
+	if !path.IsAbs(array.Mount) || path.Clean(array.Mount) != array.Mount || array.Mount == "/" {
+		return array, fmt.Errorf("invalid raid mount %q", array.Mount)
+	}
+
+	if s.Chunk != 0 {
+		if array.Level == 1 {
+			return array, fmt.Errorf("raid1 has no chunk size")
+		}
+		if s.Chunk < 4<<10 || s.Chunk&(s.Chunk-1) != 0 {
+			return array, fmt.Errorf("raid chunk %s must be a power of two of at least 4K", s.Chunk)
+		}
+	}
+
+	return array, nil
+}
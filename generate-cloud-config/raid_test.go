@@ -0,0 +1,354 @@
+package generate_cloud_config
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRaidSpecArray(t *testing.T) {
+	level := func(level int) *int { return &level }
+	members := DiskMatch{MinSize: 1 << 40}
+
+	tests := []struct {
+		name  string
+		spec  RaidSpec
+		array RaidArray
+		err   string
+	}{
+		{
+			name:  "defaults",
+			spec:  RaidSpec{},
+			array: RaidArray{Device: "/dev/md0", Level: 5, Filesystem: "ext4", Mount: "/mnt/raid", Options: "defaults"},
+		},
+		{
+			name: "raid1 of two disks",
+			spec: RaidSpec{Level: level(1), Devices: 2, Spares: 1, Members: members, Filesystem: "xfs", Mount: "/srv/data"},
+			array: RaidArray{Device: "/dev/md0", Level: 1, Devices: 2, Spares: 1, Criteria: []string{"min-size=1099511627776"},
+				Filesystem: "xfs", Mount: "/srv/data", Options: "defaults"},
+		},
+		{
+			name: "raid10 with a chunk",
+			spec: RaidSpec{Level: level(10), Devices: 4, Members: members, Chunk: 512 << 10},
+			array: RaidArray{Device: "/dev/md0", Level: 10, Devices: 4, Criteria: []string{"min-size=1099511627776"},
+				Filesystem: "ext4", Mount: "/mnt/raid", Options: "defaults", ChunkKiB: 512},
+		},
+		{name: "raid0 of one disk", spec: RaidSpec{Level: level(0), Devices: 1, Members: members}, err: "raid0 needs at least 2 devices, 1 are given"},
+		{name: "raid1 of one disk", spec: RaidSpec{Level: level(1), Devices: 1, Members: members}, err: "raid1 needs at least 2 devices"},
+		{name: "raid5 of two disks", spec: RaidSpec{Devices: 2, Members: members}, err: "raid5 needs at least 3 devices"},
+		{name: "raid6 of three disks", spec: RaidSpec{Level: level(6), Devices: 3, Members: members}, err: "raid6 needs at least 4 devices"},
+		{name: "raid10 of three disks", spec: RaidSpec{Level: level(10), Devices: 3, Members: members}, err: "raid10 needs at least 4 devices"},
+		{name: "unsupported level", spec: RaidSpec{Level: level(4)}, err: "unsupported raid level 4"},
+		{name: "negative devices", spec: RaidSpec{Devices: -1}, err: "cannot be negative"},
+		{name: "raid0 spares", spec: RaidSpec{Level: level(0), Devices: 2, Spares: 1, Members: members}, err: "raid0 cannot have spares"},
+		{name: "not an md device", spec: RaidSpec{Device: "/dev/sda"}, err: "not an md device"},
+		{name: "devices without min-size", spec: RaidSpec{Devices: 3}, err: "need a min-size"},
+		{name: "members pick a size", spec: RaidSpec{Members: DiskMatch{Size: "largest"}}, err: "cannot pick the largest"},
+		{name: "filesystem", spec: RaidSpec{Filesystem: "zfs"}, err: `unsupported raid filesystem "zfs"`},
+		{name: "relative mount", spec: RaidSpec{Mount: "mnt/raid"}, err: "invalid raid mount"},
+		{name: "root mount", spec: RaidSpec{Mount: "/"}, err: "invalid raid mount"},
+		{name: "raid1 chunk", spec: RaidSpec{Level: level(1), Chunk: 64 << 10}, err: "raid1 has no chunk size"},
+		{name: "chunk not a power of two", spec: RaidSpec{Chunk: 48 << 10}, err: "must be a power of two"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			array, err := test.spec.Array()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if array.Device != test.array.Device || array.Level != test.array.Level || array.Devices != test.array.Devices ||
+				array.Spares != test.array.Spares || !slices.Equal(array.Criteria, test.array.Criteria) ||
+				array.Filesystem != test.array.Filesystem || array.Mount != test.array.Mount ||
+				array.Options != test.array.Options || array.ChunkKiB != test.array.ChunkKiB {
+				t.Errorf("array is %+v, want %+v", array, test.array)
+			}
+		})
+	}
+}
+
+// renderSetupRaid renders setup-raid for spec.
+func renderSetupRaid(t *testing.T, spec RaidSpec) string {
+	t.Helper()
+
+	array, err := spec.Array()
+	if err != nil {
+		t.Fatal(err)
+	}
+	module, _ := lookupModule("raid")
+	files, err := MergeLayers([]FileLayer{{Name: "module:raid", FS: module.Files()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	renderCtx := RenderContext{
+		CloudConfigContext: CloudConfigContext{Hostname: "host1", AdminUsername: "admin"},
+		EnabledModules:     []string{"raid"},
+		RaidArray:          array,
+	}
+	installFiles, err := prepareFiles(renderCtx, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivery, err := deliverFiles(renderCtx, installFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(delivery.Contents["/usr/local/bin/setup-raid"])
+}
+
+func TestSetupRaidConfiguration(t *testing.T) {
+	rotational := true
+	script := renderSetupRaid(t, RaidSpec{
+		Devices:    3,
+		Spares:     1,
+		Members:    DiskMatch{Model: "WDC*", Rotational: &rotational, MinSize: 4 << 40},
+		Filesystem: "btrfs",
+		Mount:      "/srv/media library",
+		Chunk:      256 << 10,
+	})
+
+	for _, line := range []string{
+		"RAID_DEVICE='/dev/md0'",
+		"RAID_LEVEL=5",
+		"RAID_DEVICES=3",
+		"SPARE_DEVICES=1",
+		"CHUNK_KIB=256",
+		"FILESYSTEM='btrfs'",
+		"MOUNT_POINT='/srv/media library'",
+		"MOUNT_OPTIONS='defaults'",
+		"MEMBER_CRITERIA=('model=WDC*' 'rotational=1' 'min-size=4398046511104')",
+	} {
+		if !slices.Contains(strings.Split(script, "\n"), line) {
+			t.Errorf("setup-raid is missing %q", line)
+		}
+	}
+}
+
+// runSetupRaid runs setup-raid on fake disks. arrays maps a disk to the UUID
+// of the array mdadm --examine finds on it. mdadm and the other tools that
+// touch disks are replaced by scripts that log their arguments, and the
+// paths of the host are moved below a temporary root. It returns the logged
+// calls and the fstab the script leaves, with the root replaced by <root>,
+// and its output.
+func runSetupRaid(t *testing.T, spec RaidSpec, disks []fakeDisk, arrays map[string]string) (calls []string, fstab, out string, err error) {
+	t.Helper()
+
+	root := t.TempDir()
+	spec.Mount = filepath.Join(root, "mnt")
+	script := renderSetupRaid(t, spec)
+
+	for _, disk := range disks {
+		sys := filepath.Join(root, "sys", "block", disk.name)
+		files := map[string]string{
+			filepath.Join(sys, "size"):                disk.sectors,
+			filepath.Join(sys, "queue", "rotational"): disk.rotational,
+			filepath.Join(sys, "device", "model"):     "WDC",
+			filepath.Join(root, "udev", disk.name):    disk.properties,
+		}
+		if uuid, ok := arrays[disk.name]; ok {
+			files[filepath.Join(root, "md", disk.name)] = uuid
+		}
+		for path, content := range files {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, name := range []string{"fstab", "mdadm.conf", "mdstat"} {
+		if err := os.WriteFile(filepath.Join(root, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	callLog := filepath.Join(root, "calls.log")
+	record := "echo \"$(basename \"$0\") $*\" >> " + shellQuote(callLog) + "\n"
+	bin := t.TempDir()
+	stubs := map[string]string{
+		"mdadm": record + "case $1 in\n" +
+			"--examine) cat " + shellQuote(root+"/md/") + "\"${3##*/}\" 2>/dev/null | sed 's/^/MD_UUID=/' ;;\n" +
+			"--detail) case $2 in --export) echo MD_UUID=created ;; --brief) echo \"ARRAY $3 UUID=created\" ;; esac ;;\n" +
+			"esac\n",
+		"blockdev":         "echo $(( $(cat " + shellQuote(root+"/sys/block/") + "\"${2##*/}\"/size) * 512 ))\n",
+		"blkid":            "case $2 in UUID) echo fs-uuid ;; TYPE) echo ext4 ;; esac\n",
+		"udevadm":          "for arg; do case $arg in --name=/dev/*) cat " + shellQuote(root+"/udev/") + "\"${arg#--name=/dev/}\" ;; esac; done\n",
+		"readlink":         "echo /dev/md127\n",
+		"mountpoint":       "exit 1\n",
+		"lsblk":            "",
+		"df":               "",
+		"wipefs":           record,
+		"mkfs.ext4":        record,
+		"update-initramfs": record,
+		"mount":            record,
+	}
+	for name, stub := range stubs {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte("#!/bin/bash\n"+stub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	script = strings.NewReplacer(
+		"[[ $EUID -ne 0 ]]", "[[ 0 -ne 0 ]]",
+		"/sys/block", root+"/sys/block",
+		"/var/log/setup-raid.log", root+"/setup-raid.log",
+		"/etc/mdadm/mdadm.conf", root+"/mdadm.conf",
+		"/etc/fstab", root+"/fstab",
+		"/proc/mdstat", root+"/mdstat",
+	).Replace(script)
+	cmd := exec.Command("bash", "-c", script)
+	cmd.Env = append(os.Environ(), "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	output, err := cmd.CombinedOutput()
+
+	logged, readErr := os.ReadFile(callLog)
+	if readErr != nil && !os.IsNotExist(readErr) {
+		t.Fatal(readErr)
+	}
+	if len(logged) > 0 {
+		calls = strings.Split(strings.TrimSpace(strings.ReplaceAll(string(logged), root, "<root>")), "\n")
+	}
+	written, readErr := os.ReadFile(filepath.Join(root, "fstab"))
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	return calls, strings.ReplaceAll(string(written), root, "<root>"), string(output), err
+}
+
+func TestSetupRaidScript(t *testing.T) {
+	raid1 := 1
+	rotational := true
+	spec := RaidSpec{Level: &raid1, Devices: 2, Members: DiskMatch{Rotational: &rotational, MinSize: 1 << 40}}
+	// 4 TB disks, an SSD that is not a member and a small disk.
+	disks := []fakeDisk{
+		{"sda", "7814037168", "1", "ID_SERIAL=WD-1"},
+		{"sdb", "7814037168", "1", "ID_SERIAL=WD-2"},
+		{"nvme0n1", "7814037168", "0", "ID_SERIAL=SAMSUNG-1"},
+		{"sdc", "976773168", "1", "ID_SERIAL=WD-3"},
+	}
+
+	tests := []struct {
+		name   string
+		spec   RaidSpec
+		disks  []fakeDisk
+		arrays map[string]string
+		// calls are logged calls expected in order, absent those that must
+		// not be made.
+		calls  []string
+		absent []string
+		fstab  string
+		out    string
+	}{
+		{
+			name:  "creates an array on blank disks",
+			spec:  spec,
+			disks: disks,
+			calls: []string{
+				"mdadm --examine --export /dev/sda",
+				"mdadm --zero-superblock /dev/sda",
+				"wipefs -a /dev/sda",
+				"wipefs -a /dev/sdb",
+				"mdadm --create /dev/md0 --run --level=1 --raid-devices=2 /dev/sda /dev/sdb",
+				"mkfs.ext4 -F /dev/md0",
+				"mdadm --detail --brief /dev/md0",
+				"mount <root>/mnt",
+			},
+			absent: []string{"mdadm --assemble", "/dev/nvme0n1", "/dev/sdc"},
+			fstab:  "UUID=fs-uuid <root>/mnt ext4 defaults 0 2\n",
+		},
+		{
+			name:   "assembles an existing array",
+			spec:   spec,
+			disks:  disks,
+			arrays: map[string]string{"sda": "0a1b2c3d", "sdb": "0a1b2c3d"},
+			calls: []string{
+				"mdadm --assemble --scan --uuid=0a1b2c3d",
+				"mdadm --detail /dev/md127",
+				"mount <root>/mnt",
+			},
+			absent: []string{"mdadm --create", "mdadm --zero-superblock", "wipefs", "mkfs"},
+			fstab:  "UUID=fs-uuid <root>/mnt ext4 defaults 0 2\n",
+		},
+		{
+			name:   "assembles a degraded array",
+			spec:   spec,
+			disks:  disks,
+			arrays: map[string]string{"sdb": "0a1b2c3d"},
+			calls:  []string{"mdadm --assemble --scan --uuid=0a1b2c3d"},
+			absent: []string{"mdadm --create", "wipefs"},
+			fstab:  "UUID=fs-uuid <root>/mnt ext4 defaults 0 2\n",
+		},
+		{
+			name:   "refuses disks of two arrays",
+			spec:   spec,
+			disks:  disks,
+			arrays: map[string]string{"sda": "0a1b2c3d", "sdb": "4e5f6a7b"},
+			absent: []string{"mdadm --assemble", "mdadm --create", "wipefs"},
+			out:    "The member disks belong to more than one RAID array",
+		},
+		{
+			name:   "refuses to create without devices",
+			spec:   RaidSpec{Level: &raid1, Members: DiskMatch{Rotational: &rotational}},
+			disks:  disks,
+			absent: []string{"mdadm --create", "wipefs"},
+			out:    "The host spec sets no raid devices, refusing to create an array",
+		},
+		{
+			name:   "refuses to create from more disks than expected",
+			spec:   RaidSpec{Level: &raid1, Devices: 2, Members: DiskMatch{MinSize: 1 << 30}},
+			disks:  disks,
+			absent: []string{"mdadm --create", "wipefs"},
+			out:    "2 disks should match the raid members (min-size=1073741824), 4 do",
+		},
+		{
+			name: "refuses disks of different sizes",
+			spec: spec,
+			disks: []fakeDisk{
+				{"sda", "7814037168", "1", ""},
+				{"sdb", "5860533168", "1", ""},
+			},
+			absent: []string{"mdadm --create", "wipefs"},
+			out:    "differ in size by more than 1%",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls, fstab, out, err := runSetupRaid(t, test.spec, test.disks, test.arrays)
+			if test.out != "" {
+				if err == nil || !strings.Contains(out, test.out) {
+					t.Errorf("expected a failure with %q, got %v:\n%s", test.out, err, out)
+				}
+			} else if err != nil {
+				t.Fatalf("setup-raid failed: %v\n%s", err, out)
+			}
+
+			next := 0
+			for _, call := range calls {
+				if next < len(test.calls) && call == test.calls[next] {
+					next++
+				}
+				for _, absent := range test.absent {
+					if strings.Contains(call, absent) {
+						t.Errorf("unexpected call %q", call)
+					}
+				}
+			}
+			if next < len(test.calls) {
+				t.Errorf("missing call %q in %q", test.calls[next], calls)
+			}
+			if fstab != test.fstab {
+				t.Errorf("fstab is %q, want %q", fstab, test.fstab)
+			}
+		})
+	}
+}
@@ -0,0 +1,224 @@
+package generate_cloud_config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+// secretKinds are the prefixes of a SecretSource.
+var secretKinds = []string{"file", "env", "cmd", "age"}
+
+// SecretSource names where a secret is read from at generation time, so the
+// secret itself stays out of host specs and command lines. It is file:PATH
+// for the contents of a file, env:NAME for an environment variable,
+// cmd:COMMAND for the output of a shell command such as pass or gopass, or
+// age:PATH#KEY for the value at the dotted KEY of an age-encrypted YAML file.
+// A trailing newline is not part of the secret.
+type SecretSource string
+
+// IsSecretSource reports whether value names a secret source rather than
+// being the secret itself.
+func IsSecretSource(value string) bool {
+	kind, ref, ok := strings.Cut(value, ":")
+	if !ok || ref == "" {
+		return false
+	}
+	for _, k := range secretKinds {
+		if kind == k {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve reads the secret. ageIdentity is the identity file age: sources
+// are decrypted with.
+func (s SecretSource) Resolve(ageIdentity string) (string, error) {
+	kind, ref, ok := strings.Cut(string(s), ":")
+	if !ok || ref == "" {
+		return "", fmt.Errorf("secret source must be file:PATH, env:NAME, cmd:COMMAND or age:PATH#KEY")
+	}
+
+	var secret string
+	switch kind {
+	case "file":
+		content, err := os.ReadFile(ref)
+		if err != nil {
+			return "", fmt.Errorf("error reading secret file %s: %w", ref, err)
+		}
+		secret = string(content)
+	case "env":
+		value, ok := os.LookupEnv(ref)
+		if !ok {
+			return "", fmt.Errorf("secret environment variable %s is not set", ref)
+		}
+		secret = value
+	case "cmd":
+		// The command may ask for a passphrase, so it keeps the terminal. Its
+		// output is never part of the error.
+		cmd := exec.Command("sh", "-c", ref)
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("error running secret command %q: %w", ref, err)
+		}
+		secret = string(out)
+	case "age":
+		value, err := readAgeSecret(ref, ageIdentity)
+		if err != nil {
+			return "", err
+		}
+		secret = value
+	default:
+		return "", fmt.Errorf("unknown secret source %q, expected file:PATH, env:NAME, cmd:COMMAND or age:PATH#KEY", kind)
+	}
+
+	secret = strings.TrimSuffix(strings.TrimSuffix(secret, "\n"), "\r")
+	if secret == "" {
+		return "", fmt.Errorf("secret from %s is empty", s)
+	}
+	return secret, nil
+}
+
+// readAgeSecret decrypts the YAML file of ref, PATH#KEY, and returns the
+// string at KEY, whose dots select nested mappings.
+func readAgeSecret(ref, ageIdentity string) (string, error) {
+	path, key, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || key == "" {
+		return "", fmt.Errorf("age secret source must be age:PATH#KEY")
+	}
+	if ageIdentity == "" {
+		return "", fmt.Errorf("age secret %s needs an age identity file", ref)
+	}
+	identityFile, err := os.ReadFile(ageIdentity)
+	if err != nil {
+		return "", fmt.Errorf("error reading age identity file %s: %w", ageIdentity, err)
+	}
+	identities, err := age.ParseIdentities(bytes.NewReader(identityFile))
+	if err != nil {
+		return "", fmt.Errorf("error parsing age identity file %s: %w", ageIdentity, err)
+	}
+
+	encrypted, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading age secrets file %s: %w", path, err)
+	}
+	var in io.Reader = bytes.NewReader(encrypted)
+	if bytes.HasPrefix(bytes.TrimSpace(encrypted), []byte(armor.Header)) {
+		in = armor.NewReader(bufio.NewReader(bytes.NewReader(bytes.TrimSpace(encrypted))))
+	}
+	decrypted, err := age.Decrypt(in, identities...)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting age secrets file %s: %w", path, err)
+	}
+	plaintext, err := io.ReadAll(decrypted)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting age secrets file %s: %w", path, err)
+	}
+
+	var node interface{}
+	if err = yaml.Unmarshal(plaintext, &node); err != nil {
+		// The YAML error quotes the decrypted content.
+		return "", fmt.Errorf("age secrets file %s is not valid YAML", path)
+	}
+	for _, part := range strings.Split(key, ".") {
+		mapping, ok := node.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("age secrets file %s has no key %s", path, key)
+		}
+		if node, ok = mapping[part]; !ok {
+			return "", fmt.Errorf("age secrets file %s has no key %s", path, key)
+		}
+	}
+	switch value := node.(type) {
+	case string:
+		return value, nil
+	case int, float64, bool:
+		return fmt.Sprint(value), nil
+	}
+	return "", fmt.Errorf("key %s of age secrets file %s is not a string", key, path)
+}
+
+// ResolveSecrets replaces the passwords, the Plex claim, the Cloudflared
+// token, the seed and the secret template values that name a secret source
+// with the secret and reads the encryption passphrase. It returns every secret
+// of the host spec, resolved or given, so they can be kept out of logs.
+// GenerateCloudConfig calls it when it has not been called yet.
+func (c *CloudConfigContext) ResolveSecrets() (secrets []string, err error) {
+	c.secrets = map[SecretSource]string{}
+	c.secretValues = nil
+	defer func() {
+		c.secretValues = secrets
+	}()
+	type field struct {
+		name  string
+		value *string
+	}
+	fields := []field{
+		{"admin-password", &c.AdminPassword},
+		{"root-password", &c.RootPassword},
+		{"plex-claim", &c.PlexClaim},
+		{"cloudflared-token", &c.CloudflaredToken},
+		{"seed", &c.Seed},
+	}
+	for i := range c.Users {
+		fields = append(fields, field{fmt.Sprintf("password of user %s", c.Users[i].Name), &c.Users[i].Password})
+	}
+
+	for _, field := range fields {
+		if IsSecretSource(*field.value) {
+			if *field.value, err = c.resolveSecret(SecretSource(*field.value)); err != nil {
+				return nil, fmt.Errorf("error reading %s: %w", field.name, err)
+			}
+		}
+		if *field.value != "" && !cryptHash.MatchString(*field.value) {
+			secrets = append(secrets, *field.value)
+		}
+	}
+	for _, key := range c.SecretValues {
+		value := lookupValue(c.Values, key)
+		if source, ok := value.(string); ok && IsSecretSource(source) {
+			if value, err = c.resolveSecret(SecretSource(source)); err != nil {
+				return nil, fmt.Errorf("error reading value %s: %w", key, err)
+			}
+			setValue(c.Values, key, value)
+		}
+		if !isEmpty(value) {
+			secrets = append(secrets, fmt.Sprint(value))
+		}
+	}
+	if encryption := c.Storage.Encryption; encryption != nil && encryption.Passphrase != "" {
+		passphrase, err := c.resolveSecret(encryption.Passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the encryption passphrase: %w", err)
+		}
+		secrets = append(secrets, passphrase)
+	}
+	return secrets, nil
+}
+
+// resolveSecret resolves source once per host spec, so commands run and
+// files are decrypted a single time.
+func (c CloudConfigContext) resolveSecret(source SecretSource) (string, error) {
+	if secret, ok := c.secrets[source]; ok {
+		return secret, nil
+	}
+	secret, err := source.Resolve(c.AgeIdentity)
+	if err != nil {
+		return "", err
+	}
+	if c.secrets != nil {
+		c.secrets[source] = secret
+	}
+	return secret, nil
+}
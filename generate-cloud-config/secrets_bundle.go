@@ -0,0 +1,243 @@
+package generate_cloud_config
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"filippo.io/age"
+)
+
+const (
+	// secretsBundlePath holds the encrypted bundle in the installed system
+	// until first boot opens it.
+	secretsBundlePath = "/var/lib/secrets-bundle/bundle.age"
+	// openSecretsBundlePath is the script that opens the bundle.
+	openSecretsBundlePath = "/usr/local/sbin/open-secrets-bundle"
+)
+
+// SecretsBundleSpec is the secrets-bundle section of a host spec. Files that
+// carry a secret of the host are encrypted to the recipients instead of being
+// written into the autoinstall config, and decrypted by the first boot with
+// the matching age identity. Secrets the installer itself needs, such as the
+// storage encryption passphrase, stay in the autoinstall config.
+type SecretsBundleSpec struct {
+	// Recipients are the age public keys (age1...) the bundle is encrypted
+	// to.
+	Recipients []string `yaml:"recipients"`
+	// KeyFile is the name of the identity file that first boot looks for at
+	// the root of the removable drives, <hostname>.agekey by default. The
+	// identity is asked for on the console when no drive has it.
+	KeyFile string `yaml:"key-file"`
+}
+
+// bundledFile is a file of the secrets bundle.
+type bundledFile struct {
+	Target      string
+	Contents    []byte
+	Mode        fs.FileMode
+	User, Group string
+	// Home is the home directory the file is installed in, if any.
+	Home string
+}
+
+// IsZero reports whether the host has no secrets bundle.
+func (s SecretsBundleSpec) IsZero() bool {
+	return len(s.Recipients) == 0 && s.KeyFile == ""
+}
+
+// keyFile returns the name of the identity file of host.
+func (s SecretsBundleSpec) keyFile(host string) string {
+	return firstNonEmpty(s.KeyFile, host+".agekey")
+}
+
+// validate checks the section and returns the parsed recipients.
+func (s SecretsBundleSpec) validate() (recipients []age.Recipient, err error) {
+	if len(s.Recipients) == 0 {
+		return nil, fmt.Errorf("a secrets bundle needs at least one recipient")
+	}
+	for _, value := range s.Recipients {
+		recipient, err := age.ParseX25519Recipient(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %w", value, err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	if s.KeyFile != "" && (strings.ContainsAny(s.KeyFile, "/'\n") || s.KeyFile == "." || s.KeyFile == "..") {
+		return nil, fmt.Errorf("invalid key-file %q, expected a file name", s.KeyFile)
+	}
+	return
+}
+
+// minDetectedSecretLength is the length from which a secret found in a file
+// moves the file into the secrets bundle. Shorter values are too common in
+// other text; files that carry them need secret: true.
+const minDetectedSecretLength = 6
+
+// carriesSecret reports whether a rendered file belongs in the secrets bundle.
+func (c CloudConfigContext) carriesSecret(meta FileMetadata, contents []byte) bool {
+	if meta.Secret {
+		return true
+	}
+	for _, secret := range c.secretValues {
+		if len(secret) >= minDetectedSecretLength && bytes.Contains(contents, []byte(secret)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sealSecretsBundle archives the files and encrypts the archive to the
+// recipients. The files keep their owner but lose group and other
+// permissions, so only their owner can read the secrets. The directories
+// between a home directory and its files are archived with the owner of the
+// file, as tar would otherwise create them owned by root.
+func sealSecretsBundle(recipients []age.Recipient, files []bundledFile) ([]byte, error) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	archived := map[string]bool{}
+	for _, file := range files {
+		for _, dir := range homeSubdirs(file.Home, path.Dir(path.Clean(file.Target))) {
+			if archived[dir] {
+				continue
+			}
+			archived[dir] = true
+			header := &tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     strings.TrimPrefix(dir, "/") + "/",
+				Mode:     0700,
+				Uname:    file.User,
+				Gname:    file.Group,
+				Format:   tar.FormatPAX,
+			}
+			if err := tw.WriteHeader(header); err != nil {
+				return nil, fmt.Errorf("error archiving %s: %w", dir, err)
+			}
+		}
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     strings.TrimPrefix(path.Clean(file.Target), "/"),
+			Mode:     int64(file.Mode.Perm() &^ 0077),
+			Size:     int64(len(file.Contents)),
+			Uname:    file.User,
+			Gname:    file.Group,
+			Format:   tar.FormatPAX,
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return nil, fmt.Errorf("error archiving %s: %w", file.Target, err)
+		}
+		if _, err := tw.Write(file.Contents); err != nil {
+			return nil, fmt.Errorf("error archiving %s: %w", file.Target, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("error archiving the secrets bundle: %w", err)
+	}
+
+	var sealed bytes.Buffer
+	w, err := age.Encrypt(&sealed, recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting the secrets bundle: %w", err)
+	}
+	if _, err = w.Write(archive.Bytes()); err != nil {
+		return nil, fmt.Errorf("error encrypting the secrets bundle: %w", err)
+	}
+	if err = w.Close(); err != nil {
+		return nil, fmt.Errorf("error encrypting the secrets bundle: %w", err)
+	}
+	return sealed.Bytes(), nil
+}
+
+// homeSubdirs returns the directories below home down to dir, outermost
+// first.
+func homeSubdirs(home, dir string) (dirs []string) {
+	if home == "" {
+		return nil
+	}
+	for ; strings.HasPrefix(dir, home+"/"); dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+	}
+	return
+}
+
+// openSecretsBundleStep opens the bundle before the other first boot steps.
+func openSecretsBundleStep() FirstBootStep {
+	return FirstBootStep{Description: "Opening the secrets bundle", Command: openSecretsBundlePath}
+}
+
+// openSecretsBundleScript decrypts the bundle with an identity from a
+// removable drive or the console and unpacks it over /. The identity and the
+// plaintext never touch a disk: the identity stays in /run and the archive
+// goes straight from age to tar.
+func openSecretsBundleScript(host string, spec SecretsBundleSpec) string {
+	return fmt.Sprintf(`#!/bin/bash
+set -euo pipefail
+
+BUNDLE=%s
+KEY_FILE=%s
+
+if [ ! -e "$BUNDLE" ]; then
+    echo "No secrets bundle to open"
+    exit 0
+fi
+
+umask 077
+KEY=$(mktemp -p /run)
+MNT=$(mktemp -d -p /run)
+trap 'umount "$MNT" 2>/dev/null || true; rmdir "$MNT"; rm -f "$KEY"' EXIT
+
+opens_bundle() {
+    age -d -i "$KEY" -o /dev/null "$BUNDLE" 2>/dev/null
+}
+
+found=
+while read -r dev fstype mountpoint; do
+    case "$fstype" in vfat|exfat|ext2|ext3|ext4|ntfs|iso9660|udf|btrfs|xfs) ;; *) continue ;; esac
+    [ -z "$mountpoint" ] || continue
+    mount -o ro "$dev" "$MNT" 2>/dev/null || continue
+    if [ -f "$MNT/$KEY_FILE" ]; then
+        cp "$MNT/$KEY_FILE" "$KEY"
+        if opens_bundle; then
+            echo "Found the key of the secrets bundle on $dev"
+            found=1
+        else
+            echo "$KEY_FILE on $dev does not open the secrets bundle"
+        fi
+    fi
+    umount "$MNT"
+    [ -z "$found" ] || break
+done < <(lsblk -rnpo PATH,FSTYPE,MOUNTPOINT)
+
+while [ -z "$found" ]; do
+    systemd-ask-password --timeout=0 "Age identity (AGE-SECRET-KEY-1...) of the secrets bundle of %s:" > "$KEY"
+    if opens_bundle; then
+        found=1
+    else
+        echo "The identity does not open the secrets bundle"
+    fi
+done
+
+umask 022
+age -d -i "$KEY" "$BUNDLE" | tar -x -p -m --same-owner -C /
+rm -f "$BUNDLE"
+echo "Secrets bundle opened"
+`, shellQuote(secretsBundlePath), shellQuote(spec.keyFile(host)), host)
+}
+
+// bundleCommands seals the bundled files of the delivery and returns the
+// late-commands that install the bundle and the script that opens it. A large
+// bundle is carried on the ISO like any other file.
+func (d *fileDelivery) bundleCommands(ctx RenderContext, recipients []age.Recipient) ([]string, error) {
+	commands := writeFileCommands(targetRoot, openSecretsBundlePath, []byte(openSecretsBundleScript(ctx.Hostname, ctx.SecretsBundle)), 0700)
+	if len(d.Bundle) == 0 {
+		return commands, nil
+	}
+	sealed, err := sealSecretsBundle(recipients, d.Bundle)
+	if err != nil {
+		return nil, err
+	}
+	return append(commands, d.writeCommands(ctx, targetRoot, secretsBundlePath, sealed, 0600)...), nil
+}
@@ -0,0 +1,231 @@
+package generate_cloud_config
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// writeAgeSecrets encrypts content to a new identity and returns the paths of
+// the encrypted file and of the identity file.
+func writeAgeSecrets(t *testing.T, content string, armored bool) (path, identityPath string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityPath = filepath.Join(dir, "keys.txt")
+	if err = os.WriteFile(identityPath, []byte("# test key\n"+identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	var dst io.Writer = &out
+	var armorWriter io.WriteCloser
+	if armored {
+		armorWriter = armor.NewWriter(&out)
+		dst = armorWriter
+	}
+	w, err := age.Encrypt(dst, identity.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.WriteString(w, content); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if armorWriter != nil {
+		if err = armorWriter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path = filepath.Join(dir, "secrets.yaml.age")
+	if err = os.WriteFile(path, out.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestSecretSourceResolve(t *testing.T) {
+	secrets := "plex:\n  claim: claim-abc\ncloudflared-token: eyJhIjoi\nport: 32400\n"
+	binary, identity := writeAgeSecrets(t, secrets, false)
+	armored, armoredIdentity := writeAgeSecrets(t, secrets, true)
+	t.Setenv("SECRET_TEST_TOKEN", "from-env\n")
+
+	tests := []struct {
+		source   SecretSource
+		identity string
+		want     string
+		err      string
+	}{
+		{source: "env:SECRET_TEST_TOKEN", want: "from-env"},
+		{source: "env:SECRET_TEST_UNSET", err: "is not set"},
+		{source: "cmd:printf 'from-cmd\\n'", want: "from-cmd"},
+		{source: "cmd:exit 3", err: "error running secret command"},
+		{source: "cmd:true", err: "is empty"},
+		{source: SecretSource("age:" + binary + "#plex.claim"), identity: identity, want: "claim-abc"},
+		{source: SecretSource("age:" + armored + "#cloudflared-token"), identity: armoredIdentity, want: "eyJhIjoi"},
+		{source: SecretSource("age:" + binary + "#port"), identity: identity, want: "32400"},
+		{source: SecretSource("age:" + binary + "#plex"), identity: identity, err: "is not a string"},
+		{source: SecretSource("age:" + binary + "#plex.token"), identity: identity, err: "has no key plex.token"},
+		{source: SecretSource("age:" + binary + "#plex.claim"), identity: armoredIdentity, err: "error decrypting"},
+		{source: SecretSource("age:" + binary + "#plex.claim"), err: "needs an age identity file"},
+		{source: SecretSource("age:" + binary), identity: identity, err: "must be age:PATH#KEY"},
+		{source: "vault:secret/plex", err: "unknown secret source"},
+	}
+	for _, test := range tests {
+		got, err := test.source.Resolve(test.identity)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want one containing %q", test.source, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.source, err)
+		} else if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.source, got, test.want)
+		}
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "runs")
+	t.Setenv("SECRET_TEST_PASSWORD", "hunter2")
+
+	ctx := CloudConfigContext{
+		AdminPassword:    "env:SECRET_TEST_PASSWORD",
+		RootPassword:     "$6$salt$hash",
+		PlexClaim:        "claim-literal",
+		CloudflaredToken: countingCommand(counter, "token"),
+		Users:            []UserSpec{{Name: "backup", Password: countingCommand(counter, "token")}},
+	}
+	secrets, err := ctx.ResolveSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.AdminPassword != "hunter2" || ctx.CloudflaredToken != "token" || ctx.Users[0].Password != "token" {
+		t.Errorf("secret sources are not resolved: %+v", ctx)
+	}
+	if want := "hunter2 claim-literal token token"; strings.Join(secrets, " ") != want {
+		t.Errorf("got secrets %q, want %q", secrets, want)
+	}
+	runs, err := os.ReadFile(counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(runs) != "x" {
+		t.Errorf("the secret command ran %d times, want once", len(runs))
+	}
+}
+
+// countingCommand returns a cmd: source that prints secret and records each
+// run in counter.
+func countingCommand(counter, secret string) string {
+	return "cmd:printf x >> " + counter + " && echo " + secret
+}
+
+func TestDeliverFilesToSecretsBundle(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := CloudConfigContext{
+		Hostname:      "host1",
+		AdminUsername: "admin",
+		PlexClaim:     "claim-abc",
+		Values:        map[string]interface{}{"wifi": map[string]interface{}{"psk": "hunter22"}, "pin": "1"},
+		SecretValues:  []string{"wifi.psk", "pin"},
+		SecretsBundle: SecretsBundleSpec{Recipients: []string{identity.Recipient().String()}},
+	}
+	if _, err = ctx.ResolveSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	delivery := deliverTestFiles(t, ctx, fstest.MapFS{
+		"opt/compose.yml.tpl": {Data: []byte("PLEX_CLAIM={{ .PlexClaim }}\n")},
+		"etc/wpa.conf.tpl":    {Data: []byte("#meta\nmode: \"0640\"\n#/meta\npsk={{ .Values.wifi.psk }}\n")},
+		"etc/marked.conf":     {Data: []byte("#meta\nsecret: true\n#/meta\nmarked\n")},
+		"etc/hostname.tpl":    {Data: []byte("{{ .Hostname }}\n")},
+		"etc/motd":            {Data: []byte("Welcome to host1\n")},
+		"~/.config/token.tpl": {Data: []byte("{{ .PlexClaim }}\n")},
+	})
+	commands, err := delivery.bundleCommands(RenderContext{CloudConfigContext: ctx}, []age.Recipient{identity.Recipient()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delivery.WriteFiles) != 0 {
+		t.Errorf("the first-boot file carrying a secret is written by cloud-init: %+v", delivery.WriteFiles)
+	}
+	for _, command := range append(delivery.LateCommands, commands...) {
+		for _, secret := range []string{"claim-abc", "hunter22", "marked"} {
+			if strings.Contains(command, secret) || strings.Contains(command, b64enc(secret)) {
+				t.Errorf("late-command %q carries %s in plain text", command, secret)
+			}
+		}
+	}
+
+	root := t.TempDir()
+	runInFakeTarget(t, root, t.TempDir(), append(delivery.LateCommands, commands...))
+	for _, name := range []string{"etc/hostname", "etc/motd"} {
+		if _, err = os.Stat(filepath.Join(root, name)); err != nil {
+			t.Errorf("files without secrets are not written: %v", err)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(root, openSecretsBundlePath)); err != nil {
+		t.Errorf("the script that opens the bundle is not written: %v", err)
+	}
+	sealed, err := os.Open(filepath.Join(root, secretsBundlePath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(sealed *os.File) {
+		_ = sealed.Close()
+	}(sealed)
+	archive, err := age.Decrypt(sealed, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"opt/compose.yml":          "-rw------- root:root PLEX_CLAIM=claim-abc\n",
+		"etc/wpa.conf":             "-rw------- root:root psk=hunter22\n",
+		"etc/marked.conf":          "-rw------- root:root marked\n",
+		"home/admin/.config/":      "drwx------ admin:admin ",
+		"home/admin/.config/token": "-rw------- admin:admin claim-abc\n",
+	}
+	tr := tar.NewReader(archive)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := header.FileInfo().Mode().String() + " " + header.Uname + ":" + header.Gname + " " + string(contents)
+		if got != want[header.Name] {
+			t.Errorf("bundle holds %s as %q, want %q", header.Name, got, want[header.Name])
+		}
+		delete(want, header.Name)
+	}
+	for name := range want {
+		t.Errorf("bundle is missing %s", name)
+	}
+}
@@ -0,0 +1,184 @@
+package generate_cloud_config
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rsa"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// minRSABits is the smallest RSA key that is not reported as weak.
+const minRSABits = 3072
+
+// sshKeyOptions are the authorized_keys options sshd understands. Those that
+// take a value are listed with their =.
+var sshKeyOptions = []string{
+	"agent-forwarding", "cert-authority", "command=", "environment=", "expiry-time=", "from=",
+	"no-agent-forwarding", "no-port-forwarding", "no-pty", "no-touch-required", "no-user-rc",
+	"no-x11-forwarding", "permitlisten=", "permitopen=", "port-forwarding", "principals=", "pty",
+	"restrict", "tunnel=", "user-rc", "verify-required", "x11-forwarding",
+}
+
+// LoadSSHKeys adds the keys of the ssh-key-files and authorized-keys-files to
+// the ssh keys and checks every key of the host spec. Malformed keys and
+// unknown options are errors, duplicates are dropped and weak keys are
+// returned as warnings. GenerateCloudConfig calls it as well, so calling it
+// first is only needed for the warnings.
+func (c *CloudConfigContext) LoadSSHKeys() (warnings []string, err error) {
+	var files []string
+	for _, pattern := range c.SSHKeyFiles {
+		matches, err := filepath.Glob(expandHome(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ssh key file pattern %q: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no ssh key file matches %s", pattern)
+		}
+		files = append(files, matches...)
+	}
+	for _, path := range c.AuthorizedKeysFiles {
+		files = append(files, expandHome(path))
+	}
+	for _, path := range files {
+		keys, err := readSSHKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		c.SSHKeys = append(c.SSHKeys, keys...)
+	}
+	// The keys are part of SSHKeys now.
+	c.SSHKeyFiles, c.AuthorizedKeysFiles = nil, nil
+
+	var keyWarnings []string
+	if c.SSHKeys, keyWarnings, err = checkSSHKeys(c.SSHKeys); err != nil {
+		return nil, err
+	}
+	warnings = append(warnings, keyWarnings...)
+	for i, user := range c.Users {
+		if c.Users[i].SSHKeys, keyWarnings, err = checkSSHKeys(user.SSHKeys); err != nil {
+			return nil, fmt.Errorf("user %s: %w", user.Name, err)
+		}
+		for _, warning := range keyWarnings {
+			warnings = append(warnings, fmt.Sprintf("user %s: %s", user.Name, warning))
+		}
+	}
+	return warnings, nil
+}
+
+// readSSHKeyFile returns the keys of a public key or authorized_keys file.
+func readSSHKeyFile(path string) (keys []string, err error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ssh key file %s: %w", path, err)
+	}
+	if bytes.Contains(content, []byte("PRIVATE KEY-----")) {
+		return nil, fmt.Errorf("ssh key file %s holds a private key", path)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	// RSA keys with many options make long lines.
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading ssh key file %s: %w", path, err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("ssh key file %s holds no key", path)
+	}
+	return
+}
+
+// checkSSHKeys parses authorized_keys lines and returns them normalized and
+// without duplicates, with a warning for every weak or duplicate key.
+func checkSSHKeys(lines []string) (keys []string, warnings []string, err error) {
+	var seen [][]byte
+	for _, line := range lines {
+		if strings.ContainsAny(line, "\r\n") {
+			return nil, nil, fmt.Errorf("ssh key %q spans several lines", line)
+		}
+		key, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil || len(bytes.TrimSpace(rest)) > 0 {
+			return nil, nil, fmt.Errorf("malformed ssh key %q", line)
+		}
+		name := ssh.FingerprintSHA256(key)
+		if comment != "" {
+			name += " (" + comment + ")"
+		}
+		for _, option := range options {
+			if err = checkSSHKeyOption(option); err != nil {
+				return nil, nil, fmt.Errorf("ssh key %s: %w", name, err)
+			}
+		}
+
+		wire := key.Marshal()
+		if slices.ContainsFunc(seen, func(other []byte) bool { return bytes.Equal(other, wire) }) {
+			warnings = append(warnings, fmt.Sprintf("ssh key %s is given twice, keeping the first", name))
+			continue
+		}
+		seen = append(seen, wire)
+		if warning := weakSSHKey(key); warning != "" {
+			warnings = append(warnings, fmt.Sprintf("ssh key %s %s", name, warning))
+		}
+
+		normalized := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+		if len(options) > 0 {
+			normalized = strings.Join(options, ",") + " " + normalized
+		}
+		if comment != "" {
+			normalized += " " + comment
+		}
+		keys = append(keys, normalized)
+	}
+	return
+}
+
+func checkSSHKeyOption(option string) error {
+	name, _, hasValue := strings.Cut(option, "=")
+	if hasValue {
+		name += "="
+	}
+	if !slices.Contains(sshKeyOptions, strings.ToLower(name)) {
+		return fmt.Errorf("unknown option %q", option)
+	}
+	return nil
+}
+
+// weakSSHKey describes why a key is weak, or returns "" for a strong key.
+func weakSSHKey(key ssh.PublicKey) string {
+	switch key.Type() {
+	case ssh.KeyAlgoDSA:
+		return "is DSA, which current OpenSSH releases reject"
+	case ssh.KeyAlgoRSA:
+		cryptoKey, ok := key.(ssh.CryptoPublicKey)
+		if !ok {
+			return ""
+		}
+		if rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey); ok && rsaKey.N.BitLen() < minRSABits {
+			return fmt.Sprintf("is RSA with %d bits, less than the recommended %d", rsaKey.N.BitLen(), minRSABits)
+		}
+	}
+	return ""
+}
+
+// expandHome replaces a leading ~/ with the home directory of the local user.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, strings.TrimPrefix(path, "~"))
+}
@@ -0,0 +1,93 @@
+package generate_cloud_config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authorizedKey returns a new public key in authorized_keys format.
+func authorizedKey(t *testing.T, key interface{}) string {
+	t.Helper()
+
+	publicKey, err := ssh.NewPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey)))
+}
+
+// ed25519AuthorizedKey returns a new ed25519 public key in authorized_keys
+// format.
+func ed25519AuthorizedKey(t *testing.T) string {
+	t.Helper()
+
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authorizedKey(t, publicKey)
+}
+
+func TestLoadSSHKeys(t *testing.T) {
+	edPublic, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed := authorizedKey(t, edPublic)
+	weak := authorizedKey(t, &rsaPrivate.PublicKey)
+
+	dir := t.TempDir()
+	if err = os.WriteFile(filepath.Join(dir, "id_ed25519.pub"), []byte(ed+" laptop\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	authorizedKeys := "# backup host\n\n" + `from="10.0.0.0/8",no-pty ` + weak + " backup\n" + ed + " again\n"
+	if err = os.WriteFile(filepath.Join(dir, "authorized_keys"), []byte(authorizedKeys), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := CloudConfigContext{
+		SSHKeyFiles:         []string{filepath.Join(dir, "*.pub")},
+		AuthorizedKeysFiles: []string{filepath.Join(dir, "authorized_keys")},
+		Users:               []UserSpec{{Name: "backup", SSHKeys: []string{"  " + ed + "  "}}},
+	}
+	warnings, err := ctx.LoadSSHKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{ed + " laptop", `from="10.0.0.0/8",no-pty ` + weak + " backup"}
+	if strings.Join(ctx.SSHKeys, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got ssh keys %q, want %q", ctx.SSHKeys, want)
+	}
+	if len(ctx.Users[0].SSHKeys) != 1 || ctx.Users[0].SSHKeys[0] != ed {
+		t.Errorf("got ssh keys %q of user backup, want the trimmed key", ctx.Users[0].SSHKeys)
+	}
+	if len(warnings) != 2 || !strings.Contains(warnings[0], "RSA with 2048 bits") || !strings.Contains(warnings[1], "(again) is given twice") {
+		t.Errorf("got warnings %q, want one for the weak key and one for the duplicate", warnings)
+	}
+
+	tests := []struct {
+		ctx CloudConfigContext
+		err string
+	}{
+		{ctx: CloudConfigContext{SSHKeys: []string{"ssh-ed25519 AAAAC3Nza"}}, err: "malformed ssh key"},
+		{ctx: CloudConfigContext{SSHKeys: []string{`frm="x" ` + ed}}, err: "unknown option"},
+		{ctx: CloudConfigContext{Users: []UserSpec{{Name: "backup", SSHKeys: []string{"bogus"}}}}, err: "user backup: malformed"},
+		{ctx: CloudConfigContext{SSHKeyFiles: []string{filepath.Join(dir, "*.none")}}, err: "no ssh key file matches"},
+	}
+	for _, test := range tests {
+		if _, err := test.ctx.LoadSSHKeys(); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("got error %v, want one containing %q", err, test.err)
+		}
+	}
+}
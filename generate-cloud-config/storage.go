@@ -0,0 +1,599 @@
+package generate_cloud_config
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Storage is the autoinstall storage section. It holds either a subiquity
+// layout or a list of curtin actions.
+type Storage struct {
+	Layout *StorageLayout `yaml:"layout,omitempty"`
+	Config StorageActions `yaml:"config,omitempty"`
+	Swap   *StorageSwap   `yaml:"swap,omitempty"`
+}
+
+type StorageLayoutMatch struct {
+	Path string `yaml:"path"`
+}
+
+type StorageLayout struct {
+	Name  string             `yaml:"name"`
+	Match StorageLayoutMatch `yaml:"match"`
+}
+
+// StorageSwap sizes the swap file of the installed system. A size of 0
+// disables it.
+type StorageSwap struct {
+	Size StorageSize `yaml:"size"`
+}
+
+// StorageSize is a size in bytes. In YAML it can also be written with a
+// binary unit suffix, e.g. 512M or 1.5T, as curtin reads sizes. RestSize,
+// written as -1 or "rest", takes the remaining space.
+type StorageSize int64
+
+const RestSize StorageSize = -1
+
+var sizeUnits = map[string]int64{
+	"":  1,
+	"B": 1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+	"P": 1 << 50,
+}
+
+// ParseStorageSize parses a size such as 100G, 1.5T, 4096 or rest.
+func ParseStorageSize(s string) (StorageSize, error) {
+	value := strings.TrimSpace(s)
+	if strings.EqualFold(value, "rest") || value == "-1" {
+		return RestSize, nil
+	}
+
+	upper := strings.ToUpper(value)
+	upper = strings.TrimSuffix(strings.TrimSuffix(upper, "IB"), "B")
+	number := strings.TrimRight(upper, "KMGTP")
+	unit := upper[len(number):]
+	multiplier, ok := sizeUnits[unit]
+	if !ok || number == "" {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return StorageSize(n * float64(multiplier)), nil
+}
+
+func (s *StorageSize) UnmarshalYAML(node *yaml.Node) error {
+	size, err := ParseStorageSize(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	*s = size
+	return nil
+}
+
+func (s StorageSize) String() string {
+	if s == RestSize {
+		return "rest"
+	}
+	if s == 0 {
+		return "0"
+	}
+	for _, unit := range []string{"P", "T", "G", "M", "K"} {
+		if int64(s)%sizeUnits[unit] == 0 {
+			return fmt.Sprintf("%d%s", int64(s)/sizeUnits[unit], unit)
+		}
+	}
+	return strconv.FormatInt(int64(s), 10)
+}
+
+// StorageAction is one curtin storage config action. The action type is
+// written by StorageActions, so the structs only carry the action's fields.
+type StorageAction interface {
+	ActionID() string
+	ActionType() string
+	// references returns the ids of the actions this action builds on.
+	references() []string
+}
+
+type DiskAction struct {
+	ID         string     `yaml:"id"`
+	Serial     string     `yaml:"serial,omitempty"`
+	Path       string     `yaml:"path,omitempty"`
+	WWN        string     `yaml:"wwn,omitempty"`
+	Match      *DiskMatch `yaml:"match,omitempty"`
+	Ptable     string     `yaml:"ptable,omitempty"`
+	Wipe       string     `yaml:"wipe,omitempty"`
+	Preserve   bool       `yaml:"preserve"`
+	GrubDevice bool       `yaml:"grub_device,omitempty"`
+	Name       string     `yaml:"name,omitempty"`
+}
+
+type PartitionAction struct {
+	ID         string      `yaml:"id"`
+	Device     string      `yaml:"device"`
+	Size       StorageSize `yaml:"size"`
+	Number     int         `yaml:"number,omitempty"`
+	Flag       string      `yaml:"flag,omitempty"`
+	Wipe       string      `yaml:"wipe,omitempty"`
+	Preserve   bool        `yaml:"preserve"`
+	GrubDevice bool        `yaml:"grub_device,omitempty"`
+}
+
+type RaidAction struct {
+	ID           string   `yaml:"id"`
+	Name         string   `yaml:"name"`
+	RaidLevel    int      `yaml:"raidlevel"`
+	Devices      []string `yaml:"devices"`
+	SpareDevices []string `yaml:"spare_devices,omitempty"`
+	Metadata     string   `yaml:"metadata,omitempty"`
+	Wipe         string   `yaml:"wipe,omitempty"`
+	Preserve     bool     `yaml:"preserve"`
+}
+
+type VolumeGroupAction struct {
+	ID       string   `yaml:"id"`
+	Name     string   `yaml:"name"`
+	Devices  []string `yaml:"devices"`
+	Preserve bool     `yaml:"preserve"`
+}
+
+// LogicalVolumeAction takes the free space of its volume group when Size is
+// zero.
+type LogicalVolumeAction struct {
+	ID       string      `yaml:"id"`
+	Name     string      `yaml:"name"`
+	VolGroup string      `yaml:"volgroup"`
+	Size     StorageSize `yaml:"size,omitempty"`
+	Wipe     string      `yaml:"wipe,omitempty"`
+	Preserve bool        `yaml:"preserve"`
+}
+
+// DmCryptAction opens a LUKS volume. Key is the passphrase itself and
+// KeyFile a file in the installer that holds it.
+type DmCryptAction struct {
+	ID       string `yaml:"id"`
+	Volume   string `yaml:"volume"`
+	DmName   string `yaml:"dm_name"`
+	Key      string `yaml:"key,omitempty"`
+	KeyFile  string `yaml:"keyfile,omitempty"`
+	Preserve bool   `yaml:"preserve"`
+}
+
+type FormatAction struct {
+	ID       string `yaml:"id"`
+	Volume   string `yaml:"volume"`
+	FsType   string `yaml:"fstype"`
+	Label    string `yaml:"label,omitempty"`
+	Preserve bool   `yaml:"preserve"`
+}
+
+type MountAction struct {
+	ID      string `yaml:"id"`
+	Device  string `yaml:"device"`
+	Path    string `yaml:"path"`
+	Options string `yaml:"options,omitempty"`
+}
+
+func (a DiskAction) ActionID() string          { return a.ID }
+func (a PartitionAction) ActionID() string     { return a.ID }
+func (a RaidAction) ActionID() string          { return a.ID }
+func (a VolumeGroupAction) ActionID() string   { return a.ID }
+func (a LogicalVolumeAction) ActionID() string { return a.ID }
+func (a DmCryptAction) ActionID() string       { return a.ID }
+func (a FormatAction) ActionID() string        { return a.ID }
+func (a MountAction) ActionID() string         { return a.ID }
+
+func (DiskAction) ActionType() string          { return "disk" }
+func (PartitionAction) ActionType() string     { return "partition" }
+func (RaidAction) ActionType() string          { return "raid" }
+func (VolumeGroupAction) ActionType() string   { return "lvm_volgroup" }
+func (LogicalVolumeAction) ActionType() string { return "lvm_partition" }
+func (DmCryptAction) ActionType() string       { return "dm_crypt" }
+func (FormatAction) ActionType() string        { return "format" }
+func (MountAction) ActionType() string         { return "mount" }
+
+func (DiskAction) references() []string            { return nil }
+func (a PartitionAction) references() []string     { return []string{a.Device} }
+func (a RaidAction) references() []string          { return append(slices.Clone(a.Devices), a.SpareDevices...) }
+func (a VolumeGroupAction) references() []string   { return a.Devices }
+func (a LogicalVolumeAction) references() []string { return []string{a.VolGroup} }
+func (a DmCryptAction) references() []string       { return []string{a.Volume} }
+func (a FormatAction) references() []string        { return []string{a.Volume} }
+func (a MountAction) references() []string         { return []string{a.Device} }
+
+// newStorageAction returns an empty action of a curtin action type.
+func newStorageAction(actionType string) (StorageAction, error) {
+	switch actionType {
+	case "disk":
+		return &DiskAction{}, nil
+	case "partition":
+		return &PartitionAction{}, nil
+	case "raid":
+		return &RaidAction{}, nil
+	case "lvm_volgroup":
+		return &VolumeGroupAction{}, nil
+	case "lvm_partition":
+		return &LogicalVolumeAction{}, nil
+	case "dm_crypt":
+		return &DmCryptAction{}, nil
+	case "format":
+		return &FormatAction{}, nil
+	case "mount":
+		return &MountAction{}, nil
+	}
+	return nil, fmt.Errorf("unsupported storage action type %q", actionType)
+}
+
+// StorageActions is a curtin storage config. Each action is written with its
+// type key first, as in curtin's own examples. A preserved partition that
+// takes the rest is written with a placeholder size, which the reinstall
+// preflight replaces with the size the partition has on the disk.
+type StorageActions []StorageAction
+
+func (actions *StorageActions) UnmarshalYAML(node *yaml.Node) error {
+	var raw []yaml.Node
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+
+	for _, item := range raw {
+		var header struct {
+			Type string `yaml:"type"`
+		}
+		if err := item.Decode(&header); err != nil {
+			return err
+		}
+		action, err := newStorageAction(header.Type)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", item.Line, err)
+		}
+		removeKeys(&item, "type")
+		if err = item.Decode(action); err != nil {
+			return err
+		}
+		// Store the value so the actions compare and switch like the ones
+		// the presets build.
+		*actions = append(*actions, derefAction(action))
+	}
+	return nil
+}
+
+func (actions StorageActions) MarshalYAML() (interface{}, error) {
+	sequence := &yaml.Node{Kind: yaml.SequenceNode}
+	for _, action := range actions {
+		var node yaml.Node
+		if err := node.Encode(action); err != nil {
+			return nil, err
+		}
+		if partition, ok := action.(PartitionAction); ok && partition.Preserve && partition.Size == RestSize {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == "size" {
+					node.Content[i+1] = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: placeholder(partition.ID)}
+				}
+			}
+		}
+		node.Content = append([]*yaml.Node{
+			{Kind: yaml.ScalarNode, Value: "type"},
+			{Kind: yaml.ScalarNode, Value: action.ActionType()},
+		}, node.Content...)
+		sequence.Content = append(sequence.Content, &node)
+	}
+	return sequence, nil
+}
+
+func derefAction(action StorageAction) StorageAction {
+	switch a := action.(type) {
+	case *DiskAction:
+		return *a
+	case *PartitionAction:
+		return *a
+	case *RaidAction:
+		return *a
+	case *VolumeGroupAction:
+		return *a
+	case *LogicalVolumeAction:
+		return *a
+	case *DmCryptAction:
+		return *a
+	case *FormatAction:
+		return *a
+	case *MountAction:
+		return *a
+	}
+	return action
+}
+
+// luksHeaderSize is the space the LUKS2 header takes from an encrypted volume.
+const luksHeaderSize StorageSize = 16 << 20
+
+var (
+	// raidMinDevices is the number of active members each supported RAID
+	// level needs.
+	raidMinDevices = map[int]int{0: 2, 1: 2, 5: 3, 6: 4, 10: 4}
+	// referenceTypes lists the action types each action type may reference.
+	referenceTypes = map[string][]string{
+		"partition":     {"disk", "raid"},
+		"raid":          {"disk", "partition"},
+		"lvm_volgroup":  {"disk", "partition", "raid", "dm_crypt"},
+		"lvm_partition": {"lvm_volgroup"},
+		"dm_crypt":      {"disk", "partition", "raid", "lvm_partition"},
+		"format":        {"disk", "partition", "raid", "lvm_partition", "dm_crypt"},
+		"mount":         {"format"},
+	}
+	fsTypes = []string{"ext4", "ext3", "ext2", "xfs", "btrfs", "vfat", "fat32", "swap"}
+)
+
+// ValidateStorageActions checks that a curtin storage config is consistent:
+// ids are unique and referenced only after they are defined and by actions
+// that can use them, every volume is used by one action only, preserved
+// actions only build on preserved actions, partitions fit their disk where
+// its size is known, and the system has a root file system and a boot loader
+// target.
+func ValidateStorageActions(actions StorageActions, firmware string) error {
+	byID := map[string]StorageAction{}
+	usedBy := map[string]string{}
+	partitions := map[string][]PartitionAction{}
+	mounts := map[string]string{}
+	grubDevice := false
+
+	for index, action := range actions {
+		id := action.ActionID()
+		if id == "" {
+			return fmt.Errorf("storage action #%d (%s) has no id", index+1, action.ActionType())
+		}
+		if _, ok := byID[id]; ok {
+			return fmt.Errorf("storage action id %s is used more than once", id)
+		}
+
+		for _, ref := range action.references() {
+			target, ok := byID[ref]
+			if !ok {
+				return fmt.Errorf("storage action %s references %q, which is not defined before it", id, ref)
+			}
+			if !slices.Contains(referenceTypes[action.ActionType()], target.ActionType()) {
+				return fmt.Errorf("storage action %s (%s) cannot use %s (%s)", id, action.ActionType(), ref, target.ActionType())
+			}
+			if preserved(action) && !preserved(target) {
+				return fmt.Errorf("storage action %s is preserved but %s, which it is on, is not", id, ref)
+			}
+			if action.ActionType() == "partition" || action.ActionType() == "lvm_partition" {
+				continue
+			}
+			if other, ok := usedBy[ref]; ok {
+				return fmt.Errorf("storage actions %s and %s both use %s", other, id, ref)
+			}
+			if len(partitions[ref]) > 0 {
+				return fmt.Errorf("storage action %s uses %s, which is partitioned", id, ref)
+			}
+			usedBy[ref] = id
+		}
+
+		switch a := action.(type) {
+		case DiskAction:
+			if a.Serial == "" && a.Path == "" && a.WWN == "" && a.Match == nil {
+				return fmt.Errorf("disk %s needs a serial, path, wwn or match", id)
+			}
+			if a.Preserve && a.Wipe != "" {
+				return fmt.Errorf("disk %s is preserved and wiped, wipe its partitions instead", id)
+			}
+			grubDevice = grubDevice || a.GrubDevice
+		case PartitionAction:
+			if _, ok := usedBy[a.Device]; ok {
+				return fmt.Errorf("partition %s is on %s, which is used by %s", id, a.Device, usedBy[a.Device])
+			}
+			siblings := partitions[a.Device]
+			if len(siblings) > 0 && siblings[len(siblings)-1].Size == RestSize {
+				return fmt.Errorf("partition %s follows %s, which takes the rest of %s", id, siblings[len(siblings)-1].ID, a.Device)
+			}
+			if a.Size == 0 || a.Size < RestSize {
+				return fmt.Errorf("partition %s has no size", id)
+			}
+			if a.Preserve && a.Number == 0 {
+				return fmt.Errorf("partition %s is preserved, it needs its number on the disk", id)
+			}
+			if a.Flag == "bios_grub" && firmware == "uefi" {
+				return fmt.Errorf("partition %s is a bios_grub partition, which uefi firmware does not use", id)
+			}
+			partitions[a.Device] = append(siblings, a)
+			grubDevice = grubDevice || a.GrubDevice
+		case RaidAction:
+			minDevices, ok := raidMinDevices[a.RaidLevel]
+			if !ok {
+				return fmt.Errorf("raid %s has unsupported level %d", id, a.RaidLevel)
+			}
+			if len(a.Devices) < minDevices {
+				return fmt.Errorf("raid %s (raid%d) needs at least %d devices, it has %d", id, a.RaidLevel, minDevices, len(a.Devices))
+			}
+			if err := checkRaidMemberSizes(a, byID); err != nil {
+				return err
+			}
+		case VolumeGroupAction:
+			if len(a.Devices) == 0 {
+				return fmt.Errorf("volume group %s has no devices", id)
+			}
+		case LogicalVolumeAction:
+			if a.Size < 0 {
+				return fmt.Errorf("logical volume %s has a negative size, omit the size to take the free space", id)
+			}
+		case DmCryptAction:
+			if a.Key == "" && a.KeyFile == "" {
+				return fmt.Errorf("dm_crypt %s has no key, set the passphrase of the storage encryption", id)
+			}
+			if a.DmName == "" {
+				return fmt.Errorf("dm_crypt %s has no dm_name", id)
+			}
+		case FormatAction:
+			if !slices.Contains(fsTypes, a.FsType) {
+				return fmt.Errorf("format %s has unsupported fstype %q, expected one of %s", id, a.FsType, strings.Join(fsTypes, ", "))
+			}
+		case MountAction:
+			format := byID[a.Device].(FormatAction)
+			if format.FsType == "swap" {
+				if a.Path != "" && a.Path != "none" {
+					return fmt.Errorf("mount %s mounts swap at %s, swap is mounted at none", id, a.Path)
+				}
+				break
+			}
+			if !path.IsAbs(a.Path) || path.Clean(a.Path) != a.Path {
+				return fmt.Errorf("mount %s has invalid path %q", id, a.Path)
+			}
+			if other, ok := mounts[a.Path]; ok {
+				return fmt.Errorf("mounts %s and %s both mount %s", other, id, a.Path)
+			}
+			mounts[a.Path] = id
+			if a.Path == "/boot/efi" && format.FsType != "vfat" && format.FsType != "fat32" {
+				return fmt.Errorf("mount %s mounts /boot/efi, which must be vfat", id)
+			}
+		}
+
+		byID[id] = action
+	}
+
+	for device, siblings := range partitions {
+		if err := checkPartitionsFit(device, siblings, byID); err != nil {
+			return err
+		}
+	}
+	if err := checkVolumeGroupsFit(actions, byID); err != nil {
+		return err
+	}
+
+	if _, ok := mounts["/"]; !ok {
+		return fmt.Errorf("storage config mounts nothing at /")
+	}
+	if firmware == "uefi" {
+		if _, ok := mounts["/boot/efi"]; !ok {
+			return fmt.Errorf("storage config mounts nothing at /boot/efi, which uefi firmware needs")
+		}
+	}
+	if !grubDevice {
+		return fmt.Errorf("storage config has no grub_device to install the boot loader to")
+	}
+
+	return nil
+}
+
+// knownSize returns the size of an action's volume when the config fixes it.
+// A disk matched by its size is taken to be the smallest size it may have.
+func knownSize(id string, byID map[string]StorageAction) (StorageSize, bool) {
+	switch a := byID[id].(type) {
+	case DiskAction:
+		if a.Match != nil && a.Match.MinSize > 0 {
+			return a.Match.MinSize, true
+		}
+	case PartitionAction:
+		if a.Size > 0 {
+			return a.Size, true
+		}
+	case RaidAction:
+		var smallest StorageSize
+		for _, device := range a.Devices {
+			size, ok := knownSize(device, byID)
+			if !ok {
+				return 0, false
+			}
+			if smallest == 0 || size < smallest {
+				smallest = size
+			}
+		}
+		switch a.RaidLevel {
+		case 0:
+			return smallest * StorageSize(len(a.Devices)), true
+		case 1:
+			return smallest, true
+		case 5:
+			return smallest * StorageSize(len(a.Devices)-1), true
+		case 6:
+			return smallest * StorageSize(len(a.Devices)-2), true
+		case 10:
+			return smallest * StorageSize(len(a.Devices)/2), true
+		}
+	case LogicalVolumeAction:
+		if a.Size > 0 {
+			return a.Size, true
+		}
+	case DmCryptAction:
+		if size, ok := knownSize(a.Volume, byID); ok && size > luksHeaderSize {
+			return size - luksHeaderSize, true
+		}
+	}
+	return 0, false
+}
+
+// checkRaidMemberSizes refuses mirrors and parity arrays whose members are
+// known to differ in size, which would waste the larger members' space.
+func checkRaidMemberSizes(raid RaidAction, byID map[string]StorageAction) error {
+	var first StorageSize
+	for _, device := range raid.Devices {
+		size, ok := knownSize(device, byID)
+		if !ok {
+			continue
+		}
+		if first == 0 {
+			first = size
+		} else if size != first {
+			return fmt.Errorf("raid %s members differ in size (%s and %s)", raid.ID, first, size)
+		}
+	}
+	return nil
+}
+
+func checkPartitionsFit(device string, partitions []PartitionAction, byID map[string]StorageAction) error {
+	available, ok := knownSize(device, byID)
+	if !ok {
+		return nil
+	}
+	var total StorageSize
+	for _, partition := range partitions {
+		if partition.Size > 0 {
+			total += partition.Size
+		}
+	}
+	if total > available {
+		return fmt.Errorf("partitions of %s need %s, it has %s", device, total, available)
+	}
+	return nil
+}
+
+func checkVolumeGroupsFit(actions StorageActions, byID map[string]StorageAction) error {
+	for _, action := range actions {
+		group, ok := action.(VolumeGroupAction)
+		if !ok {
+			continue
+		}
+		var available StorageSize
+		for _, device := range group.Devices {
+			size, ok := knownSize(device, byID)
+			if !ok {
+				available = 0
+				break
+			}
+			available += size
+		}
+		if available == 0 {
+			continue
+		}
+
+		var total StorageSize
+		for _, other := range actions {
+			if volume, ok := other.(LogicalVolumeAction); ok && volume.VolGroup == group.ID {
+				total += volume.Size
+			}
+		}
+		if total > available {
+			return fmt.Errorf("logical volumes of %s need %s, it has %s", group.ID, total, available)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package generate_cloud_config
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// luksKeyFile holds the passphrase in the installer while curtin formats
+	// the encrypted volumes. It lives in the installer's tmpfs and never
+	// reaches the installed system.
+	luksKeyFile = "/tmp/luks.key"
+	// tpmPCRs are the PCRs clevis seals the key to. PCR 7 holds the Secure
+	// Boot state, which kernel and initramfs updates leave unchanged.
+	tpmPCRs = `{"pcr_ids":"7"}`
+)
+
+// tpmPackages unlock LUKS volumes with the TPM from the initramfs.
+var tpmPackages = []string{"clevis", "clevis-tpm2", "clevis-luks", "clevis-initramfs"}
+
+// StorageEncryption encrypts the physical volume of an LVM layout with LUKS,
+// or supplies the key of the dm_crypt actions of a custom layout.
+type StorageEncryption struct {
+	Passphrase SecretSource `yaml:"passphrase"`
+	// TPM binds the volumes to the TPM with clevis so they unlock without the
+	// passphrase. Machines without a TPM keep asking for it.
+	TPM bool `yaml:"tpm"`
+	// RecoveryKey is a local file whose key is added to the volumes as a
+	// second passphrase and carried on the ISO. A key is generated into the
+	// file when it does not exist.
+	RecoveryKey string `yaml:"recovery-key"`
+}
+
+// dmName names the nth encrypted volume the way subiquity does.
+func dmName(n int) string {
+	return fmt.Sprintf("dm_crypt-%d", n)
+}
+
+// getEncryptionSetup keys the dm_crypt actions and returns the installer
+// steps that write the key, bind the volumes to the TPM and add the recovery
+// key. resolve reads the passphrase.
+func getEncryptionSetup(encryption *StorageEncryption, actions StorageActions, resolve func(SecretSource) (string, error)) (setup storageSetup, err error) {
+	var dmNames []string
+	for i, action := range actions {
+		dmCrypt, ok := action.(DmCryptAction)
+		if !ok {
+			continue
+		}
+		if encryption != nil && dmCrypt.Key == "" && dmCrypt.KeyFile == "" {
+			dmCrypt.KeyFile = luksKeyFile
+			actions[i] = dmCrypt
+		}
+		if dmCrypt.KeyFile == luksKeyFile {
+			dmNames = append(dmNames, dmCrypt.DmName)
+		}
+	}
+	if encryption == nil {
+		return
+	}
+	if len(dmNames) == 0 {
+		return setup, fmt.Errorf("encryption is set but no volume is encrypted with its passphrase")
+	}
+	if encryption.Passphrase == "" {
+		return setup, fmt.Errorf("encryption needs a passphrase source")
+	}
+
+	passphrase, err := resolve(encryption.Passphrase)
+	if err != nil {
+		return setup, fmt.Errorf("error reading the encryption passphrase: %w", err)
+	}
+	setup.EarlyCommands = []string{fmt.Sprintf(
+		`(umask 077 && echo "%s" | base64 -d > %s)`,
+		base64.StdEncoding.EncodeToString([]byte(passphrase)), luksKeyFile,
+	)}
+
+	if encryption.RecoveryKey != "" {
+		recoveryKey, err := loadOrCreateRecoveryKey(encryption.RecoveryKey)
+		if err != nil {
+			return setup, err
+		}
+		payload := newPayload([]byte(recoveryKey))
+		setup.Payloads = append(setup.Payloads, payload)
+		for _, name := range dmNames {
+			setup.LateCommands = append(setup.LateCommands, fmt.Sprintf(
+				"cryptsetup luksAddKey --key-file %s %s %s",
+				luksKeyFile, luksDeviceOf(name), shellQuote(payloadMountDir+"/"+payload.Name),
+			))
+		}
+	}
+
+	if encryption.TPM {
+		setup.Packages = tpmPackages
+		var bind []string
+		for _, name := range dmNames {
+			bind = append(bind, fmt.Sprintf(
+				"curtin in-target -- clevis luks bind -y -k %s -d %s tpm2 %s",
+				luksKeyFile, luksDeviceOf(name), shellQuote(tpmPCRs),
+			))
+		}
+		setup.LateCommands = append(setup.LateCommands, fmt.Sprintf(
+			`if [ -e /dev/tpmrm0 ]; then install -m 0600 %s /target%s && %s && curtin in-target -- update-initramfs -u -k all; rm -f /target%s; else echo "No TPM found, encrypted volumes will ask for the passphrase at boot"; fi`,
+			luksKeyFile, luksKeyFile, strings.Join(bind, " && "), luksKeyFile,
+		))
+	}
+
+	setup.LateCommands = append(setup.LateCommands, "rm -f "+luksKeyFile)
+	return
+}
+
+// luksDeviceOf returns a shell expression for the device under an open LUKS
+// volume.
+func luksDeviceOf(dmName string) string {
+	return fmt.Sprintf(`"$(cryptsetup status %s | sed -n 's/^ *device: *//p')"`, dmName)
+}
+
+// loadOrCreateRecoveryKey reads a recovery key from path, or generates one and
+// saves it there so rebuilding the ISO keeps the key the volumes were given.
+func loadOrCreateRecoveryKey(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err == nil {
+		key := strings.TrimSpace(string(content))
+		if key == "" {
+			return "", fmt.Errorf("recovery key file %s is empty", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("error reading recovery key %s: %w", path, err)
+	}
+
+	key, err := newRecoveryKey()
+	if err != nil {
+		return "", fmt.Errorf("error generating recovery key: %w", err)
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", fmt.Errorf("error creating recovery key directory: %w", err)
+	}
+	if err = os.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("error writing recovery key %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// newRecoveryKey returns eight groups of six random digits, easy to type at a
+// console that has no copy and paste.
+func newRecoveryKey() (string, error) {
+	groups := make([]string, 8)
+	for i := range groups {
+		n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+		if err != nil {
+			return "", err
+		}
+		groups[i] = fmt.Sprintf("%06d", n.Int64())
+	}
+	return strings.Join(groups, "-"), nil
+}
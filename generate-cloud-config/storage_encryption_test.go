@@ -0,0 +1,113 @@
+package generate_cloud_config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// resolvePassphrase reads the passphrase of the encryption tests.
+func resolvePassphrase(source SecretSource) (string, error) {
+	if source == "missing" {
+		return "", fmt.Errorf("no secret")
+	}
+	return "correct horse", nil
+}
+
+func TestEncryptionSetup(t *testing.T) {
+	recoveryKeyFile := filepath.Join(t.TempDir(), "keys", "host1.recovery")
+	encryption := &StorageEncryption{Passphrase: "passphrase", TPM: true, RecoveryKey: recoveryKeyFile}
+	actions := StorageActions{
+		DmCryptAction{ID: "pv-crypt", Volume: "pv", DmName: dmName(0)},
+		DmCryptAction{ID: "data-crypt", Volume: "data", DmName: dmName(1), Key: "own key"},
+	}
+	setup, err := getEncryptionSetup(encryption, actions, resolvePassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := actions[0].(DmCryptAction).KeyFile; got != luksKeyFile {
+		t.Errorf("the volume is not keyed with the passphrase, got keyfile %q", got)
+	}
+	if got := actions[1].(DmCryptAction); got.KeyFile != "" || got.Key != "own key" {
+		t.Errorf("the volume with its own key is rekeyed: %+v", got)
+	}
+	want := fmt.Sprintf(`(umask 077 && echo "%s" | base64 -d > /tmp/luks.key)`, base64.StdEncoding.EncodeToString([]byte("correct horse")))
+	if !slices.Equal(setup.EarlyCommands, []string{want}) {
+		t.Errorf("got early-commands %q, want %q", setup.EarlyCommands, want)
+	}
+	if !slices.Equal(setup.Packages, tpmPackages) {
+		t.Errorf("got packages %q, want the clevis packages", setup.Packages)
+	}
+
+	content, err := os.ReadFile(recoveryKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recoveryKey := strings.TrimSpace(string(content))
+	if !regexp.MustCompile(`^\d{6}(-\d{6}){7}$`).MatchString(recoveryKey) {
+		t.Errorf("got recovery key %q, want eight groups of six digits", recoveryKey)
+	}
+	if len(setup.Payloads) != 1 || string(setup.Payloads[0].Contents) != recoveryKey {
+		t.Fatalf("the recovery key is not carried on the ISO: %+v", setup.Payloads)
+	}
+
+	device := `"$(cryptsetup status dm_crypt-0 | sed -n 's/^ *device: *//p')"`
+	wantLate := []string{
+		"cryptsetup luksAddKey --key-file /tmp/luks.key " + device + " '/cdrom/" + PayloadDir + "/" + setup.Payloads[0].Name + "'",
+		"if [ -e /dev/tpmrm0 ]; then install -m 0600 /tmp/luks.key /target/tmp/luks.key && " +
+			"curtin in-target -- clevis luks bind -y -k /tmp/luks.key -d " + device + ` tpm2 '{"pcr_ids":"7"}' && ` +
+			"curtin in-target -- update-initramfs -u -k all; rm -f /target/tmp/luks.key; " +
+			`else echo "No TPM found, encrypted volumes will ask for the passphrase at boot"; fi`,
+		"rm -f /tmp/luks.key",
+	}
+	if strings.Join(setup.LateCommands, "\n") != strings.Join(wantLate, "\n") {
+		t.Errorf("got late-commands\n%s\nwant\n%s", strings.Join(setup.LateCommands, "\n"), strings.Join(wantLate, "\n"))
+	}
+
+	// A rebuild gives the volumes the same recovery key.
+	again, err := getEncryptionSetup(encryption, StorageActions{DmCryptAction{ID: "pv-crypt", Volume: "pv", DmName: dmName(0)}}, resolvePassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.Payloads) != 1 || again.Payloads[0].Name != setup.Payloads[0].Name {
+		t.Errorf("the recovery key is not reused")
+	}
+}
+
+func TestEncryptionSetupErrors(t *testing.T) {
+	volume := StorageActions{DmCryptAction{ID: "pv-crypt", Volume: "pv", DmName: dmName(0)}}
+	emptyKey := filepath.Join(t.TempDir(), "empty.recovery")
+	if err := os.WriteFile(emptyKey, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		encryption *StorageEncryption
+		actions    StorageActions
+		err        string
+	}{
+		{"no encrypted volume", &StorageEncryption{Passphrase: "passphrase"}, StorageActions{DmCryptAction{ID: "c", Key: "own key"}}, "no volume is encrypted with its passphrase"},
+		{"no passphrase", &StorageEncryption{}, volume, "encryption needs a passphrase source"},
+		{"unreadable passphrase", &StorageEncryption{Passphrase: "missing"}, volume, "error reading the encryption passphrase: no secret"},
+		{"empty recovery key", &StorageEncryption{Passphrase: "passphrase", RecoveryKey: emptyKey}, volume, "is empty"},
+	}
+	for _, test := range tests {
+		actions := slices.Clone(test.actions)
+		if _, err := getEncryptionSetup(test.encryption, actions, resolvePassphrase); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want one containing %q", test.name, err, test.err)
+		}
+	}
+
+	// Without encryption the dm_crypt actions keep their keys and nothing is
+	// added.
+	setup, err := getEncryptionSetup(nil, slices.Clone(volume), resolvePassphrase)
+	if err != nil || len(setup.EarlyCommands)+len(setup.LateCommands) > 0 {
+		t.Errorf("got setup %+v and error %v without encryption", setup, err)
+	}
+}
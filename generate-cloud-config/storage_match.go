@@ -0,0 +1,239 @@
+package generate_cloud_config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// resolveDisksScript is where the disk resolver is written in the live
+// installer.
+const resolveDisksScript = "/tmp/resolve-disks"
+
+// DiskMatch selects a disk. Every criterion that is set must hold. Text
+// criteria are shell globs matched against the udev properties of the disk,
+// as the probe command prints them.
+type DiskMatch struct {
+	// Serial matches ID_SERIAL or ID_SERIAL_SHORT.
+	Serial string `yaml:"serial,omitempty"`
+	Model  string `yaml:"model,omitempty"`
+	Vendor string `yaml:"vendor,omitempty"`
+	// WWN matches ID_WWN or ID_WWN_WITH_EXTENSION.
+	WWN string `yaml:"wwn,omitempty"`
+	// Path matches the device node or one of its /dev/disk links.
+	Path    string      `yaml:"path,omitempty"`
+	MinSize StorageSize `yaml:"min-size,omitempty"`
+	MaxSize StorageSize `yaml:"max-size,omitempty"`
+	// Size picks the largest or smallest of the disks the other criteria
+	// match. Without it they must match exactly one disk.
+	Size       string `yaml:"size,omitempty"`
+	SSD        *bool  `yaml:"ssd,omitempty"`
+	Rotational *bool  `yaml:"rotational,omitempty"`
+}
+
+func (m DiskMatch) validate() error {
+	if m == (DiskMatch{}) {
+		return fmt.Errorf("disk match has no criteria")
+	}
+	if m.Size != "" && m.Size != "largest" && m.Size != "smallest" {
+		return fmt.Errorf("disk match size must be largest or smallest, not %q", m.Size)
+	}
+	if m.MinSize < 0 || m.MaxSize < 0 {
+		return fmt.Errorf("disk match sizes cannot take the rest")
+	}
+	if m.MaxSize != 0 && m.MinSize > m.MaxSize {
+		return fmt.Errorf("disk match min-size %s is larger than max-size %s", m.MinSize, m.MaxSize)
+	}
+	if m.SSD != nil && m.Rotational != nil && *m.SSD == *m.Rotational {
+		return fmt.Errorf("disk match cannot be both ssd: %t and rotational: %t", *m.SSD, *m.Rotational)
+	}
+	return nil
+}
+
+// rotational returns the value /sys/block/*/queue/rotational must have, or
+// an empty string when either kind of disk matches.
+func (m DiskMatch) rotational() string {
+	switch {
+	case m.Rotational != nil && *m.Rotational, m.SSD != nil && !*m.SSD:
+		return "1"
+	case m.Rotational != nil, m.SSD != nil:
+		return "0"
+	}
+	return ""
+}
+
+// criteria returns the match as key=value arguments of resolve_disk.
+func (m DiskMatch) criteria() (criteria []string) {
+	for _, criterion := range []struct{ key, value string }{
+		{"serial", m.Serial},
+		{"model", m.Model},
+		{"vendor", m.Vendor},
+		{"wwn", m.WWN},
+		{"path", m.Path},
+		{"rotational", m.rotational()},
+	} {
+		if criterion.value != "" {
+			criteria = append(criteria, criterion.key+"="+criterion.value)
+		}
+	}
+	if m.MinSize > 0 {
+		criteria = append(criteria, fmt.Sprintf("min-size=%d", m.MinSize))
+	}
+	if m.MaxSize > 0 {
+		criteria = append(criteria, fmt.Sprintf("max-size=%d", m.MaxSize))
+	}
+	return
+}
+
+// placeholder stands for a value of action id the installer finds out, such
+// as a disk's device node, in the autoinstall config until the resolver
+// replaces it.
+func placeholder(id string) string {
+	return "@" + id + "@"
+}
+
+// resolveDiskMatches replaces the match of every disk action with a
+// placeholder path and returns the early-command that resolves the matches
+// on the installed machine. Subiquity re-reads /autoinstall.yaml after the
+// early-commands, so the resolved device nodes reach the installer while a
+// disk that is missing or ambiguous stops the install before anything is
+// written. Preserved disks are resolved too, so the preflight can check
+// what they hold.
+func resolveDiskMatches(actions StorageActions) (resolved StorageActions, commands []string, err error) {
+	var disks []diskToResolve
+	for _, action := range actions {
+		disk, ok := action.(DiskAction)
+		switch {
+		case ok && disk.Match != nil:
+			if err = disk.Match.validate(); err != nil {
+				return nil, nil, fmt.Errorf("disk %s: %w", disk.ID, err)
+			}
+			disks = append(disks, diskToResolve{ID: disk.ID, Match: *disk.Match})
+			disk.Path = placeholder(disk.ID)
+			disk.Match = nil
+			action = disk
+		case ok && disk.Preserve:
+			disks = append(disks, diskToResolve{ID: disk.ID, Match: DiskMatch{Serial: disk.Serial, WWN: disk.WWN, Path: disk.Path}})
+		}
+		resolved = append(resolved, action)
+	}
+
+	return resolved, resolveDisksCommands(disks, preflightChecks(resolved)), nil
+}
+
+type diskToResolve struct {
+	ID    string
+	Match DiskMatch
+}
+
+// resolveDisksCommands returns the early-command that resolves disks and
+// then runs the reinstall preflight checks.
+func resolveDisksCommands(disks []diskToResolve, checks []string) []string {
+	if len(disks) == 0 {
+		return nil
+	}
+
+	script := resolveDisksLibrary
+	for _, disk := range disks {
+		args := []string{shellQuote(disk.ID), shellQuote(disk.Match.Size)}
+		for _, criterion := range disk.Match.criteria() {
+			args = append(args, shellQuote(criterion))
+		}
+		script += "resolve_disk " + strings.Join(args, " ") + "\n"
+	}
+	if len(checks) > 0 {
+		script += preflightLibrary + strings.Join(checks, "\n") + "\n"
+	}
+
+	return []string{fmt.Sprintf(
+		`echo "%s" | base64 -d > %s && bash %s`,
+		base64.StdEncoding.EncodeToString([]byte(script)), resolveDisksScript, resolveDisksScript,
+	)}
+}
+
+// diskMatchLibrary defines disk_matches, which checks a disk of /sys/block
+// against key=value criteria as DiskMatch.criteria writes them.
+const diskMatchLibrary = `disk_property() {
+	udevadm info --query=property --name="/dev/$1" 2>/dev/null | sed -n "s/^$2=//p" | head -n1
+}
+
+glob_any() {
+	local pattern=$1 value
+	shift
+	for value in "$@"; do
+		[[ -n $value && $value == $pattern ]] && return 0
+	done
+	return 1
+}
+
+disk_matches() {
+	local disk=$1 sys=/sys/block/$1 key value size
+	shift
+	size=$(( $(cat "$sys/size") * 512 ))
+	for criterion in "$@"; do
+		key=${criterion%%=*}
+		value=${criterion#*=}
+		case $key in
+		serial) glob_any "$value" "$(disk_property "$disk" ID_SERIAL)" "$(disk_property "$disk" ID_SERIAL_SHORT)" || return 1 ;;
+		model) glob_any "$value" "$(disk_property "$disk" ID_MODEL)" "$(cat "$sys/device/model" 2>/dev/null | xargs)" || return 1 ;;
+		vendor) glob_any "$value" "$(disk_property "$disk" ID_VENDOR)" "$(cat "$sys/device/vendor" 2>/dev/null | xargs)" || return 1 ;;
+		wwn) glob_any "$value" "$(disk_property "$disk" ID_WWN)" "$(disk_property "$disk" ID_WWN_WITH_EXTENSION)" || return 1 ;;
+		path) glob_any "$value" "/dev/$disk" $(disk_property "$disk" DEVLINKS) || return 1 ;;
+		rotational) [ "$(cat "$sys/queue/rotational")" = "$value" ] || return 1 ;;
+		min-size) [ "$size" -ge "$value" ] || return 1 ;;
+		max-size) [ "$size" -le "$value" ] || return 1 ;;
+		esac
+	done
+}
+`
+
+// resolveDisksLibrary finds the disks of the storage config in the live
+// installer. It leaves out the install media and disks an earlier match took.
+const resolveDisksLibrary = `#!/bin/bash
+set -euo pipefail
+
+config=/autoinstall.yaml
+media_disk=$(lsblk -no PKNAME "$(findmnt -no SOURCE /cdrom 2>/dev/null)" 2>/dev/null | head -n1 || true)
+taken=" "
+declare -A devices
+
+` + diskMatchLibrary + `
+resolve_disk() {
+	local id=$1 pick=$2 sys disk candidates=() best="" best_size=0 tied=0 size
+	shift 2
+	for sys in /sys/block/*; do
+		disk=${sys##*/}
+		[ -e "$sys/device" ] || continue
+		[ "$disk" != "$media_disk" ] || continue
+		[[ $taken != *" $disk "* ]] || continue
+		disk_matches "$disk" "$@" && candidates+=("$disk")
+	done
+
+	if [ ${#candidates[@]} -eq 0 ]; then
+		echo "No disk matches $id ($*)" >&2
+		exit 1
+	fi
+	if [ -z "$pick" ] && [ ${#candidates[@]} -gt 1 ]; then
+		echo "Disk $id ($*) matches more than one disk: ${candidates[*]}" >&2
+		exit 1
+	fi
+	for disk in "${candidates[@]}"; do
+		size=$(cat "/sys/block/$disk/size")
+		if [ -z "$best" ] || { [ "$pick" = largest ] && [ "$size" -gt "$best_size" ]; } || { [ "$pick" = smallest ] && [ "$size" -lt "$best_size" ]; }; then
+			best=$disk best_size=$size tied=0
+		elif [ "$size" -eq "$best_size" ]; then
+			tied=1
+		fi
+	done
+	if [ "$tied" -eq 1 ]; then
+		echo "Disk $id ($*) has more than one $pick disk among ${candidates[*]}" >&2
+		exit 1
+	fi
+
+	echo "Disk $id is /dev/$best"
+	taken="$taken$best "
+	devices[$id]=/dev/$best
+	sed -i "s|@$id@|/dev/$best|g" "$config"
+}
+
+`
@@ -0,0 +1,250 @@
+package generate_cloud_config
+
+import (
+	"encoding/base64"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// resolverScript matches the script of the disk resolver's early-command.
+var resolverScript = regexp.MustCompile(`^echo "([A-Za-z0-9+/=]+)" \| base64 -d > /tmp/resolve-disks && bash /tmp/resolve-disks$`)
+
+// decodeResolver returns the script the early-command of the disk resolver
+// writes.
+func decodeResolver(t *testing.T, commands []string) string {
+	t.Helper()
+
+	if len(commands) != 1 {
+		t.Fatalf("got resolver commands %q, want one", commands)
+	}
+	match := resolverScript.FindStringSubmatch(commands[0])
+	if match == nil {
+		t.Fatalf("got resolver command %q", commands[0])
+	}
+	script, err := base64.StdEncoding.DecodeString(match[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(script)
+}
+
+func TestDiskMatchValidate(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		match DiskMatch
+		err   string
+	}{
+		{DiskMatch{Serial: "WD-*", Size: "largest"}, ""},
+		{DiskMatch{}, "disk match has no criteria"},
+		{DiskMatch{Model: "X", Size: "biggest"}, `size must be largest or smallest, not "biggest"`},
+		{DiskMatch{MinSize: RestSize}, "sizes cannot take the rest"},
+		{DiskMatch{MinSize: 2 << 40, MaxSize: 1 << 40}, "min-size 2T is larger than max-size 1T"},
+		{DiskMatch{SSD: &yes, Rotational: &yes}, "cannot be both ssd: true and rotational: true"},
+		{DiskMatch{SSD: &yes, Rotational: &no}, ""},
+	}
+	for _, test := range tests {
+		err := test.match.validate()
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%+v: %v", test.match, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%+v: got error %v, want one containing %q", test.match, err, test.err)
+		}
+	}
+}
+
+func TestResolveDiskMatches(t *testing.T) {
+	ssd := true
+	actions := StorageActions{
+		DiskAction{ID: "os", Match: &DiskMatch{SSD: &ssd, MaxSize: 1 << 40}, Ptable: "gpt"},
+		DiskAction{ID: "data", Match: &DiskMatch{Serial: "WD-*", Size: "largest"}, Ptable: "gpt"},
+		DiskAction{ID: "old", Serial: "ST-1", Preserve: true},
+		DiskAction{ID: "other", Serial: "ST-2"},
+	}
+	resolved, commands, err := resolveDiskMatches(actions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range []string{"os", "data"} {
+		if disk := resolved[i].(DiskAction); disk.Path != placeholder(id) || disk.Match != nil {
+			t.Errorf("disk %s is not replaced with its placeholder: %+v", id, disk)
+		}
+	}
+
+	script := decodeResolver(t, commands)
+	var lines []string
+	for _, line := range strings.Split(script, "\n") {
+		if strings.HasPrefix(line, "resolve_disk ") {
+			lines = append(lines, line)
+		}
+	}
+	want := []string{
+		"resolve_disk 'os' '' 'rotational=0' 'max-size=1099511627776'",
+		"resolve_disk 'data' 'largest' 'serial=WD-*'",
+		"resolve_disk 'old' '' 'serial=ST-1'",
+	}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got resolver lines\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+
+	if _, _, err = resolveDiskMatches(StorageActions{DiskAction{ID: "d0", Match: &DiskMatch{}}}); err == nil || !strings.Contains(err.Error(), "disk d0: disk match has no criteria") {
+		t.Errorf("got error %v, want one about the empty match", err)
+	}
+}
+
+// fakeDisk is a disk of the fake /sys/block the resolver runs against.
+type fakeDisk struct {
+	name       string
+	sectors    string
+	rotational string
+	properties string
+}
+
+// runResolver runs the disk resolver script on fake disks with config as
+// /autoinstall.yaml and returns the config it leaves and its output.
+func runResolver(t *testing.T, script, config string, disks []fakeDisk) (string, string, error) {
+	t.Helper()
+
+	root := t.TempDir()
+	for _, disk := range disks {
+		sys := filepath.Join(root, "sys", "block", disk.name)
+		for _, dir := range []string{"device", "queue"} {
+			if err := os.MkdirAll(filepath.Join(sys, dir), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		files := map[string]string{
+			filepath.Join(sys, "size"):                disk.sectors,
+			filepath.Join(sys, "queue", "rotational"): disk.rotational,
+			filepath.Join(root, "udev", disk.name):    disk.properties,
+		}
+		for path, content := range files {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	configPath := filepath.Join(root, "autoinstall.yaml")
+	if err := os.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bin := t.TempDir()
+	stubs := map[string]string{
+		"udevadm": "#!/bin/sh\nfor arg; do case $arg in --name=/dev/*) cat " + shellQuote(root+"/udev/") + "\"${arg#--name=/dev/}\" ;; esac; done\n",
+		"lsblk":   "#!/bin/sh\n",
+		"findmnt": "#!/bin/sh\n",
+	}
+	for name, stub := range stubs {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(stub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	script = strings.NewReplacer("/sys/block", root+"/sys/block", "config=/autoinstall.yaml", "config="+configPath).Replace(script)
+	cmd := exec.Command("bash", "-c", script)
+	cmd.Env = append(os.Environ(), "PATH="+bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	out, err := cmd.CombinedOutput()
+	resolved, readErr := os.ReadFile(configPath)
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	return string(resolved), string(out), err
+}
+
+func TestDiskResolverScript(t *testing.T) {
+	disks := []fakeDisk{
+		{"sda", "1953525168", "1", "ID_SERIAL=WD-1\nID_MODEL=WDC"},
+		{"sdb", "3907029168", "1", "ID_SERIAL=WD-2\nID_MODEL=WDC"},
+		{"nvme0n1", "976773168", "0", "ID_SERIAL=SAMSUNG-1\nID_WWN=eui.0025"},
+	}
+	ssd := true
+	config := "os: @os@\ndata: @data@\n"
+
+	_, commands, err := resolveDiskMatches(StorageActions{
+		DiskAction{ID: "os", Match: &DiskMatch{SSD: &ssd}},
+		DiskAction{ID: "data", Match: &DiskMatch{Model: "WDC", Size: "largest"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved, out, err := runResolver(t, decodeResolver(t, commands), config, disks)
+	if err != nil {
+		t.Fatalf("resolver failed: %v\n%s", err, out)
+	}
+	if resolved != "os: /dev/nvme0n1\ndata: /dev/sdb\n" {
+		t.Errorf("got resolved config %q", resolved)
+	}
+
+	outputs := []struct {
+		match DiskMatch
+		out   string
+	}{
+		{DiskMatch{Serial: "WD-*"}, "matches more than one disk: sda sdb"},
+		{DiskMatch{Serial: "HGST-*"}, "No disk matches disk0 (serial=HGST-*)"},
+		{DiskMatch{Model: "WDC", MinSize: 1 << 40, Size: "smallest"}, "Disk disk0 is /dev/sdb"},
+	}
+	for _, output := range outputs {
+		_, commands, err := resolveDiskMatches(StorageActions{DiskAction{ID: "disk0", Match: &output.match}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, out, err = runResolver(t, decodeResolver(t, commands), "disk0: @disk0@\n", disks)
+		if !strings.Contains(out, output.out) {
+			t.Errorf("%+v: got output %q (%v), want %q", output.match, out, err, output.out)
+		}
+	}
+}
+
+func TestProbeDisks(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"sys/block/sda/size":               "3907029168",
+		"sys/block/sda/queue/rotational":   "1",
+		"sys/block/sda/dev":                "8:0",
+		"sys/block/sda/device/model":       "WDC WD20EFRX",
+		"sys/block/sda/device/vendor":      "ATA",
+		"sys/block/loop0/size":             "8",
+		"sys/block/loop0/queue/rotational": "0",
+		"run/udev/data/b8:0":               "S:disk/by-path/pci-0000:00:17.0-ata-1\nS:disk/by-id/ata-WDC_WD20EFRX_WD-1\nE:ID_SERIAL=WDC_WD20EFRX_WD-1\nE:ID_WWN=0x50014ee\nE:ID_WWN_WITH_EXTENSION=0x50014ee0aaaa\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	disks, err := ProbeDisks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(disks) != 1 {
+		t.Fatalf("got disks %+v, want sda only", disks)
+	}
+	disk := disks[0]
+	want := ProbedDisk{
+		Path:   "/dev/sda",
+		Serial: "WDC_WD20EFRX_WD-1",
+		Model:  "WDC WD20EFRX",
+		Vendor: "ATA",
+		WWN:    "0x50014ee0aaaa",
+		Size:   StorageSize(3907029168 * 512),
+		Links:  []string{"/dev/disk/by-id/ata-WDC_WD20EFRX_WD-1", "/dev/disk/by-path/pci-0000:00:17.0-ata-1"},
+	}
+	if disk.Path != want.Path || disk.Serial != want.Serial || disk.Model != want.Model || disk.Vendor != want.Vendor ||
+		disk.WWN != want.WWN || disk.Size != want.Size || disk.SSD || strings.Join(disk.Links, " ") != strings.Join(want.Links, " ") {
+		t.Errorf("got disk %+v, want %+v", disk, want)
+	}
+}
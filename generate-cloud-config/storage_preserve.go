@@ -0,0 +1,201 @@
+package generate_cloud_config
+
+import (
+	"strconv"
+	"strings"
+)
+
+// preserved reports whether curtin keeps an action's device or file system as
+// it finds it on the disk.
+func preserved(action StorageAction) bool {
+	switch a := action.(type) {
+	case DiskAction:
+		return a.Preserve
+	case PartitionAction:
+		return a.Preserve
+	case RaidAction:
+		return a.Preserve
+	case VolumeGroupAction:
+		return a.Preserve
+	case LogicalVolumeAction:
+		return a.Preserve
+	case DmCryptAction:
+		return a.Preserve
+	case FormatAction:
+		return a.Preserve
+	}
+	return false
+}
+
+// blkidTypes maps the curtin file system and partition table types blkid
+// names differently.
+var blkidTypes = map[string]string{"fat32": "vfat", "msdos": "dos"}
+
+func blkidType(curtinType string) string {
+	if blkidType, ok := blkidTypes[curtinType]; ok {
+		return blkidType
+	}
+	return curtinType
+}
+
+// preflightChecks returns the resolver lines that check the disks hold every
+// preserved action before the installer writes to them. Devices behind a
+// LUKS volume stay closed in the live installer, so the volume group and
+// logical volumes on one are not checked.
+func preflightChecks(actions StorageActions) (checks []string) {
+	byID := map[string]StorageAction{}
+	onCrypt := map[string]bool{}
+	for _, action := range actions {
+		id := action.ActionID()
+		byID[id] = action
+		if !preserved(action) {
+			continue
+		}
+
+		var args []string
+		switch a := action.(type) {
+		case DiskAction:
+			if a.Ptable != "" {
+				args = []string{"expect_ptable", id, blkidType(a.Ptable)}
+			}
+		case PartitionAction:
+			size := "rest"
+			if a.Size != RestSize {
+				size = strconv.FormatInt(int64(a.Size), 10)
+			}
+			args = []string{"expect_partition", id, a.Device, strconv.Itoa(a.Number), size}
+		case RaidAction:
+			args = append([]string{"expect_raid", id}, a.Devices...)
+		case DmCryptAction:
+			args = []string{"expect_luks", id, a.Volume, a.KeyFile}
+		case VolumeGroupAction:
+			for _, device := range a.Devices {
+				onCrypt[id] = onCrypt[id] || byID[device].ActionType() == "dm_crypt"
+			}
+			if !onCrypt[id] {
+				args = append([]string{"expect_volume_group", id, a.Name}, a.Devices...)
+			}
+		case LogicalVolumeAction:
+			if !onCrypt[a.VolGroup] {
+				args = []string{"expect_logical_volume", id, byID[a.VolGroup].(VolumeGroupAction).Name, a.Name}
+			}
+		case FormatAction:
+			args = []string{"expect_filesystem", id, a.Volume, blkidType(a.FsType)}
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		for i := range args[1:] {
+			args[i+1] = shellQuote(args[i+1])
+		}
+		checks = append(checks, strings.Join(args, " "))
+	}
+	return
+}
+
+// preflightLibrary checks the layout a reinstall preserves. It follows the
+// resolver, which leaves the device node of every disk in devices, and stops
+// the install before anything is written when the disks hold something else.
+// A preserved partition that takes the rest gets the size it has on the disk.
+const preflightLibrary = `
+preflight_failed() {
+	echo "Reinstall preflight: $*" >&2
+	echo "The disks do not hold the layout this config preserves. Stopping before anything is written." >&2
+	exit 1
+}
+
+expect_ptable() {
+	local id=$1 dev=${devices[$1]} want=$2 ptable
+	ptable=$(blkid -p -s PTTYPE -o value "$dev" 2>/dev/null || true)
+	[ "$ptable" = "$want" ] || preflight_failed "disk $id ($dev) has partition table '${ptable:-none}', expected $want"
+}
+
+expect_partition() {
+	local id=$1 disk=${devices[$2]:-} number=$3 want=$4 dev size
+	if [ -z "$disk" ]; then
+		[ "$want" != rest ] || preflight_failed "partition $id takes the rest of $2, which is not active, so its size is unknown"
+		echo "Cannot check partition $id before $2 is active"
+		return
+	fi
+	if [[ $disk == *[0-9] ]]; then
+		dev=${disk}p$number
+	else
+		dev=$disk$number
+	fi
+	[ -b "$dev" ] || preflight_failed "partition $id ($dev) does not exist"
+	size=$(blockdev --getsize64 "$dev")
+	if [ "$want" = rest ]; then
+		sed -i "s|@$id@|$size|g" "$config"
+	elif [ "$size" -ne "$want" ]; then
+		preflight_failed "partition $id ($dev) is $size bytes, expected $want"
+	fi
+	echo "Partition $id is $dev"
+	devices[$id]=$dev
+}
+
+expect_raid() {
+	local id=$1 member dev uuid="" member_uuid
+	shift
+	for member in "$@"; do
+		dev=${devices[$member]:-}
+		if [ -z "$dev" ]; then
+			echo "Cannot check member $member of array $id before it is active"
+			continue
+		fi
+		member_uuid=$(mdadm --examine --export "$dev" 2>/dev/null | sed -n 's/^MD_UUID=//p')
+		[ -n "$member_uuid" ] || preflight_failed "$dev ($member) is not a member of array $id"
+		[ -z "$uuid" ] || [ "$member_uuid" = "$uuid" ] || preflight_failed "$dev ($member) belongs to another array than the other members of $id"
+		uuid=$member_uuid
+	done
+	if [ -n "$uuid" ] && [ -e "/dev/disk/by-id/md-uuid-$uuid" ]; then
+		devices[$id]=$(readlink -f "/dev/disk/by-id/md-uuid-$uuid")
+		echo "Array $id is ${devices[$id]}"
+	fi
+}
+
+expect_luks() {
+	local id=$1 dev=${devices[$2]:-} keyfile=$3
+	if [ -z "$dev" ]; then
+		echo "Cannot check LUKS volume $id before $2 is active"
+		return
+	fi
+	cryptsetup isLuks "$dev" || preflight_failed "$dev ($2) is not the LUKS volume $id"
+	if [ -n "$keyfile" ]; then
+		cryptsetup open --test-passphrase --key-file "$keyfile" "$dev" || preflight_failed "the passphrase does not open the LUKS volume $id on $dev"
+	fi
+}
+
+expect_volume_group() {
+	local id=$1 name=$2 device dev group
+	shift 2
+	for device in "$@"; do
+		dev=${devices[$device]:-}
+		if [ -z "$dev" ]; then
+			echo "Cannot check physical volume $device of $id before it is active"
+			continue
+		fi
+		group=$(pvs --noheadings -o vg_name "$dev" 2>/dev/null | xargs)
+		[ "$group" = "$name" ] || preflight_failed "$dev ($device) is not a physical volume of $name"
+	done
+}
+
+expect_logical_volume() {
+	local id=$1 group=$2 name=$3
+	lvs "$group/$name" >/dev/null 2>&1 || preflight_failed "logical volume $id ($group/$name) does not exist"
+	if [ -b "/dev/$group/$name" ]; then
+		devices[$id]=$(readlink -f "/dev/$group/$name")
+	fi
+}
+
+expect_filesystem() {
+	local id=$1 dev=${devices[$2]:-} want=$3 type
+	if [ -z "$dev" ]; then
+		echo "Cannot check file system $id before $2 is active"
+		return
+	fi
+	type=$(blkid -p -s TYPE -o value "$dev" 2>/dev/null || true)
+	[ "$type" = "$want" ] || preflight_failed "$dev ($2) holds '${type:-no file system}', expected the $want file system $id"
+}
+
+`
@@ -0,0 +1,94 @@
+package generate_cloud_config
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestPreflightChecks(t *testing.T) {
+	tests := []struct {
+		name string
+		spec StorageSpec
+		want []string
+	}{
+		{
+			name: "lvm",
+			spec: StorageSpec{Layout: LayoutLVM, Mode: ModeReinstallSafe, Disks: []DiskMatch{{Serial: "A"}}, Volumes: []StorageVolume{{Mount: "/data", Size: 200 << 30, Filesystem: "xfs"}}},
+			want: []string{
+				"expect_ptable 'disk0' 'gpt'",
+				"expect_partition 'disk0-esp' 'disk0' '1' '1073741824'",
+				"expect_partition 'disk0-boot' 'disk0' '2' '2147483648'",
+				"expect_partition 'disk0-pv' 'disk0' '3' 'rest'",
+				"expect_volume_group 'vg0' 'ubuntu-vg' 'disk0-pv'",
+				"expect_logical_volume 'lv-data' 'ubuntu-vg' 'data-lv'",
+				"expect_filesystem 'lv-data-fs' 'lv-data' 'xfs'",
+				"expect_logical_volume 'lv-root' 'ubuntu-vg' 'root-lv'",
+			},
+		},
+		{
+			// The volume group on the LUKS volume stays closed in the
+			// installer and is not checked.
+			name: "encrypted raid1-lvm",
+			spec: StorageSpec{
+				Layout: LayoutRAID1LVM, Mode: ModeReinstallSafe, Disks: []DiskMatch{{Serial: "A"}, {Serial: "B"}},
+				Encryption: &StorageEncryption{Passphrase: "secret"}, Volumes: []StorageVolume{{Mount: "/data", Size: 200 << 30}},
+			},
+			want: []string{
+				"expect_ptable 'disk0' 'gpt'",
+				"expect_partition 'disk0-esp' 'disk0' '1' '1073741824'",
+				"expect_ptable 'disk1' 'gpt'",
+				"expect_partition 'disk1-esp' 'disk1' '1' '1073741824'",
+				"expect_partition 'disk0-boot' 'disk0' '2' '2147483648'",
+				"expect_partition 'disk1-boot' 'disk1' '2' '2147483648'",
+				"expect_partition 'disk0-pv' 'disk0' '3' 'rest'",
+				"expect_partition 'disk1-pv' 'disk1' '3' 'rest'",
+				"expect_raid 'md-boot' 'disk0-boot' 'disk1-boot'",
+				"expect_raid 'md-pv' 'disk0-pv' 'disk1-pv'",
+				"expect_luks 'md-pv-crypt' 'md-pv' '/tmp/luks.key'",
+				"expect_filesystem 'lv-data-fs' 'lv-data' 'ext4'",
+			},
+		},
+		{
+			name: "fresh",
+			spec: StorageSpec{Layout: LayoutLVM, Disks: []DiskMatch{{Serial: "A"}}},
+		},
+	}
+	for _, test := range tests {
+		actions, err := test.spec.Actions()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := preflightChecks(actions); strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: got checks\n%s\nwant\n%s", test.name, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+	}
+}
+
+func TestReinstallStorage(t *testing.T) {
+	ctx := CloudConfigContext{Storage: StorageSpec{
+		Layout: LayoutLVM, Mode: ModeReinstallSafe, Disks: []DiskMatch{{Serial: "A"}},
+		Volumes: []StorageVolume{{Mount: "/data", Size: 200 << 30}},
+	}}
+	setup, err := getStorage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := decodeResolver(t, setup.EarlyCommands)
+	resolve := strings.Index(script, "resolve_disk 'disk0' '' 'serial=A'")
+	preflight := strings.Index(script, "expect_partition 'disk0-pv' 'disk0' '3' 'rest'")
+	if resolve < 0 || preflight < resolve || !strings.Contains(script, "preflight_failed() {") {
+		t.Errorf("the preflight does not follow the disk resolver:\n%s", script)
+	}
+
+	// The preflight writes the size the partition has on the disk in place
+	// of the placeholder.
+	config, err := yaml.Marshal(setup.Storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(config), "size: '@disk0-pv@'") {
+		t.Errorf("the preserved partition that takes the rest has no size placeholder:\n%s", config)
+	}
+}
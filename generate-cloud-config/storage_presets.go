@@ -0,0 +1,453 @@
+package generate_cloud_config
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Storage layout presets of the host spec.
+const (
+	// LayoutDirect puts the root and every volume on a partition of one disk.
+	LayoutDirect = "direct"
+	// LayoutLVM puts /boot on a partition and the root and every volume on
+	// logical volumes of one disk. Space the volumes leave is unallocated in
+	// the volume group.
+	LayoutLVM = "lvm"
+	// LayoutRAID1 mirrors the root and every volume across two or more disks,
+	// one RAID1 array per volume.
+	LayoutRAID1 = "raid1"
+	// LayoutRAID1LVM mirrors /boot and a physical volume across two or more
+	// disks and puts the root and every volume on logical volumes.
+	LayoutRAID1LVM = "raid1-lvm"
+	// LayoutCustom uses the curtin actions of the spec as they are.
+	LayoutCustom = "custom"
+)
+
+var storageLayouts = []string{LayoutDirect, LayoutLVM, LayoutRAID1, LayoutRAID1LVM, LayoutCustom}
+
+// Storage modes of the layout presets.
+const (
+	// ModeFresh wipes the disks and creates the layout. It is the default.
+	ModeFresh = "fresh"
+	// ModeReinstallSafe keeps the partitions, arrays and volumes of an
+	// earlier install with the same spec and the data of every volume. Only
+	// the root, /boot, the ESP and swap are formatted again. A preflight stops
+	// the install when the disks do not hold the layout.
+	ModeReinstallSafe = "reinstall-safe"
+)
+
+const (
+	defaultESPSize  StorageSize = 1 << 30
+	defaultBootSize StorageSize = 2 << 30
+	biosGrubSize    StorageSize = 1 << 20
+	volumeGroupName             = "ubuntu-vg"
+)
+
+// StorageVolume is a file system beyond the root, e.g. /var/lib/docker.
+type StorageVolume struct {
+	Mount string `yaml:"mount"`
+	// Size is a size such as 200G, or rest to take the space that is left.
+	Size StorageSize `yaml:"size"`
+	// Filesystem defaults to ext4. Swap volumes have no mount.
+	Filesystem string `yaml:"filesystem"`
+	Options    string `yaml:"options"`
+	// Name names the volume's logical volume or array. It defaults to one
+	// derived from the mount point.
+	Name string `yaml:"name"`
+}
+
+// StorageSpec is the storage section of a host spec. A layout preset and the
+// disks it is laid out on generate the curtin actions, or the custom layout
+// takes them from Config.
+type StorageSpec struct {
+	Layout string `yaml:"layout"`
+	// Mode is fresh or reinstall-safe.
+	Mode  string      `yaml:"mode"`
+	Disks []DiskMatch `yaml:"disks"`
+	// Firmware is uefi (the default) or bios.
+	Firmware string `yaml:"firmware"`
+	// RootSize is the size of the root file system. It takes the rest of the
+	// disk, or of the volume group, when empty.
+	RootSize       StorageSize     `yaml:"root-size"`
+	RootFilesystem string          `yaml:"root-filesystem"`
+	ESPSize        StorageSize     `yaml:"esp-size"`
+	BootSize       StorageSize     `yaml:"boot-size"`
+	Volumes        []StorageVolume `yaml:"volumes"`
+	// Swap sizes the swap file, 0 disables it. The installer's default is
+	// used when it is empty.
+	Swap *StorageSize `yaml:"swap"`
+	// Encryption puts the physical volume of the lvm and raid1-lvm layouts on
+	// LUKS.
+	Encryption *StorageEncryption `yaml:"encryption"`
+	Config     StorageActions     `yaml:"config"`
+}
+
+// IsZero reports whether the spec leaves storage to the disk-serial shortcut.
+func (s StorageSpec) IsZero() bool {
+	return s.Layout == "" && s.Mode == "" && len(s.Disks) == 0 && len(s.Config) == 0 && s.Encryption == nil
+}
+
+func (s StorageSpec) firmware() string {
+	if s.Firmware == "" {
+		return "uefi"
+	}
+	return s.Firmware
+}
+
+// storageSetup is the storage section of a host and what the installer needs
+// around it.
+type storageSetup struct {
+	Storage       Storage
+	EarlyCommands []string
+	LateCommands  []string
+	Packages      []string
+	Payloads      []Payload
+}
+
+// getStorage returns the storage setup of a host. Without a storage section
+// the disk serial selects the disk for subiquity's lvm layout.
+func getStorage(ctx CloudConfigContext) (setup storageSetup, err error) {
+	spec := ctx.Storage
+	if spec.IsZero() {
+		if ctx.DiskSerial == "" {
+			return setup, fmt.Errorf("a disk serial or a storage section is required")
+		}
+		setup.Storage.Layout = &StorageLayout{Name: "lvm", Match: StorageLayoutMatch{Path: placeholder("disk0")}}
+		setup.EarlyCommands = resolveDisksCommands([]diskToResolve{{ID: "disk0", Match: DiskMatch{Serial: fmt.Sprintf("*%s*", ctx.DiskSerial)}}}, nil)
+		return
+	}
+
+	actions, err := spec.Actions()
+	if err != nil {
+		return setup, fmt.Errorf("error in storage section: %w", err)
+	}
+	if setup, err = getEncryptionSetup(spec.Encryption, actions, ctx.resolveSecret); err != nil {
+		return setup, fmt.Errorf("error in storage section: %w", err)
+	}
+	if err = ValidateStorageActions(actions, spec.firmware()); err != nil {
+		return setup, fmt.Errorf("error in storage section: %w", err)
+	}
+	resolved, resolveCommands, err := resolveDiskMatches(actions)
+	if err != nil {
+		return setup, fmt.Errorf("error in storage section: %w", err)
+	}
+
+	setup.Storage.Config = resolved
+	// The preflight of the resolver opens preserved LUKS volumes with the
+	// key, so the key is written first.
+	setup.EarlyCommands = append(setup.EarlyCommands, resolveCommands...)
+	if spec.Swap != nil {
+		setup.Storage.Swap = &StorageSwap{Size: *spec.Swap}
+	}
+	return
+}
+
+// Actions returns the curtin actions of the spec's layout.
+func (s StorageSpec) Actions() (StorageActions, error) {
+	if !slices.Contains(storageLayouts, s.Layout) {
+		return nil, fmt.Errorf("unknown layout %q, expected one of %s", s.Layout, strings.Join(storageLayouts, ", "))
+	}
+	if s.Firmware != "" && s.Firmware != "uefi" && s.Firmware != "bios" {
+		return nil, fmt.Errorf("unknown firmware %q, expected uefi or bios", s.Firmware)
+	}
+	if s.Mode != "" && s.Mode != ModeFresh && s.Mode != ModeReinstallSafe {
+		return nil, fmt.Errorf("unknown mode %q, expected %s or %s", s.Mode, ModeFresh, ModeReinstallSafe)
+	}
+	if s.Layout == LayoutCustom {
+		if s.Mode != "" {
+			return nil, fmt.Errorf("the custom layout sets preserve on its actions instead of a mode")
+		}
+		if len(s.Disks) > 0 || len(s.Volumes) > 0 {
+			return nil, fmt.Errorf("the custom layout takes its disks and volumes from config")
+		}
+		if len(s.Config) == 0 {
+			return nil, fmt.Errorf("the custom layout needs a config")
+		}
+		return s.Config, nil
+	}
+	if len(s.Config) > 0 {
+		return nil, fmt.Errorf("config is only used by the custom layout")
+	}
+
+	switch s.Layout {
+	case LayoutDirect, LayoutLVM:
+		if len(s.Disks) != 1 {
+			return nil, fmt.Errorf("the %s layout needs one disk, %d are given", s.Layout, len(s.Disks))
+		}
+	case LayoutRAID1, LayoutRAID1LVM:
+		if len(s.Disks) < 2 {
+			return nil, fmt.Errorf("the %s layout needs at least two disks, %d are given", s.Layout, len(s.Disks))
+		}
+	}
+
+	if s.Encryption != nil && s.Layout != LayoutLVM && s.Layout != LayoutRAID1LVM {
+		return nil, fmt.Errorf("encryption needs the %s or %s layout", LayoutLVM, LayoutRAID1LVM)
+	}
+
+	volumes, err := s.volumes()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &storageBuilder{spec: s}
+	switch s.Layout {
+	case LayoutDirect:
+		disk := b.disk(0)
+		for _, volume := range volumes {
+			b.filesystem(volume, b.partition(disk, volume.Name, volume.Size, ""))
+		}
+	case LayoutLVM:
+		disk := b.disk(0)
+		b.filesystem(StorageVolume{Mount: "/boot", Filesystem: "ext4"}, b.partition(disk, "boot", b.bootSize(), ""))
+		group := b.volumeGroup(b.encrypt(b.partition(disk, "pv", RestSize, "")))
+		for _, volume := range volumes {
+			b.filesystem(volume, b.logicalVolume(group, volume))
+		}
+	case LayoutRAID1:
+		disks := b.disks()
+		for _, volume := range volumes {
+			var members []string
+			for _, disk := range disks {
+				members = append(members, b.partition(disk, volume.Name, volume.Size, "raid"))
+			}
+			b.filesystem(volume, b.raid(volume.Name, members))
+		}
+	case LayoutRAID1LVM:
+		disks := b.disks()
+		var bootMembers, pvMembers []string
+		for _, disk := range disks {
+			bootMembers = append(bootMembers, b.partition(disk, "boot", b.bootSize(), "raid"))
+		}
+		for _, disk := range disks {
+			pvMembers = append(pvMembers, b.partition(disk, "pv", RestSize, "raid"))
+		}
+		b.filesystem(StorageVolume{Mount: "/boot", Filesystem: "ext4"}, b.raid("boot", bootMembers))
+		group := b.volumeGroup(b.encrypt(b.raid("pv", pvMembers)))
+		for _, volume := range volumes {
+			b.filesystem(volume, b.logicalVolume(group, volume))
+		}
+	}
+
+	return b.actions, nil
+}
+
+// volumes returns the root and the extra volumes with their defaults filled
+// in. At most one of them takes the rest, and it is moved to the end so it
+// becomes the last partition.
+func (s StorageSpec) volumes() (volumes []StorageVolume, err error) {
+	root := StorageVolume{Mount: "/", Size: s.RootSize, Filesystem: s.RootFilesystem, Name: "root"}
+	all := append([]StorageVolume{root}, s.Volumes...)
+
+	var rest []StorageVolume
+	mounts := map[string]bool{}
+	for i, volume := range all {
+		if volume.Filesystem == "" {
+			volume.Filesystem = "ext4"
+		}
+		if !slices.Contains(fsTypes, volume.Filesystem) {
+			return nil, fmt.Errorf("volume %s has unsupported filesystem %q", volume.Mount, volume.Filesystem)
+		}
+		if volume.Filesystem == "swap" {
+			if volume.Mount != "" {
+				return nil, fmt.Errorf("swap volume is mounted at %s, swap volumes have no mount", volume.Mount)
+			}
+			if volume.Name == "" {
+				volume.Name = "swap"
+			}
+		} else {
+			if !path.IsAbs(volume.Mount) || path.Clean(volume.Mount) != volume.Mount {
+				return nil, fmt.Errorf("volume #%d has invalid mount %q", i, volume.Mount)
+			}
+			if i > 0 && (volume.Mount == "/" || volume.Mount == "/boot" || volume.Mount == "/boot/efi") {
+				return nil, fmt.Errorf("volume %s is created by the layout", volume.Mount)
+			}
+			if mounts[volume.Mount] {
+				return nil, fmt.Errorf("volume %s is listed more than once", volume.Mount)
+			}
+			mounts[volume.Mount] = true
+		}
+		if volume.Name == "" {
+			volume.Name = strings.ReplaceAll(strings.Trim(volume.Mount, "/"), "/", "-")
+		}
+
+		switch {
+		case volume.Size == RestSize:
+			rest = append(rest, volume)
+			continue
+		case volume.Size == 0 && i == 0:
+			// The root takes the rest unless a volume does.
+			continue
+		case volume.Size == 0:
+			return nil, fmt.Errorf("volume %s has no size", volume.Mount)
+		}
+		volumes = append(volumes, volume)
+	}
+
+	if all[0].Size == 0 {
+		if len(rest) > 0 {
+			return nil, fmt.Errorf("root-size is required when volume %s takes the rest", rest[0].Mount)
+		}
+		root.Filesystem = all[0].Filesystem
+		if root.Filesystem == "" {
+			root.Filesystem = "ext4"
+		}
+		root.Size = RestSize
+		rest = append(rest, root)
+	}
+	if len(rest) > 1 {
+		return nil, fmt.Errorf("only one volume can take the rest, %s and %s both do", rest[0].Mount, rest[1].Mount)
+	}
+
+	return append(volumes, rest...), nil
+}
+
+// storageBuilder appends the actions of a layout. Ids are derived from the
+// disk index and the volume name so the generated config is readable. In the
+// reinstall-safe mode every device is preserved, and the devices of the file
+// systems that are formatted again are wiped.
+type storageBuilder struct {
+	spec       StorageSpec
+	actions    StorageActions
+	partitions map[string]int
+	raids      int
+}
+
+func (b *storageBuilder) add(action StorageAction) string {
+	b.actions = append(b.actions, action)
+	return action.ActionID()
+}
+
+func (b *storageBuilder) reinstall() bool {
+	return b.spec.Mode == ModeReinstallSafe
+}
+
+// wipe clears the file system of a preserved device so it can be formatted
+// again.
+func (b *storageBuilder) wipe(id string) {
+	for i, action := range b.actions {
+		if action.ActionID() != id {
+			continue
+		}
+		switch a := action.(type) {
+		case PartitionAction:
+			a.Wipe = "superblock"
+			b.actions[i] = a
+		case RaidAction:
+			a.Wipe = "superblock"
+			b.actions[i] = a
+		case LogicalVolumeAction:
+			a.Wipe = "superblock"
+			b.actions[i] = a
+		}
+	}
+}
+
+func (b *storageBuilder) bootSize() StorageSize {
+	if b.spec.BootSize != 0 {
+		return b.spec.BootSize
+	}
+	return defaultBootSize
+}
+
+func (b *storageBuilder) disks() (ids []string) {
+	for i := range b.spec.Disks {
+		ids = append(ids, b.disk(i))
+	}
+	return
+}
+
+// disk adds a wiped GPT disk with its boot partitions. On uefi the first
+// disk's ESP is mounted and every disk's ESP receives the boot loader so any
+// of them can boot. A reinstall keeps the partition table.
+func (b *storageBuilder) disk(index int) string {
+	match := b.spec.Disks[index]
+	bios := b.spec.firmware() == "bios"
+	disk := DiskAction{
+		ID:         fmt.Sprintf("disk%d", index),
+		Match:      &match,
+		Ptable:     "gpt",
+		Wipe:       "superblock-recursive",
+		Preserve:   b.reinstall(),
+		GrubDevice: bios,
+	}
+	if disk.Preserve {
+		disk.Wipe = ""
+	}
+	id := b.add(disk)
+
+	if bios {
+		b.add(PartitionAction{ID: id + "-bios", Device: id, Size: biosGrubSize, Number: b.nextNumber(id), Flag: "bios_grub", Preserve: b.reinstall()})
+		return id
+	}
+
+	espSize := b.spec.ESPSize
+	if espSize == 0 {
+		espSize = defaultESPSize
+	}
+	esp := b.add(PartitionAction{ID: id + "-esp", Device: id, Size: espSize, Number: b.nextNumber(id), Flag: "boot", Preserve: b.reinstall(), GrubDevice: true})
+	if b.reinstall() {
+		b.wipe(esp)
+	}
+	format := b.add(FormatAction{ID: esp + "-fs", Volume: esp, FsType: "vfat"})
+	if index == 0 {
+		b.add(MountAction{ID: esp + "-mount", Device: format, Path: "/boot/efi"})
+	}
+	return id
+}
+
+func (b *storageBuilder) nextNumber(disk string) int {
+	if b.partitions == nil {
+		b.partitions = map[string]int{}
+	}
+	b.partitions[disk]++
+	return b.partitions[disk]
+}
+
+func (b *storageBuilder) partition(disk, name string, size StorageSize, flag string) string {
+	return b.add(PartitionAction{ID: disk + "-" + name, Device: disk, Size: size, Number: b.nextNumber(disk), Flag: flag, Preserve: b.reinstall()})
+}
+
+func (b *storageBuilder) raid(name string, members []string) string {
+	id := b.add(RaidAction{ID: "md-" + name, Name: fmt.Sprintf("md%d", b.raids), RaidLevel: 1, Devices: members, Preserve: b.reinstall()})
+	b.raids++
+	return id
+}
+
+// encrypt puts a LUKS volume on device when the spec asks for encryption.
+func (b *storageBuilder) encrypt(device string) string {
+	if b.spec.Encryption == nil {
+		return device
+	}
+	return b.add(DmCryptAction{ID: device + "-crypt", Volume: device, DmName: dmName(0), KeyFile: luksKeyFile, Preserve: b.reinstall()})
+}
+
+func (b *storageBuilder) volumeGroup(device string) string {
+	return b.add(VolumeGroupAction{ID: "vg0", Name: volumeGroupName, Devices: []string{device}, Preserve: b.reinstall()})
+}
+
+// logicalVolume adds a logical volume. A volume that takes the rest leaves
+// its size out so it takes the free space of the group.
+func (b *storageBuilder) logicalVolume(group string, volume StorageVolume) string {
+	size := volume.Size
+	if size == RestSize {
+		size = 0
+	}
+	return b.add(LogicalVolumeAction{ID: "lv-" + volume.Name, Name: volume.Name + "-lv", VolGroup: group, Size: size, Preserve: b.reinstall()})
+}
+
+// filesystem formats and mounts a volume. A reinstall keeps the file systems
+// of the extra volumes and formats the root, /boot and swap again.
+func (b *storageBuilder) filesystem(volume StorageVolume, device string) {
+	keep := b.reinstall() && volume.Mount != "/" && volume.Mount != "/boot" && volume.Filesystem != "swap"
+	if b.reinstall() && !keep {
+		b.wipe(device)
+	}
+	format := b.add(FormatAction{ID: device + "-fs", Volume: device, FsType: volume.Filesystem, Preserve: keep})
+	mountPath := volume.Mount
+	if volume.Filesystem == "swap" {
+		mountPath = "none"
+	}
+	b.add(MountAction{ID: device + "-mount", Device: format, Path: mountPath, Options: volume.Options})
+}
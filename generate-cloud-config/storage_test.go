@@ -0,0 +1,322 @@
+package generate_cloud_config
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// describeAction writes an action on one line with the fields that tell the
+// actions of a layout apart.
+func describeAction(action StorageAction) string {
+	var line string
+	switch a := action.(type) {
+	case DiskAction:
+		line = fmt.Sprintf("disk %s ptable=%s wipe=%s", a.ID, a.Ptable, a.Wipe)
+		if a.GrubDevice {
+			line += " grub"
+		}
+	case PartitionAction:
+		line = fmt.Sprintf("partition %s on %s #%d %s", a.ID, a.Device, a.Number, a.Size)
+		if a.Flag != "" {
+			line += " flag=" + a.Flag
+		}
+		if a.Wipe != "" {
+			line += " wipe=" + a.Wipe
+		}
+		if a.GrubDevice {
+			line += " grub"
+		}
+	case RaidAction:
+		line = fmt.Sprintf("raid %s %s raid%d of %s", a.ID, a.Name, a.RaidLevel, strings.Join(a.Devices, ","))
+		if a.Wipe != "" {
+			line += " wipe=" + a.Wipe
+		}
+	case VolumeGroupAction:
+		line = fmt.Sprintf("lvm_volgroup %s %s of %s", a.ID, a.Name, strings.Join(a.Devices, ","))
+	case LogicalVolumeAction:
+		line = fmt.Sprintf("lvm_partition %s %s in %s %s", a.ID, a.Name, a.VolGroup, a.Size)
+		if a.Wipe != "" {
+			line += " wipe=" + a.Wipe
+		}
+	case DmCryptAction:
+		line = fmt.Sprintf("dm_crypt %s %s on %s keyfile=%s", a.ID, a.DmName, a.Volume, a.KeyFile)
+	case FormatAction:
+		line = fmt.Sprintf("format %s %s on %s", a.ID, a.FsType, a.Volume)
+	case MountAction:
+		line = fmt.Sprintf("mount %s %s at %s", a.ID, a.Device, a.Path)
+		if a.Options != "" {
+			line += " options=" + a.Options
+		}
+	}
+	if preserved(action) {
+		line += " preserve"
+	}
+	return line
+}
+
+// parseStorageActions reads a curtin storage config written in YAML.
+func parseStorageActions(t *testing.T, config string) StorageActions {
+	t.Helper()
+
+	var actions StorageActions
+	if err := yaml.Unmarshal([]byte(config), &actions); err != nil {
+		t.Fatal(err)
+	}
+	return actions
+}
+
+func TestStorageSpecActions(t *testing.T) {
+	diskA, diskB := DiskMatch{Serial: "A"}, DiskMatch{Serial: "B"}
+	tests := []struct {
+		name string
+		spec StorageSpec
+		want []string
+	}{
+		{
+			name: "direct with a volume taking the rest and swap",
+			spec: StorageSpec{Layout: LayoutDirect, Disks: []DiskMatch{diskA}, RootSize: 50 << 30, Volumes: []StorageVolume{
+				{Mount: "/srv", Size: RestSize, Filesystem: "xfs", Options: "noatime"},
+				{Filesystem: "swap", Size: 4 << 30},
+			}},
+			want: []string{
+				"disk disk0 ptable=gpt wipe=superblock-recursive",
+				"partition disk0-esp on disk0 #1 1G flag=boot grub",
+				"format disk0-esp-fs vfat on disk0-esp",
+				"mount disk0-esp-mount disk0-esp-fs at /boot/efi",
+				"partition disk0-root on disk0 #2 50G",
+				"format disk0-root-fs ext4 on disk0-root",
+				"mount disk0-root-mount disk0-root-fs at /",
+				"partition disk0-swap on disk0 #3 4G",
+				"format disk0-swap-fs swap on disk0-swap",
+				"mount disk0-swap-mount disk0-swap-fs at none",
+				"partition disk0-srv on disk0 #4 rest",
+				"format disk0-srv-fs xfs on disk0-srv",
+				"mount disk0-srv-mount disk0-srv-fs at /srv options=noatime",
+			},
+		},
+		{
+			name: "lvm on bios",
+			spec: StorageSpec{Layout: LayoutLVM, Firmware: "bios", Disks: []DiskMatch{diskA}, Volumes: []StorageVolume{{Mount: "/var/lib/docker", Size: 100 << 30}}},
+			want: []string{
+				"disk disk0 ptable=gpt wipe=superblock-recursive grub",
+				"partition disk0-bios on disk0 #1 1M flag=bios_grub",
+				"partition disk0-boot on disk0 #2 2G",
+				"format disk0-boot-fs ext4 on disk0-boot",
+				"mount disk0-boot-mount disk0-boot-fs at /boot",
+				"partition disk0-pv on disk0 #3 rest",
+				"lvm_volgroup vg0 ubuntu-vg of disk0-pv",
+				"lvm_partition lv-var-lib-docker var-lib-docker-lv in vg0 100G",
+				"format lv-var-lib-docker-fs ext4 on lv-var-lib-docker",
+				"mount lv-var-lib-docker-mount lv-var-lib-docker-fs at /var/lib/docker",
+				"lvm_partition lv-root root-lv in vg0 0",
+				"format lv-root-fs ext4 on lv-root",
+				"mount lv-root-mount lv-root-fs at /",
+			},
+		},
+		{
+			name: "raid1",
+			spec: StorageSpec{Layout: LayoutRAID1, Disks: []DiskMatch{diskA, diskB}, RootSize: 40 << 30, Volumes: []StorageVolume{{Mount: "/data", Size: RestSize}}},
+			want: []string{
+				"disk disk0 ptable=gpt wipe=superblock-recursive",
+				"partition disk0-esp on disk0 #1 1G flag=boot grub",
+				"format disk0-esp-fs vfat on disk0-esp",
+				"mount disk0-esp-mount disk0-esp-fs at /boot/efi",
+				"disk disk1 ptable=gpt wipe=superblock-recursive",
+				"partition disk1-esp on disk1 #1 1G flag=boot grub",
+				"format disk1-esp-fs vfat on disk1-esp",
+				"partition disk0-root on disk0 #2 40G flag=raid",
+				"partition disk1-root on disk1 #2 40G flag=raid",
+				"raid md-root md0 raid1 of disk0-root,disk1-root",
+				"format md-root-fs ext4 on md-root",
+				"mount md-root-mount md-root-fs at /",
+				"partition disk0-data on disk0 #3 rest flag=raid",
+				"partition disk1-data on disk1 #3 rest flag=raid",
+				"raid md-data md1 raid1 of disk0-data,disk1-data",
+				"format md-data-fs ext4 on md-data",
+				"mount md-data-mount md-data-fs at /data",
+			},
+		},
+		{
+			name: "encrypted raid1-lvm reinstalled",
+			spec: StorageSpec{
+				Layout: LayoutRAID1LVM, Mode: ModeReinstallSafe, Disks: []DiskMatch{diskA, diskB},
+				Encryption: &StorageEncryption{Passphrase: "secret"}, Volumes: []StorageVolume{{Mount: "/data", Size: 200 << 30}},
+			},
+			want: []string{
+				"disk disk0 ptable=gpt wipe= preserve",
+				"partition disk0-esp on disk0 #1 1G flag=boot wipe=superblock grub preserve",
+				"format disk0-esp-fs vfat on disk0-esp",
+				"mount disk0-esp-mount disk0-esp-fs at /boot/efi",
+				"disk disk1 ptable=gpt wipe= preserve",
+				"partition disk1-esp on disk1 #1 1G flag=boot wipe=superblock grub preserve",
+				"format disk1-esp-fs vfat on disk1-esp",
+				"partition disk0-boot on disk0 #2 2G flag=raid preserve",
+				"partition disk1-boot on disk1 #2 2G flag=raid preserve",
+				"partition disk0-pv on disk0 #3 rest flag=raid preserve",
+				"partition disk1-pv on disk1 #3 rest flag=raid preserve",
+				"raid md-boot md0 raid1 of disk0-boot,disk1-boot wipe=superblock preserve",
+				"format md-boot-fs ext4 on md-boot",
+				"mount md-boot-mount md-boot-fs at /boot",
+				"raid md-pv md1 raid1 of disk0-pv,disk1-pv preserve",
+				"dm_crypt md-pv-crypt dm_crypt-0 on md-pv keyfile=/tmp/luks.key preserve",
+				"lvm_volgroup vg0 ubuntu-vg of md-pv-crypt preserve",
+				"lvm_partition lv-data data-lv in vg0 200G preserve",
+				"format lv-data-fs ext4 on lv-data preserve",
+				"mount lv-data-mount lv-data-fs at /data",
+				"lvm_partition lv-root root-lv in vg0 0 wipe=superblock preserve",
+				"format lv-root-fs ext4 on lv-root",
+				"mount lv-root-mount lv-root-fs at /",
+			},
+		},
+		{
+			name: "custom",
+			spec: StorageSpec{Layout: LayoutCustom, Config: parseStorageActions(t, validStorageConfig)},
+			want: []string{
+				"disk d0 ptable=gpt wipe=superblock-recursive",
+				"partition esp on d0 #1 1G flag=boot grub",
+				"format esp-fs vfat on esp",
+				"mount esp-mount esp-fs at /boot/efi",
+				"partition root on d0 #2 20G",
+				"format root-fs ext4 on root",
+				"mount root-mount root-fs at /",
+			},
+		},
+	}
+	for _, test := range tests {
+		actions, err := test.spec.Actions()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		var got []string
+		for _, action := range actions {
+			got = append(got, describeAction(action))
+		}
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: got actions\n%s\nwant\n%s", test.name, strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+		}
+		if err = ValidateStorageActions(actions, test.spec.firmware()); err != nil {
+			t.Errorf("%s: the layout does not validate: %v", test.name, err)
+		}
+	}
+}
+
+func TestStorageSpecActionsErrors(t *testing.T) {
+	disk := DiskMatch{Serial: "A"}
+	tests := []struct {
+		spec StorageSpec
+		err  string
+	}{
+		{StorageSpec{Layout: "zfs"}, `unknown layout "zfs"`},
+		{StorageSpec{Layout: LayoutDirect, Firmware: "efi", Disks: []DiskMatch{disk}}, `unknown firmware "efi"`},
+		{StorageSpec{Layout: LayoutDirect, Mode: "keep", Disks: []DiskMatch{disk}}, `unknown mode "keep"`},
+		{StorageSpec{Layout: LayoutCustom, Mode: ModeReinstallSafe}, "sets preserve on its actions"},
+		{StorageSpec{Layout: LayoutCustom, Disks: []DiskMatch{disk}}, "takes its disks and volumes from config"},
+		{StorageSpec{Layout: LayoutCustom}, "needs a config"},
+		{StorageSpec{Layout: LayoutDirect, Disks: []DiskMatch{disk}, Config: StorageActions{DiskAction{ID: "d0"}}}, "only used by the custom layout"},
+		{StorageSpec{Layout: LayoutLVM, Disks: []DiskMatch{disk, disk}}, "the lvm layout needs one disk, 2 are given"},
+		{StorageSpec{Layout: LayoutRAID1, Disks: []DiskMatch{disk}}, "the raid1 layout needs at least two disks, 1 are given"},
+		{StorageSpec{Layout: LayoutDirect, Disks: []DiskMatch{disk}, Encryption: &StorageEncryption{}}, "encryption needs the lvm or raid1-lvm layout"},
+		{StorageSpec{Layout: LayoutDirect, Disks: []DiskMatch{disk}, RootFilesystem: "zfs"}, `volume / has unsupported filesystem "zfs"`},
+		{StorageSpec{Layout: LayoutDirect, Disks: []DiskMatch{disk}, Volumes: []StorageVolume{{Mount: "/swap", Filesystem: "swap", Size: 1 << 30}}}, "swap volume is mounted at /swap"},
+		{StorageSpec{Layout: LayoutDirect, Disks: []DiskMatch{disk}, Volumes: []StorageVolume{{Mount: "srv", Size: 1 << 30}}}, `volume #1 has invalid mount "srv"`},
+		{StorageSpec{Layout: LayoutDirect, Disks: []DiskMatch{disk}, Volumes: []StorageVolume{{Mount: "/boot", Size: 1 << 30}}}, "volume /boot is created by the layout"},
+		{StorageSpec{Layout: LayoutDirect, Disks: []DiskMatch{disk}, Volumes: []StorageVolume{{Mount: "/srv", Size: 1 << 30}, {Mount: "/srv", Size: 1 << 30}}}, "volume /srv is listed more than once"},
+		{StorageSpec{Layout: LayoutDirect, Disks: []DiskMatch{disk}, Volumes: []StorageVolume{{Mount: "/srv"}}}, "volume /srv has no size"},
+		{StorageSpec{Layout: LayoutDirect, Disks: []DiskMatch{disk}, Volumes: []StorageVolume{{Mount: "/srv", Size: RestSize}}}, "root-size is required when volume /srv takes the rest"},
+		{StorageSpec{Layout: LayoutDirect, Disks: []DiskMatch{disk}, RootSize: 1 << 30, Volumes: []StorageVolume{{Mount: "/srv", Size: RestSize}, {Mount: "/data", Size: RestSize}}}, "only one volume can take the rest, /srv and /data both do"},
+	}
+	for _, test := range tests {
+		if _, err := test.spec.Actions(); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%+v: got error %v, want one containing %q", test.spec, err, test.err)
+		}
+	}
+}
+
+// validStorageConfig is a uefi layout on one disk that the storage errors
+// below add to.
+const validStorageConfig = `
+- {type: disk, id: d0, serial: S1, ptable: gpt, wipe: superblock-recursive}
+- {type: partition, id: esp, device: d0, size: 1G, number: 1, flag: boot, grub_device: true}
+- {type: format, id: esp-fs, volume: esp, fstype: vfat}
+- {type: mount, id: esp-mount, device: esp-fs, path: /boot/efi}
+- {type: partition, id: root, device: d0, size: 20G, number: 2}
+- {type: format, id: root-fs, volume: root, fstype: ext4}
+- {type: mount, id: root-mount, device: root-fs, path: /}
+`
+
+func TestValidateStorageActions(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		firmware string
+		err      string
+	}{
+		{name: "valid", config: validStorageConfig},
+		{name: "no id", config: validStorageConfig + "- {type: disk, serial: S2}\n", err: "storage action #8 (disk) has no id"},
+		{name: "duplicate id", config: validStorageConfig + "- {type: disk, id: d0, serial: S2}\n", err: "storage action id d0 is used more than once"},
+		{name: "forward reference", config: "- {type: format, id: f, volume: p, fstype: ext4}\n" + validStorageConfig, err: `storage action f references "p", which is not defined before it`},
+		{name: "wrong reference type", config: validStorageConfig + "- {type: partition, id: p, device: root-fs, size: 1G}\n", err: "storage action p (partition) cannot use root-fs (format)"},
+		{name: "preserved on new", config: validStorageConfig + "- {type: partition, id: p, device: d0, size: 1G, number: 3, preserve: true}\n", err: "storage action p is preserved but d0, which it is on, is not"},
+		{name: "volume used twice", config: validStorageConfig + "- {type: format, id: f, volume: root, fstype: ext4}\n", err: "storage actions root-fs and f both use root"},
+		{name: "partitioned volume used", config: validStorageConfig + "- {type: format, id: f, volume: d0, fstype: ext4}\n", err: "storage action f uses d0, which is partitioned"},
+		{name: "disk without selector", config: validStorageConfig + "- {type: disk, id: d1}\n", err: "disk d1 needs a serial, path, wwn or match"},
+		{name: "preserved disk wiped", config: validStorageConfig + "- {type: disk, id: d1, serial: S2, preserve: true, wipe: superblock}\n", err: "disk d1 is preserved and wiped"},
+		{name: "partition on used disk", config: validStorageConfig + "- {type: disk, id: d1, serial: S2}\n- {type: format, id: f, volume: d1, fstype: ext4}\n- {type: partition, id: p, device: d1, size: 1G}\n", err: "partition p is on d1, which is used by f"},
+		{name: "partition after rest", config: validStorageConfig + "- {type: partition, id: p, device: d0, size: rest}\n- {type: partition, id: q, device: d0, size: 1G}\n", err: "partition q follows p, which takes the rest of d0"},
+		{name: "partition without size", config: validStorageConfig + "- {type: partition, id: p, device: d0}\n", err: "partition p has no size"},
+		{name: "preserved partition without number", config: "- {type: disk, id: d1, serial: S2, preserve: true}\n- {type: partition, id: p, device: d1, size: 1G, preserve: true}\n" + validStorageConfig, err: "partition p is preserved, it needs its number on the disk"},
+		{name: "bios_grub on uefi", config: validStorageConfig + "- {type: partition, id: p, device: d0, size: 1M, flag: bios_grub}\n", err: "partition p is a bios_grub partition"},
+		{name: "raid level", config: validStorageConfig + "- {type: disk, id: d1, serial: S2}\n- {type: raid, id: md, raidlevel: 3, devices: [d1]}\n", err: "raid md has unsupported level 3"},
+		{name: "raid devices", config: validStorageConfig + "- {type: disk, id: d1, serial: S2}\n- {type: raid, id: md, raidlevel: 5, devices: [d1]}\n", err: "raid md (raid5) needs at least 3 devices, it has 1"},
+		{
+			name:   "raid member sizes",
+			config: validStorageConfig + "- {type: partition, id: a, device: d0, size: 10G}\n- {type: partition, id: b, device: d0, size: 20G}\n- {type: raid, id: md, raidlevel: 1, devices: [a, b]}\n",
+			err:    "raid md members differ in size (10G and 20G)",
+		},
+		{name: "volume group without devices", config: validStorageConfig + "- {type: lvm_volgroup, id: vg, name: vg}\n", err: "volume group vg has no devices"},
+		{name: "negative logical volume", config: validStorageConfig + "- {type: partition, id: pv, device: d0, size: 10G}\n- {type: lvm_volgroup, id: vg, name: vg, devices: [pv]}\n- {type: lvm_partition, id: lv, name: lv, volgroup: vg, size: rest}\n", err: "logical volume lv has a negative size"},
+		{name: "dm_crypt without key", config: validStorageConfig + "- {type: partition, id: p, device: d0, size: 10G}\n- {type: dm_crypt, id: c, volume: p, dm_name: c}\n", err: "dm_crypt c has no key"},
+		{name: "dm_crypt without name", config: validStorageConfig + "- {type: partition, id: p, device: d0, size: 10G}\n- {type: dm_crypt, id: c, volume: p, key: k}\n", err: "dm_crypt c has no dm_name"},
+		{name: "fstype", config: validStorageConfig + "- {type: partition, id: p, device: d0, size: 10G}\n- {type: format, id: f, volume: p, fstype: zfs}\n", err: `format f has unsupported fstype "zfs"`},
+		{name: "swap mount", config: validStorageConfig + "- {type: partition, id: p, device: d0, size: 1G}\n- {type: format, id: f, volume: p, fstype: swap}\n- {type: mount, id: m, device: f, path: /swap}\n", err: "mount m mounts swap at /swap"},
+		{name: "relative mount", config: validStorageConfig + "- {type: partition, id: p, device: d0, size: 1G}\n- {type: format, id: f, volume: p, fstype: ext4}\n- {type: mount, id: m, device: f, path: srv}\n", err: `mount m has invalid path "srv"`},
+		{name: "mount twice", config: validStorageConfig + "- {type: partition, id: p, device: d0, size: 1G}\n- {type: format, id: f, volume: p, fstype: ext4}\n- {type: mount, id: m, device: f, path: /}\n", err: "mounts root-mount and m both mount /"},
+		{
+			name:   "esp not vfat",
+			config: strings.Replace(validStorageConfig, "fstype: vfat", "fstype: ext4", 1),
+			err:    "mount esp-mount mounts /boot/efi, which must be vfat",
+		},
+		{
+			name:   "partitions do not fit",
+			config: strings.Replace(validStorageConfig, "serial: S1", "match: {min-size: 10G}", 1),
+			err:    "partitions of d0 need 21G, it has 10G",
+		},
+		{
+			name:   "logical volumes do not fit",
+			config: validStorageConfig + "- {type: partition, id: pv, device: d0, size: 10G}\n- {type: lvm_volgroup, id: vg, name: vg, devices: [pv]}\n- {type: lvm_partition, id: lv, name: lv, volgroup: vg, size: 20G}\n",
+			err:    "logical volumes of vg need 20G, it has 10G",
+		},
+		{name: "no root", config: strings.Replace(validStorageConfig, "path: /}", "path: /srv}", 1), err: "storage config mounts nothing at /"},
+		{name: "no esp", config: strings.Replace(validStorageConfig, "path: /boot/efi", "path: /efi", 1), err: "mounts nothing at /boot/efi"},
+		{name: "no esp on bios", config: strings.Replace(validStorageConfig, "path: /boot/efi", "path: /efi", 1), firmware: "bios"},
+		{name: "no grub device", config: strings.Replace(validStorageConfig, ", grub_device: true", "", 1), err: "storage config has no grub_device"},
+	}
+	for _, test := range tests {
+		firmware := test.firmware
+		if firmware == "" {
+			firmware = "uefi"
+		}
+		err := ValidateStorageActions(parseStorageActions(t, test.config), firmware)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want one containing %q", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package generate_cloud_config
+
+import (
+	"bytes"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/hunoz/ubuntu-iso-builder/crypt"
+	"gopkg.in/yaml.v3"
+)
+
+// ValuesEnvPrefix is the prefix of environment variables exposed as .Values.
+// ISO_BUILDER_VALUE_PLEX_CLAIM becomes .Values.plex_claim.
+const ValuesEnvPrefix = "ISO_BUILDER_VALUE_"
+
+const alphaNum = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// LoadValues builds the .Values map from environment variables, values files
+// and key=value assignments, in that order of precedence from lowest to
+// highest. Dotted keys in assignments address nested maps.
+func LoadValues(environ []string, valuesFiles []string, sets []string) (values map[string]interface{}, err error) {
+	values = map[string]interface{}{}
+
+	for _, env := range environ {
+		key, value, ok := strings.Cut(env, "=")
+		if !ok || !strings.HasPrefix(key, ValuesEnvPrefix) {
+			continue
+		}
+		values[strings.ToLower(strings.TrimPrefix(key, ValuesEnvPrefix))] = value
+	}
+
+	for _, file := range valuesFiles {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading values file %s: %w", file, err)
+		}
+		var fileValues map[string]interface{}
+		if err = yaml.Unmarshal(content, &fileValues); err != nil {
+			return nil, fmt.Errorf("error parsing values file %s: %w", file, err)
+		}
+		MergeValues(values, fileValues)
+	}
+
+	for _, set := range sets {
+		key, value, ok := strings.Cut(set, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid value %q, expected key=value", set)
+		}
+		setValue(values, key, value)
+	}
+
+	return
+}
+
+// MergeValues deep-merges src into dst, src winning. Nested maps of src are
+// copied, so later merges into dst never modify src.
+func MergeValues(dst, src map[string]interface{}) {
+	for key, value := range src {
+		srcMap, srcIsMap := value.(map[string]interface{})
+		if !srcIsMap {
+			dst[key] = value
+			continue
+		}
+		dstMap, dstIsMap := dst[key].(map[string]interface{})
+		if !dstIsMap {
+			dstMap = map[string]interface{}{}
+			dst[key] = dstMap
+		}
+		MergeValues(dstMap, srcMap)
+	}
+}
+
+// templateRenderer renders the .tpl files of a merged tree. All templates are
+// parsed into one set named by their target path, so a template can include
+// another file or a block defined elsewhere. Random values are drawn from a
+// generator keyed with the host spec's seed, so they are reproducible, or with
+// random bytes when there is no seed, so nobody can predict them.
+type templateRenderer struct {
+	set  *template.Template
+	ctx  RenderContext
+	rand *rand.Rand
+}
+
+func newTemplateRenderer(ctx RenderContext, files []installFile) (r *templateRenderer, err error) {
+	var key [32]byte
+	if ctx.Seed != "" {
+		key = sha256.Sum256([]byte(ctx.Seed))
+	} else if _, err = cryptorand.Read(key[:]); err != nil {
+		return nil, fmt.Errorf("error seeding templates: %w", err)
+	}
+	r = &templateRenderer{
+		ctx:  ctx,
+		rand: rand.New(rand.NewChaCha8(key)),
+	}
+
+	r.set = template.New("").Funcs(r.funcs())
+	for _, file := range files {
+		if !file.isTemplate(file.Meta) {
+			continue
+		}
+		if _, err = r.set.New(file.Path).Parse(string(file.Body)); err != nil {
+			return nil, fmt.Errorf("error parsing template %s from %s: %w", file.Source, file.Layer, err)
+		}
+	}
+
+	return
+}
+
+func (r *templateRenderer) render(file installFile) ([]byte, error) {
+	var contents bytes.Buffer
+	if err := r.set.ExecuteTemplate(&contents, file.Path, r.ctx); err != nil {
+		return nil, fmt.Errorf("error executing template %s from %s: %w", file.Source, file.Layer, err)
+	}
+	return contents.Bytes(), nil
+}
+
+func (r *templateRenderer) funcs() template.FuncMap {
+	return template.FuncMap{
+		"default":      defaultValue,
+		"required":     requiredValue,
+		"b64enc":       b64enc,
+		"toYaml":       toYaml,
+		"indent":       indent,
+		"sha512crypt":  r.sha512crypt,
+		"randAlphaNum": r.randAlphaNum,
+		"include":      r.include,
+		"fileContents": fileContents,
+		"shellQuote":   shellQuote,
+		// diskMatchFunctions are the shell functions the disk resolver
+		// matches disks with, for scripts that match the same criteria.
+		"diskMatchFunctions": func() string { return diskMatchLibrary },
+	}
+}
+
+// isEmpty reports whether value is nil or the zero value of its type, the
+// same notion of "unset" used by default and required.
+func isEmpty(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Pointer, reflect.Interface:
+		return v.IsNil()
+	default:
+		return v.IsZero()
+	}
+}
+
+func defaultValue(fallback interface{}, value ...interface{}) interface{} {
+	if len(value) == 0 || isEmpty(value[0]) {
+		return fallback
+	}
+	return value[0]
+}
+
+func requiredValue(message string, value interface{}) (interface{}, error) {
+	if isEmpty(value) {
+		return nil, errors.New(message)
+	}
+	return value, nil
+}
+
+func b64enc(value string) string {
+	return base64.StdEncoding.EncodeToString([]byte(value))
+}
+
+func toYaml(value interface{}) (string, error) {
+	out, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func indent(spaces int, value string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.ReplaceAll(value, "\n", "\n"+pad)
+}
+
+func fileContents(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+func (r *templateRenderer) randAlphaNum(length int) string {
+	out := make([]byte, length)
+	for i := range out {
+		out[i] = alphaNum[r.rand.IntN(len(alphaNum))]
+	}
+	return string(out)
+}
+
+// sha512crypt hashes password with a salt drawn from the renderer's
+// generator, so a host spec with a seed always renders the same hash.
+func (r *templateRenderer) sha512crypt(password string) string {
+	salt := make([]byte, 16)
+	for i := range salt {
+		salt[i] = byte(r.rand.UintN(256))
+	}
+	encoded, _ := crypt.NewSalt(bytes.NewReader(salt), len(salt))
+	return crypt.SHA512(password, encoded, 0)
+}
+
+func (r *templateRenderer) include(name string, data interface{}) (string, error) {
+	var out bytes.Buffer
+	if err := r.set.ExecuteTemplate(&out, name, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,141 @@
+package generate_cloud_config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// renderTestFiles renders the files of tree for ctx and returns their contents
+// by installed path.
+func renderTestFiles(ctx CloudConfigContext, tree fstest.MapFS) (map[string][]byte, error) {
+	files, err := MergeLayers([]FileLayer{{Name: "test", FS: tree}})
+	if err != nil {
+		return nil, err
+	}
+	renderCtx := RenderContext{CloudConfigContext: ctx}
+	installFiles, err := prepareFiles(renderCtx, files)
+	if err != nil {
+		return nil, err
+	}
+	delivery, err := deliverFiles(renderCtx, installFiles)
+	return delivery.Contents, err
+}
+
+func TestLoadValues(t *testing.T) {
+	valuesFile := filepath.Join(t.TempDir(), "values.yaml")
+	err := os.WriteFile(valuesFile, []byte("file: file\nboth: file\nall: file\nnested:\n  a: file\n  b: file\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	environ := []string{
+		"ISO_BUILDER_VALUE_ENV=env",
+		"ISO_BUILDER_VALUE_BOTH=env",
+		"ISO_BUILDER_VALUE_ALL=env",
+		"OTHER_VALUE=ignored",
+	}
+	values, err := LoadValues(environ, []string{valuesFile}, []string{"all=set", "nested.b=set", "new.key=set"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"env":    "env",
+		"file":   "file",
+		"both":   "file",
+		"all":    "set",
+		"nested": map[string]interface{}{"a": "file", "b": "set"},
+		"new":    map[string]interface{}{"key": "set"},
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("got values %v, want %v", values, want)
+	}
+
+	if _, err = LoadValues(nil, nil, []string{"novalue"}); err == nil || !strings.Contains(err.Error(), "expected key=value") {
+		t.Errorf("got error %v for an assignment without a value", err)
+	}
+	if _, err = LoadValues(nil, []string{filepath.Join(t.TempDir(), "missing.yaml")}, nil); err == nil {
+		t.Errorf("a missing values file is accepted")
+	}
+}
+
+func TestTemplateRequired(t *testing.T) {
+	tree := fstest.MapFS{
+		"etc/claim.tpl": {Data: []byte("# claim\n{{ required \"plex-claim is required\" .Values.claim }}\n")},
+	}
+	contents, err := renderTestFiles(CloudConfigContext{Values: map[string]interface{}{"claim": "abc"}}, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(contents["/etc/claim"]); got != "# claim\nabc\n" {
+		t.Errorf("got %q", got)
+	}
+
+	_, err = renderTestFiles(CloudConfigContext{}, tree)
+	for _, want := range []string{"etc/claim.tpl from test", ":2:", "plex-claim is required"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("got error %v, want one containing %q", err, want)
+		}
+	}
+}
+
+func TestTemplateInclude(t *testing.T) {
+	contents, err := renderTestFiles(CloudConfigContext{Hostname: "host1"}, fstest.MapFS{
+		"etc/motd.tpl":  {Data: []byte("Welcome\n{{ include \"/etc/issue\" . }}")},
+		"etc/issue.tpl": {Data: []byte("{{ .Hostname }}\n")},
+		"etc/banner.tpl": {Data: []byte(`{{ define "banner" }}== {{ . }} =={{ end }}{{ include "banner" "host1" | indent 2 }}
+`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for target, want := range map[string]string{
+		"/etc/motd":   "Welcome\nhost1\n",
+		"/etc/issue":  "host1\n",
+		"/etc/banner": "  == host1 ==\n",
+	} {
+		if got := string(contents[target]); got != want {
+			t.Errorf("%s contains %q, want %q", target, got, want)
+		}
+	}
+
+	_, err = renderTestFiles(CloudConfigContext{}, fstest.MapFS{
+		"etc/motd.tpl": {Data: []byte("{{ include \"/etc/missing\" . }}")},
+	})
+	if err == nil || !strings.Contains(err.Error(), "/etc/missing") {
+		t.Errorf("got error %v for a missing include", err)
+	}
+}
+
+// TestTemplateRandomness checks that random values are reproducible with a
+// seed and differ between generations without one.
+func TestTemplateRandomness(t *testing.T) {
+	tree := fstest.MapFS{
+		"etc/random.tpl": {Data: []byte("{{ randAlphaNum 32 }} {{ sha512crypt \"secret\" }}\n")},
+	}
+	render := func(seed string) string {
+		contents, err := renderTestFiles(CloudConfigContext{Hostname: "host1", Seed: seed}, tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(contents["/etc/random"])
+	}
+
+	if first, second := render("s3cret"), render("s3cret"); first != second {
+		t.Errorf("renders with the same seed differ: %q and %q", first, second)
+	}
+	if seeded, other := render("s3cret"), render("other"); seeded == other {
+		t.Errorf("renders with different seeds are equal: %q", seeded)
+	}
+	first, second := render(""), render("")
+	for i, a := range strings.Fields(first) {
+		if b := strings.Fields(second)[i]; a == b {
+			t.Errorf("renders without a seed share %q", a)
+		}
+	}
+	if !strings.HasPrefix(strings.Fields(first)[1], "$6$") {
+		t.Errorf("sha512crypt rendered %q", first)
+	}
+}
@@ -0,0 +1,227 @@
+package generate_cloud_config
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// defaultAdminSudo is the sudo rule of the admin user unless the users
+// section replaces it.
+const defaultAdminSudo = "ALL=(ALL) NOPASSWD:ALL"
+
+// UserSpec is an account of the users section. An entry named root or like
+// the admin user replaces that account instead of adding one.
+type UserSpec struct {
+	Name  string `yaml:"name"`
+	Gecos string `yaml:"gecos"`
+	// Password is a crypt hash, or plaintext that is hashed with the host
+	// spec's password-hash.
+	Password string `yaml:"password"`
+	// LockPassword disables password logins. It defaults to true when there is
+	// no password.
+	LockPassword *bool    `yaml:"lock-password"`
+	SSHKeys      []string `yaml:"ssh-keys"`
+	// PrimaryGroup defaults to a group named like the user.
+	PrimaryGroup string   `yaml:"primary-group"`
+	Groups       []string `yaml:"groups"`
+	Shell        string   `yaml:"shell"`
+	// Sudo are sudoers rules, e.g. "ALL=(ALL) ALL".
+	Sudo []string `yaml:"sudo"`
+	UID  int      `yaml:"uid"`
+	// System creates a system account, which has no home unless Home is set.
+	System bool   `yaml:"system"`
+	Home   string `yaml:"home"`
+}
+
+// GroupSpec is a group of the groups section. A fixed GID keeps file
+// ownership on shared storage consistent across hosts.
+type GroupSpec struct {
+	Name   string `yaml:"name"`
+	GID    int    `yaml:"gid"`
+	System bool   `yaml:"system"`
+}
+
+var accountName = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// baseGroups are the groups base-passwd creates with a fixed gid on every
+// Ubuntu install.
+var baseGroups = map[string]int{
+	"root": 0, "daemon": 1, "bin": 2, "sys": 3, "adm": 4, "tty": 5, "disk": 6, "lp": 7,
+	"mail": 8, "news": 9, "uucp": 10, "man": 12, "proxy": 13, "kmem": 15, "dialout": 20,
+	"fax": 21, "voice": 22, "cdrom": 24, "floppy": 25, "tape": 26, "sudo": 27, "audio": 29,
+	"dip": 30, "www-data": 33, "backup": 34, "operator": 37, "list": 38, "irc": 39, "src": 40,
+	"shadow": 42, "utmp": 43, "video": 44, "sasl": 45, "plugdev": 46, "staff": 50,
+	"games": 60, "users": 100, "nogroup": 65534,
+}
+
+// script returns the shell commands that create the group in the target. The
+// group may already exist, from the base system or from the postinst of a
+// package like docker, in which case a fixed gid is applied to it instead.
+func (g GroupSpec) script() string {
+	args := []string{"groupadd"}
+	if g.System {
+		args = append(args, "--system")
+	}
+	if g.GID == 0 {
+		return fmt.Sprintf("getent group %s > /dev/null || %s %s", g.Name, strings.Join(args, " "), g.Name)
+	}
+	args = append(args, "--gid", fmt.Sprint(g.GID), g.Name)
+	return fmt.Sprintf(`gid=$(getent group %[1]s | cut -d: -f3); if [ -z "$gid" ]; then %[2]s; elif [ "$gid" != %[3]d ]; then groupmod --gid %[3]d %[1]s; fi`,
+		g.Name, strings.Join(args, " "), g.GID)
+}
+
+// getUsers returns the accounts cloud-init creates and the late commands that
+// create the groups section before it does.
+func getUsers(ctx CloudConfigContext) (users []User, commands []string, err error) {
+	if scheme := ctx.PasswordHash; scheme != "" && scheme != PasswordHashYescrypt && scheme != PasswordHashSHA512 {
+		return nil, nil, fmt.Errorf("unsupported password-hash %q, expected %s or %s", scheme, PasswordHashYescrypt, PasswordHashSHA512)
+	}
+	groups := map[string]bool{}
+	gids := map[int]string{}
+	for _, group := range ctx.Groups {
+		if !accountName.MatchString(group.Name) {
+			return nil, nil, fmt.Errorf("invalid group name %q", group.Name)
+		}
+		if groups[group.Name] {
+			return nil, nil, fmt.Errorf("group %s is defined twice", group.Name)
+		}
+		groups[group.Name] = true
+		if group.GID != 0 {
+			if group.GID < 0 {
+				return nil, nil, fmt.Errorf("group %s: gid cannot be negative", group.Name)
+			}
+			if other, ok := gids[group.GID]; ok {
+				return nil, nil, fmt.Errorf("groups %s and %s have the same gid %d", other, group.Name, group.GID)
+			}
+			gids[group.GID] = group.Name
+			if gid, ok := baseGroups[group.Name]; ok && gid != group.GID {
+				return nil, nil, fmt.Errorf("group %s has gid %d on Ubuntu, it cannot be changed to %d", group.Name, gid, group.GID)
+			}
+		}
+		commands = append(commands, "curtin in-target -- sh -c '"+group.script()+"'")
+	}
+
+	root := User{
+		Name:              "root",
+		Passwd:            ctx.RootPassword,
+		LockPasswd:        ctx.RootPassword == "",
+		SshAuthorizedKeys: ctx.SSHKeys,
+	}
+	if ctx.LockRoot {
+		root = User{Name: "root", LockPasswd: true}
+	}
+	admin := User{
+		Name:              ctx.AdminUsername,
+		Passwd:            ctx.AdminPassword,
+		LockPasswd:        ctx.AdminPassword == "",
+		PrimaryGroup:      ctx.AdminUsername,
+		Groups:            []string{"sudo"},
+		SshAuthorizedKeys: ctx.SSHKeys,
+		Sudo:              []string{defaultAdminSudo},
+		Shell:             "/bin/bash",
+	}
+	users = []User{root, admin}
+
+	names := map[string]bool{}
+	uids := map[int]string{}
+	for _, spec := range ctx.Users {
+		if names[spec.Name] {
+			return nil, nil, fmt.Errorf("user %s is defined twice", spec.Name)
+		}
+		names[spec.Name] = true
+		var user User
+		if user, err = spec.user(groups); err != nil {
+			return nil, nil, fmt.Errorf("user %s: %w", spec.Name, err)
+		}
+		if spec.UID != 0 {
+			if other, ok := uids[spec.UID]; ok {
+				return nil, nil, fmt.Errorf("users %s and %s have the same uid %d", other, spec.Name, spec.UID)
+			}
+			uids[spec.UID] = spec.Name
+		}
+
+		switch spec.Name {
+		case "root":
+			if ctx.LockRoot {
+				return nil, nil, fmt.Errorf("lock-root is set and the users section configures root")
+			}
+			if spec.UID != 0 || spec.System || spec.Home != "" || spec.PrimaryGroup != "" {
+				return nil, nil, fmt.Errorf("user root only takes a password, ssh keys, groups, a shell and sudo rules")
+			}
+			users[0] = user
+		case ctx.AdminUsername:
+			if spec.System || (spec.Home != "" && spec.Home != "/home/"+spec.Name) {
+				return nil, nil, fmt.Errorf("the admin user %s must be a regular account with its home in /home", spec.Name)
+			}
+			users[1] = user
+		default:
+			users = append(users, user)
+		}
+	}
+
+	if admin := users[1]; admin.LockPasswd && len(admin.SshAuthorizedKeys) == 0 {
+		return nil, nil, fmt.Errorf("the admin user %s has neither a password nor ssh keys, nobody could log in", admin.Name)
+	}
+	for i := range users {
+		if users[i].Passwd, err = hashPassword(ctx, users[i].Name, users[i].Passwd); err != nil {
+			return nil, nil, err
+		}
+	}
+	return
+}
+
+// user checks the spec and returns it as cloud-init takes it. groups are the
+// groups of the groups section.
+func (s UserSpec) user(groups map[string]bool) (user User, err error) {
+	if !accountName.MatchString(s.Name) {
+		return user, fmt.Errorf("invalid user name")
+	}
+	lock := s.Password == ""
+	if s.LockPassword != nil {
+		lock = *s.LockPassword
+	}
+	if s.UID < 0 {
+		return user, fmt.Errorf("uid cannot be negative")
+	}
+	primaryGroup := s.PrimaryGroup
+	if primaryGroup == "" && groups[s.Name] {
+		// useradd refuses to create a user group that already exists.
+		primaryGroup = s.Name
+	}
+	if primaryGroup != "" && primaryGroup != s.Name && primaryGroup != "users" && !groups[primaryGroup] {
+		return user, fmt.Errorf("primary group %s must be the user's own group, users or a group of the groups section", primaryGroup)
+	}
+	for _, group := range s.Groups {
+		if !accountName.MatchString(group) {
+			return user, fmt.Errorf("invalid group name %q", group)
+		}
+	}
+	if s.Shell != "" && !path.IsAbs(s.Shell) {
+		return user, fmt.Errorf("shell %q is not an absolute path", s.Shell)
+	}
+	if s.Home != "" && (!path.IsAbs(s.Home) || path.Clean(s.Home) != s.Home) {
+		return user, fmt.Errorf("invalid home %q", s.Home)
+	}
+	for _, rule := range s.Sudo {
+		if strings.TrimSpace(rule) == "" || strings.ContainsAny(rule, "\n\r") {
+			return user, fmt.Errorf("invalid sudo rule %q", rule)
+		}
+	}
+
+	return User{
+		Name:              s.Name,
+		Gecos:             s.Gecos,
+		Passwd:            s.Password,
+		PrimaryGroup:      primaryGroup,
+		Groups:            s.Groups,
+		LockPasswd:        lock,
+		SshAuthorizedKeys: s.SSHKeys,
+		Sudo:              s.Sudo,
+		Shell:             s.Shell,
+		UID:               s.UID,
+		System:            s.System,
+		Homedir:           s.Home,
+	}, nil
+}
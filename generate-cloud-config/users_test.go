@@ -0,0 +1,155 @@
+package generate_cloud_config
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGetUsers(t *testing.T) {
+	ctx := CloudConfigContext{
+		AdminUsername: "admin",
+		AdminPassword: "secret",
+		Groups:        []GroupSpec{{Name: "media", GID: 2000}, {Name: "backup-agent", System: true}},
+		Users: []UserSpec{
+			{Name: "root", Shell: "/bin/zsh"},
+			{Name: "media", UID: 2000, Groups: []string{"docker"}},
+			{Name: "jane", PrimaryGroup: "users"},
+		},
+	}
+	users, commands, err := getUsers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, user := range users {
+		names = append(names, user.Name)
+	}
+	if want := []string{"root", "admin", "media", "jane"}; !slices.Equal(names, want) {
+		t.Fatalf("users are %q, want %q", names, want)
+	}
+	if users[0].Shell != "/bin/zsh" || !users[0].LockPasswd {
+		t.Errorf("root is %+v, want the users section's locked root with zsh", users[0])
+	}
+	if users[2].PrimaryGroup != "media" || users[3].PrimaryGroup != "users" {
+		t.Errorf("primary groups are %q and %q, want media and users", users[2].PrimaryGroup, users[3].PrimaryGroup)
+	}
+	if len(commands) != 2 || !strings.HasPrefix(commands[0], "curtin in-target -- sh -c '") {
+		t.Errorf("unexpected group commands %q", commands)
+	}
+}
+
+func TestGetUsersErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		groups []GroupSpec
+		users  []UserSpec
+		lock   bool
+		err    string
+	}{
+		{name: "invalid group name", groups: []GroupSpec{{Name: "Media"}}, err: `invalid group name "Media"`},
+		{name: "duplicate group", groups: []GroupSpec{{Name: "media"}, {Name: "media"}}, err: "group media is defined twice"},
+		{name: "duplicate gid", groups: []GroupSpec{{Name: "media", GID: 2000}, {Name: "video-edit", GID: 2000}}, err: "groups media and video-edit have the same gid 2000"},
+		{name: "negative gid", groups: []GroupSpec{{Name: "media", GID: -1}}, err: "group media: gid cannot be negative"},
+		{name: "gid of a base group", groups: []GroupSpec{{Name: "sudo", GID: 2000}}, err: "group sudo has gid 27 on Ubuntu, it cannot be changed to 2000"},
+		{name: "duplicate user", users: []UserSpec{{Name: "jane"}, {Name: "jane"}}, err: "user jane is defined twice"},
+		{name: "duplicate uid", users: []UserSpec{{Name: "jane", UID: 2000}, {Name: "john", UID: 2000}}, err: "users jane and john have the same uid 2000"},
+		{name: "root with lock-root", users: []UserSpec{{Name: "root", SSHKeys: []string{"ssh-ed25519 AAAA"}}}, lock: true, err: "lock-root is set and the users section configures root"},
+		{name: "root with a home", users: []UserSpec{{Name: "root", Home: "/srv/root"}}, err: "user root only takes a password, ssh keys, groups, a shell and sudo rules"},
+		{name: "admin as a system account", users: []UserSpec{{Name: "admin", System: true}}, err: "the admin user admin must be a regular account with its home in /home"},
+		{name: "admin home outside /home", users: []UserSpec{{Name: "admin", Home: "/srv/admin"}}, err: "the admin user admin must be a regular account"},
+		{name: "invalid primary group", users: []UserSpec{{Name: "jane", PrimaryGroup: "staff"}}, err: "user jane: primary group staff must be the user's own group, users or a group of the groups section"},
+		{name: "invalid user name", users: []UserSpec{{Name: "Jane"}}, err: "user Jane: invalid user name"},
+		{name: "negative uid", users: []UserSpec{{Name: "jane", UID: -1}}, err: "user jane: uid cannot be negative"},
+		{name: "relative shell", users: []UserSpec{{Name: "jane", Shell: "bash"}}, err: `shell "bash" is not an absolute path`},
+		{name: "multi-line sudo rule", users: []UserSpec{{Name: "jane", Sudo: []string{"ALL=(ALL) ALL\njane ALL=(ALL) NOPASSWD:ALL"}}}, err: "invalid sudo rule"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := CloudConfigContext{AdminUsername: "admin", AdminPassword: "secret", LockRoot: test.lock, Groups: test.groups, Users: test.users}
+			if _, _, err := getUsers(ctx); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+// runGroupCommand runs a group command of getUsers in a target whose group
+// database holds existing, with stubbed getent, groupadd and groupmod, and
+// returns the groupadd and groupmod calls.
+func runGroupCommand(t *testing.T, command, existing string) []string {
+	t.Helper()
+
+	script, ok := strings.CutPrefix(command, "curtin in-target -- sh -c '")
+	if !ok || !strings.HasSuffix(script, "'") {
+		t.Fatalf("%q does not run a script in the target", command)
+	}
+	script = strings.TrimSuffix(script, "'")
+
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "bin")
+	if err := os.Mkdir(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	stubs := map[string]string{
+		"getent":   `grep "^$2:" "$GROUP_FILE"`,
+		"groupadd": `echo "groupadd $*" >> "$CALLS"`,
+		"groupmod": `echo "groupmod $*" >> "$CALLS"`,
+	}
+	for name, body := range stubs {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	groupFile, calls := filepath.Join(dir, "group"), filepath.Join(dir, "calls")
+	if err := os.WriteFile(groupFile, []byte(existing), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Env = append(os.Environ(), "PATH="+bin+":"+os.Getenv("PATH"), "GROUP_FILE="+groupFile, "CALLS="+calls)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%s: %v\n%s", script, err, output)
+	}
+	logged, err := os.ReadFile(calls)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(logged)), "\n")
+}
+
+func TestGroupCommands(t *testing.T) {
+	const existing = "sudo:x:27:\nusers:x:100:\ndocker:x:999:\n"
+	tests := []struct {
+		name  string
+		group GroupSpec
+		calls []string
+	}{
+		{name: "new group", group: GroupSpec{Name: "media"}, calls: []string{"groupadd media"}},
+		{name: "new system group with a gid", group: GroupSpec{Name: "media", GID: 2000, System: true}, calls: []string{"groupadd --system --gid 2000 media"}},
+		{name: "existing group", group: GroupSpec{Name: "users"}},
+		{name: "base group with its gid", group: GroupSpec{Name: "sudo", GID: 27}},
+		{name: "group of a package postinst", group: GroupSpec{Name: "docker", System: true}},
+		{name: "group of a package postinst with another gid", group: GroupSpec{Name: "docker", GID: 2001}, calls: []string{"groupmod --gid 2001 docker"}},
+		{name: "group of a package postinst with its gid", group: GroupSpec{Name: "docker", GID: 999}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, commands, err := getUsers(CloudConfigContext{AdminUsername: "admin", AdminPassword: "secret", Groups: []GroupSpec{test.group}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if calls := runGroupCommand(t, commands[0], existing); !slices.Equal(calls, test.calls) {
+				t.Errorf("calls are %q, want %q", calls, test.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package images
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Dir is the directory at the root of the ISO that holds image archives.
+const Dir = "images"
+
+// maxMetadataSize bounds the archive members read into memory while looking
+// for manifests and image configs. Layers are streamed past.
+const maxMetadataSize = 4 * 1024 * 1024
+
+// Archive is an image tarball in docker-archive or OCI layout format, as
+// written by docker save or skopeo.
+type Archive struct {
+	Path   string
+	SHA256 string
+	Images []Image
+}
+
+// Name is the file name of the archive on the ISO. It starts with the
+// archive's sum so archives from different directories never collide.
+func (a Archive) Name() string {
+	return a.SHA256[:12] + "-" + path.Base(a.Path)
+}
+
+// Image is one image of an archive.
+type Image struct {
+	// ID is the digest of the image config, which docker reports as the
+	// image ID after loading it.
+	ID string
+	// Refs are the normalized references the image is tagged with.
+	Refs []string
+	// Digests are the manifest digests of an OCI archive, the digests a
+	// reference pinned with @sha256: names.
+	Digests []string
+}
+
+type dockerManifest struct {
+	Config   string
+	RepoTags []string
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+	Config      *ociDescriptor    `json:"config"`
+	Manifests   []ociDescriptor   `json:"manifests"`
+}
+
+// Inspect reads the images of an archive, optionally gzip-compressed.
+func Inspect(archivePath string) (archive Archive, err error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return archive, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	hash := sha256.New()
+	buffered := bufio.NewReader(io.TeeReader(f, hash))
+	var r io.Reader = buffered
+	if magic, _ := buffered.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		if r, err = gzip.NewReader(buffered); err != nil {
+			return archive, fmt.Errorf("error reading %s: %w", archivePath, err)
+		}
+	}
+
+	members := map[string][]byte{}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return archive, fmt.Errorf("error reading %s: %w", archivePath, err)
+		}
+		if header.Typeflag != tar.TypeReg || header.Size > maxMetadataSize {
+			continue
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return archive, fmt.Errorf("error reading %s: %w", archivePath, err)
+		}
+		members[path.Clean(header.Name)] = content
+	}
+	// Hash whatever follows the tar end marker too, so the sum covers the file.
+	if _, err = io.Copy(io.Discard, buffered); err != nil {
+		return archive, fmt.Errorf("error reading %s: %w", archivePath, err)
+	}
+
+	archive = Archive{Path: archivePath, SHA256: hex.EncodeToString(hash.Sum(nil))}
+	if archive.Images, err = readImages(members); err != nil {
+		return archive, fmt.Errorf("error reading %s: %w", archivePath, err)
+	}
+	if len(archive.Images) == 0 {
+		return archive, fmt.Errorf("%s holds no images", archivePath)
+	}
+
+	return
+}
+
+// readImages prefers the OCI index, which carries manifest digests, and
+// falls back to the docker-archive manifest.
+func readImages(members map[string][]byte) (images []Image, err error) {
+	if index, ok := members["index.json"]; ok {
+		return readOCIImages(members, index)
+	}
+
+	manifest, ok := members["manifest.json"]
+	if !ok {
+		return nil, errors.New("archive has neither index.json nor manifest.json")
+	}
+	var entries []dockerManifest
+	if err = json.Unmarshal(manifest, &entries); err != nil {
+		return nil, fmt.Errorf("invalid manifest.json: %w", err)
+	}
+	for _, entry := range entries {
+		image := Image{ID: "sha256:" + strings.TrimSuffix(path.Base(entry.Config), ".json")}
+		for _, tag := range entry.RepoTags {
+			image.Refs = append(image.Refs, NormalizeRef(tag))
+		}
+		images = append(images, image)
+	}
+	return
+}
+
+func readOCIImages(members map[string][]byte, index []byte) (images []Image, err error) {
+	var root ociDescriptor
+	if err = json.Unmarshal(index, &root); err != nil {
+		return nil, fmt.Errorf("invalid index.json: %w", err)
+	}
+
+	byID := map[string]*Image{}
+	var order []string
+	var walk func(descriptors []ociDescriptor, ref string) error
+	walk = func(descriptors []ociDescriptor, ref string) error {
+		for _, descriptor := range descriptors {
+			name := ref
+			if n := descriptor.Annotations["io.containerd.image.name"]; n != "" {
+				name = n
+			} else if n = descriptor.Annotations["org.opencontainers.image.ref.name"]; n != "" && strings.ContainsAny(n, "/:") {
+				name = n
+			}
+
+			blob, ok := members[blobPath(descriptor.Digest)]
+			if !ok {
+				// Platforms that were not exported are referenced without
+				// their blobs.
+				continue
+			}
+			var content ociDescriptor
+			if err := json.Unmarshal(blob, &content); err != nil {
+				return fmt.Errorf("invalid blob %s: %w", descriptor.Digest, err)
+			}
+			if len(content.Manifests) > 0 {
+				if err := walk(content.Manifests, name); err != nil {
+					return err
+				}
+				continue
+			}
+			if content.Config == nil {
+				continue
+			}
+
+			image, ok := byID[content.Config.Digest]
+			if !ok {
+				image = &Image{ID: content.Config.Digest}
+				byID[image.ID] = image
+				order = append(order, image.ID)
+			}
+			image.Digests = appendUnique(image.Digests, descriptor.Digest)
+			if name != "" {
+				image.Refs = appendUnique(image.Refs, NormalizeRef(name))
+			}
+		}
+		return nil
+	}
+	if err = walk(root.Manifests, ""); err != nil {
+		return nil, err
+	}
+
+	for _, id := range order {
+		images = append(images, *byID[id])
+	}
+	return
+}
+
+func blobPath(digest string) string {
+	algorithm, hex, _ := strings.Cut(digest, ":")
+	return path.Join("blobs", algorithm, hex)
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
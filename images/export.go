@@ -0,0 +1,56 @@
+package images
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Export saves an image from the local docker daemon into dir, pulling it
+// first if the daemon does not have it. Pointing ref at a local registry makes
+// the daemon a stand-in for registries the build cannot reach.
+func Export(ref, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("error creating image directory %s: %w", dir, err)
+	}
+
+	if err := exec.Command("docker", "image", "inspect", ref).Run(); err != nil {
+		if out, err := exec.Command("docker", "pull", ref).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("error pulling %s: %w\n%s", ref, err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	archivePath := filepath.Join(dir, unsafeFileChars.ReplaceAllString(ref, "_")+".tar")
+	if out, err := exec.Command("docker", "image", "save", "-o", archivePath, ref).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("error saving %s: %w\n%s", ref, err, strings.TrimSpace(string(out)))
+	}
+
+	return archivePath, nil
+}
+
+// Collect inspects the archives and exports the refs into exportDir.
+func Collect(archives []string, refs []string, exportDir string) (collected []Archive, err error) {
+	paths := append([]string{}, archives...)
+	for _, ref := range refs {
+		archivePath, err := Export(ref, exportDir)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, archivePath)
+	}
+
+	for _, archivePath := range paths {
+		archive, err := Inspect(archivePath)
+		if err != nil {
+			return nil, err
+		}
+		collected = append(collected, archive)
+	}
+
+	return
+}
@@ -0,0 +1,57 @@
+package images
+
+import (
+	"strings"
+)
+
+// Ref is an image reference split into its parts.
+type Ref struct {
+	// Name is the repository with its registry, e.g.
+	// docker.io/linuxserver/sonarr.
+	Name   string
+	Tag    string
+	Digest string
+}
+
+func (r Ref) String() string {
+	ref := r.Name
+	if r.Tag != "" {
+		ref += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		ref += "@" + r.Digest
+	}
+	return ref
+}
+
+// ParseRef parses a reference the way docker resolves it: a missing registry
+// is Docker Hub, single-component Docker Hub names are in library/, and a
+// reference without tag or digest means latest.
+func ParseRef(ref string) Ref {
+	var r Ref
+	ref, r.Digest, _ = strings.Cut(ref, "@")
+
+	name := ref
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		name, r.Tag = ref[:i], ref[i+1:]
+	}
+
+	first, _, hasSlash := strings.Cut(name, "/")
+	if !hasSlash || (!strings.ContainsAny(first, ".:") && first != "localhost") {
+		name = "docker.io/" + name
+	}
+	if strings.Count(name, "/") == 1 && strings.HasPrefix(name, "docker.io/") {
+		name = "docker.io/library/" + strings.TrimPrefix(name, "docker.io/")
+	}
+	r.Name = name
+
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = "latest"
+	}
+	return r
+}
+
+// NormalizeRef returns the fully qualified form of a reference.
+func NormalizeRef(ref string) string {
+	return ParseRef(ref).String()
+}
@@ -53,3 +53,26 @@ type FlagKey[T any] struct {
 func (f FlagKey[T]) GetAdd() func(cmd *cobra.Command) {
 	return f.Add
 }
+
+// specKeyFlags maps the host spec keys of lists to their flags, which take one
+// item at a time. Every other key is named like its flag.
+var specKeyFlags = map[string]string{
+	"ssh-keys":              "ssh-key",
+	"ssh-key-files":         "ssh-key-file",
+	"authorized-keys-files": "authorized-keys-file",
+	"known-hosts-names":     "known-hosts-name",
+	"modules":               "module",
+	"without-modules":       "without-module",
+	"files-dirs":            "files-dir",
+}
+
+// SpecKeyChanged returns a function that reports whether the flag behind a
+// host spec key was given on the command line.
+func SpecKeyChanged(cmd *cobra.Command) func(key string) bool {
+	return func(key string) bool {
+		if flag, ok := specKeyFlags[key]; ok {
+			key = flag
+		}
+		return cmd.Flags().Changed(key)
+	}
+}
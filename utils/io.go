@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -119,3 +120,20 @@ func UploadWithProgress(url string, reader io.Reader, size int64) error {
 	log.Infoln("Upload complete!")
 	return nil
 }
+
+// WriteOutput writes content to path, or to stdout when path is -.
+func WriteOutput(path, content string) error {
+	if path == "-" {
+		if _, err := os.Stdout.WriteString(content); err != nil {
+			return fmt.Errorf("error writing to stdout: %w", err)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating directory of %s: %w", path, err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		return fmt.Errorf("error writing %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+// PasswordPrompt returns a function that asks for the password of a user on
+// the terminal without echoing it, or nil when stdin is not a terminal. An
+// empty answer leaves the password empty.
+func PasswordPrompt() func(user string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil
+	}
+	return func(user string) (string, error) {
+		readPassword := func(prompt string) (string, error) {
+			_, _ = fmt.Fprint(os.Stderr, prompt)
+			password, err := term.ReadPassword(fd)
+			_, _ = fmt.Fprintln(os.Stderr)
+			return string(password), err
+		}
+		for {
+			password, err := readPassword(fmt.Sprintf("Password for %s (empty to lock it): ", user))
+			if err != nil || password == "" {
+				return "", err
+			}
+			again, err := readPassword(fmt.Sprintf("Repeat the password for %s: ", user))
+			if err != nil {
+				return "", err
+			}
+			if again == password {
+				return password, nil
+			}
+			_, _ = fmt.Fprintln(os.Stderr, "The passwords do not match, try again")
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const redacted = "[REDACTED]"
+
+// redactHook replaces secrets in log entries before they are formatted.
+type redactHook struct {
+	mu      sync.RWMutex
+	secrets []string
+}
+
+var (
+	redactor        = &redactHook{}
+	installRedactor sync.Once
+)
+
+// RedactSecrets keeps secrets out of all further log output, whatever the
+// level.
+func RedactSecrets(secrets ...string) {
+	installRedactor.Do(func() {
+		log.AddHook(redactor)
+	})
+	redactor.mu.Lock()
+	defer redactor.mu.Unlock()
+	for _, secret := range secrets {
+		if secret != "" {
+			redactor.secrets = append(redactor.secrets, secret)
+		}
+	}
+}
+
+func (h *redactHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *redactHook) Fire(entry *log.Entry) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	entry.Message = h.redact(entry.Message)
+	for key, value := range entry.Data {
+		switch value := value.(type) {
+		case string:
+			entry.Data[key] = h.redact(value)
+		case error:
+			entry.Data[key] = h.redact(value.Error())
+		case fmt.Stringer:
+			entry.Data[key] = h.redact(value.String())
+		}
+	}
+	return nil
+}
+
+func (h *redactHook) redact(s string) string {
+	for _, secret := range h.secrets {
+		s = strings.ReplaceAll(s, secret, redacted)
+	}
+	return s
+}